@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/cmd/server/adminserver"
+	"github.com/linushung/hermes/internal/app/kafkaconsumer"
+	"github.com/linushung/hermes/internal/pkg/configs"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	adminTimeout     = 15 * time.Second
+	defaultAdminAddr = "localhost:8090"
+)
+
+// adminClient calls admin API of a running hermes
+type adminClient struct {
+	opts    cliOptions
+	address string
+	token   string
+	client  *http.Client
+}
+
+// bind binds flags of admin API to fs
+func (ac *adminClient) bind(fs *flag.FlagSet) {
+	ac.opts.bind(fs)
+	fs.StringVar(&ac.address, "admin", "", "address of admin API, default to admin.address or localhost:admin.port of configuration")
+	fs.StringVar(&ac.token, "token", os.Getenv("HERMES_ADMIN_TOKEN"), "token of admin API, default to $HERMES_ADMIN_TOKEN or admin.token of configuration")
+}
+
+// prepare fills address and token which are not given by flags from admin configuration. The configuration file
+// is optional unless it is given by -c, so the commands work against remote hermes with flags only.
+func (ac *adminClient) prepare() {
+	ac.client = &http.Client{Timeout: adminTimeout}
+	if level, err := log.ParseLevel(ac.opts.logLevel); err == nil {
+		log.SetLevel(level)
+	}
+
+	err := configs.Load(ac.opts.layers())
+	switch {
+	case err != nil && len(ac.opts.configFiles()) > 0:
+		log.Fatalf("***** [ADMIN][FAIL] ***** Failed to load configuration:: %v", err)
+	case err == nil:
+		if ac.address == "" {
+			ac.address = adminserver.Address()
+		}
+		if ac.token == "" {
+			ac.token = configs.GetConfigStr("admin.token")
+		}
+	}
+
+	if ac.address == "" {
+		ac.address = defaultAdminAddr
+	}
+	if host, port, err := net.SplitHostPort(ac.address); err == nil && (host == "" || host == "0.0.0.0") {
+		ac.address = net.JoinHostPort("localhost", port)
+	}
+}
+
+// call sends the request to admin API and decodes the JSON response into v
+func (ac *adminClient) call(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, "http://"+ac.address+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ac.token)
+
+	res, err := ac.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		e := struct {
+			Error string `json:"error"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&e)
+		return fmt.Errorf("%s %s: %s %s", method, path, res.Status, e.Error)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// runConsumers lists Kafka consumers with their total lag, or offset and lag of each partition of a consumer, e.g.
+// hermes consumers -admin hermes:8090 notificationService
+func runConsumers(args []string) {
+	fs := flag.NewFlagSet("consumers", flag.ExitOnError)
+	ac := &adminClient{}
+	ac.bind(fs)
+	fs.Parse(args)
+	ac.prepare()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	if cli := fs.Arg(0); cli != "" {
+		offsets := []kafkaconsumer.PartitionOffset{}
+		if err := ac.call(http.MethodGet, "/consumers/"+cli+"/offsets", &offsets); err != nil {
+			log.Fatalf("***** [ADMIN][FAIL] ***** %v", err)
+		}
+		fmt.Fprintln(w, "PARTITION\tCOMMITTED\tHIGH WATERMARK\tLAG\tLAST READ")
+		for _, po := range offsets {
+			fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\n", po.Partition, po.Committed, po.HighWatermark, po.Lag, po.LastRead)
+		}
+		return
+	}
+
+	infos := []kafkaconsumer.ConsumerInfo{}
+	if err := ac.call(http.MethodGet, "/consumers", &infos); err != nil {
+		log.Fatalf("***** [ADMIN][FAIL] ***** %v", err)
+	}
+	fmt.Fprintln(w, "CLIENT\tTOPIC\tGROUP\tCONCURRENCY\tPAUSED\tLAG")
+	for _, info := range infos {
+		lag := "-"
+		offsets := []kafkaconsumer.PartitionOffset{}
+		if err := ac.call(http.MethodGet, "/consumers/"+info.Client+"/offsets", &offsets); err == nil {
+			total := int64(0)
+			for _, po := range offsets {
+				if po.Lag > 0 {
+					total += po.Lag
+				}
+			}
+			lag = fmt.Sprint(total)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%t\t%s\n", info.Client, info.Topic, info.GroupID, info.Concurrency, info.Paused, lag)
+	}
+}
+
+// runCircuits lists circuit state of each register, or trips or resets the circuit of a register, e.g.
+// hermes circuits trip NotificationServiceHandler
+func runCircuits(args []string) {
+	fs := flag.NewFlagSet("circuits", flag.ExitOnError)
+	ac := &adminClient{}
+	ac.bind(fs)
+	fs.Parse(args)
+	ac.prepare()
+
+	method, path := http.MethodGet, "/circuits"
+	switch action := fs.Arg(0); action {
+	case "":
+	case "trip", "reset":
+		if fs.Arg(1) == "" {
+			log.Fatalf("***** [ADMIN][FAIL] ***** Register is required to %s a circuit", action)
+		}
+		method, path = http.MethodPost, "/circuits/"+fs.Arg(1)+"/"+action
+	default:
+		log.Fatalf("***** [ADMIN][FAIL] ***** Unknown action %q, expect trip or reset", action)
+	}
+
+	states := []server.CircuitState{}
+	if err := ac.call(method, path, &states); err != nil {
+		log.Fatalf("***** [ADMIN][FAIL] ***** %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "REGISTER\tOPEN\tTRIPPED")
+	for _, s := range states {
+		fmt.Fprintf(w, "%s\t%t\t%t\n", s.Register, s.Open, s.Tripped)
+	}
+}
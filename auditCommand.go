@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/audit"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/pkg/eventhandler"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const auditQueryTimeout = 5 * time.Minute
+
+// runAudit prints delivery attempts of a message from the audit journal of configuration, e.g.
+// hermes audit -topic advertisement -partition 0 -offset 42, or hermes audit -key user-1
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	opts := cliOptions{}
+	opts.bind(fs)
+	key := fs.String("key", "", "key of the Kafka message")
+	messageID := fs.String("message-id", "", "message id of the RabbitMQ message")
+	topic := fs.String("topic", "", "topic of the Kafka message")
+	partition := fs.Int("partition", -1, "partition of the Kafka message")
+	offset := fs.Int64("offset", -1, "offset of the Kafka message")
+	limit := fs.Int("limit", 0, "print the latest records only, default to all records")
+	asJSON := fs.Bool("json", false, "print records as JSON lines")
+	fs.Parse(args)
+
+	q := audit.Query{Topic: *topic, Key: *key, MessageID: *messageID, Limit: *limit}
+	if *partition >= 0 {
+		q.Partition = partition
+	}
+	if *offset >= 0 {
+		q.Offset = offset
+	}
+	if err := q.Validate(); err != nil {
+		log.Fatalf("***** [AUDIT][FAIL] ***** %v", err)
+	}
+
+	log.SetLevel(log.WarnLevel)
+	if err := configs.Load(opts.layers()); err != nil {
+		log.Fatalf("***** [AUDIT][FAIL] ***** Failed to load configuration:: %v", err)
+	}
+	if !configs.IsConfigSet("audit") {
+		log.Fatalf("***** [AUDIT][FAIL] ***** Audit is not configured")
+	}
+	j, err := audit.Open()
+	if err != nil {
+		log.Fatalf("***** [AUDIT][FAIL] ***** Failed to open audit journal:: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditQueryTimeout)
+	defer cancel()
+	records, err := j.Query(ctx, q)
+	j.Close(ctx)
+	if err != nil {
+		log.Fatalf("***** [AUDIT][FAIL] ***** Failed to query audit journal:: %v", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range records {
+			enc.Encode(r)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "TIME\tSOURCE\tENDPOINT\tATTEMPT\tSTATUS\tLATENCY\tOUTCOME\tERROR")
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%dms\t%s\t%s\n", r.Time.Format(time.RFC3339Nano), source(r.Source), r.Endpoint,
+			r.Attempt, r.StatusCode, r.LatencyMs, r.Outcome, r.Error)
+	}
+}
+
+// source returns the message of s as topic/partition@offset or queue/message id
+func source(s audit.Source) string {
+	if s.Type == eventhandler.SourceRabbitMQ {
+		return fmt.Sprintf("%s/%s", s.Queue, s.MessageID)
+	}
+	return fmt.Sprintf("%s/%d@%d", s.Topic, s.Partition, s.Offset)
+}
@@ -0,0 +1,292 @@
+package adminserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/app/kafkaconsumer"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/logging"
+)
+
+// log is the logger of admin component
+var log = logging.For(logging.Admin)
+
+const (
+	defaultHost = "127.0.0.1"
+	defaultPort = "8090"
+	// bearerPrefix starts Authorization header which carries the token
+	bearerPrefix = "Bearer "
+	// offsetTimeout is how long to wait for brokers when reading offsets of partitions
+	offsetTimeout = 10 * time.Second
+)
+
+type adminServer struct {
+	token string
+}
+
+type concurrencyRequest struct {
+	Concurrency int `json:"concurrency"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// InitAdminServer starts the admin REST API of hermes. Every request has to carry "Authorization: Bearer <token>"
+// header with the token of admin.token configuration.
+//
+// Only Kafka consumers are managed, requests for RabbitMQ consumers under /rabbitmq are rejected with 501.
+//
+//	GET  /consumers                             list Kafka consumers
+//	GET  /consumers/{client}                    show a Kafka consumer
+//	GET  /consumers/{client}/offsets            show committed offset and lag of each partition
+//	POST /consumers/{client}/pause              pause a Kafka consumer
+//	POST /consumers/{client}/resume             resume a Kafka consumer
+//	PUT  /consumers/{client}/concurrency        change concurrency of a Kafka consumer, body {"concurrency":N}
+//	POST /replays                               start a replay job, body is kafkaconsumer.ReplayRequest
+//	GET  /replays                               list replay jobs with their progress
+//	GET  /replays/{id}                          show progress of a replay job
+//	DELETE /replays/{id}                        cancel a replay job
+//	GET  /circuits                              list circuit state of each register
+//	POST /circuits/{register}/trip              force the circuit of a register open
+//	POST /circuits/{register}/reset             close the circuit of a register
+func InitAdminServer() (*http.Server, error) {
+	token := configs.GetConfigStr("admin.token")
+	if token == "" {
+		return nil, errors.New("admin.token has to be set to protect admin API")
+	}
+
+	addr := Address()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen admin server on %s: %v", addr, err)
+	}
+	srv := &http.Server{Addr: addr, Handler: (&adminServer{token}).handler()}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("***** [ADMIN][FAIL] ***** Admin server stopped:: %v", err)
+		}
+	}()
+	log.Infof("***** [INIT:ADMIN] ***** Start admin server on %s ......", addr)
+	return srv, nil
+}
+
+// handler routes requests of admin API, every route is authorized by the token
+func (as *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/consumers", as.authorize(as.consumersHandler))
+	mux.HandleFunc("/consumers/", as.authorize(as.consumersHandler))
+	mux.HandleFunc("/replays", as.authorize(as.replaysHandler))
+	mux.HandleFunc("/replays/", as.authorize(as.replaysHandler))
+	mux.HandleFunc("/circuits", as.authorize(as.circuitsHandler))
+	mux.HandleFunc("/circuits/", as.authorize(as.circuitsHandler))
+	mux.HandleFunc("/rabbitmq", as.authorize(as.rabbitmqHandler))
+	mux.HandleFunc("/rabbitmq/", as.authorize(as.rabbitmqHandler))
+	return mux
+}
+
+// Address returns the address which admin server listens on, admin.address or loopback on admin.port
+func Address() string {
+	if addr := configs.GetConfigStr("admin.address"); addr != "" {
+		return addr
+	}
+
+	port := configs.GetConfigStr("admin.port")
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(defaultHost, port)
+}
+
+// ValidateConfig checks admin configuration strictly without starting admin server
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("admin", struct {
+		Address string `mapstructure:"address"`
+		Port    string `mapstructure:"port"`
+		Token   string `mapstructure:"token"`
+	}{})
+	if configs.GetConfigStr("admin.token") == "" {
+		ps = append(ps, configs.Problemf("admin.token", "token is required to protect admin API"))
+	}
+	if addr := configs.GetConfigStr("admin.address"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			ps = append(ps, configs.Problemf("admin.address", "%v", err))
+		}
+	}
+	if port := configs.GetConfigStr("admin.port"); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			ps = append(ps, configs.Problemf("admin.port", "%q is not a valid port", port))
+		}
+	}
+	return ps
+}
+
+func (as *adminServer) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(auth, bearerPrefix)
+		if len(token) == len(auth) || subtle.ConstantTimeCompare([]byte(token), []byte(as.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{"invalid token"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (as *adminServer) consumersHandler(w http.ResponseWriter, r *http.Request) {
+	cmgr := kafkaconsumer.GetConsumerMgr()
+	if cmgr == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{"kafka is not configured"})
+		return
+	}
+
+	segments := pathSegments(r.URL.Path, "/consumers")
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, cmgr.ListConsumers())
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		info, err := cmgr.GetConsumer(segments[0])
+		writeResult(w, info, err)
+	case len(segments) == 2 && segments[1] == "offsets" && r.Method == http.MethodGet:
+		ctx, cancel := context.WithTimeout(r.Context(), offsetTimeout)
+		defer cancel()
+		offsets, err := cmgr.PartitionOffsets(ctx, segments[0])
+		writeResult(w, offsets, err)
+	case len(segments) == 2 && segments[1] == "pause" && r.Method == http.MethodPost:
+		as.writeConsumer(w, segments[0], cmgr.Pause(segments[0]))
+	case len(segments) == 2 && segments[1] == "resume" && r.Method == http.MethodPost:
+		as.writeConsumer(w, segments[0], cmgr.Resume(segments[0]))
+	case len(segments) == 2 && segments[1] == "concurrency" && r.Method == http.MethodPut:
+		req := concurrencyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+			return
+		}
+		as.writeConsumer(w, segments[0], cmgr.SetConcurrency(segments[0], req.Concurrency))
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{"not found"})
+	}
+}
+
+// rabbitmqHandler rejects requests for RabbitMQ consumers, which cannot be listed, paused or resumed by admin API
+func (as *adminServer) rabbitmqHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusNotImplemented, errorResponse{"RabbitMQ consumers are not managed by admin API, change rabbitmq configuration instead"})
+}
+
+func (as *adminServer) replaysHandler(w http.ResponseWriter, r *http.Request) {
+	cmgr := kafkaconsumer.GetConsumerMgr()
+	if cmgr == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{"kafka is not configured"})
+		return
+	}
+
+	segments := pathSegments(r.URL.Path, "/replays")
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, cmgr.ReplayJobs())
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		req := kafkaconsumer.ReplayRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+			return
+		}
+		job, err := cmgr.StartReplay(req)
+		if err != nil {
+			writeResult(w, nil, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, job.Status())
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		job, err := cmgr.GetReplayJob(segments[0])
+		if err != nil {
+			writeResult(w, nil, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, job.Status())
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		job, err := cmgr.GetReplayJob(segments[0])
+		if err != nil {
+			writeResult(w, nil, err)
+			return
+		}
+		job.Cancel()
+		<-job.Done()
+		writeJSON(w, http.StatusOK, job.Status())
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{"not found"})
+	}
+}
+
+func (as *adminServer) circuitsHandler(w http.ResponseWriter, r *http.Request) {
+	cbm := server.GetCircuitBreakerMgr()
+	segments := pathSegments(r.URL.Path, "/circuits")
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, cbm.CircuitStates())
+	case len(segments) == 2 && segments[1] == "trip" && r.Method == http.MethodPost:
+		as.writeCircuits(w, cbm.TripCircuit(segments[0]))
+	case len(segments) == 2 && segments[1] == "reset" && r.Method == http.MethodPost:
+		as.writeCircuits(w, cbm.ResetCircuit(segments[0]))
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{"not found"})
+	}
+}
+
+func (as *adminServer) writeCircuits(w http.ResponseWriter, err error) {
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, server.GetCircuitBreakerMgr().CircuitStates())
+}
+
+func (as *adminServer) writeConsumer(w http.ResponseWriter, cli string, err error) {
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	info, err := kafkaconsumer.GetConsumerMgr().GetConsumer(cli)
+	writeResult(w, info, err)
+}
+
+func writeResult(w http.ResponseWriter, v interface{}, err error) {
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, v)
+	case kafkaconsumer.ErrConsumerNotFound, kafkaconsumer.ErrReplayNotFound, server.ErrUnknownRegister:
+		writeJSON(w, http.StatusNotFound, errorResponse{err.Error()})
+	case kafkaconsumer.ErrInvalidConcurrency, kafkaconsumer.ErrInvalidReplay:
+		writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+	default:
+		writeJSON(w, http.StatusBadGateway, errorResponse{err.Error()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("***** [ADMIN][FAIL] ***** Failed to encode response:: %v", err)
+	}
+}
+
+// pathSegments splits path after prefix into non-empty segments
+func pathSegments(path, prefix string) []string {
+	var segments []string
+	for _, s := range strings.Split(strings.TrimPrefix(path, prefix), "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
@@ -0,0 +1,211 @@
+package adminserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/app/kafkaconsumer"
+	"github.com/linushung/hermes/internal/pkg/configs"
+)
+
+const testToken = "admin-token"
+
+var initCircuitBreaker sync.Once
+
+func loadConfig(t *testing.T, values map[string]interface{}) {
+	t.Helper()
+	values["kafka.bootstrapservers"] = "localhost:9092"
+	if err := configs.LoadConfig("", values); err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+}
+
+// serve sends a request of method and path with authorization header to admin API and returns status and body of the response
+func serve(t *testing.T, method, path, authorization string) (int, string) {
+	t.Helper()
+	initCircuitBreaker.Do(func() {
+		loadConfig(t, map[string]interface{}{"circuitbreaker.registers.orderhandler.timeout": 1000})
+		if err := server.InitCircuitBreakerMgr(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	req := httptest.NewRequest(method, path, nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	(&adminServer{testToken}).handler().ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestAdminServerAuthorizes(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{name: "without token", status: http.StatusUnauthorized},
+		{name: "other token", header: "Bearer other", status: http.StatusUnauthorized},
+		{name: "token without bearer", header: testToken, status: http.StatusUnauthorized},
+		{name: "token", header: "Bearer " + testToken, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := serve(t, http.MethodGet, "/circuits", tt.header); status != tt.status {
+				t.Errorf("GET /circuits = %d %s, want %d", status, body, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdminServerRoutes(t *testing.T) {
+	// Kafka consumers are not started in tests, hence consumers and replays are not found
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{method: http.MethodGet, path: "/consumers", status: http.StatusNotFound, body: "kafka is not configured"},
+		{method: http.MethodPost, path: "/consumers/notification/pause", status: http.StatusNotFound, body: "kafka is not configured"},
+		{method: http.MethodGet, path: "/replays", status: http.StatusNotFound, body: "kafka is not configured"},
+		{method: http.MethodGet, path: "/rabbitmq/consumers", status: http.StatusNotImplemented, body: "not managed by admin API"},
+		{method: http.MethodPost, path: "/circuits/orderhandler/trip", status: http.StatusOK, body: `{"register":"orderhandler","open":true,"tripped":true}`},
+		{method: http.MethodPost, path: "/circuits/orderhandler/reset", status: http.StatusOK, body: `{"register":"orderhandler","open":false,"tripped":false}`},
+		{method: http.MethodPost, path: "/circuits/unknown/trip", status: http.StatusNotFound, body: server.ErrUnknownRegister.Error()},
+		{method: http.MethodDelete, path: "/circuits", status: http.StatusNotFound, body: "not found"},
+		{method: http.MethodGet, path: "/circuits/orderhandler", status: http.StatusNotFound, body: "not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			status, body := serve(t, tt.method, tt.path, "Bearer "+testToken)
+			if status != tt.status || !strings.Contains(body, tt.body) {
+				t.Errorf("%s %s = %d %s, want %d with %s", tt.method, tt.path, status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestAdminServerListsCircuits(t *testing.T) {
+	status, body := serve(t, http.MethodGet, "/circuits", "Bearer "+testToken)
+	if status != http.StatusOK {
+		t.Fatalf("GET /circuits status = %d, want %d", status, http.StatusOK)
+	}
+
+	var states []server.CircuitState
+	if err := json.Unmarshal([]byte(body), &states); err != nil {
+		t.Fatalf("GET /circuits body %s is not circuit states: %v", body, err)
+	}
+	if len(states) != 2 || states[0].Register != server.DefaultHandler || states[1].Register != "orderhandler" {
+		t.Errorf("GET /circuits = %+v, want circuits of default register and orderhandler", states)
+	}
+}
+
+func TestWriteResultStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{status: http.StatusOK},
+		{err: kafkaconsumer.ErrConsumerNotFound, status: http.StatusNotFound},
+		{err: kafkaconsumer.ErrReplayNotFound, status: http.StatusNotFound},
+		{err: server.ErrUnknownRegister, status: http.StatusNotFound},
+		{err: kafkaconsumer.ErrInvalidConcurrency, status: http.StatusBadRequest},
+		{err: kafkaconsumer.ErrInvalidReplay, status: http.StatusBadRequest},
+		{err: errors.New("broker is unreachable"), status: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeResult(rec, struct{}{}, tt.err)
+		if rec.Code != tt.status {
+			t.Errorf("writeResult() of %v status = %d, want %d", tt.err, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestInitAdminServer(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		err    string
+	}{
+		{name: "without token", values: map[string]interface{}{}, err: "admin.token has to be set"},
+		{name: "address in use", values: map[string]interface{}{"admin.token": testToken, "admin.address": busy.Addr().String()}, err: "failed to listen admin server"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, tt.values)
+			srv, err := InitAdminServer()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("InitAdminServer() = %v, %v, want error %q", srv, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		keys   []string
+	}{
+		{name: "valid", values: map[string]interface{}{"admin.token": testToken, "admin.port": "8090"}},
+		{name: "without token", values: map[string]interface{}{"admin.port": "8090"}, keys: []string{"admin.token"}},
+		{name: "address without port", values: map[string]interface{}{"admin.token": testToken, "admin.address": "localhost"}, keys: []string{"admin.address"}},
+		{name: "port out of range", values: map[string]interface{}{"admin.token": testToken, "admin.port": "70000"}, keys: []string{"admin.port"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, tt.values)
+			ps := ValidateConfig()
+			if len(ps) != len(tt.keys) {
+				t.Fatalf("ValidateConfig() = %v, want problems of %v", ps, tt.keys)
+			}
+			for i, p := range ps {
+				if p.Key != tt.keys[i] {
+					t.Errorf("ValidateConfig()[%d] = %s, want problem of %s", i, p, tt.keys[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDebugToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		token  string
+	}{
+		{name: "unprotected", values: map[string]interface{}{}},
+		{name: "admin token", values: map[string]interface{}{"admin.token": testToken}, token: testToken},
+		{name: "debug token", values: map[string]interface{}{"admin.token": testToken, "debug.token": "debug"}, token: "debug"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, tt.values)
+			if got := debugToken(); got != tt.token {
+				t.Errorf("debugToken() = %q, want %q", got, tt.token)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package adminserver
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+)
+
+// defaultDebugAddress keeps pprof profiles and expvar metrics on loopback unless debug.address says otherwise
+const defaultDebugAddress = "127.0.0.1:8081"
+
+// InitDebugServer serves pprof profiles and expvar metrics(e.g. spool depth) of hermes on debug.address. Requests
+// have to carry "Authorization: Bearer <token>" header if debug.token, or admin.token in its absence, is set.
+//
+//	GET  /debug/pprof/...                       pprof profiles
+//	GET  /debug/vars                            expvar metrics
+func InitDebugServer() (*http.Server, error) {
+	addr := DebugAddress()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	var handler http.Handler = mux
+	if token := debugToken(); token != "" {
+		handler = (&adminServer{token}).authorize(mux.ServeHTTP)
+	} else {
+		log.Warnf("***** [INIT:DEBUG] ***** Debug server on %s is not protected by token ......", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen debug server on %s: %v", addr, err)
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("***** [DEBUG][FAIL] ***** Debug server stopped:: %v", err)
+		}
+	}()
+	log.Infof("***** [INIT:DEBUG] ***** Start debug server on %s ......", addr)
+	return srv, nil
+}
+
+// DebugAddress returns the address which debug server listens on, debug.address or loopback by default
+func DebugAddress() string {
+	if addr := configs.GetConfigStr("debug.address"); addr != "" {
+		return addr
+	}
+	return defaultDebugAddress
+}
+
+// debugToken returns the token which protects debug server, admin token is shared unless debug.token is set
+func debugToken() string {
+	if token := configs.GetConfigStr("debug.token"); token != "" {
+		return token
+	}
+	return configs.GetConfigStr("admin.token")
+}
+
+// ValidateDebugConfig checks debug configuration strictly without starting debug server
+func ValidateDebugConfig() []configs.Problem {
+	ps := configs.UnknownKeys("debug", struct {
+		Address string `mapstructure:"address"`
+		Token   string `mapstructure:"token"`
+	}{})
+	if addr := configs.GetConfigStr("debug.address"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			ps = append(ps, configs.Problemf("debug.address", "%v", err))
+		}
+	}
+	return ps
+}
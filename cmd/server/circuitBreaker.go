@@ -1,24 +1,32 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
 
 	"github.com/afex/hystrix-go/hystrix"
 	"github.com/hashicorp/go-retryablehttp"
-	log "github.com/sirupsen/logrus"
 )
 
 var (
 	once     sync.Once
 	instance *CircuitBreakerManager
+	// initErr is the error of the first InitCircuitBreakerMgrWithClient, which is returned by later calls
+	initErr error
+	// ErrUnknownRegister is returned when the register is not configured in circuitbreaker.registers
+	ErrUnknownRegister = errors.New("circuitbreaker: unknown register")
 	/*
 		Timeout value has to be considered with timeout of http.Client in order for consistent response. Set
 		this value a little less than http.Client makes http request mainly handle by hystrix
@@ -37,6 +45,10 @@ var (
 
 const (
 	DefaultHandler = "GeneralEventHandler"
+	// defaultStreamAddress keeps metrics stream of Hystrix on loopback unless circuitbreaker.streamAddress says otherwise
+	defaultStreamAddress = "127.0.0.1:8092"
+	// circuitPollInterval is how often a paused consumer checks whether the circuit of its handler has closed
+	circuitPollInterval = 500 * time.Millisecond
 )
 
 type circuitBreakerConfig struct {
@@ -53,80 +65,241 @@ type CircuitBreakerManager struct {
 	Register map[string]*circuitBreakerConfig `mapstructure:"registers"`
 	HTTPClient
 	RetryHTTPClient
+	// grpc delivers events to endpoints of gRPC services
+	grpc *GRPCClient
+	// tripped keeps circuits which are forced open by TripCircuit
+	tripped *sync.Map
+	// mu guards Register which is swapped by reloading configuration
+	mu *sync.RWMutex
+}
+
+// CircuitState describes state of the circuit of a register
+type CircuitState struct {
+	Register string `json:"register"`
+	Open     bool   `json:"open"`
+	Tripped  bool   `json:"tripped"`
 }
 
 func GetCircuitBreakerMgr() *CircuitBreakerManager {
 	return instance
 }
 
-func initHystrixStreamServer() {
+// InitHystrixStreamServer serves metrics stream of Hystrix circuits on circuitbreaker.streamAddress, or loopback
+// on port 8092 by default. The stream handler stops once the returned server is shut down.
+func InitHystrixStreamServer() (*http.Server, error) {
+	addr := configs.GetConfigStr("circuitbreaker.streamAddress")
+	if addr == "" {
+		addr = defaultStreamAddress
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen Hystrix stream server on %s: %v", addr, err)
+	}
+
 	hystrixStreamHandler := hystrix.NewStreamHandler()
 	hystrixStreamHandler.Start()
-	go http.ListenAndServe(net.JoinHostPort("", "8092"), hystrixStreamHandler)
+	srv := &http.Server{Addr: addr, Handler: hystrixStreamHandler}
+	srv.RegisterOnShutdown(hystrixStreamHandler.Stop)
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("***** [CIRCUITBREAKER][FAIL] ***** Hystrix stream server stopped:: %v", err)
+		}
+	}()
+	log.Infof("***** [INIT:CIRCUITBREAKER] ***** Start Hystrix stream server on %s ......", addr)
+	return srv, nil
 }
 
-func InitCircuitBreakerMgr() {
+func InitCircuitBreakerMgr() error {
+	return InitCircuitBreakerMgrWithClient(nil)
+}
+
+// InitCircuitBreakerMgrWithClient initialises circuit breaker manager which makes requests by client, the default
+// client of hermes is used if client is nil
+func InitCircuitBreakerMgrWithClient(client *http.Client) error {
 	once.Do(func() {
-		cbm := &CircuitBreakerManager{}
-		if err := configs.GetConfigUnmarshalKey("circuitbreaker", cbm); err != nil {
-			log.Fatalf("***** [INIT:CIRCUITBREAKER][FAIL] ***** Failed to init Circuit Breaker configuration:: %v ......", err)
-			os.Exit(1)
-		}
-
-		cbm.Register[DefaultHandler] = &circuitBreakerConfig{
-			Timeout:                defaultTimeout,
-			MaxConcurrentRequests:  defaultMaxConcurrent,
-			RequestVolumeThreshold: defaultVolumeThreshold,
-			SleepWindow:            defaultSleepWindow,
-			ErrorPercentThreshold:  defaultErrorPercentThreshold,
-			Retryable:              false,
-		}
-		for r, c := range cbm.Register {
-			hystrix.ConfigureCommand(r, hystrix.CommandConfig{
-				Timeout:                c.Timeout,
-				MaxConcurrentRequests:  c.MaxConcurrentRequests,
-				RequestVolumeThreshold: c.RequestVolumeThreshold,
-				SleepWindow:            c.SleepWindow,
-				ErrorPercentThreshold:  c.ErrorPercentThreshold,
-			})
+		registers, err := loadRegisters()
+		if err != nil {
+			initErr = fmt.Errorf("failed to init Circuit Breaker configuration: %v", err)
+			return
+		}
+		configureCommands(registers)
+
+		gc, err := InitGRPCClient()
+		if err != nil {
+			initErr = fmt.Errorf("failed to init gRPC client: %v", err)
+			return
 		}
 
 		hc := InitHTTPClient()
 		rc := InitRetryClient()
-		initHystrixStreamServer()
-		instance = &CircuitBreakerManager{cbm.Register, *hc, *rc}
+		if client != nil {
+			hc.Client = client
+			rc.HTTPClient = client
+		}
+		instance = &CircuitBreakerManager{
+			Register:        registers,
+			HTTPClient:      *hc,
+			RetryHTTPClient: *rc,
+			grpc:            gc,
+			tripped:         &sync.Map{},
+			mu:              &sync.RWMutex{},
+		}
 		log.Infof("***** [INIT:CIRCUITBREAKER] ***** Initialise circuit breaker manager with %d registers ......", len(instance.Register))
 	})
+	return initErr
+}
+
+// loadRegisters reads circuit breaker configuration of each register along with the default register
+func loadRegisters() (map[string]*circuitBreakerConfig, error) {
+	cbm := &CircuitBreakerManager{}
+	if err := configs.GetConfigUnmarshalKey("circuitbreaker", cbm); err != nil {
+		return nil, err
+	}
+	if cbm.Register == nil {
+		cbm.Register = make(map[string]*circuitBreakerConfig)
+	}
+
+	for r, c := range cbm.Register {
+		if c.Timeout < 0 || c.MaxConcurrentRequests < 0 || c.RequestVolumeThreshold < 0 || c.SleepWindow < 0 || c.ErrorPercentThreshold < 0 {
+			return nil, fmt.Errorf("settings of register::%s must not be negative", r)
+		}
+	}
+
+	cbm.Register[DefaultHandler] = &circuitBreakerConfig{
+		Timeout:                defaultTimeout,
+		MaxConcurrentRequests:  defaultMaxConcurrent,
+		RequestVolumeThreshold: defaultVolumeThreshold,
+		SleepWindow:            defaultSleepWindow,
+		ErrorPercentThreshold:  defaultErrorPercentThreshold,
+		Retryable:              false,
+	}
+	return cbm.Register, nil
+}
+
+// ValidateConfig checks circuit breaker configuration strictly, every register must be known settings which are
+// not negative
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("circuitbreaker", struct {
+		Registers     map[string]*circuitBreakerConfig `mapstructure:"registers"`
+		StreamAddress string                           `mapstructure:"streamAddress"`
+	}{})
+	if _, err := loadRegisters(); err != nil {
+		ps = append(ps, configs.Problemf("circuitbreaker.registers", "%v", err))
+	}
+	if addr := configs.GetConfigStr("circuitbreaker.streamAddress"); addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			ps = append(ps, configs.Problemf("circuitbreaker.streamAddress", "%v", err))
+		}
+	}
+	return ps
+}
+
+// configureCommands configures the Hystrix command of each register, commands are named by registers in lower case
+func configureCommands(registers map[string]*circuitBreakerConfig) {
+	for r, c := range registers {
+		hystrix.ConfigureCommand(strings.ToLower(r), hystrix.CommandConfig{
+			Timeout:                c.Timeout,
+			MaxConcurrentRequests:  c.MaxConcurrentRequests,
+			RequestVolumeThreshold: c.RequestVolumeThreshold,
+			SleepWindow:            c.SleepWindow,
+			ErrorPercentThreshold:  c.ErrorPercentThreshold,
+		})
+	}
+}
+
+// PrepareReload reads circuit breaker configuration again and returns the function which swaps registers to it.
+// Hystrix applies new settings to requests made after the swap, except maxConcurrentRequests of circuits which
+// have been created already.
+func (cbm *CircuitBreakerManager) PrepareReload() (func(), error) {
+	registers, err := loadRegisters()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		configureCommands(registers)
+		cbm.mu.Lock()
+		cbm.Register = registers
+		cbm.mu.Unlock()
+		log.Infof("***** [CIRCUITBREAKER] ***** Reload circuit breaker configuration with %d registers ......", len(registers))
+	}, nil
+}
+
+// registerConfig resolves the register to a configured one, registers which are not configured fall back to
+// DefaultHandler
+func (cbm *CircuitBreakerManager) registerConfig(register string) (string, *circuitBreakerConfig) {
+	r, c, ok := cbm.lookupRegister(register)
+	if !ok {
+		return cbm.registerConfig(DefaultHandler)
+	}
+	return r, c
+}
+
+// lookupRegister finds the configured register whose name equals register case-insensitively, as keys of
+// configuration are in lower case while handlers refer to registers in their own case
+func (cbm *CircuitBreakerManager) lookupRegister(register string) (string, *circuitBreakerConfig, bool) {
+	cbm.mu.RLock()
+	defer cbm.mu.RUnlock()
+
+	if c, ok := cbm.Register[register]; ok {
+		return register, c, true
+	}
+	for r, c := range cbm.Register {
+		if strings.EqualFold(r, register) {
+			return r, c, true
+		}
+	}
+	return "", nil, false
+}
+
+// commandTimeout returns timeout of the hystrix command of the register, hystrix uses its default if it is not set
+func (cbm *CircuitBreakerManager) commandTimeout(register string) time.Duration {
+	_, c := cbm.registerConfig(register)
+	if c.Timeout == 0 {
+		return time.Duration(hystrix.DefaultTimeout) * time.Millisecond
+	}
+	return time.Duration(c.Timeout) * time.Millisecond
 }
 
 // CBHTTPGet makes HTTP GET request with Hystrix circuit breaker
 func (cbm *CircuitBreakerManager) CBHTTPGet(register, url, headers string, retryable bool) ([]byte, error) {
-	if _, ok := cbm.Register[register]; ok {
-		register = DefaultHandler
+	register, _ = cbm.registerConfig(register)
+	if cbm.isTripped(register) {
+		return nil, hystrix.ErrCircuitOpen
 	}
 
 	resTube := make(chan []byte, 1)
-	runFunc := cbm.runFuncGenerator("GET", url, headers, nil, retryable, resTube)
+	runFunc := cbm.runFuncGenerator(context.Background(), "GET", url, headers, nil, retryable, cbm.commandTimeout(register), resTube)
 	errTube := hystrix.Go(strings.ToLower(register), runFunc, fallbackFunc)
 
 	select {
 	case res := <-resTube:
 		return res, nil
 	case err := <-errTube:
-		log.Errorf("***** [CIRCUITBREAKER][FAIL] ***** Error:: %#v", err.Error())
+		log.Errorf("***** [CIRCUITBREAKER][FAIL] ***** Error:: %q", logpolicy.Error(err))
 		return nil, err
 	}
 }
 
 // CBHTTPPost makes HTTP POST request with Hystrix circuit breaker
 func (cbm *CircuitBreakerManager) CBHTTPPost(register, url, headers string, reqBody []byte) ([]byte, error) {
-	if _, ok := cbm.Register[register]; !ok {
-		register = DefaultHandler
+	return cbm.CBHTTPPostContext(context.Background(), register, url, headers, reqBody)
+}
+
+// CBHTTPPostContext makes HTTP POST request with Hystrix circuit breaker and logs with fields of ctx, e.g. consumer
+// and offset of the message. The request is not cancelled by ctx. Endpoints of gRPC services, grpc://host:port or
+// grpcs://host:port, are called by Deliver RPC with reqBody and fields of ctx as the event instead.
+func (cbm *CircuitBreakerManager) CBHTTPPostContext(ctx context.Context, register, url, headers string, reqBody []byte) ([]byte, error) {
+	ctx = logging.NewContext(context.Background(), logging.FromContext(ctx))
+	register, config := cbm.registerConfig(register)
+
+	if cbm.isTripped(register) {
+		return nil, hystrix.ErrCircuitOpen
 	}
 
 	resTube := make(chan []byte, 1)
-	retryable := cbm.Register[register].Retryable
-	runFunc := cbm.runFuncGenerator("POST", url, headers, reqBody, retryable, resTube)
+	retryable := config.Retryable
+	runFunc := cbm.runFuncGenerator(ctx, "POST", url, headers, reqBody, retryable, cbm.commandTimeout(register), resTube)
 
 	errTube := hystrix.Go(strings.ToLower(register), runFunc, fallbackFunc)
 
@@ -134,22 +307,30 @@ func (cbm *CircuitBreakerManager) CBHTTPPost(register, url, headers string, reqB
 	case res := <-resTube:
 		return res, nil
 	case err := <-errTube:
-		log.Errorf("***** [CIRCUITBREAKER][FAIL] ***** Error:: %#v", err.Error())
+		log.WithContext(ctx).Errorf("***** [CIRCUITBREAKER][FAIL] ***** Error:: %q", logpolicy.Error(err))
 		return nil, err
 	}
 }
 
-func (cbm CircuitBreakerManager) runFuncGenerator(method, url, headers string, reqBody []byte, retryable bool, resTube chan []byte) func() error {
+func (cbm CircuitBreakerManager) runFuncGenerator(ctx context.Context, method, url, headers string, reqBody []byte, retryable bool, deadline time.Duration, resTube chan []byte) func() error {
+	if IsGRPC(url) {
+		if method != "POST" {
+			return func() error {
+				return fmt.Errorf("grpc: %s request is not supported", method)
+			}
+		}
+		return cbm.grpcRunFunc(ctx, url, headers, reqBody, retryable, deadline, resTube)
+	}
 	if retryable {
-		return cbm.retryableRunFunc(method, url, headers, reqBody, resTube)
+		return cbm.retryableRunFunc(ctx, method, url, headers, reqBody, resTube)
 	}
 
-	return cbm.cbRunFunc(method, url, headers, reqBody, resTube)
+	return cbm.cbRunFunc(ctx, method, url, headers, reqBody, resTube)
 }
 
-func (cbm CircuitBreakerManager) cbRunFunc(method, url, headers string, reqBody []byte, resTube chan []byte) func() error {
+func (cbm CircuitBreakerManager) cbRunFunc(ctx context.Context, method, url, headers string, reqBody []byte, resTube chan []byte) func() error {
 	return func() error {
-		res, httpErr := cbm.HTTPClient.HTTPRequest(method, url, map[string]string{"Content-Type": headers}, reqBody)
+		res, httpErr := cbm.HTTPClient.HTTPRequestContext(ctx, method, url, map[string]string{"Content-Type": headers}, reqBody)
 		if httpErr != nil {
 			// Return error to fallbackFunc
 			return httpErr
@@ -160,28 +341,32 @@ func (cbm CircuitBreakerManager) cbRunFunc(method, url, headers string, reqBody
 	}
 }
 
-func (cbm CircuitBreakerManager) retryableRunFunc(method, url, headers string, reqBody []byte, resTube chan []byte) func() error {
+func (cbm CircuitBreakerManager) retryableRunFunc(ctx context.Context, method, url, headers string, reqBody []byte, resTube chan []byte) func() error {
 	return func() error {
+		// Every failure is returned to fallbackFunc, which sends it to errTube, so the caller always gets a result
 		req, err := retryablehttp.NewRequest(method, url, reqBody)
 		if err != nil {
-			log.Errorf("***** [CIRCUITBREAKER][FAIL] ***** Cannot create request")
-			return nil
+			log.WithContext(ctx).Errorf("***** [CIRCUITBREAKER][FAIL] ***** Cannot create request")
+			return err
 		}
 
+		// Retries are logged with fields of ctx by RequestLogHook
+		req = req.WithContext(ctx)
 		req.Header.Set("Content-Type", headers)
 		res, httpErr := cbm.RetryHTTPClient.Do(req)
 		if httpErr != nil {
-			// Return error to fallbackFunc
 			return httpErr
 		}
+		// without closing the response body, the connection may remain open and cause resource leak.
+		defer res.Body.Close()
 		if res.StatusCode != 200 {
-			return fmt.Errorf("***** [HTTP::ERROR] *****[Status:%s] [StatusCode:%d]", res.Status, res.StatusCode)
+			return HTTPError{res.Status, res.StatusCode}
 		}
 
 		resBody, ioErr := ioutil.ReadAll(res.Body)
 		if ioErr != nil {
-			log.Errorf("***** HTTPPost::[FAIL] *****ReadAll Execution [Error:%v] ", ioErr)
-			return nil
+			log.WithContext(ctx).Errorf("***** HTTPPost::[FAIL] *****ReadAll Execution [Error:%v] ", ioErr)
+			return ioErr
 		}
 
 		resTube <- resBody
@@ -189,6 +374,117 @@ func (cbm CircuitBreakerManager) retryableRunFunc(method, url, headers string, r
 	}
 }
 
+// circuitName resolves the register to the name of the Hystrix command which is used by hystrix.Go
+func (cbm *CircuitBreakerManager) circuitName(register string) string {
+	register, _ = cbm.registerConfig(register)
+	return strings.ToLower(register)
+}
+
+// IsCircuitOpen reports whether Hystrix has opened the circuit of the register
+func (cbm *CircuitBreakerManager) IsCircuitOpen(register string) bool {
+	if cbm.isTripped(register) {
+		return true
+	}
+
+	circuit, _, err := hystrix.GetCircuit(cbm.circuitName(register))
+	if err != nil {
+		return false
+	}
+
+	return circuit.IsOpen()
+}
+
+// WaitCircuitClosed blocks the caller while the circuit of the register is open so that consumers stop fetching
+// messages which would only fail fast and get lost. Once the sleep window of the circuit elapses it returns to let
+// a single message through, which Hystrix uses as the test request to decide whether to close the circuit again.
+// It returns the error of ctx if ctx is done before then.
+func (cbm *CircuitBreakerManager) WaitCircuitClosed(ctx context.Context, register string) error {
+	if !cbm.IsCircuitOpen(register) {
+		return nil
+	}
+
+	sleepWindow := time.Duration(defaultSleepWindow) * time.Millisecond
+	if s, ok := hystrix.GetCircuitSettings()[cbm.circuitName(register)]; ok {
+		sleepWindow = s.SleepWindow
+	}
+
+	log.Warnf("***** [CIRCUITBREAKER:%s][OPEN] ***** Pause consumption until circuit is closed ......", register)
+	ticker := time.NewTicker(circuitPollInterval)
+	defer ticker.Stop()
+
+	deadline := time.Now().Add(sleepWindow)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if !cbm.IsCircuitOpen(register) {
+			log.Infof("***** [CIRCUITBREAKER:%s][CLOSED] ***** Resume consumption ......", register)
+			return nil
+		}
+		// Tripped circuit stays open until it is reset, hence no message is released to test it
+		if time.Now().After(deadline) && !cbm.isTripped(register) {
+			log.Infof("***** [CIRCUITBREAKER:%s][HALF-OPEN] ***** Release a message to test if circuit can be closed ......", register)
+			return nil
+		}
+	}
+}
+
+// CircuitStates returns state of circuit of each register
+func (cbm *CircuitBreakerManager) CircuitStates() []CircuitState {
+	cbm.mu.RLock()
+	registers := make([]string, 0, len(cbm.Register))
+	for r := range cbm.Register {
+		registers = append(registers, r)
+	}
+	cbm.mu.RUnlock()
+
+	states := make([]CircuitState, 0, len(registers))
+	for _, r := range registers {
+		states = append(states, CircuitState{r, cbm.IsCircuitOpen(r), cbm.isTripped(r)})
+	}
+
+	sort.Slice(states, func(i, j int) bool { return states[i].Register < states[j].Register })
+	return states
+}
+
+// TripCircuit forces the circuit of the register open until ResetCircuit is called, it returns ErrUnknownRegister
+// if the register is not configured
+func (cbm *CircuitBreakerManager) TripCircuit(register string) error {
+	r, _, ok := cbm.lookupRegister(register)
+	if !ok {
+		return ErrUnknownRegister
+	}
+	cbm.tripped.Store(strings.ToLower(r), true)
+	log.Warnf("***** [CIRCUITBREAKER:%s][TRIPPED] ***** Force circuit open ......", r)
+	return nil
+}
+
+// ResetCircuit closes the circuit of the register and resets its health metrics, other circuits are not affected.
+// It returns ErrUnknownRegister if the register is not configured.
+func (cbm *CircuitBreakerManager) ResetCircuit(register string) error {
+	r, _, ok := cbm.lookupRegister(register)
+	if !ok {
+		return ErrUnknownRegister
+	}
+	cbm.tripped.Delete(strings.ToLower(r))
+	// hystrix-go closes an open circuit and resets its metrics once a success is reported to it
+	if circuit, _, err := hystrix.GetCircuit(strings.ToLower(r)); err == nil && circuit.IsOpen() {
+		if err := circuit.ReportEvent([]string{"success"}, time.Now(), 0); err != nil {
+			return err
+		}
+	}
+	log.Infof("***** [CIRCUITBREAKER:%s][RESET] ***** Close circuit and reset its metrics ......", r)
+	return nil
+}
+
+func (cbm *CircuitBreakerManager) isTripped(register string) bool {
+	_, ok := cbm.tripped.Load(cbm.circuitName(register))
+	return ok
+}
+
 func fallbackFunc(err error) error {
 	// Return error to errTube
 	return err
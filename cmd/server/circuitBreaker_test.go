@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afex/hystrix-go/hystrix"
+)
+
+func TestCircuitRegistersMatchCaseInsensitively(t *testing.T) {
+	cbm := newTestManager(nil, map[string]*circuitBreakerConfig{
+		DefaultHandler:               {Timeout: 1000},
+		"notificationservicehandler": {Timeout: 2000},
+		"billingservicehandler":      {Timeout: 3000},
+	})
+
+	if r, c := cbm.registerConfig("NotificationServiceHandler"); r != "notificationservicehandler" || c.Timeout != 2000 {
+		t.Errorf("registerConfig(NotificationServiceHandler) = %s with timeout %d, want notificationservicehandler with timeout 2000", r, c.Timeout)
+	}
+	if r, _ := cbm.registerConfig("UnknownHandler"); r != DefaultHandler {
+		t.Errorf("registerConfig(UnknownHandler) = %s, want %s", r, DefaultHandler)
+	}
+
+	if err := cbm.TripCircuit("UnknownHandler"); err != ErrUnknownRegister {
+		t.Errorf("TripCircuit(UnknownHandler) error = %v, want %v", err, ErrUnknownRegister)
+	}
+	if err := cbm.ResetCircuit("UnknownHandler"); err != ErrUnknownRegister {
+		t.Errorf("ResetCircuit(UnknownHandler) error = %v, want %v", err, ErrUnknownRegister)
+	}
+
+	for _, r := range []string{"NotificationServiceHandler", "BillingServiceHandler"} {
+		if err := cbm.TripCircuit(r); err != nil {
+			t.Fatalf("TripCircuit(%s) error = %v", r, err)
+		}
+	}
+	if !cbm.IsCircuitOpen("notificationServiceHandler") {
+		t.Errorf("circuit of notificationServiceHandler is closed after it is tripped as NotificationServiceHandler")
+	}
+
+	if err := cbm.ResetCircuit("NOTIFICATIONSERVICEHANDLER"); err != nil {
+		t.Fatalf("ResetCircuit() error = %v", err)
+	}
+	if cbm.IsCircuitOpen("NotificationServiceHandler") {
+		t.Errorf("circuit of NotificationServiceHandler is open after reset")
+	}
+	if !cbm.IsCircuitOpen("BillingServiceHandler") {
+		t.Errorf("reset of NotificationServiceHandler closes circuit of BillingServiceHandler")
+	}
+}
+
+func TestResetCircuitClosesOnlyCircuitOfRegister(t *testing.T) {
+	cbm := newTestManager(nil, map[string]*circuitBreakerConfig{
+		DefaultHandler:     {},
+		"resethandler":     {RequestVolumeThreshold: 1, ErrorPercentThreshold: 1, SleepWindow: 60000},
+		"untouchedhandler": {RequestVolumeThreshold: 1, ErrorPercentThreshold: 1, SleepWindow: 60000},
+	})
+
+	for _, r := range []string{"ResetHandler", "UntouchedHandler"} {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cbm.IsCircuitOpen(r) {
+			if time.Now().After(deadline) {
+				t.Fatalf("circuit of %s does not open after failures", r)
+			}
+			hystrix.Do(strings.ToLower(r), func() error { return errors.New("endpoint is down") }, nil)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := cbm.ResetCircuit("ResetHandler"); err != nil {
+		t.Fatalf("ResetCircuit() error = %v", err)
+	}
+	if cbm.IsCircuitOpen("ResetHandler") {
+		t.Errorf("circuit of ResetHandler is open after reset")
+	}
+	if !cbm.IsCircuitOpen("UntouchedHandler") {
+		t.Errorf("reset of ResetHandler closes circuit of UntouchedHandler")
+	}
+}
+
+func TestRetryablePostReturnsEveryFailure(t *testing.T) {
+	cbm := newTestManager(nil, map[string]*circuitBreakerConfig{
+		DefaultHandler:     {},
+		"retryablehandler": {Timeout: 2000, Retryable: true},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such endpoint", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		err  string
+	}{
+		{name: "non-200 response", url: srv.URL, err: "404"},
+		{name: "invalid url", url: "://invalid", err: "missing protocol scheme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			go func() {
+				_, err := cbm.CBHTTPPost("RetryableHandler", tt.url, "application/json", []byte(`{"id":1}`))
+				errs <- err
+			}()
+			select {
+			case err := <-errs:
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("CBHTTPPost() error = %v, want %q", err, tt.err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatalf("CBHTTPPost() does not return")
+			}
+		})
+	}
+}
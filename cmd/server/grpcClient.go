@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server/grpcserver/api"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/internal/pkg/tlsconfig"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// maxGRPCMessageSize limits responses of gRPC endpoints
+const maxGRPCMessageSize = 4 << 20
+
+// grpcStatus are HTTP statuses which gRPC status codes are classified as, codes which are not listed are classified
+// as 500. Ref: https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+var grpcStatus = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// GRPCError represents a status other than OK of gRPC response, which is classified by the HTTP status of its code
+type GRPCError struct {
+	Code    codes.Code
+	Message string
+}
+
+func (e GRPCError) Error() string {
+	return fmt.Sprintf("***** [GRPC::ERROR] *****[Code:%s] [Message:%s]", e.Code, e.Message)
+}
+
+// HTTPStatus returns the HTTP status which code of e is classified as
+func (e GRPCError) HTTPStatus() int {
+	if s, ok := grpcStatus[e.Code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// grpcSchema lists settings of grpc configuration, which is used to find unknown keys
+type grpcSchema struct {
+	TLS       tlsconfig.Schema `mapstructure:"tls"`
+	Token     string           `mapstructure:"token"`
+	TokenFile string           `mapstructure:"tokenFile"`
+}
+
+// GRPCClient invokes Deliver RPC of hermes.v1.Delivery service of gRPC endpoints. Endpoints of grpc://host:port are
+// called in plaintext, endpoints of grpcs://host:port by TLS of grpc.tls, which may carry a client certificate for
+// mTLS. Every call carries grpc.token as bearer token if it is set. A connection is dialled once for each endpoint
+// and shared by calls.
+type GRPCClient struct {
+	tls   *tls.Config
+	token string
+	// options are added to dial options of every connection, e.g. a dialer of in-process listeners in tests
+	options []grpc.DialOption
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// IsGRPC reports whether endpoint is a gRPC service, i.e. grpc://host:port or grpcs://host:port
+func IsGRPC(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && (u.Scheme == "grpc" || u.Scheme == "grpcs")
+}
+
+// ValidateGRPCConfig checks grpc configuration strictly without connecting to endpoints
+func ValidateGRPCConfig() []configs.Problem {
+	ps := configs.UnknownKeys("grpc", grpcSchema{})
+	if _, err := InitGRPCClient(); err != nil {
+		ps = append(ps, configs.Problemf("grpc", "%v", err))
+	}
+	return ps
+}
+
+// InitGRPCClient returns a gRPC client with TLS and token of grpc configuration, endpoints are dialled once they
+// are called
+func InitGRPCClient() (*GRPCClient, error) {
+	tlsConfig, err := tlsconfig.NewTLSConfig("grpc.tls")
+	if err != nil {
+		return nil, err
+	}
+	token, err := configs.GetConfigCredential("grpc.token")
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCClient{tls: tlsConfig, token: token, conns: make(map[string]*grpc.ClientConn)}, nil
+}
+
+// conn returns the connection to the host of endpoint, it is dialled without waiting for the connection to be ready
+func (gc *GRPCClient) conn(endpoint string) (*grpc.ClientConn, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	key := u.Scheme + "://" + u.Host
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if c, ok := gc.conns[key]; ok {
+		return c, nil
+	}
+
+	creds := grpc.WithInsecure()
+	if u.Scheme == "grpcs" {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(gc.tls))
+	}
+	opts := append([]grpc.DialOption{creds, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxGRPCMessageSize))}, gc.options...)
+	c, err := grpc.Dial(u.Host, opts...)
+	if err != nil {
+		return nil, err
+	}
+	gc.conns[key] = c
+	return c, nil
+}
+
+// Deliver invokes Deliver RPC of endpoint with an event of body and metadata, it returns body of the response. A
+// status other than OK is returned as GRPCError.
+func (gc *GRPCClient) Deliver(ctx context.Context, endpoint, contentType string, body []byte, md map[string]string) ([]byte, error) {
+	logger := log.WithContext(ctx)
+	logger.Debugf("***** GRPCDeliver *****[URL:%s] [BODY:%s] ", logpolicy.URL(endpoint), logpolicy.Body(body))
+
+	conn, err := gc.conn(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if gc.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+gc.token)
+	}
+
+	res, err := api.NewDeliveryClient(conn).Deliver(ctx, &api.Event{ContentType: contentType, Value: body, Metadata: md})
+	if err != nil {
+		if st, ok := status.FromError(err); ok {
+			err = GRPCError{Code: st.Code(), Message: st.Message()}
+		}
+		logger.Errorf("***** GRPCDeliver::[FAIL] *****[URL:%s] [BODY:%s] [Error:%s] ", logpolicy.URL(endpoint), logpolicy.Body(body), logpolicy.Error(err))
+		return nil, err
+	}
+	logger.Infof("***** GRPCDeliver::[SUCCESS] *****[URL:%s] [RESPONSE:%s] ", logpolicy.URL(endpoint), logpolicy.Body(res.GetBody()))
+	return res.GetBody(), nil
+}
+
+// Close closes connections to every endpoint
+func (gc *GRPCClient) Close() {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	for key, c := range gc.conns {
+		c.Close()
+		delete(gc.conns, key)
+	}
+}
+
+// eventMetadata returns log fields of ctx as metadata of event, e.g. consumer, topic, partition and offset
+func eventMetadata(ctx context.Context) map[string]string {
+	fields := logging.FromContext(ctx)
+	md := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if k == logging.FieldEndpoint {
+			continue
+		}
+		md[k] = fmt.Sprint(v)
+	}
+	return md
+}
+
+// retryGRPC classifies errors of Deliver as defaultRetryPolicy classifies HTTP responses, statuses are retried if
+// they are classified as 5xx except 501 and calls which run out of time, other errors are not retried
+func retryGRPC(err error) bool {
+	e, ok := err.(GRPCError)
+	if !ok || e.Code == codes.DeadlineExceeded {
+		return false
+	}
+	status := e.HTTPStatus()
+	return status >= 500 && status != http.StatusNotImplemented
+}
+
+// grpcRunFunc delivers reqBody to the gRPC endpoint, it is retried with backoff of the retryable HTTP client if the
+// register is retryable. Attempts and waits between them stop at deadline, the timeout of the hystrix command, so
+// they never outlive the command which hystrix has given up on.
+func (cbm CircuitBreakerManager) grpcRunFunc(ctx context.Context, endpoint, contentType string, reqBody []byte, retryable bool, deadline time.Duration, resTube chan []byte) func() error {
+	return func() error {
+		ctx, cancel := context.WithTimeout(ctx, deadline)
+		defer cancel()
+
+		md := eventMetadata(ctx)
+		res, err := cbm.grpc.Deliver(ctx, endpoint, contentType, reqBody, md)
+		rc := cbm.RetryHTTPClient
+		for attempt := 1; retryable && retryGRPC(err) && attempt <= rc.RetryMax; attempt++ {
+			wait := time.NewTimer(rc.Backoff(rc.RetryWaitMin, rc.RetryWaitMax, attempt-1, nil))
+			select {
+			case <-wait.C:
+			case <-ctx.Done():
+				wait.Stop()
+				return err
+			}
+			log.WithContext(ctx).WithField(logging.FieldAttempt, attempt+1).
+				Warnf("***** [GRPC][RETRY] ***** Retry Deliver to [url::%s]", logpolicy.URL(endpoint))
+			res, err = cbm.grpc.Deliver(ctx, endpoint, contentType, reqBody, md)
+		}
+		if err != nil {
+			// Return error to fallbackFunc
+			return err
+		}
+
+		resTube <- res
+		return nil
+	}
+}
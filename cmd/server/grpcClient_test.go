@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server/grpcserver/api"
+	"github.com/linushung/hermes/internal/pkg/logging"
+
+	"github.com/afex/hystrix-go/hystrix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const testEndpoint = "grpc://delivery.internal:9000"
+
+// deliveryServer records events and tokens of Deliver calls, fail returns the status of the nth call
+type deliveryServer struct {
+	mu     sync.Mutex
+	events []*api.Event
+	tokens []string
+	fail   func(call int) error
+}
+
+func (s *deliveryServer) Deliver(ctx context.Context, e *api.Event) (*api.DeliverResponse, error) {
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.tokens = append(s.tokens, md.Get("authorization")...)
+	call := len(s.events)
+	s.mu.Unlock()
+
+	if s.fail != nil {
+		if err := s.fail(call); err != nil {
+			return nil, err
+		}
+	}
+	return &api.DeliverResponse{Body: append([]byte("ack:"), e.Value...)}, nil
+}
+
+func (s *deliveryServer) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events)
+}
+
+// startDeliveryServer serves srv on an in-process listener and returns a client which dials every endpoint to it
+func startDeliveryServer(srv *deliveryServer) (*GRPCClient, func()) {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	api.RegisterDeliveryServer(s, srv)
+	go s.Serve(lis)
+
+	gc := &GRPCClient{
+		token: "secret",
+		conns: make(map[string]*grpc.ClientConn),
+		options: []grpc.DialOption{grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		})},
+	}
+	return gc, func() {
+		gc.Close()
+		s.Stop()
+	}
+}
+
+// newTestManager returns a circuit breaker manager of registers which delivers to gRPC endpoints by gc, retries
+// wait for a few milliseconds
+func newTestManager(gc *GRPCClient, registers map[string]*circuitBreakerConfig) *CircuitBreakerManager {
+	configureCommands(registers)
+	rc := InitRetryClient()
+	rc.RetryWaitMin, rc.RetryWaitMax = time.Millisecond, 5*time.Millisecond
+	return &CircuitBreakerManager{
+		Register:        registers,
+		RetryHTTPClient: *rc,
+		grpc:            gc,
+		tripped:         &sync.Map{},
+		mu:              &sync.RWMutex{},
+	}
+}
+
+func unavailable(int) error {
+	return status.Error(codes.Unavailable, "endpoint is down")
+}
+
+func TestGRPCDeliver(t *testing.T) {
+	srv := &deliveryServer{}
+	gc, stop := startDeliveryServer(srv)
+	defer stop()
+
+	ctx := logging.NewContext(context.Background(), logging.Fields{logging.FieldTopic: "user.event", logging.FieldOffset: 42, logging.FieldEndpoint: testEndpoint})
+	res, err := gc.Deliver(ctx, testEndpoint, "application/json", []byte(`{"id":1}`), eventMetadata(ctx))
+	if err != nil {
+		t.Fatalf("Deliver() error = %v", err)
+	}
+	if string(res) != `ack:{"id":1}` {
+		t.Errorf("Deliver() = %s, want body of DeliverResponse", res)
+	}
+
+	e := srv.events[0]
+	if e.ContentType != "application/json" || string(e.Value) != `{"id":1}` {
+		t.Errorf("event = %q %s, want application/json {\"id\":1}", e.ContentType, e.Value)
+	}
+	if e.Metadata["topic"] != "user.event" || e.Metadata["offset"] != "42" {
+		t.Errorf("event metadata = %v, want topic and offset", e.Metadata)
+	}
+	if _, ok := e.Metadata[logging.FieldEndpoint]; ok {
+		t.Errorf("event metadata = %v, want no endpoint", e.Metadata)
+	}
+	if len(srv.tokens) != 1 || srv.tokens[0] != "Bearer secret" {
+		t.Errorf("authorization = %v, want Bearer secret", srv.tokens)
+	}
+}
+
+func TestGRPCDeliverStatusMapping(t *testing.T) {
+	tests := []struct {
+		code   codes.Code
+		status int
+		retry  bool
+	}{
+		{codes.Unavailable, http.StatusServiceUnavailable, true},
+		{codes.Internal, http.StatusInternalServerError, true},
+		{codes.Unknown, http.StatusInternalServerError, true},
+		{codes.Unimplemented, http.StatusNotImplemented, false},
+		{codes.DeadlineExceeded, http.StatusGatewayTimeout, false},
+		{codes.InvalidArgument, http.StatusBadRequest, false},
+		{codes.NotFound, http.StatusNotFound, false},
+		{codes.Unauthenticated, http.StatusUnauthorized, false},
+		{codes.PermissionDenied, http.StatusForbidden, false},
+		{codes.ResourceExhausted, http.StatusTooManyRequests, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code.String(), func(t *testing.T) {
+			code := tt.code
+			srv := &deliveryServer{fail: func(int) error { return status.Error(code, "failed") }}
+			gc, stop := startDeliveryServer(srv)
+			defer stop()
+
+			_, err := gc.Deliver(context.Background(), testEndpoint, "application/json", []byte(`{}`), nil)
+			ge, ok := err.(GRPCError)
+			if !ok || ge.Code != tt.code || ge.Message != "failed" {
+				t.Fatalf("Deliver() error = %#v, want GRPCError of %s", err, tt.code)
+			}
+			if got := StatusCode(err); got != tt.status {
+				t.Errorf("StatusCode() = %d, want %d", got, tt.status)
+			}
+			if got := retryGRPC(err); got != tt.retry {
+				t.Errorf("retryGRPC() = %t, want %t", got, tt.retry)
+			}
+		})
+	}
+
+	if got := (GRPCError{Code: codes.Code(42)}).HTTPStatus(); got != http.StatusInternalServerError {
+		t.Errorf("HTTPStatus() of unknown code = %d, want 500", got)
+	}
+}
+
+func TestCBHTTPPostContextRetriesGRPC(t *testing.T) {
+	srv := &deliveryServer{fail: func(call int) error {
+		if call < 3 {
+			return unavailable(call)
+		}
+		return nil
+	}}
+	gc, stop := startDeliveryServer(srv)
+	defer stop()
+	cbm := newTestManager(gc, map[string]*circuitBreakerConfig{
+		DefaultHandler: {Timeout: 1000},
+		"grpcretry":    {Timeout: 2000, Retryable: true},
+	})
+
+	res, err := cbm.CBHTTPPostContext(context.Background(), "grpcretry", testEndpoint, "application/json", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("CBHTTPPostContext() error = %v", err)
+	}
+	if string(res) != "ack:{}" || srv.calls() != 3 {
+		t.Errorf("CBHTTPPostContext() = %s after %d calls, want ack:{} after 3 calls", res, srv.calls())
+	}
+
+	// Registers which are not retryable fail at the first status
+	srv.fail = unavailable
+	if _, err := cbm.CBHTTPPostContext(context.Background(), DefaultHandler, testEndpoint, "application/json", []byte(`{}`)); err == nil || !strings.Contains(err.Error(), "Code:Unavailable") {
+		t.Errorf("CBHTTPPostContext() error = %v, want Unavailable", err)
+	}
+	if srv.calls() != 4 {
+		t.Errorf("endpoint is called %d times, want 4", srv.calls())
+	}
+}
+
+func TestGRPCRetryStopsAtCommandTimeout(t *testing.T) {
+	srv := &deliveryServer{fail: unavailable}
+	gc, stop := startDeliveryServer(srv)
+	defer stop()
+	cbm := newTestManager(gc, map[string]*circuitBreakerConfig{DefaultHandler: {Timeout: 1000}})
+	cbm.RetryHTTPClient.RetryWaitMin, cbm.RetryHTTPClient.RetryWaitMax = 10*time.Second, 10*time.Second
+
+	run := cbm.grpcRunFunc(context.Background(), testEndpoint, "application/json", []byte(`{}`), true, 100*time.Millisecond, make(chan []byte, 1))
+	start := time.Now()
+	err := run()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("run function returns after %v, want it to stop at the command timeout", elapsed)
+	}
+	if StatusCode(err) != http.StatusServiceUnavailable || srv.calls() != 1 {
+		t.Errorf("run function error = %v after %d calls, want 503 after 1 call", err, srv.calls())
+	}
+}
+
+func TestCBHTTPPostContextOpensCircuitOfGRPC(t *testing.T) {
+	srv := &deliveryServer{fail: unavailable}
+	gc, stop := startDeliveryServer(srv)
+	defer stop()
+	cbm := newTestManager(gc, map[string]*circuitBreakerConfig{
+		DefaultHandler: {Timeout: 1000},
+		"grpccircuit": {
+			Timeout:                1000,
+			MaxConcurrentRequests:  10,
+			RequestVolumeThreshold: 3,
+			SleepWindow:            60000,
+			ErrorPercentThreshold:  50,
+		},
+	})
+
+	for i := 0; i < 100 && !cbm.IsCircuitOpen("grpccircuit"); i++ {
+		cbm.CBHTTPPostContext(context.Background(), "grpccircuit", testEndpoint, "application/json", []byte(`{}`))
+		// Hystrix counts results asynchronously
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !cbm.IsCircuitOpen("grpccircuit") {
+		t.Fatal("IsCircuitOpen() = false after failed calls, want true")
+	}
+
+	calls := srv.calls()
+	if _, err := cbm.CBHTTPPostContext(context.Background(), "grpccircuit", testEndpoint, "application/json", []byte(`{}`)); err == nil || !strings.Contains(err.Error(), hystrix.ErrCircuitOpen.Error()) {
+		t.Errorf("CBHTTPPostContext() error = %v, want %v", err, hystrix.ErrCircuitOpen)
+	}
+	if srv.calls() != calls {
+		t.Errorf("endpoint is called while circuit is open")
+	}
+}
@@ -2,15 +2,20 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
 )
 
+// log is the logger of http component
+var log = logging.For(logging.HTTP)
+
 const (
 	timeout = 4 * time.Second
 )
@@ -43,14 +48,33 @@ func (e HTTPError) Error() string {
 	return fmt.Sprintf("***** [HTTP::ERROR] *****[Status:%s] [StatusCode:%d]", e.Status, e.StatusCode)
 }
 
+// StatusCode returns status code of the response which err is caused by, or 0 if no response is received
+func StatusCode(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	switch e := err.(type) {
+	case HTTPError:
+		return e.StatusCode
+	case GRPCError:
+		return e.HTTPStatus()
+	}
+	return 0
+}
+
 func (hc HTTPClient) HTTPRequest(method, url string, headers map[string]string, reqBody []byte) ([]byte, error) {
+	return hc.HTTPRequestContext(context.Background(), method, url, headers, reqBody)
+}
+
+// HTTPRequestContext makes the request and logs with fields of ctx, e.g. consumer and offset of the message
+func (hc HTTPClient) HTTPRequestContext(ctx context.Context, method, url string, headers map[string]string, reqBody []byte) ([]byte, error) {
 	switch strings.ToUpper(method) {
 	case "GET":
-		return hc.HTTPGet(url, headers)
+		return hc.get(ctx, url, headers)
 	case "POST":
-		return hc.HTTPPost(url, headers, reqBody)
+		return hc.post(ctx, url, headers, reqBody)
 	case "DELETE":
-		return hc.HTTPDelete(url, headers)
+		return hc.delete(ctx, url, headers)
 	default:
 		return nil, fmt.Errorf("net/http: invalid method %q", method)
 	}
@@ -58,8 +82,23 @@ func (hc HTTPClient) HTTPRequest(method, url string, headers map[string]string,
 
 // HTTPGet implement HTTP GET request
 func (hc HTTPClient) HTTPGet(url string, headers map[string]string) ([]byte, error) {
+	return hc.get(context.Background(), url, headers)
+}
+
+// HTTPPost implement HTTP POST request
+func (hc HTTPClient) HTTPPost(url string, headers map[string]string, reqBody []byte) ([]byte, error) {
+	return hc.post(context.Background(), url, headers, reqBody)
+}
+
+// HTTPDelete implement HTTP DELETE request
+func (hc HTTPClient) HTTPDelete(url string, headers map[string]string) ([]byte, error) {
+	return hc.delete(context.Background(), url, headers)
+}
+
+func (hc HTTPClient) get(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+	logger := log.WithContext(ctx)
 	request, _ := http.NewRequest("GET", url, nil)
-	log.Printf("***** HTTPGet *****[URL:%s] [HEADERS:%s]", url, headers)
+	logger.Debugf("***** HTTPGet *****[URL:%s] [HEADERS:%s]", logpolicy.URL(url), logpolicy.Headers(headers))
 
 	if len(headers) > 0 {
 		for key, value := range headers {
@@ -69,11 +108,11 @@ func (hc HTTPClient) HTTPGet(url string, headers map[string]string) ([]byte, err
 
 	response, httpErr := hc.Do(request)
 	if httpErr != nil {
-		log.Errorf("***** HTTPGet::[FAIL] *****[URL:%s] [HEADERS:%s] [Error:%v] ", url, headers, httpErr)
+		logger.Errorf("***** HTTPGet::[FAIL] *****[URL:%s] [HEADERS:%s] [Error:%s] ", logpolicy.URL(url), logpolicy.Headers(headers), logpolicy.Error(httpErr))
 		return nil, httpErr
 	}
 	if response.StatusCode != 200 {
-		log.Errorf("***** HTTPGet::[FAIL] *****[URL:%s] [HEADERS:%s] [StatusCode:%d] [RESPONSE:%s] ", url, headers, response.StatusCode, response.Status)
+		logger.Errorf("***** HTTPGet::[FAIL] *****[URL:%s] [HEADERS:%s] [StatusCode:%d] [RESPONSE:%s] ", logpolicy.URL(url), logpolicy.Headers(headers), response.StatusCode, response.Status)
 		return nil, HTTPError{response.Status, response.StatusCode}
 	}
 	// without closing the response body, the connection may remain open and cause resource leak.
@@ -81,17 +120,17 @@ func (hc HTTPClient) HTTPGet(url string, headers map[string]string) ([]byte, err
 
 	resBody, ioErr := ioutil.ReadAll(response.Body)
 	if ioErr != nil {
-		log.Errorf("***** HTTPGet::[FAIL] *****ReadAll Execution [Error:%v] ", ioErr)
+		logger.Errorf("***** HTTPGet::[FAIL] *****ReadAll Execution [Error:%v] ", ioErr)
 		return nil, ioErr
 	}
 
 	return resBody, nil
 }
 
-// HTTPPost implement HTTP POST request
-func (hc HTTPClient) HTTPPost(url string, headers map[string]string, reqBody []byte) ([]byte, error) {
+func (hc HTTPClient) post(ctx context.Context, url string, headers map[string]string, reqBody []byte) ([]byte, error) {
+	logger := log.WithContext(ctx)
 	request, _ := http.NewRequest("POST", url, bytes.NewReader(reqBody))
-	log.Printf("***** HTTPPost *****[URL:%s] [HEADERS:%s] [BODY:%s] ", url, headers, string(reqBody))
+	logger.Debugf("***** HTTPPost *****[URL:%s] [HEADERS:%s] [BODY:%s] ", logpolicy.URL(url), logpolicy.Headers(headers), logpolicy.Body(reqBody))
 
 	if len(headers) > 0 {
 		for key, value := range headers {
@@ -101,29 +140,29 @@ func (hc HTTPClient) HTTPPost(url string, headers map[string]string, reqBody []b
 
 	response, httpErr := hc.Do(request)
 	if httpErr != nil {
-		log.Errorf("***** HTTPPost::[FAIL] *****[URL:%s] [HEADERS:%s] [BODY:%s] [Error:%v] ", url, headers, string(reqBody), httpErr)
+		logger.Errorf("***** HTTPPost::[FAIL] *****[URL:%s] [HEADERS:%s] [BODY:%s] [Error:%s] ", logpolicy.URL(url), logpolicy.Headers(headers), logpolicy.Body(reqBody), logpolicy.Error(httpErr))
 		return nil, httpErr
 	}
 	if response.StatusCode != 200 {
-		log.Errorf("***** HTTPPost::[FAIL] *****[URL:%s] [HEADERS:%s] [BODY:%s] [StatusCode:%d] [RESPONSE:%s] ", url, headers, string(reqBody), response.StatusCode, response.Status)
+		logger.Errorf("***** HTTPPost::[FAIL] *****[URL:%s] [HEADERS:%s] [BODY:%s] [StatusCode:%d] [RESPONSE:%s] ", logpolicy.URL(url), logpolicy.Headers(headers), logpolicy.Body(reqBody), response.StatusCode, response.Status)
 		return nil, HTTPError{response.Status, response.StatusCode}
 	}
 	defer response.Body.Close()
 
 	resBody, ioErr := ioutil.ReadAll(response.Body)
 	if ioErr != nil {
-		log.Errorf("***** HTTPPost::[FAIL] *****ReadAll Execution [Error:%v] ", ioErr)
+		logger.Errorf("***** HTTPPost::[FAIL] *****ReadAll Execution [Error:%v] ", ioErr)
 		return nil, ioErr
 	}
 
-	log.Infof("***** HTTPPost::[SUCCESS] *****[URL:%s] [RESPONSE:%s] ", url, resBody)
+	logger.Infof("***** HTTPPost::[SUCCESS] *****[URL:%s] [RESPONSE:%s] ", logpolicy.URL(url), logpolicy.Body(resBody))
 	return resBody, nil
 }
 
-// HTTPDelete implement HTTP DELETE request
-func (hc HTTPClient) HTTPDelete(url string, headers map[string]string) ([]byte, error) {
+func (hc HTTPClient) delete(ctx context.Context, url string, headers map[string]string) ([]byte, error) {
+	logger := log.WithContext(ctx)
 	request, _ := http.NewRequest("DELETE", url, bytes.NewReader([]byte{}))
-	log.Printf("***** HTTPDelete *****[URL:%s] [HEADERS:%s] ", url, headers)
+	logger.Debugf("***** HTTPDelete *****[URL:%s] [HEADERS:%s] ", logpolicy.URL(url), logpolicy.Headers(headers))
 
 	if len(headers) > 0 {
 		for key, value := range headers {
@@ -133,21 +172,21 @@ func (hc HTTPClient) HTTPDelete(url string, headers map[string]string) ([]byte,
 
 	response, httpErr := hc.Do(request)
 	if httpErr != nil {
-		log.Errorf("***** HTTPDelete::[FAIL] *****[URL:%s] [HEADERS:%s] [Error:%v] ", url, headers, httpErr)
+		logger.Errorf("***** HTTPDelete::[FAIL] *****[URL:%s] [HEADERS:%s] [Error:%s] ", logpolicy.URL(url), logpolicy.Headers(headers), logpolicy.Error(httpErr))
 		return nil, httpErr
 	}
 	if response.StatusCode != 200 {
-		log.Errorf("***** HTTPDelete::[FAIL] *****[URL:%s] [HEADERS:%s] [StatusCode:%d] [RESPONSE:%s] ", url, headers, response.StatusCode, response.Status)
+		logger.Errorf("***** HTTPDelete::[FAIL] *****[URL:%s] [HEADERS:%s] [StatusCode:%d] [RESPONSE:%s] ", logpolicy.URL(url), logpolicy.Headers(headers), response.StatusCode, response.Status)
 		return nil, HTTPError{response.Status, response.StatusCode}
 	}
 	defer response.Body.Close()
 
 	resBody, ioErr := ioutil.ReadAll(response.Body)
 	if ioErr != nil {
-		log.Errorf("***** HTTPDelete::[FAIL] *****ReadAll Execution [Error:%v] ", ioErr)
+		logger.Errorf("***** HTTPDelete::[FAIL] *****ReadAll Execution [Error:%v] ", ioErr)
 		return nil, ioErr
 	}
 
-	log.Infof("***** HTTPDelete::[SUCCESS] *****[URL:%s] [RESPONSE:%s] ", url, resBody)
+	logger.Infof("***** HTTPDelete::[SUCCESS] *****[URL:%s] [RESPONSE:%s] ", logpolicy.URL(url), logpolicy.Body(resBody))
 	return resBody, nil
 }
@@ -2,13 +2,16 @@ package server
 
 import (
 	"crypto/x509"
+	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
 	"time"
 
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+
 	rhttp "github.com/hashicorp/go-retryablehttp"
-	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 )
 
@@ -26,13 +29,30 @@ type RetryHTTPClient struct {
 	*rhttp.Client
 }
 
+// retryLogger logs retries of retryablehttp with URLs masked by logging policy
+type retryLogger struct{}
+
+func (retryLogger) Printf(format string, args ...interface{}) {
+	log.Debug(logpolicy.Text(fmt.Sprintf(format, args...)))
+}
+
+// logRetry logs each retry of request with fields of its context, e.g. consumer and offset of the message
+func logRetry(_ rhttp.Logger, req *http.Request, attempt int) {
+	if attempt == 0 {
+		return
+	}
+	log.WithContext(req.Context()).WithField(logging.FieldAttempt, attempt+1).
+		Warnf("***** [HTTP][RETRY] ***** Retry %s request to [url::%s]", req.Method, logpolicy.URL(req.URL.String()))
+}
+
 // Ref: https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
 // InitRetryClient return a retryable HTTP client with default config of Hermes service
 func InitRetryClient() *RetryHTTPClient {
 	rc := rhttp.NewClient()
 	// Replace default timeout "0" for http.client
 	rc.HTTPClient.Timeout = timeout
-	rc.Logger = log.New()
+	rc.Logger = retryLogger{}
+	rc.RequestLogHook = logRetry
 	rc.RetryMax = defaultRetryMax
 	rc.CheckRetry = defaultRetryPolicy
 	//rc.Backoff = rhttp.LinearJitterBackoff
@@ -48,7 +68,7 @@ func InitRetryClient() *RetryHTTPClient {
 	return &RetryHTTPClient{rc}
 }
 
-//Ref: rhttp.DefaultRetryPolicy()
+// Ref: rhttp.DefaultRetryPolicy()
 func defaultRetryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
 	// A regular expression to match the error returned by net/http when the
 	// configured number of redirects is exhausted. This error isn't typed
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runConfig prints the effective configuration merged from files, drop-in files and environment variables with
+// the source of each key, e.g. hermes config print -c configs/default.yaml -config-dir /etc/hermes/conf.d
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "Usage: hermes config print [flags]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("config print", flag.ExitOnError)
+	opts := cliOptions{}
+	opts.bind(fs)
+	fs.Parse(args[1:])
+
+	log.SetLevel(log.WarnLevel)
+	if err := configs.Load(opts.layers()); err != nil {
+		log.Fatalf("***** [CONFIG][FAIL] ***** Failed to load configuration:: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, s := range configs.Settings() {
+		v, err := json.Marshal(s.Value)
+		if err != nil {
+			v = []byte(fmt.Sprint(s.Value))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, v, s.Source)
+	}
+}
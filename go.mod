@@ -5,10 +5,17 @@ go 1.13
 require (
 	github.com/afex/hystrix-go v0.0.0-20180502004556-fa1af6a1f4f5
 	github.com/bshuster-repo/logrus-logstash-hook v0.4.1
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/golang/protobuf v1.3.5
 	github.com/hashicorp/go-retryablehttp v0.6.4
-	github.com/segmentio/kafka-go v0.3.4
+	github.com/jhump/protoreflect v1.6.1
+	github.com/linkedin/goavro/v2 v2.12.0
+	github.com/segmentio/kafka-go v0.4.47
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/viper v1.5.0
 	github.com/streadway/amqp v0.0.0-20190827072141-edfb9018d271
-	golang.org/x/net v0.0.0-20191204025024-5ee1b9f4859a
+	github.com/xeipuuv/gojsonschema v1.2.0
+	golang.org/x/net v0.17.0
+	google.golang.org/grpc v1.27.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -1,60 +1,175 @@
 package main
 
 import (
-	"sync"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
-	"github.com/linushung/hermes/cmd/server"
-	"github.com/linushung/hermes/internal/app/kafkaconsumer"
-	"github.com/linushung/hermes/internal/app/rabbitmqconsumer"
 	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/pkg/hermes"
 
-	logrustash "github.com/bshuster-repo/logrus-logstash-hook"
 	log "github.com/sirupsen/logrus"
-	//"go.elastic.co/apm/module/apmlogrus"
 )
 
-func initLogrus() {
-	logstashHost := configs.GetConfigStr("connection.logstash.host")
+const usage = `Usage: hermes <command> [flags]
 
-	if logstashHost == "" {
-		log.SetLevel(log.DebugLevel)
-		log.SetFormatter(&log.TextFormatter{
-			// DisableColors: true,
-			TimestampFormat: "2006-01-02 15:04:05.000",
-			FullTimestamp:   true,
-		})
-	} else {
-		log.SetFormatter(&log.JSONFormatter{})
-		hook, err := logrustash.NewHookWithFields("udp", logstashHost, "hermes", log.Fields{})
-		if err != nil {
-			log.Fatal(err)
-		}
+Commands:
+  serve      consume events from Kafka and RabbitMQ and post them to endpoints, the default command
+  validate   check configuration file strictly, e.g. in CI before deploys
+  replay     re-send past Kafka events through handler and endpoints of a consumer
+  produce    send a test event to a Kafka topic
+  consumers  list Kafka consumers with their lag, or partitions of a consumer, by admin API
+  circuits   list circuit state of each register, or trip and reset a circuit, by admin API
+  config     print the effective configuration with the file or environment variable of each key
+  audit      show delivery attempts of a message to endpoints from the audit journal
 
-		log.AddHook(hook)
-		//log.AddHook(&apmlogrus.Hook{})
+Run "hermes <command> -h" for flags of the command.
+`
+
+// offsetOverrides collects "client=position" values of -reset-offsets flag
+type offsetOverrides map[string]string
+
+func (o offsetOverrides) String() string {
+	return fmt.Sprint(map[string]string(o))
+}
+
+func (o offsetOverrides) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("expect client=position, got %q", value)
 	}
+	o[kv[0]] = kv[1]
+	return nil
+}
+
+// configFiles collects values of repeated -c flag
+type configFiles []string
+
+func (c *configFiles) String() string {
+	return strings.Join(*c, ",")
 }
 
-func initService() {
-	var wg sync.WaitGroup
-	server.InitCircuitBreakerMgr()
+func (c *configFiles) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// cliOptions are flags which commands loading configuration share
+type cliOptions struct {
+	files       configFiles
+	environment string
+	dir         string
+	logLevel    string
+}
+
+func (o *cliOptions) bind(fs *flag.FlagSet) {
+	fs.Var(&o.files, "c", "configuration file, repeat it to override the base file by overlays in order. Default to comma separated $HERMES_CONFIG or configs/default.yaml")
+	fs.StringVar(&o.environment, "env", os.Getenv("HERMES_ENV"), "environment whose overlay next to the base file is merged, e.g. production for configs/default.production.yaml")
+	fs.StringVar(&o.dir, "config-dir", os.Getenv("HERMES_CONFIG_DIR"), "directory of drop-in *.yaml files which are merged after configuration files")
+	fs.StringVar(&o.logLevel, "log-level", "", "log level of all components, e.g. debug, info, warn or error, default to levels of logging configuration")
+}
+
+// configFiles returns configuration files of -c flags, or of $HERMES_CONFIG when no -c flag is given
+func (o *cliOptions) configFiles() []string {
+	if len(o.files) > 0 {
+		return o.files
+	}
+	if file := os.Getenv("HERMES_CONFIG"); file != "" {
+		return strings.Split(file, ",")
+	}
+	return nil
+}
 
-	if configs.IsConfigSet("kafka") {
-		wg.Add(1)
-		kafkaconsumer.InitConsumerMgr().InitConsumerGroup()
+// config returns hermes.Config of configuration layers and log level of the flags
+func (o *cliOptions) config(config hermes.Config) hermes.Config {
+	if files := o.configFiles(); len(files) > 0 {
+		config.File, config.Overlays = files[0], files[1:]
 	}
+	config.Environment = o.environment
+	config.Dir = o.dir
+	config.LogLevel = o.logLevel
+	return config
+}
 
-	if configs.IsConfigSet("rabbitmq") {
-		wg.Add(1)
-		rabbitmqconsumer.InitRabbitMQConnector().InitConsumerGroup()
+// layers returns configuration layers of the flags for commands which do not run an App
+func (o *cliOptions) layers() configs.Layers {
+	return configs.Layers{Files: o.configFiles(), Environment: o.environment, Dir: o.dir}
+}
+
+// newApp loads configuration and initialises logging by the flags
+func (o *cliOptions) newApp(config hermes.Config) *hermes.App {
+	config = o.config(config)
+	app, err := hermes.New(config)
+	if err != nil {
+		log.Fatalf("***** [INIT:HERMES][FAIL] ***** %v", err)
 	}
+	return app
+}
 
-	wg.Wait()
+// signalContext returns a context which is cancelled once hermes receives SIGINT or SIGTERM
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	return ctx
 }
 
 func main() {
-	log.Infof("***** [INIT:HERMES] ***** Start to launch Hermes 🤓 ...")
-	configs.InitConfig()
-	initLogrus()
-	initService()
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		runServe(args)
+	case "validate":
+		runValidate(args)
+	case "replay":
+		runReplay(args)
+	case "produce":
+		runProduce(args)
+	case "consumers":
+		runConsumers(args)
+	case "circuits":
+		runCircuits(args)
+	case "config":
+		runConfig(args)
+	case "audit":
+		runAudit(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "hermes: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// runServe runs hermes until it receives SIGINT or SIGTERM, e.g.
+// hermes serve -c /etc/hermes/config.yaml -log-level info -admin 127.0.0.1:8090
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	opts := cliOptions{}
+	opts.bind(fs)
+	admin := fs.String("admin", "", "address which admin API listens on, overrides admin.address and admin.port")
+	resetOffsets := offsetOverrides{}
+	fs.Var(resetOffsets, "reset-offsets", "one-off seek of consumer group before consumers start, e.g. notificationService=2019-12-01T00:00:00Z. Position is earliest, latest, RFC3339 timestamp or offset")
+	fs.Parse(args)
+
+	config := hermes.Config{ResetOffsets: resetOffsets}
+	if *admin != "" {
+		config.Values = map[string]interface{}{"admin.address": *admin}
+	}
+	app := opts.newApp(config)
+	if err := app.Run(signalContext()); err != nil {
+		log.Fatalf("***** [HERMES][FAIL] ***** %v", err)
+	}
 }
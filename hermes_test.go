@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/linushung/hermes/pkg/hermes"
+)
+
+// parse binds cliOptions to a flag set and parses args
+func parse(t *testing.T, args ...string) *cliOptions {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	opts := &cliOptions{}
+	opts.bind(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Parse(%v) error = %v", args, err)
+	}
+	return opts
+}
+
+func TestCLIOptionsConfigFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   string
+		args  []string
+		files []string
+	}{
+		{name: "default"},
+		{name: "flag", args: []string{"-c", "base.yaml"}, files: []string{"base.yaml"}},
+		{name: "repeated flag", args: []string{"-c", "base.yaml", "-c", "prod.yaml"}, files: []string{"base.yaml", "prod.yaml"}},
+		{name: "environment variable", env: "base.yaml,prod.yaml", files: []string{"base.yaml", "prod.yaml"}},
+		{name: "flag overrides environment variable", env: "env.yaml", args: []string{"-c", "base.yaml"}, files: []string{"base.yaml"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HERMES_CONFIG", tt.env)
+			opts := parse(t, tt.args...)
+			if files := opts.configFiles(); !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("configFiles() = %v, want %v", files, tt.files)
+			}
+			if files := opts.layers().Files; !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("layers() files = %v, want %v", files, tt.files)
+			}
+		})
+	}
+}
+
+func TestCLIOptionsConfig(t *testing.T) {
+	t.Setenv("HERMES_CONFIG", "env.yaml")
+	t.Setenv("HERMES_ENV", "staging")
+	t.Setenv("HERMES_CONFIG_DIR", "")
+
+	tests := []struct {
+		name string
+		args []string
+		want hermes.Config
+	}{
+		{
+			name: "environment variables",
+			want: hermes.Config{File: "env.yaml", Overlays: []string{}, Environment: "staging", Values: map[string]interface{}{"admin.address": ":8090"}},
+		},
+		{
+			name: "flags",
+			args: []string{"-c", "base.yaml", "-c", "prod.yaml", "-env", "production", "-config-dir", "conf.d", "-log-level", "debug"},
+			want: hermes.Config{
+				File: "base.yaml", Overlays: []string{"prod.yaml"}, Environment: "production", Dir: "conf.d", LogLevel: "debug",
+				Values: map[string]interface{}{"admin.address": ":8090"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parse(t, tt.args...).config(hermes.Config{Values: map[string]interface{}{"admin.address": ":8090"}})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("config() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOffsetOverridesSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  offsetOverrides
+		err   string
+	}{
+		{value: "notificationService=earliest", want: offsetOverrides{"notificationService": "earliest"}},
+		{value: "notificationService=2019-12-01T00:00:00Z", want: offsetOverrides{"notificationService": "2019-12-01T00:00:00Z"}},
+		{value: "notificationService", err: "expect client=position"},
+		{value: "=earliest", err: "expect client=position"},
+		{value: "notificationService=", err: "expect client=position"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			o := offsetOverrides{}
+			err := o.Set(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Set(%q) error = %v, want %q", tt.value, err, tt.err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(o, tt.want) {
+				t.Errorf("Set(%q) = %v, %v, want %v", tt.value, o, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package kafkaconsumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/pkg/audit"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/dedup"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	batchFormatJSON        = "json"
+	batchFormatNDJSON      = "ndjson"
+	defaultBatchMessages   = 100
+	defaultBatchBytes      = 1 << 20 // 1MB
+	defaultBatchLinger     = 1 * time.Second
+	defaultBatchBufferSize = 1000
+)
+
+// errBatchStopped is returned when a message is added to a batch endpoint which has been stopped
+var errBatchStopped = errors.New("kafka: batch endpoint is stopped")
+
+// batchEndpoint accumulates messages and posts them as a JSON array or NDJSON body once MaxMessages, MaxBytes or
+// Linger is reached. A batch succeeds or fails as one unit, a failed batch is split and each message is retried
+// individually if SplitOnFailure is set, and messages which still fail are kept in spool.
+//
+// Messages are handed over to the batch without waiting for it to be posted, each of them gets a batchAck which
+// reports whether the message is kept once its batch is posted. Consumers commit the offset of a message only after
+// then, while they go on handling later messages meanwhile.
+type batchEndpoint struct {
+	URL            string        `mapstructure:"url"`
+	MaxMessages    int           `mapstructure:"maxMessages"`
+	MaxBytes       int           `mapstructure:"maxBytes"`
+	Linger         time.Duration `mapstructure:"linger"`
+	Format         string        `mapstructure:"format"`
+	SplitOnFailure bool          `mapstructure:"splitOnFailure"`
+
+	register string
+	dedupKey *dedup.Key
+	tube     chan *batchAck
+	quit     chan struct{}
+	// done is closed once every message which has been handed over is posted after stop
+	done chan struct{}
+	once sync.Once
+	// mu is held for reading while a message is handed over, so stop waits for adds in flight
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// validate checks batch configuration and fills defaults
+func (b *batchEndpoint) validate() error {
+	switch {
+	case b.URL == "":
+		return fmt.Errorf("url of batch endpoint is required")
+	case server.IsGRPC(b.URL):
+		return fmt.Errorf("batch endpoint::%s is a gRPC endpoint, batches are posted to HTTP endpoints only", b.URL)
+	case b.MaxMessages < 0, b.MaxBytes < 0, b.Linger < 0:
+		return fmt.Errorf("maxMessages, maxBytes and linger of batch endpoint::%s must not be negative", b.URL)
+	}
+	if err := configs.ValidateURL(b.URL); err != nil {
+		return err
+	}
+
+	if b.MaxMessages == 0 {
+		b.MaxMessages = defaultBatchMessages
+	}
+	if b.MaxBytes == 0 {
+		b.MaxBytes = defaultBatchBytes
+	}
+	if b.Linger == 0 {
+		b.Linger = defaultBatchLinger
+	}
+
+	switch strings.ToLower(b.Format) {
+	case "":
+		b.Format = batchFormatJSON
+	case batchFormatJSON, batchFormatNDJSON:
+		b.Format = strings.ToLower(b.Format)
+	default:
+		return fmt.Errorf("unknown format %q of batch endpoint::%s, expect %s or %s", b.Format, b.URL, batchFormatJSON, batchFormatNDJSON)
+	}
+	return nil
+}
+
+// start launches the goroutine which accumulates and posts batches with circuit breaker of the register, messages
+// are remembered by dedupKey once their batch is delivered
+func (b *batchEndpoint) start(register string, dedupKey *dedup.Key) {
+	b.once.Do(func() {
+		b.register, b.dedupKey = register, dedupKey
+		b.tube = make(chan *batchAck, defaultBatchBufferSize)
+		b.quit = make(chan struct{})
+		b.done = make(chan struct{})
+		go b.run()
+	})
+}
+
+// add hands message over to the batch and returns the ack of it, it fails with errBatchStopped once the batch is
+// stopped
+func (b *batchEndpoint) add(msg *kafka.Message) (*batchAck, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.stopped {
+		return nil, errBatchStopped
+	}
+	a := &batchAck{msg: msg, kept: make(chan bool, 1)}
+	b.tube <- a
+	return a, nil
+}
+
+// stop waits for messages being added, then it posts every message which has been handed over and returns once they
+// are posted
+func (b *batchEndpoint) stop() {
+	b.mu.Lock()
+	if !b.stopped {
+		b.stopped = true
+		close(b.quit)
+	}
+	b.mu.Unlock()
+	<-b.done
+}
+
+func (b *batchEndpoint) run() {
+	defer close(b.done)
+
+	var batch []*batchAck
+	size := 0
+	timer := time.NewTimer(b.Linger)
+	timer.Stop()
+
+	flush := func() {
+		if len(batch) > 0 {
+			b.post(batch)
+		}
+		batch, size = nil, 0
+		timer.Stop()
+	}
+	push := func(a *batchAck) {
+		if len(batch) > 0 && size+len(a.msg.Value) > b.MaxBytes {
+			flush()
+		}
+		if len(batch) == 0 {
+			// The timer may have expired while the previous batch was posted, its tick would flush this batch early
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(b.Linger)
+		}
+		batch = append(batch, a)
+		size += len(a.msg.Value)
+		if len(batch) >= b.MaxMessages || size >= b.MaxBytes {
+			flush()
+		}
+	}
+
+	for {
+		select {
+		case a := <-b.tube:
+			push(a)
+		case <-timer.C:
+			flush()
+		case <-b.quit:
+			for len(b.tube) > 0 {
+				push(<-b.tube)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// post delivers batch to the batch endpoint, every message of batch gets an audit record of the batch attempt and of
+// its own post if the batch is split. The ack of each message reports whether it is posted or kept in spool.
+func (b *batchEndpoint) post(batch []*batchAck) {
+	ctx := logging.NewContext(context.Background(), logging.Fields{logging.FieldEndpoint: logpolicy.URL(b.URL)})
+	msgs := make([]*kafka.Message, len(batch))
+	for i, a := range batch {
+		msgs[i] = a.msg
+	}
+	body, contentType := b.encode(msgs)
+	start := time.Now()
+	_, httpErr := server.GetCircuitBreakerMgr().CBHTTPPostContext(ctx, b.register, b.URL, contentType, body)
+	if httpErr == nil {
+		for _, a := range batch {
+			audit.GetJournal().Record(audit.Attempt(messageSource(ctx, a.msg), b.URL, 1, start, nil))
+			dedup.GetDedup().MarkDelivered(b.URL, dedupID(b.dedupKey, a.msg))
+			a.kept <- true
+		}
+		return
+	}
+
+	log.WithContext(ctx).Errorf("***** [HANDLER][FAIL] ***** Receive post error of batch with %d messages from [handler::%s] [Error::%s]", len(batch), b.register, logpolicy.Error(httpErr))
+	for _, a := range batch {
+		msg := a.msg
+		mctx := messageContext(ctx, msg)
+		r := audit.Attempt(messageSource(ctx, msg), b.URL, 1, start, httpErr)
+		err := httpErr
+		if b.SplitOnFailure {
+			r.Outcome = audit.Retrying
+			audit.GetJournal().Record(r)
+
+			body, contentType := b.encode([]*kafka.Message{msg})
+			start = time.Now()
+			_, err = server.GetCircuitBreakerMgr().CBHTTPPostContext(mctx, b.register, b.URL, contentType, body)
+			r = audit.Attempt(messageSource(ctx, msg), b.URL, 2, start, err)
+			if err == nil {
+				audit.GetJournal().Record(r)
+				dedup.GetDedup().MarkDelivered(b.URL, dedupID(b.dedupKey, msg))
+				a.kept <- true
+				continue
+			}
+		}
+		r.Outcome = spoolMessage(mctx, b.register, b.URL, b.dedupKey, msg, err)
+		audit.GetJournal().Record(r)
+		dedup.GetDedup().Release(b.URL, dedupID(b.dedupKey, msg))
+		a.kept <- r.Outcome == audit.Spooled
+	}
+}
+
+// batchAck reports whether a message handed over to a batch endpoint is kept, which is when its batch is posted or
+// the message is kept in spool after the batch fails
+type batchAck struct {
+	msg  *kafka.Message
+	kept chan bool
+}
+
+// waitBatches blocks until batches of acks are posted and reports whether every message of them is kept
+func waitBatches(acks []*batchAck) bool {
+	kept := true
+	for _, a := range acks {
+		if !<-a.kept {
+			kept = false
+		}
+	}
+	return kept
+}
+
+type batchAcksKey struct{}
+
+// batchAcks collects acks of messages which handler hands over to batch endpoints while it handles a message, events
+// may be delivered by goroutines of handler
+type batchAcks struct {
+	mu   sync.Mutex
+	acks []*batchAck
+}
+
+// withBatchAcks returns ctx which collects acks of batch endpoints into the returned batchAcks
+func withBatchAcks(ctx context.Context) (context.Context, *batchAcks) {
+	ba := &batchAcks{}
+	return context.WithValue(ctx, batchAcksKey{}, ba), ba
+}
+
+// collectAck adds a to batchAcks of ctx, ack is dropped if ctx does not collect acks
+func collectAck(ctx context.Context, a *batchAck) {
+	ba, ok := ctx.Value(batchAcksKey{}).(*batchAcks)
+	if !ok {
+		return
+	}
+	ba.mu.Lock()
+	ba.acks = append(ba.acks, a)
+	ba.mu.Unlock()
+}
+
+// list returns collected acks
+func (ba *batchAcks) list() []*batchAck {
+	ba.mu.Lock()
+	defer ba.mu.Unlock()
+	return ba.acks
+}
+
+// encode joins message values into a JSON array or NDJSON body, values which are not JSON are encoded as strings
+func (b *batchEndpoint) encode(batch []*kafka.Message) ([]byte, string) {
+	buf := &bytes.Buffer{}
+	if b.Format == batchFormatJSON {
+		buf.WriteByte('[')
+	}
+
+	for i, msg := range batch {
+		if i > 0 && b.Format == batchFormatJSON {
+			buf.WriteByte(',')
+		}
+		if err := json.Compact(buf, msg.Value); err != nil {
+			v, _ := json.Marshal(string(msg.Value))
+			buf.Write(v)
+		}
+		if b.Format == batchFormatNDJSON {
+			buf.WriteByte('\n')
+		}
+	}
+
+	if b.Format == batchFormatJSON {
+		buf.WriteByte(']')
+		return buf.Bytes(), "application/json"
+	}
+	return buf.Bytes(), "application/x-ndjson"
+}
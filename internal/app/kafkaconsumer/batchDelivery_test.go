@@ -0,0 +1,232 @@
+package kafkaconsumer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/pkg/configs"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var initCircuitBreaker sync.Once
+
+// batchServer records bodies of batches, batches whose body contains fail are answered with 500 and every batch is
+// answered after delay
+type batchServer struct {
+	mu     sync.Mutex
+	bodies []string
+	fail   string
+	delay  time.Duration
+}
+
+func (s *batchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.delay)
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	s.bodies = append(s.bodies, string(body))
+	s.mu.Unlock()
+
+	if s.fail != "" && strings.Contains(string(body), s.fail) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (s *batchServer) posted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+// startBatch starts b which posts batches to srv with circuit breaker of the default register
+func startBatch(t *testing.T, b *batchEndpoint, srv *httptest.Server) {
+	t.Helper()
+	initCircuitBreaker.Do(func() {
+		values := map[string]interface{}{"kafka.bootstrapservers": "localhost:9092"}
+		if err := configs.LoadConfig("", values); err != nil {
+			t.Fatalf("failed to load configuration: %v", err)
+		}
+		if err := server.InitCircuitBreakerMgr(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	b.URL = srv.URL
+	if err := b.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	b.start(server.DefaultHandler, nil)
+}
+
+// addAll hands values over to b and returns their acks
+func addAll(t *testing.T, b *batchEndpoint, values ...string) []*batchAck {
+	t.Helper()
+	acks := make([]*batchAck, 0, len(values))
+	for i, v := range values {
+		a, err := b.add(&kafka.Message{Topic: "events", Offset: int64(i), Value: []byte(v)})
+		if err != nil {
+			t.Fatalf("add(%s) error = %v", v, err)
+		}
+		acks = append(acks, a)
+	}
+	return acks
+}
+
+func TestBatchEndpointRefusesMessagesAfterStop(t *testing.T) {
+	b := &batchEndpoint{URL: "http://localhost:8000/anything"}
+	if err := b.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	b.start(server.DefaultHandler, nil)
+	b.stop()
+	b.stop()
+
+	if _, err := b.add(&kafka.Message{Value: []byte(`{}`)}); err != errBatchStopped {
+		t.Fatalf("add() after stop error = %v, want %v", err, errBatchStopped)
+	}
+}
+
+func TestBatchEndpointRejectsGRPCEndpoint(t *testing.T) {
+	for _, url := range []string{"grpc://localhost:9000", "grpcs://localhost:9000"} {
+		b := &batchEndpoint{URL: url}
+		if err := b.validate(); err == nil || !strings.Contains(err.Error(), "is a gRPC endpoint") {
+			t.Errorf("validate() of %s error = %v, want gRPC endpoint is rejected", url, err)
+		}
+	}
+}
+
+func TestBatchEndpointFlushes(t *testing.T) {
+	tests := []struct {
+		name   string
+		batch  *batchEndpoint
+		values []string
+		// flushed is number of messages which are posted before stop
+		flushed int
+		bodies  []string
+	}{
+		{
+			name:    "by count",
+			batch:   &batchEndpoint{MaxMessages: 2, Linger: time.Hour},
+			values:  []string{"1", "2", "3", "4", "5"},
+			flushed: 4,
+			bodies:  []string{"[1,2]", "[3,4]", "[5]"},
+		},
+		{
+			name:    "by bytes",
+			batch:   &batchEndpoint{MaxBytes: 10, Linger: time.Hour},
+			values:  []string{"1111", "2222", "3333", "4444", "5555"},
+			flushed: 4,
+			bodies:  []string{"[1111,2222]", "[3333,4444]", "[5555]"},
+		},
+		{
+			name:    "by linger",
+			batch:   &batchEndpoint{Linger: 20 * time.Millisecond},
+			values:  []string{"1", "2"},
+			flushed: 2,
+			bodies:  []string{"[1,2]"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := &batchServer{}
+			srv := httptest.NewServer(bs)
+			defer srv.Close()
+			b := tt.batch
+			startBatch(t, b, srv)
+
+			acks := addAll(t, b, tt.values...)
+			if !waitBatches(acks[:tt.flushed]) {
+				t.Fatalf("acks of posted messages report they are not kept")
+			}
+			b.stop()
+			if !waitBatches(acks[tt.flushed:]) {
+				t.Fatalf("acks of messages posted by stop report they are not kept")
+			}
+
+			if got := bs.posted(); strings.Join(got, " ") != strings.Join(tt.bodies, " ") {
+				t.Errorf("posted %v, want %v", got, tt.bodies)
+			}
+		})
+	}
+}
+
+func TestBatchEndpointIgnoresLingerExpiredDuringPost(t *testing.T) {
+	// Linger of the first batch expires while it is posted, which must not flush the next batch early
+	bs := &batchServer{delay: 100 * time.Millisecond}
+	srv := httptest.NewServer(bs)
+	defer srv.Close()
+	b := &batchEndpoint{MaxMessages: 2, Linger: 30 * time.Millisecond}
+	startBatch(t, b, srv)
+
+	acks := addAll(t, b, "1", "2", "3", "4")
+	if !waitBatches(acks) {
+		t.Fatalf("acks of posted messages report they are not kept")
+	}
+	b.stop()
+
+	want := []string{"[1,2]", "[3,4]"}
+	if got := bs.posted(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("posted %v, want %v", got, want)
+	}
+}
+
+func TestBatchEndpointEncode(t *testing.T) {
+	batch := []*kafka.Message{{Value: []byte(`{"id": 1}`)}, {Value: []byte(`not json`)}}
+	tests := []struct {
+		format      string
+		body        string
+		contentType string
+	}{
+		{batchFormatJSON, `[{"id":1},"not json"]`, "application/json"},
+		{batchFormatNDJSON, "{\"id\":1}\n\"not json\"\n", "application/x-ndjson"},
+	}
+
+	for _, tt := range tests {
+		b := &batchEndpoint{Format: tt.format}
+		body, contentType := b.encode(batch)
+		if string(body) != tt.body || contentType != tt.contentType {
+			t.Errorf("encode() of %s = %q, %s, want %q, %s", tt.format, body, contentType, tt.body, tt.contentType)
+		}
+	}
+}
+
+func TestBatchEndpointSplitsFailedBatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		split bool
+		kept  []bool
+		posts int
+	}{
+		{name: "split and retry", split: true, kept: []bool{true, false, true}, posts: 4},
+		{name: "fail as one unit", split: false, kept: []bool{false, false, false}, posts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := &batchServer{fail: "bad"}
+			srv := httptest.NewServer(bs)
+			defer srv.Close()
+			b := &batchEndpoint{MaxMessages: 3, Linger: time.Hour, SplitOnFailure: tt.split}
+			startBatch(t, b, srv)
+
+			acks := addAll(t, b, `"good-1"`, `"bad"`, `"good-2"`)
+			for i, a := range acks {
+				if kept := <-a.kept; kept != tt.kept[i] {
+					t.Errorf("message %d kept = %v, want %v as spool is disabled", i, kept, tt.kept[i])
+				}
+			}
+			b.stop()
+
+			if got := len(bs.posted()); got != tt.posts {
+				t.Errorf("posted %d requests, want %d", got, tt.posts)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+)
+
+// PrepareReload reads configuration of consumers again and returns the function which applies it. Consumers are
+// started, stopped or restarted only if they are added, removed or their topic or groupID changes, concurrency is
+// changed in place and handler(handleFuncName, endpoints, batch endpoints, replies and validation) is swapped while
+// consumers keep running. Changes of startOffset, reader, ordering, bootstrap servers and security take effect after
+// restart. Start offsets of added and restarted consumers are resolved before anything is applied, so configuration
+// whose start offset cannot be resolved is rejected.
+func (cmgr *consumerManager) PrepareReload() (func(), error) {
+	next := make(map[string]*consumer)
+	for _, cli := range configs.GetConfigSlice("kafka.clients") {
+		con, err := newConsumer(cli, cmgr.baseConsumer)
+		if err != nil {
+			return nil, err
+		}
+		next[cli] = con
+	}
+
+	cmgr.mu.RLock()
+	var restarted []string
+	for cli, nc := range next {
+		if con, ok := cmgr.Consumers[cli]; !ok || con.Topic != nc.Topic || con.GroupID != nc.GroupID {
+			restarted = append(restarted, cli)
+		}
+	}
+	cmgr.mu.RUnlock()
+
+	offsets := make(map[string]map[int]int64)
+	for _, cli := range restarted {
+		nc := next[cli]
+		o, err := nc.resolveStartOffsets(cmgr.baseConsumer)
+		if err != nil {
+			return nil, startOffsetError(cli, nc, err)
+		}
+		offsets[cli] = o
+	}
+
+	return func() {
+		cmgr.applyReload(next, offsets)
+	}, nil
+}
+
+// applyReload applies consumers of next, offsets are start offsets of added and restarted consumers resolved by
+// PrepareReload
+func (cmgr *consumerManager) applyReload(next map[string]*consumer, offsets map[string]map[int]int64) {
+	cmgr.mu.Lock()
+	defer cmgr.mu.Unlock()
+
+	for cli, con := range cmgr.Consumers {
+		if _, ok := next[cli]; !ok {
+			con.stop()
+			delete(cmgr.Consumers, cli)
+			log.Infof("***** [KAFKA:%s] ***** Stop Consumer Group::%s which is removed from configuration ......", cli, con.GroupID)
+		}
+	}
+
+	for cli, nc := range next {
+		con, ok := cmgr.Consumers[cli]
+		if ok && con.Topic == nc.Topic && con.GroupID == nc.GroupID {
+			con.reload(cmgr.ctx, cli, nc, cmgr.baseConsumer)
+			continue
+		}
+
+		// Workers of the old consumer leave consumer group before the new one joins it, its batch endpoints keep
+		// running until the new one starts, so the old one can be started again if the new one fails
+		if ok {
+			con.stopWorkers()
+			log.Infof("***** [KAFKA:%s] ***** Restart Consumer Group::%s for Topic::%s as Consumer Group::%s for Topic::%s ......", cli, con.GroupID, con.Topic, nc.GroupID, nc.Topic)
+		}
+		nc.startBatches()
+		if err := cmgr.startConsumer(cli, nc, offsets[cli]); err != nil {
+			nc.stop()
+			if ok {
+				log.Warnf("***** [KAFKA:%s] ***** Start Consumer Group::%s for Topic::%s again ......", cli, con.GroupID, con.Topic)
+				cmgr.startWorkers(con)
+			}
+			continue
+		}
+		if ok {
+			con.stopBatches()
+		}
+		cmgr.Consumers[cli] = nc
+	}
+}
+
+// stop stops all workers of consumer and waits for them to return, then it stops batch endpoints which post every
+// message handed over to them by the workers
+func (c *consumer) stop() {
+	c.stopWorkers()
+	c.stopBatches()
+}
+
+// stopWorkers stops all workers of consumer and waits for them to return, so they leave consumer group before
+// another consumer joins it
+func (c *consumer) stopWorkers() {
+	c.mu.Lock()
+	for len(c.workers) > 0 {
+		c.stopWorker()
+	}
+	c.mu.Unlock()
+	c.active.Wait()
+}
+
+// stopBatches stops batch endpoints of consumer, which post every message handed over to them
+func (c *consumer) stopBatches() {
+	for _, b := range c.currentHandler().BatchEndPoints {
+		b.stop()
+	}
+}
+
+// reload swaps handler of consumer to the one of nc and changes concurrency if it is changed by configuration, added
+// workers stop once ctx is done. It returns once the workers which are stopped by reduced concurrency return and
+// batch endpoints of the old handler stop, which is after the lock of consumer is released.
+func (c *consumer) reload(ctx context.Context, cli string, nc *consumer, bc baseConsumer) {
+	var stopped []<-chan struct{}
+	var oldBatches []*batchEndpoint
+	defer func() {
+		for _, done := range stopped {
+			<-done
+		}
+		// Old batches post messages which have been added before they stop, messages which workers handling with
+		// the old handler add afterwards are refused and kept in spool
+		for _, b := range oldBatches {
+			b.stop()
+		}
+	}()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	old := c.Handler
+	if sameHandler(old, nc.Handler) {
+		nc.Handler.BatchEndPoints = old.BatchEndPoints
+	} else {
+		for _, b := range nc.Handler.BatchEndPoints {
+			b.start(nc.Handler.register(), nc.Handler.dedupKey)
+		}
+		oldBatches = old.BatchEndPoints
+		log.Infof("***** [KAFKA:%s] ***** Reload handler::%s with %d endpoints and %d batch endpoints ......", cli, nc.Handler.Handler, len(nc.Handler.EndPoints), len(nc.Handler.BatchEndPoints))
+	}
+	c.Handler = nc.Handler
+
+	// Concurrency changed by admin API is kept unless concurrency of configuration changes
+	if nc.Concurrency != c.configConcurrency {
+		for len(c.workers) < nc.Concurrency {
+			c.startWorker(ctx, bc)
+		}
+		for len(c.workers) > nc.Concurrency {
+			stopped = append(stopped, c.stopWorker())
+		}
+		log.Infof("***** [KAFKA:%s] ***** Change concurrency of Consumer Group::%s from %d to %d ......", cli, c.GroupID, c.Concurrency, nc.Concurrency)
+		c.Concurrency = nc.Concurrency
+		c.configConcurrency = nc.Concurrency
+	}
+
+	if c.StartOffset != nc.StartOffset || c.Ordering != nc.Ordering || c.Lanes != nc.Lanes || !reflect.DeepEqual(c.Reader, nc.Reader) {
+		log.Warnf("***** [KAFKA:%s] ***** Changes of startOffset, ordering, lanes and reader take effect after restart ......", cli)
+	}
+}
+
+// sameHandler reports whether handler configuration of a and b is the same, runtime state of batch endpoints is
+// not compared
+func sameHandler(a, b handler) bool {
+	if a.Handler != b.Handler || !reflect.DeepEqual(a.EndPoints, b.EndPoints) || !reflect.DeepEqual(a.Replies, b.Replies) ||
+		a.dedupKey.String() != b.dedupKey.String() || !reflect.DeepEqual(a.Validation, b.Validation) {
+		return false
+	}
+	if len(a.BatchEndPoints) != len(b.BatchEndPoints) {
+		return false
+	}
+	for i, ba := range a.BatchEndPoints {
+		bb := b.BatchEndPoints[i]
+		if ba.URL != bb.URL || ba.MaxMessages != bb.MaxMessages || ba.MaxBytes != bb.MaxBytes || ba.Linger != bb.Linger || ba.Format != bb.Format || ba.SplitOnFailure != bb.SplitOnFailure {
+			return false
+		}
+	}
+	return true
+}
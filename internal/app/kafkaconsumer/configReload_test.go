@@ -0,0 +1,103 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/validation"
+)
+
+func TestSameHandler(t *testing.T) {
+	base := func() handler {
+		return handler{
+			Handler:        "NotificationServiceHandler",
+			EndPoints:      []string{"http://localhost:8000/events"},
+			BatchEndPoints: []*batchEndpoint{{URL: "http://localhost:8000/batches", MaxMessages: 10}},
+			Validation:     &validation.Config{Schema: "schemas/event.json"},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(h *handler)
+		same   bool
+	}{
+		{name: "unchanged", change: func(h *handler) {}, same: true},
+		{name: "endpoints", change: func(h *handler) { h.EndPoints = append(h.EndPoints, "http://localhost:8001/events") }},
+		{name: "batch endpoint", change: func(h *handler) { h.BatchEndPoints[0].MaxMessages = 20 }},
+		{name: "validation schema", change: func(h *handler) { h.Validation.Schema = "schemas/event-v2.json" }},
+		{name: "validation removed", change: func(h *handler) { h.Validation = nil }},
+		{name: "invalid events", change: func(h *handler) {
+			h.Validation.InvalidEvents = &validation.Destination{Topic: "invalid-events"}
+		}},
+	}
+
+	for _, tt := range tests {
+		b := base()
+		tt.change(&b)
+		if same := sameHandler(base(), b); same != tt.same {
+			t.Errorf("sameHandler() with changed %s = %v, want %v", tt.name, same, tt.same)
+		}
+	}
+}
+
+func TestReloadStopsOldBatchesWithoutLock(t *testing.T) {
+	posting, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case posting <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer srv.Close()
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	defer unblock()
+
+	old := &batchEndpoint{MaxMessages: 1}
+	startBatch(t, old, srv)
+	next := &batchEndpoint{MaxMessages: 2}
+	startBatch(t, next, srv)
+	defer next.stop()
+
+	c := &consumer{Handler: handler{Handler: "NotificationServiceHandler", BatchEndPoints: []*batchEndpoint{old}}}
+	nc := &consumer{Handler: handler{Handler: "NotificationServiceHandler", BatchEndPoints: []*batchEndpoint{next}}}
+	addAll(t, old, `{"id":1}`)
+	<-posting
+
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		c.reload(context.Background(), "notificationService", nc, baseConsumer{})
+	}()
+
+	// Workers read handler while the old batch posts the message handed over to it
+	swapped := make(chan handler)
+	go func() {
+		for {
+			if h := c.currentHandler(); len(h.BatchEndPoints) == 1 && h.BatchEndPoints[0] == next {
+				swapped <- h
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case <-swapped:
+	case <-time.After(time.Second):
+		t.Fatalf("currentHandler() blocks while old batch endpoints stop")
+	}
+	select {
+	case <-reloaded:
+		t.Fatalf("reload() returns before old batch endpoints stop")
+	default:
+	}
+
+	unblock()
+	<-reloaded
+}
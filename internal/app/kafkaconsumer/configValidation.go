@@ -0,0 +1,94 @@
+package kafkaconsumer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/kafkadialer"
+)
+
+// kafkaSchema lists settings of Kafka configuration, which is used to find unknown keys
+type kafkaSchema struct {
+	BootstrapServers string                     `mapstructure:"bootstrapservers"`
+	Security         kafkadialer.SecuritySchema `mapstructure:"security"`
+	Reader           readerConfig               `mapstructure:"reader"`
+	Clients          []string                   `mapstructure:"clients"`
+	Consumers        map[string]*consumer       `mapstructure:"consumers"`
+}
+
+// ValidateConfig checks Kafka configuration strictly without connecting to brokers
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("kafka", kafkaSchema{})
+	if configs.GetConfigStr("kafka.bootstrapservers") == "" {
+		ps = append(ps, configs.Problemf("kafka.bootstrapservers", "bootstrapservers is required"))
+	}
+
+	dialer, err := kafkadialer.NewDialer()
+	if err != nil {
+		ps = append(ps, configs.Problemf("kafka.security", "%v", err))
+	}
+	bc, err := newBaseConsumer(dialer)
+	if err != nil {
+		return append(ps, configs.Problemf("kafka.reader", "%v", err))
+	}
+
+	clients := configs.GetConfigSlice("kafka.clients")
+	if len(clients) == 0 {
+		ps = append(ps, configs.Problemf("kafka.clients", "at least one client is required"))
+	}
+	listed := make(map[string]bool, len(clients))
+	for _, cli := range clients {
+		listed[strings.ToLower(cli)] = true
+		_, cps := loadConsumer(cli, bc)
+		ps = append(ps, cps...)
+	}
+	for name := range configs.GetConfigMap("kafka.consumers") {
+		if !listed[strings.ToLower(name)] {
+			ps = append(ps, configs.Problemf("kafka.consumers."+name, "consumer is not listed in kafka.clients"))
+		}
+	}
+	return ps
+}
+
+// loadConsumer reads configuration of consumer of the client and returns problems of it
+func loadConsumer(cli string, bc baseConsumer) (*consumer, []configs.Problem) {
+	key := "kafka.consumers." + cli
+	if !configs.IsConfigSet(key) {
+		return nil, []configs.Problem{configs.Problemf(key, "client %s is listed in kafka.clients but not configured in kafka.consumers", cli)}
+	}
+
+	con := &consumer{name: cli, Reader: bc.inherit()}
+	if err := configs.GetConfigUnmarshalKey(key, con); err != nil {
+		return nil, []configs.Problem{configs.Problemf(key, "%v", err)}
+	}
+	con.Reader.merge(bc.readerConfig)
+	return con, con.problems(key, bc)
+}
+
+// problems validates settings of consumer configured under key
+func (c *consumer) problems(key string, bc baseConsumer) []configs.Problem {
+	var ps []configs.Problem
+	if c.Topic == "" {
+		ps = append(ps, configs.Problemf(key+".topic", "topic is required"))
+	}
+	if c.GroupID == "" {
+		ps = append(ps, configs.Problemf(key+".groupID", "groupID is required"))
+	}
+	if c.Concurrency < 1 {
+		ps = append(ps, configs.Problemf(key+".concurrency", "%v", ErrInvalidConcurrency))
+	}
+	if c.StartOffset != "" {
+		if err := offsetPosition(c.StartOffset).validate(false); err != nil {
+			ps = append(ps, configs.Problemf(key+".startOffset", "%v", err))
+		}
+	}
+	if err := c.validateOrdering(); err != nil {
+		ps = append(ps, configs.Problemf(key+".ordering", "%v", err))
+	}
+	ps = append(ps, c.Handler.problems(key+".handler")...)
+	if err := c.validateReader(bc); err != nil {
+		ps = append(ps, configs.Problemf(key+".reader", "%v", fmt.Errorf("invalid reader configuration: %v", err)))
+	}
+	return ps
+}
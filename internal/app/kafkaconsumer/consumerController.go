@@ -0,0 +1,280 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ConsumerInfo describes configuration and state of a consumer
+type ConsumerInfo struct {
+	Client      string   `json:"client"`
+	Topic       string   `json:"topic"`
+	GroupID     string   `json:"groupID"`
+	Concurrency int      `json:"concurrency"`
+	Ordering    string   `json:"ordering,omitempty"`
+	Handler     string   `json:"handler"`
+	EndPoints   []string `json:"endPoints"`
+	Paused      bool     `json:"paused"`
+}
+
+// PartitionOffset describes the offset which consumer group commits to a partition and lag of it. Committed and Lag
+// are -1 if consumer group has no committed offset of the partition. LastRead is the latest offset read by this
+// hermes instance, it is -1 if hermes has not read any message from the partition since it started.
+type PartitionOffset struct {
+	Partition     int   `json:"partition"`
+	Committed     int64 `json:"committed"`
+	HighWatermark int64 `json:"highWatermark"`
+	Lag           int64 `json:"lag"`
+	LastRead      int64 `json:"lastRead"`
+}
+
+// ListConsumers returns all consumers ordered by client name
+func (cmgr *consumerManager) ListConsumers() []ConsumerInfo {
+	cmgr.mu.RLock()
+	defer cmgr.mu.RUnlock()
+
+	infos := make([]ConsumerInfo, 0, len(cmgr.Consumers))
+	for cli, con := range cmgr.Consumers {
+		infos = append(infos, con.info(cli))
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Client < infos[j].Client })
+	return infos
+}
+
+// GetConsumer returns the consumer of the client
+func (cmgr *consumerManager) GetConsumer(cli string) (ConsumerInfo, error) {
+	cli, con, err := cmgr.lookup(cli)
+	if err != nil {
+		return ConsumerInfo{}, err
+	}
+	return con.info(cli), nil
+}
+
+// PartitionOffsets returns committed offset of consumer group and lag of each partition of the topic which the
+// client consumes, committed offsets are fetched from brokers
+func (cmgr *consumerManager) PartitionOffsets(ctx context.Context, cli string) ([]PartitionOffset, error) {
+	_, con, err := cmgr.lookup(cli)
+	if err != nil {
+		return nil, err
+	}
+
+	committed, err := cmgr.Client.ConsumerOffsets(ctx, kafka.TopicAndGroup{Topic: con.Topic, GroupId: con.GroupID})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := cmgr.Dialer.DialContext(ctx, "tcp", cmgr.BootstrapServers[0])
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(con.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	con.mu.Lock()
+	read := make(map[int]int64, len(con.offsets))
+	for p, o := range con.offsets {
+		read[p] = o
+	}
+	con.mu.Unlock()
+
+	offsets := make([]PartitionOffset, 0, len(partitions))
+	for _, p := range partitions {
+		pconn, err := cmgr.Dialer.DialPartition(ctx, "tcp", "", p)
+		if err != nil {
+			return nil, err
+		}
+		last, err := pconn.ReadLastOffset()
+		pconn.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		po := PartitionOffset{Partition: p.ID, Committed: -1, HighWatermark: last, Lag: -1, LastRead: -1}
+		// Committed offset is the offset of the next message which consumer group reads
+		if o, ok := committed[p.ID]; ok && o >= 0 {
+			po.Committed = o
+			po.Lag = last - o
+		}
+		if o, ok := read[p.ID]; ok {
+			po.LastRead = o
+		}
+		offsets = append(offsets, po)
+	}
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i].Partition < offsets[j].Partition })
+	return offsets, nil
+}
+
+// Pause stops readers of the client from fetching messages, they stay in consumer group to avoid rebalancing
+func (cmgr *consumerManager) Pause(cli string) error {
+	cli, con, err := cmgr.lookup(cli)
+	if err != nil {
+		return err
+	}
+
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	if !con.paused() {
+		con.running = make(chan struct{})
+		log.Infof("***** [KAFKA:%s] ***** Pause Consumer Group::%s ......", cli, con.GroupID)
+	}
+	return nil
+}
+
+// Resume lets paused readers of the client fetch messages again
+func (cmgr *consumerManager) Resume(cli string) error {
+	cli, con, err := cmgr.lookup(cli)
+	if err != nil {
+		return err
+	}
+
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	if con.paused() {
+		close(con.running)
+		log.Infof("***** [KAFKA:%s] ***** Resume Consumer Group::%s ......", cli, con.GroupID)
+	}
+	return nil
+}
+
+// SetConcurrency starts or stops readers of the client until it runs the given number of readers, it returns once the
+// stopped readers return
+func (cmgr *consumerManager) SetConcurrency(cli string, concurrency int) error {
+	if concurrency < 1 {
+		return ErrInvalidConcurrency
+	}
+
+	cli, con, err := cmgr.lookup(cli)
+	if err != nil {
+		return err
+	}
+
+	// Stopped workers are waited for once the lock is released, as they read handler with it
+	var stopped []<-chan struct{}
+	con.mu.Lock()
+	for len(con.workers) < concurrency {
+		con.startWorker(cmgr.ctx, cmgr.baseConsumer)
+	}
+	for len(con.workers) > concurrency {
+		stopped = append(stopped, con.stopWorker())
+	}
+	log.Infof("***** [KAFKA:%s] ***** Change concurrency of Consumer Group::%s from %d to %d ......", cli, con.GroupID, con.Concurrency, concurrency)
+	con.Concurrency = concurrency
+	con.mu.Unlock()
+
+	for _, done := range stopped {
+		<-done
+	}
+	return nil
+}
+
+// lookup finds consumer by client name, client name is case insensitive as keys of configuration
+func (cmgr *consumerManager) lookup(cli string) (string, *consumer, error) {
+	cmgr.mu.RLock()
+	defer cmgr.mu.RUnlock()
+
+	if con, ok := cmgr.Consumers[cli]; ok {
+		return cli, con, nil
+	}
+	for name, con := range cmgr.Consumers {
+		if strings.EqualFold(name, cli) {
+			return name, con, nil
+		}
+	}
+	return "", nil, ErrConsumerNotFound
+}
+
+func (c *consumer) info(cli string) ConsumerInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	handler := c.Handler.Handler
+	if handler == "" {
+		handler = c.Handler.register()
+	}
+	return ConsumerInfo{
+		Client:      cli,
+		Topic:       c.Topic,
+		GroupID:     c.GroupID,
+		Concurrency: c.Concurrency,
+		Ordering:    c.Ordering,
+		Handler:     handler,
+		EndPoints:   c.Handler.EndPoints,
+		Paused:      c.paused(),
+	}
+}
+
+// paused reports whether consumer is paused, caller must hold the lock
+func (c *consumer) paused() bool {
+	select {
+	case <-c.running:
+		return false
+	default:
+		return true
+	}
+}
+
+// Shutdown stops all workers of every consumer and replay jobs and waits for workers to commit offsets of delivered
+// messages, then it stops batch endpoints which post every message handed over to them before it returns. It
+// returns an error if workers do not stop before ctx is done, but it still waits for them. Messages which have been
+// fetched but not handled yet are left uncommitted.
+func (cmgr *consumerManager) Shutdown(ctx context.Context) error {
+	cmgr.mu.RLock()
+	defer cmgr.mu.RUnlock()
+
+	cmgr.cancel()
+	var workers sync.WaitGroup
+	for _, done := range replays.running() {
+		workers.Add(1)
+		go func(done <-chan struct{}) {
+			defer workers.Done()
+			<-done
+		}(done)
+	}
+	for _, con := range cmgr.Consumers {
+		con.mu.Lock()
+		for len(con.workers) > 0 {
+			con.stopWorker()
+		}
+		con.mu.Unlock()
+
+		workers.Add(1)
+		go func(con *consumer) {
+			defer workers.Done()
+			con.active.Wait()
+		}(con)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	// Workers hand messages over to batch endpoints, spool, dedup and audit journal, which are closed after they
+	// return even if they do not stop in time
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = fmt.Errorf("kafka: workers and replay jobs do not stop in time: %v", ctx.Err())
+		log.Warnf("***** [KAFKA] ***** Wait for workers and replay jobs which do not stop in time ......")
+		<-stopped
+	}
+
+	for _, con := range cmgr.Consumers {
+		for _, b := range con.currentHandler().BatchEndPoints {
+			b.stop()
+		}
+	}
+	return err
+}
@@ -2,14 +2,33 @@ package kafkaconsumer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/linushung/hermes/cmd/server"
 	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/kafkadialer"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
 
 	"github.com/segmentio/kafka-go"
-	log "github.com/sirupsen/logrus"
+)
+
+// log is the logger of kafka component
+var log = logging.For(logging.Kafka)
+
+// redeliverInterval is how long to wait before a lost message is delivered again while circuit is closed
+const redeliverInterval = time.Second
+
+var (
+	instance *consumerManager
+	// ErrConsumerNotFound is returned when the client is not configured in kafka.clients
+	ErrConsumerNotFound = errors.New("kafka: consumer not found")
+	// ErrInvalidConcurrency is returned when concurrency of consumer is less than 1
+	ErrInvalidConcurrency = errors.New("kafka: concurrency must be greater than 0")
 )
 
 type consumer struct {
@@ -17,6 +36,27 @@ type consumer struct {
 	GroupID     string  `mapstructure:"groupID"`
 	Concurrency int     `mapstructure:"concurrency"`
 	Handler     handler `mapstructure:"handler"`
+	// StartOffset is where consumer group starts in partitions without committed offset, which is earliest, latest
+	// or RFC3339 timestamp
+	StartOffset string       `mapstructure:"startOffset"`
+	Reader      readerConfig `mapstructure:"reader"`
+	// Ordering is none or key, key delivers messages with the same key in sequence by Lanes of each reader
+	Ordering string `mapstructure:"ordering"`
+	Lanes    int    `mapstructure:"lanes"`
+
+	// name is the client of consumer, which is logged as consumer field
+	name string
+	mu   sync.Mutex
+	// configConcurrency is concurrency of the latest loaded configuration, which may differ from Concurrency changed
+	// by admin API
+	configConcurrency int
+	// running is closed while consumer is not paused, readers wait on it before fetching messages
+	running chan struct{}
+	// workers keeps each member of consumer group which is started, active counts members which have not returned
+	workers []worker
+	active  sync.WaitGroup
+	// offsets keeps the latest offset read from each partition
+	offsets map[int]int64
 }
 
 // KafkaConfig defines Kafka configuration of hermes
@@ -26,86 +66,234 @@ type kafkaConfig struct {
 
 type baseConsumer struct {
 	BootstrapServers []string
-	MinBytes         int
-	MaxBytes         int
-	MaxWait          time.Duration
-	ReadLagInterval  time.Duration
-	SessionTimeout   time.Duration
-	// HeartbeatInterval time.Duration
-	GroupBalancers []kafka.GroupBalancer
+	Dialer           *kafka.Dialer
+	// Client sends requests to brokers which readers do not, e.g. fetching committed offsets
+	Client *kafka.Client
+	readerConfig
 }
 
 // consumerManager defines the basic configuration of consumer for each topic
 type consumerManager struct {
+	// mu guards Consumers which are added, replaced or removed by reloading configuration
+	mu sync.RWMutex
 	kafkaConfig
 	baseConsumer
+	// ctx is the parent of replay jobs, it is cancelled by Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // InitConsumerMgr prepares consumer's base configuration and channel for each topic
-func InitConsumerMgr() *consumerManager {
+func InitConsumerMgr() (*consumerManager, error) {
+	dialer, err := kafkadialer.NewDialer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to init security configuration of Kafka: %v", err)
+	}
+
+	baseConsumer, err := newBaseConsumer(dialer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init reader configuration of Kafka: %v", err)
+	}
+
 	cons := make(map[string]*consumer)
 	for _, cli := range configs.GetConfigSlice("kafka.clients") {
-		con := &consumer{}
-		if err := configs.GetConfigUnmarshalKey(fmt.Sprintf("kafka.consumers.%s", cli), con); err != nil {
-			log.Errorf("***** [INIT:KAFKA][FAIL] ***** Failed to init consumer::%s configuration:: %v ......", cli, err)
+		con, err := newConsumer(cli, baseConsumer)
+		if err != nil {
+			// Batch endpoints of prepared consumers are stopped as no worker has been started
+			for _, c := range cons {
+				c.stop()
+			}
+			return nil, err
 		}
-
-		con.Handler.Tube = make(chan *kafka.Message)
-		con.Handler.HandleFunc = con.Handler.handlerDispatcher()
+		con.startBatches()
 		cons[cli] = con
 		log.Infof("***** [INIT:KAFKA] ***** Prepare consumer for client::%s ......", cli)
 	}
-	kconf := kafkaConfig{cons}
-
-	baseConsumer := baseConsumer{
-		BootstrapServers: strings.Split(configs.GetConfigStr("kafka.bootstrapservers"), ","),
-		MinBytes:         10e3,            // 10KB
-		MaxBytes:         10e6,            // 10MB
-		MaxWait:          1 * time.Second, // Maximum amount of time to wait for new data to come when fetching batches of messages from kafka.
-		ReadLagInterval:  -1,
-		SessionTimeout:   10,
-		GroupBalancers:   []kafka.GroupBalancer{kafka.RoundRobinGroupBalancer{}},
+
+	ctx, cancel := context.WithCancel(context.Background())
+	instance = &consumerManager{kafkaConfig: kafkaConfig{cons}, baseConsumer: baseConsumer, ctx: ctx, cancel: cancel}
+	return instance, nil
+}
+
+// newBaseConsumer reads brokers and reader configuration which consumers inherit
+func newBaseConsumer(dialer *kafka.Dialer) (baseConsumer, error) {
+	brokers := strings.Split(configs.GetConfigStr("kafka.bootstrapservers"), ",")
+	bc := baseConsumer{
+		BootstrapServers: brokers,
+		Dialer:           dialer,
+		Client:           kafkadialer.NewClient(brokers, dialer),
+		readerConfig:     defaultReaderConfig(),
+	}
+	err := configs.GetConfigUnmarshalKey("kafka.reader", &bc.readerConfig)
+	return bc, err
+}
+
+// newConsumer reads and validates configuration of consumer of the client
+func newConsumer(cli string, bc baseConsumer) (*consumer, error) {
+	con, ps := loadConsumer(cli, bc)
+	if err := configs.ProblemsError(ps); err != nil {
+		return nil, err
 	}
 
-	return &consumerManager{kconf, baseConsumer}
+	con.configConcurrency = con.Concurrency
+	con.running = make(chan struct{})
+	close(con.running)
+	con.offsets = make(map[int]int64)
+	return con, nil
+}
+
+// startBatches starts batch endpoints of handler of consumer
+func (c *consumer) startBatches() {
+	for _, b := range c.Handler.BatchEndPoints {
+		b.start(c.Handler.register(), c.Handler.dedupKey)
+	}
 }
 
-// ConsumerInitialiser initialise all consumers of Kafka topics
-func (cmgr *consumerManager) InitConsumerGroup() {
+// currentHandler returns handler of consumer, which may be swapped by reloading configuration
+func (c *consumer) currentHandler() handler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Handler
+}
+
+// GetConsumerMgr returns consumer manager of Kafka, or nil if Kafka is not configured
+func GetConsumerMgr() *consumerManager {
+	return instance
+}
+
+// ConsumerInitialiser initialise all consumers of Kafka topics, it returns an error if start offset of any consumer
+// cannot be applied, consumers would start from earliest or latest offset otherwise
+func (cmgr *consumerManager) InitConsumerGroup() error {
+	cmgr.mu.RLock()
+	defer cmgr.mu.RUnlock()
 	for cli, con := range cmgr.Consumers {
-		log.Infof("***** [KAFKA:%s] ***** Init Consumer Group::%s with %d consumers for Topic::%s ......", cli, con.GroupID, con.Concurrency, con.Topic)
-		for i := 1; i <= con.Concurrency; i++ {
-			go con.initKafkaConsumer(cmgr.baseConsumer)
-			go con.Handler.HandleFunc.Call(nil)
+		offsets, err := con.resolveStartOffsets(cmgr.baseConsumer)
+		if err != nil {
+			return startOffsetError(cli, con, err)
+		}
+		if err := cmgr.startConsumer(cli, con, offsets); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func (c *consumer) initKafkaConsumer(bc baseConsumer) {
-	config := kafka.ReaderConfig{
-		Brokers:         bc.BootstrapServers,
-		GroupID:         c.GroupID,
-		Topic:           c.Topic,
-		MinBytes:        bc.MinBytes,
-		MaxBytes:        bc.MaxBytes,
-		MaxWait:         bc.MaxWait,
-		ReadLagInterval: bc.ReadLagInterval,
+// startConsumer commits start offsets of consumer which are resolved by resolveStartOffsets and starts its workers,
+// no worker is started if start offsets cannot be committed
+func (cmgr *consumerManager) startConsumer(cli string, con *consumer, offsets map[int]int64) error {
+	log.Infof("***** [KAFKA:%s] ***** Init Consumer Group::%s with %d consumers for Topic::%s ......", cli, con.GroupID, con.Concurrency, con.Topic)
+	if err := con.commitStartOffsets(cli, cmgr.baseConsumer, offsets); err != nil {
+		return startOffsetError(cli, con, err)
 	}
+	cmgr.startWorkers(con)
+	return nil
+}
+
+// startWorkers starts members of consumer group by concurrency of consumer
+func (cmgr *consumerManager) startWorkers(con *consumer) {
+	con.mu.Lock()
+	defer con.mu.Unlock()
+	for len(con.workers) < con.Concurrency {
+		con.startWorker(cmgr.ctx, cmgr.baseConsumer)
+	}
+}
 
-	reader := kafka.NewReader(config)
-	// reader.SetOffset(kafka.LastOffset)
-	defer reader.Close()
+// startOffsetError logs and returns err of applying start offset of consumer
+func startOffsetError(cli string, con *consumer, err error) error {
+	log.Errorf("***** [KAFKA:%s][FAIL] ***** Failed to apply startOffset::%s to Consumer Group::%s:: %v", cli, con.StartOffset, con.GroupID, err)
+	return fmt.Errorf("failed to apply startOffset::%s to consumer::%s: %v", con.StartOffset, cli, err)
+}
+
+// worker is a member of consumer group, done is closed once it returns
+type worker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startWorker starts a member of consumer group with its lanes, which stops once parent is done, caller must hold
+// the lock
+func (c *consumer) startWorker(parent context.Context, bc baseConsumer) {
+	ctx, cancel := context.WithCancel(logging.NewContext(parent, logging.Fields{logging.FieldConsumer: c.name}))
+	w := worker{cancel: cancel, done: make(chan struct{})}
+	c.workers = append(c.workers, w)
+	c.active.Add(1)
+	go func() {
+		defer c.active.Done()
+		defer close(w.done)
+		c.initKafkaConsumer(ctx, bc)
+	}()
+}
+
+// stopWorker stops the latest started member and its lanes and returns the channel which is closed once it
+// returns, caller must hold the lock and must not wait for the channel with it, as members read handler with it
+func (c *consumer) stopWorker() <-chan struct{} {
+	last := len(c.workers) - 1
+	w := c.workers[last]
+	w.cancel()
+	c.workers = c.workers[:last]
+	return w.done
+}
+
+// resumed returns a channel which is closed while consumer is not paused
+func (c *consumer) resumed() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running
+}
 
+// handleUntilKept hands msg over to the current handler until every endpoint receives it or keeps it in spool, and
+// returns acks of batch endpoints which the message is handed over to. The message which is lost, e.g. failed while
+// circuit is open and spool is disabled, is delivered again once circuit of handler is closed, endpoints which
+// received it are skipped if messages are deduplicated. It returns false if ctx is done before the message is kept,
+// its offset must not be committed then.
+func (c *consumer) handleUntilKept(ctx context.Context, msg *kafka.Message) ([]*batchAck, bool) {
 	for {
-		msg, err := reader.ReadMessage(context.Background())
-		if err != nil {
-			log.Errorf("Failed to receive message from Topic::%s: %#v", msg.Topic, err.Error())
-			continue
+		h := c.currentHandler()
+		mctx, acks := withBatchAcks(messageContext(ctx, msg))
+		err := h.handleMessage(mctx, msg)
+		if err == nil {
+			return acks.list(), true
+		}
+		log.WithContext(mctx).Errorf("***** [HANDLER][FAIL] ***** Failed to handle message of [handler::%s] [Error::%s]", h.Handler, logpolicy.Error(err))
+		if !isLost(err) {
+			return acks.list(), true
+		}
+		if !c.waitRedelivery(mctx, h) {
+			return nil, false
+		}
+	}
+}
+
+// awaitKept waits until batches of acks are posted. If batch endpoints lose msg, it is handled again once circuit
+// of handler is closed. It reports whether msg is kept, which is false if ctx is done first.
+func (c *consumer) awaitKept(ctx context.Context, msg *kafka.Message, acks []*batchAck) bool {
+	for !waitBatches(acks) {
+		if !c.waitRedelivery(messageContext(ctx, msg), c.currentHandler()) {
+			return false
 		}
 
-		// Log message metadata received by consumer
-		//log.Infof("***** [KAFKA:CONSUMER] ***** Consumer Group::%s receives message from Topic::%s ......", config.GroupID, config.Topic)
-		//log.Infof("***** [KAFKA:CONSUMER] ***** Topic::%s Partition::%d Offset::%d ......", msg.Topic, msg.Partition, msg.Offset)
-		c.Handler.Tube <- &msg
+		var ok bool
+		if acks, ok = c.handleUntilKept(ctx, msg); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// waitRedelivery waits until circuit of h is closed before a lost message is delivered again, it returns false if
+// ctx is done first
+func (c *consumer) waitRedelivery(ctx context.Context, h handler) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	log.WithContext(ctx).Warnf("***** [HANDLER][RETRY] ***** Deliver message again once circuit of [handler::%s] is closed ......", h.Handler)
+	if err := server.GetCircuitBreakerMgr().WaitCircuitClosed(ctx, h.register()); err != nil {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(redeliverInterval):
+		return true
 	}
 }
@@ -0,0 +1,270 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	positionEarliest = "earliest"
+	positionLatest   = "latest"
+	// seekTimeout is how long to wait for joining consumer group and committing offsets
+	seekTimeout = 2 * time.Minute
+)
+
+// ErrGroupActive is returned when offsets of consumer group are overridden while other members are consuming
+var ErrGroupActive = errors.New("kafka: consumer group has active members, stop them before overriding offsets")
+
+// offsetPosition is a position in partition which is earliest, latest, RFC3339 timestamp or absolute offset
+type offsetPosition string
+
+// validate checks the position, absolute offset is only allowed when allowOffset is true
+func (pos offsetPosition) validate(allowOffset bool) error {
+	switch strings.ToLower(string(pos)) {
+	case positionEarliest, positionLatest:
+		return nil
+	}
+	if _, err := time.Parse(time.RFC3339, string(pos)); err == nil {
+		return nil
+	}
+	if _, err := strconv.ParseInt(string(pos), 10, 64); err == nil && allowOffset {
+		return nil
+	}
+	return fmt.Errorf("kafka: invalid offset position %q", string(pos))
+}
+
+// isTime reports whether the position is a RFC3339 timestamp
+func (pos offsetPosition) isTime() bool {
+	_, err := time.Parse(time.RFC3339, string(pos))
+	return err == nil
+}
+
+// readerStartOffset returns StartOffset of kafka.ReaderConfig and kafka.ConsumerGroupConfig, timestamp falls back
+// to FirstOffset since partitions without committed offset have been committed at the timestamp before readers start
+func (pos offsetPosition) readerStartOffset() int64 {
+	if strings.ToLower(string(pos)) == positionLatest {
+		return kafka.LastOffset
+	}
+	return kafka.FirstOffset
+}
+
+// resolve returns absolute offset of the position in the partition which conn is connected to
+func (pos offsetPosition) resolve(conn *kafka.Conn) (int64, error) {
+	first, last, err := conn.ReadOffsets()
+	if err != nil {
+		return 0, err
+	}
+
+	switch strings.ToLower(string(pos)) {
+	case positionEarliest:
+		return first, nil
+	case positionLatest:
+		return last, nil
+	}
+	if t, err := time.Parse(time.RFC3339, string(pos)); err == nil {
+		return conn.ReadOffset(t)
+	}
+
+	offset, err := strconv.ParseInt(string(pos), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if offset < first || offset > last {
+		return 0, fmt.Errorf("kafka: offset %d is out of range [%d, %d]", offset, first, last)
+	}
+	return offset, nil
+}
+
+// OverrideOffsets seeks consumer group of the client to the position before consumers start. Position is earliest,
+// latest, RFC3339 timestamp or absolute offset. It refuses to commit if other members of the consumer group are
+// consuming, or an absolute offset is out of range of any partition.
+func (cmgr *consumerManager) OverrideOffsets(cli, position string) error {
+	cli, con, err := cmgr.lookup(cli)
+	if err != nil {
+		return err
+	}
+
+	pos := offsetPosition(position)
+	if err := pos.validate(true); err != nil {
+		return err
+	}
+
+	log.Warnf("***** [KAFKA:%s] ***** Override offsets of Consumer Group::%s to %s ......", cli, con.GroupID, position)
+	return con.seekGroup(cli, cmgr.baseConsumer, pos)
+}
+
+// resolveStartOffsets returns offsets at the timestamp of StartOffset for partitions which have no committed offset
+// of consumer group, they are committed by commitStartOffsets. Earliest and latest are handled by
+// kafka.ReaderConfig.StartOffset, hence nothing is returned for them.
+func (c *consumer) resolveStartOffsets(bc baseConsumer) (map[int]int64, error) {
+	pos := offsetPosition(c.StartOffset)
+	if !pos.isTime() {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), seekTimeout)
+	defer cancel()
+
+	committed, err := bc.Client.ConsumerOffsets(ctx, kafka.TopicAndGroup{Topic: c.Topic, GroupId: c.GroupID})
+	if err != nil {
+		return nil, err
+	}
+	var uncommitted []int
+	for partition, offset := range committed {
+		if offset < 0 {
+			uncommitted = append(uncommitted, partition)
+		}
+	}
+	if len(uncommitted) == 0 {
+		return nil, nil
+	}
+
+	leaders, err := c.partitionLeaders(ctx, bc)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[int]int64, len(uncommitted))
+	for _, partition := range uncommitted {
+		if offsets[partition], err = resolvePosition(ctx, bc, leaders[partition], pos); err != nil {
+			return nil, fmt.Errorf("partition %d: %v", partition, err)
+		}
+	}
+	return offsets, nil
+}
+
+// commitStartOffsets joins consumer group with a temporary member and commits offsets which are resolved by
+// resolveStartOffsets, partitions which have been committed meanwhile are kept
+func (c *consumer) commitStartOffsets(cli string, bc baseConsumer, offsets map[int]int64) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), seekTimeout)
+	defer cancel()
+
+	cg, gen, err := c.joinGroup(ctx, bc)
+	if err != nil {
+		return err
+	}
+	defer cg.Close()
+
+	commits := make(map[int]int64)
+	for _, a := range gen.Assignments[c.Topic] {
+		if offset, ok := offsets[a.ID]; ok && a.Offset < 0 {
+			commits[a.ID] = offset
+		}
+	}
+	return c.commitGroup(cli, gen, commits)
+}
+
+// seekGroup joins consumer group with a temporary member, commits offsets of the position to every partition and
+// leaves the group. Every partition has to be assigned to the temporary member, which means no other member is
+// consuming.
+func (c *consumer) seekGroup(cli string, bc baseConsumer, pos offsetPosition) error {
+	ctx, cancel := context.WithTimeout(context.Background(), seekTimeout)
+	defer cancel()
+
+	cg, gen, err := c.joinGroup(ctx, bc)
+	if err != nil {
+		return err
+	}
+	defer cg.Close()
+
+	leaders, err := c.partitionLeaders(ctx, bc)
+	if err != nil {
+		return err
+	}
+	assignments := gen.Assignments[c.Topic]
+	if len(assignments) != len(leaders) {
+		return ErrGroupActive
+	}
+
+	commits := make(map[int]int64)
+	for _, a := range assignments {
+		offset, err := resolvePosition(ctx, bc, leaders[a.ID], pos)
+		if err != nil {
+			return fmt.Errorf("partition %d: %v", a.ID, err)
+		}
+		commits[a.ID] = offset
+	}
+	return c.commitGroup(cli, gen, commits)
+}
+
+// joinGroup joins consumer group with a temporary member, caller closes the returned group to leave it
+func (c *consumer) joinGroup(ctx context.Context, bc baseConsumer) (*kafka.ConsumerGroup, *kafka.Generation, error) {
+	// Temporary member has to support balancers of consumers, otherwise it cannot join the group
+	balancers, _ := c.Reader.groupBalancers()
+	cg, err := kafka.NewConsumerGroup(kafka.ConsumerGroupConfig{
+		ID:             c.GroupID,
+		Brokers:        bc.BootstrapServers,
+		Dialer:         bc.Dialer,
+		Topics:         []string{c.Topic},
+		GroupBalancers: balancers,
+		SessionTimeout: c.Reader.SessionTimeout,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gen, err := cg.Next(ctx)
+	if err != nil {
+		cg.Close()
+		return nil, nil, err
+	}
+	return cg, gen, nil
+}
+
+// partitionLeaders returns partitions of topic of consumer by their IDs
+func (c *consumer) partitionLeaders(ctx context.Context, bc baseConsumer) (map[int]kafka.Partition, error) {
+	conn, err := bc.Dialer.DialContext(ctx, "tcp", bc.BootstrapServers[0])
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := conn.ReadPartitions(c.Topic)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	leaders := make(map[int]kafka.Partition, len(partitions))
+	for _, p := range partitions {
+		leaders[p.ID] = p
+	}
+	return leaders, nil
+}
+
+// resolvePosition returns absolute offset of the position in partition p
+func resolvePosition(ctx context.Context, bc baseConsumer, p kafka.Partition, pos offsetPosition) (int64, error) {
+	pconn, err := bc.Dialer.DialPartition(ctx, "tcp", "", p)
+	if err != nil {
+		return 0, err
+	}
+	defer pconn.Close()
+	return pos.resolve(pconn)
+}
+
+// commitGroup commits offsets of partitions of topic of consumer by generation of consumer group
+func (c *consumer) commitGroup(cli string, gen *kafka.Generation, offsets map[int]int64) error {
+	if err := gen.CommitOffsets(map[string]map[int]int64{c.Topic: offsets}); err != nil {
+		return err
+	}
+	for _, a := range gen.Assignments[c.Topic] {
+		if offset, ok := offsets[a.ID]; ok {
+			log.Infof("***** [KAFKA:%s] ***** Commit offset of Consumer Group::%s Topic::%s Partition::%d from %s to %d ......", cli, c.GroupID, c.Topic, a.ID, committedOffset(a.Offset), offset)
+		}
+	}
+	return nil
+}
+
+func committedOffset(offset int64) string {
+	if offset < 0 {
+		return "none"
+	}
+	return strconv.FormatInt(offset, 10)
+}
@@ -0,0 +1,326 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/pkg/logging"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	orderingNone = "none"
+	orderingKey  = "key"
+	defaultLanes = 8
+	// laneCapacity is how many messages can wait in a lane before the reader blocks
+	laneCapacity = 64
+)
+
+// trackedMessage is a message fetched in a generation of consumer group which waits to be delivered
+type trackedMessage struct {
+	msg       kafka.Message
+	delivered bool
+}
+
+// offsetTracker keeps fetched messages of each partition assigned by a generation in order. Offset of a partition is
+// committed only when all messages before it have been delivered, otherwise a restart would skip messages still
+// waiting in other lanes. Commits are serialised, hence the committed offset of a partition never moves backwards.
+type offsetTracker struct {
+	mu       sync.Mutex
+	inflight map[int][]*trackedMessage
+	// next keeps the offset of each partition which all messages before it have been delivered
+	next map[int]int64
+
+	// commitMu serialises commits, committed keeps offsets which have been committed
+	commitMu  sync.Mutex
+	committed map[int]int64
+	commit    func(offsets map[int]int64) error
+
+	// batching counts messages which wait for their batches to be posted before they are completed
+	batching sync.WaitGroup
+}
+
+func newOffsetTracker(commit func(offsets map[int]int64) error) *offsetTracker {
+	return &offsetTracker{
+		inflight:  make(map[int][]*trackedMessage),
+		next:      make(map[int]int64),
+		committed: make(map[int]int64),
+		commit:    commit,
+	}
+}
+
+func (t *offsetTracker) add(msg kafka.Message) *trackedMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tm := &trackedMessage{msg: msg}
+	t.inflight[msg.Partition] = append(t.inflight[msg.Partition], tm)
+	return tm
+}
+
+// complete marks message delivered and reports whether the offset of its partition which can be committed moves
+// forward
+func (t *offsetTracker) complete(tm *trackedMessage) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tm.delivered = true
+	queue := t.inflight[tm.msg.Partition]
+	i := 0
+	for i < len(queue) && queue[i].delivered {
+		i++
+	}
+	if i == 0 {
+		return false
+	}
+
+	t.next[tm.msg.Partition] = queue[i-1].msg.Offset + 1
+	t.inflight[tm.msg.Partition] = queue[i:]
+	return true
+}
+
+// flush commits offsets of partitions which have moved forward since the last commit
+func (t *offsetTracker) flush() error {
+	t.commitMu.Lock()
+	defer t.commitMu.Unlock()
+
+	t.mu.Lock()
+	offsets := make(map[int]int64)
+	for p, o := range t.next {
+		if c, ok := t.committed[p]; !ok || o > c {
+			offsets[p] = o
+		}
+	}
+	t.mu.Unlock()
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	if err := t.commit(offsets); err != nil {
+		return err
+	}
+	for p, o := range offsets {
+		t.committed[p] = o
+	}
+	return nil
+}
+
+// validateOrdering checks ordering mode and lanes of consumer. Key ordering excludes batch endpoints, as lanes go on
+// while batches are posted and the message which batches lose would be delivered after later ones of its key.
+func (c *consumer) validateOrdering() error {
+	switch strings.ToLower(c.Ordering) {
+	case "", orderingNone:
+	case orderingKey:
+		if len(c.Handler.BatchEndPoints) > 0 {
+			return fmt.Errorf("ordering %s cannot be combined with batch endpoints", orderingKey)
+		}
+	default:
+		return fmt.Errorf("unknown ordering %q, expect %s or %s", c.Ordering, orderingNone, orderingKey)
+	}
+	if c.Lanes < 0 {
+		return fmt.Errorf("lanes must not be negative")
+	}
+	if c.Lanes == 0 {
+		c.Lanes = defaultLanes
+	}
+	return nil
+}
+
+func (c *consumer) orderedByKey() bool {
+	return strings.ToLower(c.Ordering) == orderingKey
+}
+
+// laneCount returns number of lanes of each worker, a worker delivers messages one by one by a single lane unless
+// messages are ordered by key
+func (c *consumer) laneCount() int {
+	if c.orderedByKey() {
+		return c.Lanes
+	}
+	return 1
+}
+
+// lane returns index of the lane which delivers the message. Messages with the same key always go to the same lane,
+// messages without key are spread by offset since there is no order to keep among them.
+func (c *consumer) lane(msg *kafka.Message) int {
+	n := c.laneCount()
+	if len(msg.Key) == 0 {
+		return int(msg.Offset % int64(n))
+	}
+
+	h := fnv.New32a()
+	h.Write(msg.Key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// initKafkaConsumer joins consumer group as a member, and each generation of the group reads the partitions which it
+// assigns to the member from their committed offsets. In key ordering mode messages with the same key are delivered
+// strictly in sequence while different keys are delivered in parallel by hashed lanes. Offsets are committed to the
+// generation after delivery, hence messages which are not delivered when the worker stops or partitions are
+// reassigned will be consumed again by the member which takes the partitions over.
+func (c *consumer) initKafkaConsumer(ctx context.Context, bc baseConsumer) {
+	cg, err := kafka.NewConsumerGroup(c.groupConfig(bc))
+	if err != nil {
+		log.WithContext(ctx).Errorf("***** [KAFKA][FAIL] ***** Failed to join Consumer Group::%s:: %v", c.GroupID, err)
+		return
+	}
+	defer cg.Close()
+
+	for {
+		// Next returns once the previous generation ends, which is when partition assignment of the member changes
+		gen, err := cg.Next(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithContext(ctx).Errorf("***** [KAFKA][FAIL] ***** Consumer Group::%s stops:: %v", c.GroupID, err)
+			}
+			return
+		}
+		log.WithContext(ctx).WithField(logging.FieldTopic, c.Topic).Infof("***** [KAFKA] ***** Join generation %d of Consumer Group::%s with %d partitions ......", gen.ID, c.GroupID, len(gen.Assignments[c.Topic]))
+		gen.Start(func(gctx context.Context) {
+			c.consumeGeneration(logging.NewContext(gctx, logging.FromContext(ctx)), bc, gen)
+		})
+	}
+}
+
+// consumeGeneration reads partitions which gen assigns to the member until the generation ends, then it waits for
+// lanes and commits offsets of delivered messages before partitions are handed over to other members
+func (c *consumer) consumeGeneration(ctx context.Context, bc baseConsumer, gen *kafka.Generation) {
+	tracker := newOffsetTracker(func(offsets map[int]int64) error {
+		return gen.CommitOffsets(map[string]map[int]int64{c.Topic: offsets})
+	})
+
+	lanes := make([]chan *trackedMessage, c.laneCount())
+	var handlers sync.WaitGroup
+	for i := range lanes {
+		lanes[i] = make(chan *trackedMessage, laneCapacity)
+		handlers.Add(1)
+		go c.runLane(ctx, tracker, lanes[i], &handlers)
+	}
+
+	var fetchers sync.WaitGroup
+	for _, a := range gen.Assignments[c.Topic] {
+		fetchers.Add(1)
+		go func(a kafka.PartitionAssignment) {
+			defer fetchers.Done()
+			c.fetchPartition(ctx, bc, a, tracker, lanes)
+		}(a)
+	}
+	if interval := c.Reader.CommitInterval; interval > 0 {
+		go commitEvery(ctx, tracker, interval)
+	}
+
+	<-ctx.Done()
+	fetchers.Wait()
+	for _, lane := range lanes {
+		close(lane)
+	}
+	handlers.Wait()
+	tracker.batching.Wait()
+	if err := tracker.flush(); err != nil {
+		log.WithContext(ctx).WithField(logging.FieldTopic, c.Topic).Errorf("***** [KAFKA][FAIL] ***** Failed to commit offsets:: %v", err)
+	}
+}
+
+// fetchPartition reads messages of the partition from the offset which the generation assigns and hands them over to
+// lanes until the generation ends
+func (c *consumer) fetchPartition(ctx context.Context, bc baseConsumer, a kafka.PartitionAssignment, tracker *offsetTracker, lanes []chan *trackedMessage) {
+	reader := kafka.NewReader(c.partitionReaderConfig(bc, a.ID))
+	defer reader.Close()
+	if err := reader.SetOffset(a.Offset); err != nil {
+		log.WithContext(ctx).WithField(logging.FieldPartition, a.ID).Errorf("***** [KAFKA][FAIL] ***** Failed to seek to offset %d:: %v", a.Offset, err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.resumed():
+		}
+
+		// Stop fetching while the circuit of handler is open, otherwise messages fail fast and are lost
+		if err := server.GetCircuitBreakerMgr().WaitCircuitClosed(ctx, c.currentHandler().register()); err != nil {
+			return
+		}
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.WithContext(ctx).WithField(logging.FieldTopic, c.Topic).Errorf("Failed to receive message:: %v", err)
+			continue
+		}
+
+		c.mu.Lock()
+		c.offsets[msg.Partition] = msg.Offset
+		c.mu.Unlock()
+
+		select {
+		case lanes[c.lane(&msg)] <- tracker.add(msg):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// commitEvery commits offsets of delivered messages every interval until ctx is done
+func commitEvery(ctx context.Context, tracker *offsetTracker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := tracker.flush(); err != nil {
+				log.WithContext(ctx).Errorf("***** [KAFKA][FAIL] ***** Failed to commit offsets:: %v", err)
+			}
+		}
+	}
+}
+
+func (c *consumer) runLane(ctx context.Context, tracker *offsetTracker, lane <-chan *trackedMessage, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for tm := range lane {
+		// Leave remaining messages uncommitted once the generation ends, they are consumed again by the member which
+		// the partition is assigned to
+		if ctx.Err() != nil {
+			continue
+		}
+
+		// Later messages of the lane wait while the lost message is delivered again, so keys stay in order
+		acks, ok := c.handleUntilKept(ctx, &tm.msg)
+		if !ok {
+			continue
+		}
+		if len(acks) == 0 {
+			c.complete(ctx, tracker, tm)
+			continue
+		}
+
+		// The lane goes on with later messages while batch endpoints post the message, its offset is committed once
+		// the batches are posted. The message which batch endpoints lose is delivered again after later messages,
+		// which is why key ordering excludes batch endpoints.
+		tracker.batching.Add(1)
+		go func(tm *trackedMessage) {
+			defer tracker.batching.Done()
+			if c.awaitKept(ctx, &tm.msg, acks) {
+				c.complete(ctx, tracker, tm)
+			}
+		}(tm)
+	}
+}
+
+// complete marks tm delivered and commits offsets, unless they are committed by commitEvery as commitInterval is set
+func (c *consumer) complete(ctx context.Context, tracker *offsetTracker, tm *trackedMessage) {
+	if tracker.complete(tm) && c.Reader.CommitInterval == 0 {
+		if err := tracker.flush(); err != nil {
+			log.WithContext(messageContext(ctx, &tm.msg)).Errorf("***** [KAFKA][FAIL] ***** Failed to commit offset:: %v", err)
+		}
+	}
+}
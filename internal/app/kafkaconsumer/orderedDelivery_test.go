@@ -0,0 +1,174 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linushung/hermes/pkg/eventhandler"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// commitLog records offsets committed by offsetTracker
+type commitLog struct {
+	mu      sync.Mutex
+	commits []map[int]int64
+}
+
+func (l *commitLog) commit(offsets map[int]int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commits = append(l.commits, offsets)
+	return nil
+}
+
+func TestValidateOrdering(t *testing.T) {
+	batches := []*batchEndpoint{{URL: "http://localhost:8000/batches"}}
+	tests := []struct {
+		name     string
+		ordering string
+		lanes    int
+		batches  []*batchEndpoint
+		err      string
+	}{
+		{name: "none with batch endpoints", ordering: orderingNone, batches: batches},
+		{name: "key", ordering: "KEY"},
+		{name: "key with batch endpoints", ordering: orderingKey, batches: batches, err: "cannot be combined with batch endpoints"},
+		{name: "unknown", ordering: "partition", err: "unknown ordering"},
+		{name: "negative lanes", ordering: orderingKey, lanes: -1, err: "lanes must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &consumer{Ordering: tt.ordering, Lanes: tt.lanes}
+			c.Handler.BatchEndPoints = tt.batches
+			err := c.validateOrdering()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("validateOrdering() error = %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("validateOrdering() error = %v, want %s", err, tt.err)
+			case err == nil && c.Lanes != defaultLanes:
+				t.Errorf("lanes = %d, want default %d", c.Lanes, defaultLanes)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerCommitsInOrder(t *testing.T) {
+	cl := &commitLog{}
+	tracker := newOffsetTracker(cl.commit)
+	first := tracker.add(kafka.Message{Partition: 0, Offset: 10})
+	second := tracker.add(kafka.Message{Partition: 0, Offset: 11})
+	other := tracker.add(kafka.Message{Partition: 1, Offset: 5})
+
+	if tracker.complete(second) {
+		t.Fatalf("complete(11) moves offset before 10 is delivered")
+	}
+	if err := tracker.flush(); err != nil || len(cl.commits) != 0 {
+		t.Fatalf("flush() commits %v, %v before 10 is delivered", cl.commits, err)
+	}
+	if !tracker.complete(first) {
+		t.Fatalf("complete(10) does not move offset")
+	}
+	if !tracker.complete(other) {
+		t.Fatalf("complete(1/5) does not move offset")
+	}
+	if err := tracker.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if len(cl.commits) != 1 || cl.commits[0][0] != 12 || cl.commits[0][1] != 6 {
+		t.Fatalf("commits = %v, want [map[0:12 1:6]]", cl.commits)
+	}
+
+	if err := tracker.flush(); err != nil || len(cl.commits) != 1 {
+		t.Errorf("flush() commits %v, %v again without new deliveries", cl.commits, err)
+	}
+}
+
+func TestOffsetTrackerNeverCommitsBackwards(t *testing.T) {
+	cl := &commitLog{}
+	tracker := newOffsetTracker(cl.commit)
+	tms := make([]*trackedMessage, 200)
+	for i := range tms {
+		tms[i] = tracker.add(kafka.Message{Partition: 0, Offset: int64(i)})
+	}
+
+	var wg sync.WaitGroup
+	for _, tm := range tms {
+		wg.Add(1)
+		go func(tm *trackedMessage) {
+			defer wg.Done()
+			if tracker.complete(tm) {
+				tracker.flush()
+			}
+		}(tm)
+	}
+	wg.Wait()
+
+	last := int64(-1)
+	for _, c := range cl.commits {
+		if c[0] <= last {
+			t.Fatalf("offset is committed as %d after %d", c[0], last)
+		}
+		last = c[0]
+	}
+	if last != int64(len(tms)) {
+		t.Errorf("last committed offset = %d, want %d", last, len(tms))
+	}
+}
+
+func TestRunLaneKeepsKeysInOrder(t *testing.T) {
+	var mu sync.Mutex
+	delivered := make(map[string][]int64)
+	c := &consumer{Topic: "events", Ordering: orderingKey, Lanes: 4}
+	c.Handler.handle = eventhandler.HandlerFunc(func(ctx context.Context, e *eventhandler.Event, deliver eventhandler.DeliverFunc) error {
+		// Messages of a key would overtake each other if they were handled in parallel
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+		offset, _ := strconv.ParseInt(e.Metadata["offset"], 10, 64)
+		mu.Lock()
+		delivered[string(e.Key)] = append(delivered[string(e.Key)], offset)
+		mu.Unlock()
+		return nil
+	})
+
+	cl := &commitLog{}
+	tracker := newOffsetTracker(cl.commit)
+	lanes := make([]chan *trackedMessage, c.Lanes)
+	var wg sync.WaitGroup
+	for i := range lanes {
+		lanes[i] = make(chan *trackedMessage, laneCapacity)
+		wg.Add(1)
+		go c.runLane(context.Background(), tracker, lanes[i], &wg)
+	}
+
+	const keys, messages = 8, 400
+	for i := 0; i < messages; i++ {
+		msg := kafka.Message{Topic: c.Topic, Key: []byte(fmt.Sprintf("key-%d", i%keys)), Offset: int64(i)}
+		lanes[c.lane(&msg)] <- tracker.add(msg)
+	}
+	for _, lane := range lanes {
+		close(lane)
+	}
+	wg.Wait()
+
+	for key, offsets := range delivered {
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Fatalf("messages of %s are delivered in order %v", key, offsets)
+			}
+		}
+	}
+	if len(delivered) != keys {
+		t.Errorf("messages of %d keys are delivered, want %d", len(delivered), keys)
+	}
+	if last := cl.commits[len(cl.commits)-1][0]; last != messages {
+		t.Errorf("last committed offset = %d, want %d", last, messages)
+	}
+}
@@ -0,0 +1,184 @@
+package kafkaconsumer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultMinBytes        = 10e3            // 10KB
+	defaultMaxBytes        = 10e6            // 10MB
+	defaultMaxWait         = 1 * time.Second // Maximum amount of time to wait for new data to come when fetching batches of messages from kafka.
+	defaultReadLagInterval = -1
+)
+
+// readerConfig defines tuning of kafka.Reader. It is configured under kafka.reader for all consumers and can be
+// overridden under kafka.consumers.<client>.reader. Zero values fall back to defaults of kafka-go, except that maxBytes
+// of 0 requires minBytes of 0 as kafka-go rejects minBytes greater than maxBytes. Durations are written as "10s" or
+// "500ms".
+type readerConfig struct {
+	MinBytes               int           `mapstructure:"minBytes"`
+	MaxBytes               int           `mapstructure:"maxBytes"`
+	MaxWait                time.Duration `mapstructure:"maxWait"`
+	ReadLagInterval        time.Duration `mapstructure:"readLagInterval"`
+	QueueCapacity          int           `mapstructure:"queueCapacity"`
+	SessionTimeout         time.Duration `mapstructure:"sessionTimeout"`
+	HeartbeatInterval      time.Duration `mapstructure:"heartbeatInterval"`
+	RebalanceTimeout       time.Duration `mapstructure:"rebalanceTimeout"`
+	CommitInterval         time.Duration `mapstructure:"commitInterval"`
+	WatchPartitionChanges  *bool         `mapstructure:"watchPartitionChanges"`
+	PartitionWatchInterval time.Duration `mapstructure:"partitionWatchInterval"`
+	// IsolationLevel is readUncommitted or readCommitted
+	IsolationLevel string `mapstructure:"isolationLevel"`
+	// GroupBalancers are range, roundRobin and rackAffinity in order of preference. rackAffinity assigns partitions
+	// to members in the same rack as leaders of them, which requires Rack.
+	GroupBalancers []string `mapstructure:"groupBalancers"`
+	// Rack is the rack which hermes runs in, e.g. the availability zone, which is compared with broker.rack of
+	// partition leaders by rackAffinity
+	Rack string `mapstructure:"rack"`
+}
+
+func defaultReaderConfig() readerConfig {
+	return readerConfig{
+		MinBytes:        defaultMinBytes,
+		MaxBytes:        defaultMaxBytes,
+		MaxWait:         defaultMaxWait,
+		ReadLagInterval: defaultReadLagInterval,
+	}
+}
+
+// inherit returns a copy of reader configuration which a consumer overrides. Balancers are left empty since
+// decoding a shorter list into an existing slice keeps the tail of it.
+func (rc readerConfig) inherit() readerConfig {
+	rc.GroupBalancers = nil
+	return rc
+}
+
+// merge fills balancers which the consumer does not override
+func (rc *readerConfig) merge(base readerConfig) {
+	if len(rc.GroupBalancers) == 0 {
+		rc.GroupBalancers = base.GroupBalancers
+	}
+}
+
+// validate rejects invalid values and combinations of reader configuration
+func (rc readerConfig) validate() error {
+	switch {
+	case rc.MinBytes < 0, rc.MaxBytes < 0, rc.MaxWait < 0, rc.QueueCapacity < 0, rc.SessionTimeout < 0,
+		rc.HeartbeatInterval < 0, rc.RebalanceTimeout < 0, rc.CommitInterval < 0, rc.PartitionWatchInterval < 0:
+		return fmt.Errorf("minBytes, maxBytes, maxWait, queueCapacity, sessionTimeout, heartbeatInterval, rebalanceTimeout, commitInterval and partitionWatchInterval must not be negative")
+	case rc.MaxBytes < rc.MinBytes:
+		return fmt.Errorf("maxBytes(%d) must not be less than minBytes(%d)", rc.MaxBytes, rc.MinBytes)
+	case rc.SessionTimeout > 0 && rc.SessionTimeout < time.Second:
+		return fmt.Errorf("sessionTimeout(%v) is too short, durations are written as %q", rc.SessionTimeout, "30s")
+	case rc.HeartbeatInterval > 0 && rc.HeartbeatInterval >= rc.sessionTimeout():
+		return fmt.Errorf("heartbeatInterval(%v) must be less than sessionTimeout(%v)", rc.HeartbeatInterval, rc.sessionTimeout())
+	case rc.PartitionWatchInterval > 0 && !rc.watchPartitionChanges():
+		return fmt.Errorf("partitionWatchInterval requires watchPartitionChanges")
+	}
+
+	if _, err := rc.isolationLevel(); err != nil {
+		return err
+	}
+	_, err := rc.groupBalancers()
+	return err
+}
+
+// sessionTimeout returns session timeout which kafka-go applies
+func (rc readerConfig) sessionTimeout() time.Duration {
+	if rc.SessionTimeout == 0 {
+		return 30 * time.Second
+	}
+	return rc.SessionTimeout
+}
+
+func (rc readerConfig) watchPartitionChanges() bool {
+	return rc.WatchPartitionChanges != nil && *rc.WatchPartitionChanges
+}
+
+func (rc readerConfig) isolationLevel() (kafka.IsolationLevel, error) {
+	switch strings.ToLower(rc.IsolationLevel) {
+	case "", "readuncommitted":
+		return kafka.ReadUncommitted, nil
+	case "readcommitted":
+		return kafka.ReadCommitted, nil
+	default:
+		return 0, fmt.Errorf("unknown isolationLevel %q, expect readUncommitted or readCommitted", rc.IsolationLevel)
+	}
+}
+
+func (rc readerConfig) groupBalancers() ([]kafka.GroupBalancer, error) {
+	var balancers []kafka.GroupBalancer
+	for _, b := range rc.GroupBalancers {
+		switch strings.ToLower(strings.Replace(b, "-", "", -1)) {
+		case "range":
+			balancers = append(balancers, kafka.RangeGroupBalancer{})
+		case "roundrobin":
+			balancers = append(balancers, kafka.RoundRobinGroupBalancer{})
+		case "rackaffinity":
+			if rc.Rack == "" {
+				return nil, fmt.Errorf("groupBalancer %q requires rack", b)
+			}
+			balancers = append(balancers, kafka.RackAffinityGroupBalancer{Rack: rc.Rack})
+		default:
+			return nil, fmt.Errorf("unknown groupBalancer %q, expect range, roundRobin or rackAffinity", b)
+		}
+	}
+	return balancers, nil
+}
+
+// validateReader checks reader configuration of consumer, including the rules of kafka-go
+func (c *consumer) validateReader(bc baseConsumer) error {
+	if err := c.Reader.validate(); err != nil {
+		return err
+	}
+
+	gc := c.groupConfig(bc)
+	if err := gc.Validate(); err != nil {
+		return err
+	}
+	pc := c.partitionReaderConfig(bc, 0)
+	return pc.Validate()
+}
+
+// groupConfig builds kafka.ConsumerGroupConfig of the member which a worker joins consumer group as, configuration
+// has been validated at startup
+func (c *consumer) groupConfig(bc baseConsumer) kafka.ConsumerGroupConfig {
+	rc := c.Reader
+	balancers, _ := rc.groupBalancers()
+	return kafka.ConsumerGroupConfig{
+		ID:                     c.GroupID,
+		Brokers:                bc.BootstrapServers,
+		Dialer:                 bc.Dialer,
+		Topics:                 []string{c.Topic},
+		GroupBalancers:         balancers,
+		HeartbeatInterval:      rc.HeartbeatInterval,
+		PartitionWatchInterval: rc.PartitionWatchInterval,
+		WatchPartitionChanges:  rc.watchPartitionChanges(),
+		SessionTimeout:         rc.SessionTimeout,
+		RebalanceTimeout:       rc.RebalanceTimeout,
+		StartOffset:            offsetPosition(c.StartOffset).readerStartOffset(),
+	}
+}
+
+// partitionReaderConfig builds kafka.ReaderConfig which reads a partition assigned to the member, offsets are
+// committed to the generation instead of by the reader
+func (c *consumer) partitionReaderConfig(bc baseConsumer, partition int) kafka.ReaderConfig {
+	rc := c.Reader
+	isolation, _ := rc.isolationLevel()
+	return kafka.ReaderConfig{
+		Brokers:         bc.BootstrapServers,
+		Dialer:          bc.Dialer,
+		Topic:           c.Topic,
+		Partition:       partition,
+		MinBytes:        rc.MinBytes,
+		MaxBytes:        rc.MaxBytes,
+		MaxWait:         rc.MaxWait,
+		ReadLagInterval: rc.ReadLagInterval,
+		QueueCapacity:   rc.QueueCapacity,
+		IsolationLevel:  isolation,
+	}
+}
@@ -0,0 +1,64 @@
+package kafkaconsumer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestGroupBalancers(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    readerConfig
+		protocols []string
+		err       string
+	}{
+		{
+			name:      "range and round robin",
+			config:    readerConfig{GroupBalancers: []string{"range", "round-robin"}},
+			protocols: []string{"range", "roundrobin"},
+		},
+		{
+			name:      "rack affinity with rack",
+			config:    readerConfig{GroupBalancers: []string{"rackAffinity", "range"}, Rack: "us-east-1a"},
+			protocols: []string{"rack-affinity", "range"},
+		},
+		{
+			name:   "rack affinity without rack",
+			config: readerConfig{GroupBalancers: []string{"rackAffinity"}},
+			err:    "requires rack",
+		},
+		{
+			name:   "unknown balancer",
+			config: readerConfig{GroupBalancers: []string{"sticky"}},
+			err:    `unknown groupBalancer "sticky"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			balancers, err := tt.config.groupBalancers()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("groupBalancers() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("groupBalancers() error = %v", err)
+			}
+
+			var protocols []string
+			for _, b := range balancers {
+				protocols = append(protocols, b.ProtocolName())
+			}
+			if strings.Join(protocols, ",") != strings.Join(tt.protocols, ",") {
+				t.Errorf("groupBalancers() = %v, want %v", protocols, tt.protocols)
+			}
+			if rack, ok := balancers[0].(kafka.RackAffinityGroupBalancer); ok && rack.Rack != tt.config.Rack {
+				t.Errorf("rack of rackAffinity = %q, want %q", rack.Rack, tt.config.Rack)
+			}
+		})
+	}
+}
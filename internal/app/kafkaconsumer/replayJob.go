@@ -0,0 +1,416 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// States of replay job
+const (
+	ReplayRunning   = "running"
+	ReplayCompleted = "completed"
+	ReplayFailed    = "failed"
+	ReplayCancelled = "cancelled"
+)
+
+// replayRetention is how long a finished replay job is kept for its status to be queried
+const replayRetention = 24 * time.Hour
+
+var (
+	// ErrReplayNotFound is returned when there is no replay job with the given ID
+	ErrReplayNotFound = errors.New("kafka: replay job not found")
+	// ErrInvalidReplay is returned when replay request has no start position or more than one of them
+	ErrInvalidReplay = errors.New("kafka: replay requires exactly one of startOffset and startTime")
+)
+
+// ReplayRequest describes events to re-send through handler and endpoints of a consumer. Events are read from
+// start position of each partition until end bound, which is exclusive and defaults to high watermark of partition
+// when the job starts. Events are delivered only if they match Key and all Headers when the filters are given.
+type ReplayRequest struct {
+	Client      string            `json:"client"`
+	Topic       string            `json:"topic,omitempty"`
+	Partitions  []int             `json:"partitions,omitempty"`
+	StartOffset *int64            `json:"startOffset,omitempty"`
+	StartTime   *time.Time        `json:"startTime,omitempty"`
+	EndOffset   *int64            `json:"endOffset,omitempty"`
+	EndTime     *time.Time        `json:"endTime,omitempty"`
+	Key         string            `json:"key,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// PartitionProgress describes progress of replay job on a partition
+type PartitionProgress struct {
+	Partition int   `json:"partition"`
+	Start     int64 `json:"start"`
+	End       int64 `json:"end"`
+	Current   int64 `json:"current"`
+	Delivered int64 `json:"delivered"`
+	Filtered  int64 `json:"filtered"`
+	Failed    int64 `json:"failed"`
+	Done      bool  `json:"done"`
+}
+
+// ReplayStatus is a snapshot of replay job
+type ReplayStatus struct {
+	ID         string              `json:"id"`
+	Request    ReplayRequest       `json:"request"`
+	State      string              `json:"state"`
+	Error      string              `json:"error,omitempty"`
+	StartedAt  time.Time           `json:"startedAt"`
+	FinishedAt *time.Time          `json:"finishedAt,omitempty"`
+	Partitions []PartitionProgress `json:"partitions"`
+}
+
+// ReplayJob re-sends past events with readers which do not join consumer group, hence committed offsets of the
+// consumer group are not affected
+type ReplayJob struct {
+	mu       sync.Mutex
+	status   ReplayStatus
+	progress map[int]*PartitionProgress
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+type replayJobs struct {
+	mu   sync.Mutex
+	seq  int
+	jobs map[string]*ReplayJob
+}
+
+var replays = replayJobs{jobs: make(map[string]*ReplayJob)}
+
+// prune removes replay jobs which have finished for longer than replayRetention, caller must hold the lock
+func (rj *replayJobs) prune(now time.Time) {
+	for id, job := range rj.jobs {
+		job.mu.Lock()
+		finished := job.status.FinishedAt
+		job.mu.Unlock()
+		if finished != nil && now.Sub(*finished) > replayRetention {
+			delete(rj.jobs, id)
+		}
+	}
+}
+
+// running returns channels of replay jobs which are closed once the jobs finish
+func (rj *replayJobs) running() []<-chan struct{} {
+	rj.mu.Lock()
+	defer rj.mu.Unlock()
+
+	var done []<-chan struct{}
+	for _, job := range rj.jobs {
+		done = append(done, job.done)
+	}
+	return done
+}
+
+// StartReplay validates the request and starts a replay job in background, the job is cancelled by Shutdown
+func (cmgr *consumerManager) StartReplay(req ReplayRequest) (*ReplayJob, error) {
+	if (req.StartOffset == nil) == (req.StartTime == nil) {
+		return nil, ErrInvalidReplay
+	}
+
+	cli, con, err := cmgr.lookup(req.Client)
+	if err != nil {
+		return nil, err
+	}
+	req.Client = cli
+	if req.Topic == "" {
+		req.Topic = con.Topic
+	}
+
+	ctx, cancel := context.WithCancel(cmgr.ctx)
+	ranges, err := cmgr.replayRanges(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	replays.mu.Lock()
+	replays.prune(time.Now())
+	replays.seq++
+	job := &ReplayJob{
+		status: ReplayStatus{
+			ID:        fmt.Sprintf("replay-%d", replays.seq),
+			Request:   req,
+			State:     ReplayRunning,
+			StartedAt: time.Now(),
+		},
+		progress: ranges,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	replays.jobs[job.status.ID] = job
+	replays.mu.Unlock()
+
+	log.Infof("***** [KAFKA:REPLAY:%s] ***** Replay Topic::%s of %d partitions through handler of client::%s ......", job.status.ID, req.Topic, len(ranges), cli)
+	go job.run(ctx, cmgr.baseConsumer, con.currentHandler())
+	return job, nil
+}
+
+// ReplayJobs returns status of replay jobs which are running or have finished within replayRetention
+func (cmgr *consumerManager) ReplayJobs() []ReplayStatus {
+	replays.mu.Lock()
+	replays.prune(time.Now())
+	jobs := make([]*ReplayJob, 0, len(replays.jobs))
+	for _, job := range replays.jobs {
+		jobs = append(jobs, job)
+	}
+	replays.mu.Unlock()
+
+	statuses := make([]ReplayStatus, 0, len(jobs))
+	for _, job := range jobs {
+		statuses = append(statuses, job.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].StartedAt.Before(statuses[j].StartedAt) })
+	return statuses
+}
+
+// GetReplayJob returns replay job of the ID
+func (cmgr *consumerManager) GetReplayJob(id string) (*ReplayJob, error) {
+	replays.mu.Lock()
+	defer replays.mu.Unlock()
+
+	replays.prune(time.Now())
+	job, ok := replays.jobs[id]
+	if !ok {
+		return nil, ErrReplayNotFound
+	}
+	return job, nil
+}
+
+// replayRanges resolves start position and end bound of each partition into offsets
+func (cmgr *consumerManager) replayRanges(ctx context.Context, req ReplayRequest) (map[int]*PartitionProgress, error) {
+	conn, err := cmgr.Dialer.DialContext(ctx, "tcp", cmgr.BootstrapServers[0])
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[int]bool, len(req.Partitions))
+	for _, p := range req.Partitions {
+		wanted[p] = true
+	}
+
+	ranges := make(map[int]*PartitionProgress)
+	for _, p := range partitions {
+		if len(wanted) > 0 && !wanted[p.ID] {
+			continue
+		}
+		delete(wanted, p.ID)
+
+		pp, err := partitionRange(ctx, cmgr.Dialer, p, req)
+		if err != nil {
+			return nil, err
+		}
+		ranges[p.ID] = pp
+	}
+
+	for p := range wanted {
+		return nil, fmt.Errorf("kafka: partition %d does not exist in Topic::%s", p, req.Topic)
+	}
+	return ranges, nil
+}
+
+func partitionRange(ctx context.Context, dialer *kafka.Dialer, p kafka.Partition, req ReplayRequest) (*PartitionProgress, error) {
+	conn, err := dialer.DialPartition(ctx, "tcp", "", p)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	first, last, err := conn.ReadOffsets()
+	if err != nil {
+		return nil, err
+	}
+
+	start := first
+	switch {
+	case req.StartOffset != nil && *req.StartOffset > first:
+		start = *req.StartOffset
+	case req.StartTime != nil:
+		if start, err = conn.ReadOffset(*req.StartTime); err != nil {
+			return nil, err
+		}
+	}
+
+	end := last
+	switch {
+	case req.EndOffset != nil && *req.EndOffset < last:
+		end = *req.EndOffset
+	case req.EndTime != nil:
+		if end, err = conn.ReadOffset(*req.EndTime); err != nil {
+			return nil, err
+		}
+	}
+
+	return &PartitionProgress{Partition: p.ID, Start: start, End: end, Current: start, Done: start >= end}, nil
+}
+
+// Status returns a snapshot of replay job
+func (job *ReplayJob) Status() ReplayStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	status := job.status
+	status.Partitions = make([]PartitionProgress, 0, len(job.progress))
+	for _, pp := range job.progress {
+		status.Partitions = append(status.Partitions, *pp)
+	}
+	sort.Slice(status.Partitions, func(i, j int) bool { return status.Partitions[i].Partition < status.Partitions[j].Partition })
+	return status
+}
+
+// Cancel stops replay job, events which have been delivered are not recalled
+func (job *ReplayJob) Cancel() {
+	job.cancel()
+}
+
+// Done returns a channel which is closed when replay job finishes
+func (job *ReplayJob) Done() <-chan struct{} {
+	return job.done
+}
+
+func (job *ReplayJob) run(ctx context.Context, bc baseConsumer, h handler) {
+	defer job.cancel()
+	defer close(job.done)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(job.progress))
+	for _, pp := range job.progress {
+		if pp.Done {
+			continue
+		}
+
+		wg.Add(1)
+		go func(pp *PartitionProgress) {
+			defer wg.Done()
+			if err := job.replayPartition(ctx, bc, h, pp); err != nil {
+				errs <- err
+			}
+		}(pp)
+	}
+	wg.Wait()
+	close(errs)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	now := time.Now()
+	job.status.FinishedAt = &now
+	job.status.State = ReplayCompleted
+	if err := <-errs; err != nil {
+		job.status.State = ReplayFailed
+		job.status.Error = err.Error()
+		if ctx.Err() == context.Canceled {
+			job.status.State = ReplayCancelled
+		}
+	}
+	log.Infof("***** [KAFKA:REPLAY:%s] ***** Replay %s ......", job.status.ID, job.status.State)
+}
+
+func (job *ReplayJob) replayPartition(ctx context.Context, bc baseConsumer, h handler, pp *PartitionProgress) error {
+	req := job.status.Request
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   bc.BootstrapServers,
+		Dialer:    bc.Dialer,
+		Topic:     req.Topic,
+		Partition: pp.Partition,
+		MinBytes:  bc.MinBytes,
+		MaxBytes:  bc.MaxBytes,
+		MaxWait:   bc.MaxWait,
+	})
+	defer reader.Close()
+	// Events are replayed on purpose, hence they are posted even if they have been delivered
+	h.dedupKey = nil
+
+	// Events handed over to batch endpoints are counted once their batches are posted
+	var batches sync.WaitGroup
+	defer batches.Wait()
+	count := func(filtered, failed bool) {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		switch {
+		case filtered:
+			pp.Filtered++
+		case failed:
+			pp.Failed++
+		default:
+			pp.Delivered++
+		}
+	}
+
+	if err := reader.SetOffset(pp.Start); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return err
+		}
+		if msg.Offset >= pp.End {
+			break
+		}
+
+		if !req.matches(&msg) {
+			count(true, false)
+		} else {
+			mctx, acks := withBatchAcks(messageContext(ctx, &msg))
+			if err := h.handleMessage(mctx, &msg); err != nil || len(acks.list()) == 0 {
+				count(false, err != nil)
+			} else {
+				batches.Add(1)
+				go func() {
+					defer batches.Done()
+					count(false, !waitBatches(acks.list()))
+				}()
+			}
+		}
+
+		job.mu.Lock()
+		pp.Current = msg.Offset + 1
+		finished := pp.Current >= pp.End
+		job.mu.Unlock()
+
+		if finished {
+			break
+		}
+	}
+
+	job.mu.Lock()
+	pp.Done = true
+	job.mu.Unlock()
+	log.Infof("***** [KAFKA:REPLAY:%s] ***** Partition::%d finishes replay to offset %d ......", job.status.ID, pp.Partition, pp.End)
+	return nil
+}
+
+// matches checks message against key and header filters of replay request
+func (req ReplayRequest) matches(msg *kafka.Message) bool {
+	if req.Key != "" && string(msg.Key) != req.Key {
+		return false
+	}
+
+	for k, v := range req.Headers {
+		found := false
+		for _, h := range msg.Headers {
+			if h.Key == k && string(h.Value) == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// unreachableBroker returns address of a broker which refuses connections
+func unreachableBroker(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+	return address
+}
+
+// startReplayJob runs a replay job of progress as StartReplay does, without resolving ranges from brokers
+func startReplayJob(t *testing.T, parent context.Context, progress map[int]*PartitionProgress) *ReplayJob {
+	t.Helper()
+	ctx, cancel := context.WithCancel(parent)
+	job := &ReplayJob{
+		status:   ReplayStatus{ID: "replay-" + t.Name(), Request: ReplayRequest{Client: "notification", Topic: "orders"}, State: ReplayRunning, StartedAt: time.Now()},
+		progress: progress,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	replays.mu.Lock()
+	replays.jobs[job.status.ID] = job
+	replays.mu.Unlock()
+	t.Cleanup(func() {
+		cancel()
+		<-job.Done()
+		replays.mu.Lock()
+		delete(replays.jobs, job.status.ID)
+		replays.mu.Unlock()
+	})
+
+	bc := baseConsumer{BootstrapServers: []string{unreachableBroker(t)}, Dialer: &kafka.Dialer{Timeout: 100 * time.Millisecond}}
+	go job.run(ctx, bc, handler{})
+	return job
+}
+
+// finish waits for job to finish and returns its status
+func finish(t *testing.T, job *ReplayJob) ReplayStatus {
+	t.Helper()
+	select {
+	case <-job.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("replay job does not finish, status = %+v", job.Status())
+	}
+	return job.Status()
+}
+
+func TestReplayJobStates(t *testing.T) {
+	tests := []struct {
+		name     string
+		progress map[int]*PartitionProgress
+		cancel   bool
+		state    string
+		err      bool
+	}{
+		{
+			name:     "completed without events",
+			progress: map[int]*PartitionProgress{0: {Start: 5, End: 5, Current: 5, Done: true}},
+			state:    ReplayCompleted,
+		},
+		{
+			name:     "failed by unreachable broker",
+			progress: map[int]*PartitionProgress{0: {Start: 0, End: 10}},
+			state:    ReplayFailed,
+			err:      true,
+		},
+		{
+			name:     "cancelled",
+			progress: map[int]*PartitionProgress{0: {Start: 0, End: 10}, 1: {Partition: 1, Start: 3, End: 3, Done: true}},
+			cancel:   true,
+			state:    ReplayCancelled,
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := startReplayJob(t, context.Background(), tt.progress)
+			if tt.cancel {
+				if s := job.Status(); s.State != ReplayRunning || s.FinishedAt != nil {
+					t.Fatalf("status before cancel = %s finished at %v, want %s", s.State, s.FinishedAt, ReplayRunning)
+				}
+				job.Cancel()
+			}
+
+			s := finish(t, job)
+			if s.State != tt.state || (s.Error != "") != tt.err || s.FinishedAt == nil {
+				t.Errorf("status = %s with error %q finished at %v, want %s with error %t", s.State, s.Error, s.FinishedAt, tt.state, tt.err)
+			}
+			for _, pp := range s.Partitions {
+				if pp.Delivered != 0 || pp.Failed != 0 || pp.Filtered != 0 {
+					t.Errorf("partition %d counts events %+v, want none", pp.Partition, pp)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownCancelsReplayJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmgr := &consumerManager{ctx: ctx, cancel: cancel}
+	job := startReplayJob(t, cmgr.ctx, map[int]*PartitionProgress{0: {Start: 0, End: 10}})
+
+	sctx, scancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer scancel()
+	if err := cmgr.Shutdown(sctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+
+	select {
+	case <-job.Done():
+	default:
+		t.Fatalf("Shutdown() returns before replay job finishes")
+	}
+	if s := job.Status(); s.State != ReplayCancelled {
+		t.Errorf("status after Shutdown() = %s with error %q, want %s", s.State, s.Error, ReplayCancelled)
+	}
+}
+
+func TestReplayRequestMatches(t *testing.T) {
+	msg := &kafka.Message{Key: []byte("order-1"), Headers: []kafka.Header{{Key: "type", Value: []byte("created")}, {Key: "tenant", Value: []byte("acme")}}}
+
+	tests := []struct {
+		name string
+		req  ReplayRequest
+		want bool
+	}{
+		{name: "without filters", want: true},
+		{name: "key", req: ReplayRequest{Key: "order-1"}, want: true},
+		{name: "other key", req: ReplayRequest{Key: "order-2"}},
+		{name: "headers", req: ReplayRequest{Key: "order-1", Headers: map[string]string{"type": "created", "tenant": "acme"}}, want: true},
+		{name: "other header value", req: ReplayRequest{Headers: map[string]string{"type": "deleted"}}},
+		{name: "missing header", req: ReplayRequest{Headers: map[string]string{"region": "eu"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.matches(msg); got != tt.want {
+				t.Errorf("matches() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayJobsArePrunedAfterRetention(t *testing.T) {
+	now := time.Now()
+	finished := func(ago time.Duration) *ReplayJob {
+		at := now.Add(-ago)
+		return &ReplayJob{status: ReplayStatus{FinishedAt: &at}}
+	}
+	rj := replayJobs{jobs: map[string]*ReplayJob{
+		"running":  {},
+		"recent":   finished(time.Minute),
+		"retained": finished(replayRetention),
+		"expired":  finished(replayRetention + time.Second),
+	}}
+
+	rj.prune(now)
+	for _, id := range []string{"running", "recent", "retained"} {
+		if _, ok := rj.jobs[id]; !ok {
+			t.Errorf("replay job %s is pruned", id)
+		}
+	}
+	if _, ok := rj.jobs["expired"]; ok {
+		t.Errorf("replay job which finished before retention is kept")
+	}
+}
@@ -1,52 +1,418 @@
 package kafkaconsumer
 
 import (
-	"reflect"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/pkg/audit"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/dedup"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/internal/pkg/reply"
+	"github.com/linushung/hermes/internal/pkg/schemaregistry"
+	"github.com/linushung/hermes/internal/pkg/spool"
+	"github.com/linushung/hermes/internal/pkg/validation"
+	"github.com/linushung/hermes/pkg/eventhandler"
 	"github.com/segmentio/kafka-go"
-
-	log "github.com/sirupsen/logrus"
 )
 
 type handler struct {
-	Handler    string   `mapstructure:"handleFuncName"`
-	EndPoints  []string `mapstructure:"endPoints"`
-	Tube       chan *kafka.Message
-	HandleFunc reflect.Value
+	Handler        string               `mapstructure:"handleFuncName"`
+	EndPoints      []string             `mapstructure:"endPoints"`
+	BatchEndPoints []*batchEndpoint     `mapstructure:"batchEndPoints"`
+	Replies        []*reply.Destination `mapstructure:"replies"`
+	// DedupKey overrides dedup.key of configuration for messages of handler
+	DedupKey string `mapstructure:"dedupKey"`
+	// Validation validates events which handler delivers against a JSON Schema
+	Validation *validation.Config `mapstructure:"validation"`
+	handle     eventhandler.Handler
+	dedupKey   *dedup.Key
+	validator  *validation.Validator
+}
+
+// resolve looks up the registered handler of handleFuncName
+func (h *handler) resolve() error {
+	eh, err := eventhandler.Lookup(h.Handler)
+	if err != nil {
+		return err
+	}
+	h.handle = eh
+	return nil
+}
+
+// register returns the circuit breaker register which the handler posts events with
+func (h handler) register() string {
+	return eventhandler.CircuitRegister(h.Handler)
+}
+
+// messageContext returns ctx carrying topic, partition, offset and trace id of msg for logs
+func messageContext(ctx context.Context, msg *kafka.Message) context.Context {
+	fields := logging.Fields{
+		logging.FieldTopic:     msg.Topic,
+		logging.FieldPartition: msg.Partition,
+		logging.FieldOffset:    msg.Offset,
+	}
+	headers := make(map[string]string, len(msg.Headers))
+	for _, hd := range msg.Headers {
+		headers[hd.Key] = string(hd.Value)
+	}
+	if id := logging.TraceID(headers); id != "" {
+		fields[logging.FieldTraceID] = id
+	}
+	return logging.NewContext(ctx, fields)
 }
 
-func (h handler) handlerDispatcher() reflect.Value {
-	if h.Handler == "" {
-		h.Handler = server.DefaultHandler
+// dedupID returns the id of msg by dedup key k, or "" if messages are not deduplicated
+func dedupID(k *dedup.Key, msg *kafka.Message) string {
+	if k == nil {
+		return ""
 	}
-	return reflect.ValueOf(h).MethodByName(h.Handler)
+	headers := make(map[string]string, len(msg.Headers))
+	for _, hd := range msg.Headers {
+		headers[hd.Key] = string(hd.Value)
+	}
+	return k.ID(msg.Key, headers, msg.Value)
+}
+
+// messageSource returns the audit source of msg, the consumer is taken from ctx
+func messageSource(ctx context.Context, msg *kafka.Message) audit.Source {
+	consumer, _ := logging.FromContext(ctx)[logging.FieldConsumer].(string)
+	return audit.Source{
+		Type:      eventhandler.SourceKafka,
+		Consumer:  consumer,
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+	}
+}
+
+// spoolMessage keeps the message which cannot be delivered to endpoint in spool for re-drive, if spool is enabled.
+// It returns the audit outcome of the delivery, spooled if the message is kept in spool, otherwise failed.
+func spoolMessage(ctx context.Context, register, endpoint string, dedupKey *dedup.Key, msg *kafka.Message, httpErr error) string {
+	sp := spool.GetSpool()
+	if sp == nil {
+		return audit.Failed
+	}
+
+	source := messageSource(ctx, msg)
+	e := &spool.Entry{
+		Register:    register,
+		Endpoint:    endpoint,
+		ContentType: "application/json",
+		Payload:     msg.Value,
+		Metadata: map[string]string{
+			"topic":     msg.Topic,
+			"partition": strconv.Itoa(msg.Partition),
+			"offset":    strconv.FormatInt(msg.Offset, 10),
+			"key":       string(msg.Key),
+		},
+		Reason:  httpErr.Error(),
+		Source:  &source,
+		DedupID: dedupID(dedupKey, msg),
+	}
+	if err := sp.Append(e); err != nil {
+		log.WithContext(ctx).Errorf("***** [HANDLER][FAIL] ***** Failed to spool message:: %v", err)
+		return audit.Failed
+	}
+	return audit.Spooled
+}
+
+// deliveryError reports endpoints which failed to receive a message, lost of them are failures which are not kept
+// in spool
+type deliveryError struct {
+	failed, lost, total int
+}
+
+func (e *deliveryError) Error() string {
+	return fmt.Sprintf("%d of %d endpoints failed to receive message", e.failed, e.total)
 }
 
-/* Below handler functions will return by reflect.Value.MethodByName() and have to be Exported methods */
+// lostError reports a message which is neither delivered nor kept for other reasons than endpoints, e.g. schema
+// registry cannot be reached to decode it, so it is handled again instead of being committed
+type lostError struct {
+	err error
+}
+
+func (e *lostError) Error() string {
+	return e.err.Error()
+}
 
-func (h handler) GeneralEventHandler() {
-	for {
-		msg := <-h.Tube
-		for _, e := range h.EndPoints {
-			_, httpErr := server.GetCircuitBreakerMgr().CBHTTPPost(server.DefaultHandler, e, "application/json", msg.Value)
-			if httpErr != nil {
-				log.Errorf("***** [HANDLER][FAIL] ***** Receive post error from [handler::%s] [url::%s] [Error::%s]", server.DefaultHandler, e, httpErr.Error())
+func (e *lostError) Unwrap() error {
+	return e.err
+}
+
+// isLost reports whether err leaves the message with endpoints which neither received it nor keep it in spool, or
+// leaves it not kept at all
+func isLost(err error) bool {
+	var de *deliveryError
+	var le *lostError
+	return errors.As(err, &de) && de.lost > 0 || errors.As(err, &le)
+}
+
+// deliver posts message to every endpoint of handler and hands it over to batch endpoints, whose acks are collected
+// into ctx. It returns the number of endpoints which failed and of those which do not keep it in spool.
+func (h handler) deliver(ctx context.Context, register string, msg *kafka.Message) (failed, lost int) {
+	dd, id := dedup.GetDedup(), dedupID(h.dedupKey, msg)
+	for _, b := range h.BatchEndPoints {
+		if reserved, err := dd.Reserve(ctx, b.URL, id); err != nil {
+			failed++
+			lost++
+			continue
+		} else if !reserved {
+			log.WithContext(ctx).Infof("***** [HANDLER][DEDUP] ***** Skip message which has been delivered to batch endpoint [id::%s]", id)
+			continue
+		}
+		// Batch endpoints of a handler which is replaced by reload are stopped, message is kept in spool as other
+		// failed deliveries to be re-driven to the endpoint
+		start := time.Now()
+		ack, err := b.add(msg)
+		if err != nil {
+			bctx := logging.NewContext(ctx, logging.Fields{logging.FieldEndpoint: logpolicy.URL(b.URL)})
+			log.WithContext(bctx).Errorf("***** [HANDLER][FAIL] ***** Failed to hand message over to batch endpoint:: %v", err)
+			r := audit.Attempt(messageSource(ctx, msg), b.URL, 1, start, err)
+			r.Outcome = spoolMessage(bctx, register, b.URL, h.dedupKey, msg, err)
+			audit.GetJournal().Record(r)
+			dd.Release(b.URL, id)
+			failed++
+			if r.Outcome != audit.Spooled {
+				lost++
 			}
+			continue
 		}
+		collectAck(ctx, ack)
 	}
-}
 
-func (h handler) NotificationServiceHandler() {
-	han := strings.ToLower(h.Handler)
-	for {
-		msg := <-h.Tube
-		for _, e := range h.EndPoints {
-			_, httpErr := server.GetCircuitBreakerMgr().CBHTTPPost(han, e, "application/json", msg.Value)
-			if httpErr != nil {
-				log.Errorf("***** [HANDLER][FAIL] ***** Receive post error from [handler::%s] [url::%s] [Error::%s]", h.Handler, e, httpErr.Error())
+	for _, e := range h.EndPoints {
+		ectx := logging.NewContext(ctx, logging.Fields{logging.FieldEndpoint: logpolicy.URL(e)})
+		if reserved, err := dd.Reserve(ectx, e, id); err != nil {
+			failed++
+			lost++
+			continue
+		} else if !reserved {
+			log.WithContext(ectx).Infof("***** [HANDLER][DEDUP] ***** Skip message which has been delivered [id::%s]", id)
+			continue
+		}
+		start := time.Now()
+		res, httpErr := server.GetCircuitBreakerMgr().CBHTTPPostContext(ectx, register, e, "application/json", msg.Value)
+		h.publishReply(e, msg, res, httpErr, time.Since(start))
+		r := audit.Attempt(messageSource(ctx, msg), e, 1, start, httpErr)
+		if httpErr != nil {
+			log.WithContext(ectx).Errorf("***** [HANDLER][FAIL] ***** Receive post error from [handler::%s] [Error::%s]", register, logpolicy.Error(httpErr))
+			r.Outcome = spoolMessage(ectx, register, e, h.dedupKey, msg, httpErr)
+			dd.Release(e, id)
+			failed++
+			if r.Outcome != audit.Spooled {
+				lost++
 			}
+		} else {
+			dd.MarkDelivered(e, id)
 		}
+		audit.GetJournal().Record(r)
+	}
+	return failed, lost
+}
+
+// problems validates handleFuncName, endpoints, batch endpoints and replies of handler configured under key
+func (h *handler) problems(key string) []configs.Problem {
+	var ps []configs.Problem
+	if err := h.resolve(); err != nil {
+		ps = append(ps, configs.Problemf(key+".handleFuncName", "%v", err))
+	} else if r := h.register(); r != server.DefaultHandler && !configs.IsConfigSet("circuitbreaker.registers."+r) {
+		ps = append(ps, configs.Problemf(key+".handleFuncName", "circuit breaker register %s is referenced but not defined in circuitbreaker.registers", h.Handler))
+	}
+
+	var err error
+	if h.dedupKey, err = dedup.KeyOf(h.DedupKey); err != nil {
+		ps = append(ps, configs.Problemf(key+".dedupKey", "%v", err))
+	} else if h.DedupKey != "" && h.dedupKey == nil {
+		ps = append(ps, configs.Problemf(key+".dedupKey", "dedupKey requires dedup section"))
+	}
+
+	if h.validator, err = validation.New(h.Validation); err != nil {
+		ps = append(ps, configs.Problemf(key+".validation", "%v", err))
+	}
+
+	if len(h.EndPoints) == 0 && len(h.BatchEndPoints) == 0 {
+		ps = append(ps, configs.Problemf(key+".endPoints", "at least one of endPoints and batchEndPoints is required"))
+	}
+	for i, e := range h.EndPoints {
+		if err := configs.ValidateEndpoint(e); err != nil {
+			ps = append(ps, configs.Problemf(fmt.Sprintf("%s.endPoints[%d]", key, i), "%v", err))
+		}
+	}
+	for i, b := range h.BatchEndPoints {
+		if err := b.validate(); err != nil {
+			ps = append(ps, configs.Problemf(fmt.Sprintf("%s.batchEndPoints[%d]", key, i), "%v", err))
+		}
+	}
+	for i, d := range h.Replies {
+		if err := validateReply(d, h.EndPoints); err != nil {
+			ps = append(ps, configs.Problemf(fmt.Sprintf("%s.replies[%d]", key, i), "%v", err))
+		}
+	}
+	return ps
+}
+
+// validateReply checks the reply destination refers to one of endpoints
+func validateReply(d *reply.Destination, endpoints []string) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	for _, e := range endpoints {
+		if e == d.EndPoint {
+			return nil
+		}
+	}
+	return fmt.Errorf("reply destination refers to unknown endpoint %s", d.EndPoint)
+}
+
+// publishReply publishes the response of endpoint to reply destinations of the endpoint. The correlation id is
+// taken from "correlation-id" header of message, or topic, partition and offset of message if there is no such
+// header. Replies are published for failed posts as well, so requesters are not left waiting for spooled messages.
+func (h handler) publishReply(endpoint string, msg *kafka.Message, res []byte, httpErr error, latency time.Duration) {
+	if len(h.Replies) == 0 {
+		return
+	}
+
+	r := &reply.Reply{
+		CorrelationID: fmt.Sprintf("%s-%d-%d", msg.Topic, msg.Partition, msg.Offset),
+		Key:           msg.Key,
+		EndPoint:      endpoint,
+		Status:        server.StatusCode(httpErr),
+		Latency:       latency,
+		Body:          res,
+		Source: map[string]string{
+			"topic":     msg.Topic,
+			"partition": strconv.Itoa(msg.Partition),
+			"offset":    strconv.FormatInt(msg.Offset, 10),
+		},
+	}
+	for _, hd := range msg.Headers {
+		if strings.EqualFold(hd.Key, "correlation-id") {
+			r.CorrelationID = string(hd.Value)
+		}
+	}
+	if httpErr != nil {
+		r.Error = httpErr.Error()
+	}
+
+	for _, d := range h.Replies {
+		if d.EndPoint != endpoint {
+			continue
+		}
+		if err := reply.GetPublisher().Publish(d, r); err != nil {
+			log.Errorf("***** [HANDLER][FAIL] ***** Failed to publish reply of [url::%s] to [%s] [Error::%s]", logpolicy.URL(endpoint), d, logpolicy.Error(err))
+		}
+	}
+}
+
+// handleMessage passes message to the registered handler as an event, the event which the handler delivers is
+// posted to endpoints of handler. Values in wire format of schema registry are converted to JSON beforehand, and
+// messages whose values cannot be converted are kept by keepUndecodable. Messages whose schemas cannot be fetched
+// are lost, they are decoded again once schema registry recovers.
+func (h handler) handleMessage(ctx context.Context, msg *kafka.Message) error {
+	value := msg.Value
+	if r := schemaregistry.GetRegistry(); r != nil && schemaregistry.IsWireFormat(value) {
+		decoded, err := r.Decode(ctx, value)
+		if schemaregistry.IsFetchError(err) {
+			return &lostError{err}
+		}
+		if err != nil {
+			return h.keepUndecodable(ctx, msg, err)
+		}
+		value = decoded
+	}
+
+	e := &eventhandler.Event{
+		Source:  eventhandler.SourceKafka,
+		Topic:   msg.Topic,
+		Key:     msg.Key,
+		Value:   value,
+		Headers: make(map[string]string, len(msg.Headers)),
+		Metadata: map[string]string{
+			"partition": strconv.Itoa(msg.Partition),
+			"offset":    strconv.FormatInt(msg.Offset, 10),
+		},
+	}
+	for _, hd := range msg.Headers {
+		e.Headers[hd.Key] = string(hd.Value)
+	}
+
+	return h.handle.Handle(ctx, e, func(e *eventhandler.Event) error {
+		m := *msg
+		m.Key, m.Value = e.Key, e.Value
+		if errs := h.validator.Validate(m.Value); len(errs) > 0 {
+			return h.rejectMessage(ctx, &m, errs)
+		}
+		if failed, lost := h.deliver(ctx, h.register(), &m); failed > 0 {
+			return &deliveryError{failed: failed, lost: lost, total: len(h.EndPoints) + len(h.BatchEndPoints)}
+		}
+		return nil
+	})
+}
+
+// keepUndecodable keeps the message whose value cannot be decoded by schema registry instead of dropping it. It is
+// routed to the invalid-events destination of handler if there is one, otherwise it is kept in spool without being
+// re-driven, as endpoints would receive the undecoded value. The message is lost if it cannot be kept either way.
+func (h handler) keepUndecodable(ctx context.Context, msg *kafka.Message, decodeErr error) error {
+	errs := []string{"/: " + decodeErr.Error()}
+	if h.validator.Destination() != nil {
+		return h.rejectMessage(ctx, msg, errs)
+	}
+
+	sp := spool.GetSpool()
+	if sp == nil {
+		return &lostError{fmt.Errorf("no invalid-events destination or spool keeps message which cannot be decoded: %v", decodeErr)}
+	}
+	source := messageSource(ctx, msg)
+	log.WithContext(ctx).Warnf("***** [HANDLER][INVALID] ***** Keep message which cannot be decoded in spool:: %s", logpolicy.Error(decodeErr))
+	err := sp.Append(&spool.Entry{
+		Register:    h.register(),
+		ContentType: "application/octet-stream",
+		Payload:     msg.Value,
+		Metadata: map[string]string{
+			"topic":     msg.Topic,
+			"partition": strconv.Itoa(msg.Partition),
+			"offset":    strconv.FormatInt(msg.Offset, 10),
+			"key":       string(msg.Key),
+		},
+		Reason:  "failed to decode value by schema registry",
+		Source:  &source,
+		Invalid: errs,
+	})
+	if err != nil {
+		return &lostError{fmt.Errorf("failed to spool message which cannot be decoded: %v", err)}
+	}
+	return nil
+}
+
+// rejectMessage routes the message which fails validation to the invalid-events destination of handler instead of
+// delivering it to endpoints, the message is dropped if handler has no such destination. The message is lost if it
+// cannot be routed, so it is handled again instead of being committed.
+func (h handler) rejectMessage(ctx context.Context, msg *kafka.Message, errs []string) error {
+	v := h.validator
+	log.WithContext(ctx).Warnf("***** [HANDLER][INVALID] ***** Reject message of [schema::%s] [errors::%s]", v.Name(), logpolicy.Text(strings.Join(errs, "; ")))
+	err := v.Reject(&validation.Invalid{
+		Key:     msg.Key,
+		Payload: msg.Value,
+		Errors:  errs,
+		Source: map[string]string{
+			"topic":     msg.Topic,
+			"partition": strconv.Itoa(msg.Partition),
+			"offset":    strconv.FormatInt(msg.Offset, 10),
+			"key":       string(msg.Key),
+		},
+		Register: h.register(),
+	})
+	if err != nil {
+		return &lostError{fmt.Errorf("failed to route invalid message to %s: %v", v.Destination(), err)}
 	}
+	return nil
 }
@@ -0,0 +1,115 @@
+package kafkaconsumer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/schemaregistry"
+	"github.com/linushung/hermes/internal/pkg/validation"
+	"github.com/linushung/hermes/pkg/eventhandler"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// unavailableSchema is answered with 503 by the test schema registry, other schemas with 404
+	unavailableSchema = 5
+	unknownSchema     = 9
+)
+
+var initRegistry sync.Once
+
+// startRegistry initialises schema registry of the process with a registry which knows no schema, it is shared by
+// tests as schema registry is initialised once
+func startRegistry(t *testing.T) {
+	t.Helper()
+	initRegistry.Do(func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == fmt.Sprintf("/schemas/ids/%d", unavailableSchema) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		values := map[string]interface{}{"kafka.bootstrapservers": "localhost:9092", "schemaRegistry.url": srv.URL}
+		if err := configs.LoadConfig("", values); err != nil {
+			t.Fatalf("failed to load configuration: %v", err)
+		}
+		if err := schemaregistry.InitRegistry(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// wireFormat prefixes payload with the magic byte and schema id of Confluent wire format
+func wireFormat(id uint32, payload []byte) []byte {
+	b := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(b[1:], id)
+	return append(b, payload...)
+}
+
+func TestHandleMessageLosesMessageWhichIsNotKept(t *testing.T) {
+	startRegistry(t)
+
+	tests := []struct {
+		name  string
+		value []byte
+	}{
+		{name: "schema registry unavailable", value: wireFormat(unavailableSchema, []byte{0})},
+		{name: "undecodable without spool", value: wireFormat(unknownSchema, []byte{0})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := handler{Handler: "NotificationServiceHandler"}
+			err := h.handleMessage(context.Background(), &kafka.Message{Topic: "events", Value: tt.value})
+			if !isLost(err) {
+				t.Errorf("handleMessage() error = %v, want a lost error so the message is not committed", err)
+			}
+		})
+	}
+}
+
+// newSpoolValidator returns a validator which requires id and routes invalid events to spool, which is not
+// initialised, so routing invalid events fails
+func newSpoolValidator(t *testing.T) *validation.Validator {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kafkaconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schema := filepath.Join(dir, "event.json")
+	if err := ioutil.WriteFile(schema, []byte(`{"type": "object", "required": ["id"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := configs.LoadConfig("", map[string]interface{}{"spool.directory": dir}); err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+
+	v, err := validation.New(&validation.Config{Schema: schema, InvalidEvents: &validation.Destination{Spool: true}})
+	if err != nil {
+		t.Fatalf("validation.New() error = %v", err)
+	}
+	return v
+}
+
+func TestHandleMessageLosesMessageWhichIsNotRouted(t *testing.T) {
+	h := handler{Handler: "NotificationServiceHandler", handle: eventhandler.Deliver, validator: newSpoolValidator(t)}
+	err := h.handleMessage(context.Background(), &kafka.Message{Topic: "events", Value: []byte(`{}`)})
+	if err == nil || !strings.Contains(err.Error(), "failed to route invalid message to spool") {
+		t.Fatalf("handleMessage() error = %v, want invalid message is not routed", err)
+	}
+	if !isLost(err) {
+		t.Errorf("handleMessage() error = %v, want a lost error so the message is not committed", err)
+	}
+}
@@ -0,0 +1,51 @@
+package rabbitmqconsumer
+
+import (
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/reply"
+	"github.com/linushung/hermes/internal/pkg/tlsconfig"
+	"github.com/linushung/hermes/internal/pkg/validation"
+)
+
+// rabbitMQSchema lists settings of RabbitMQ configuration, which is used to find unknown keys
+type rabbitMQSchema struct {
+	Username       string               `mapstructure:"username"`
+	UsernameFile   string               `mapstructure:"usernameFile"`
+	Password       string               `mapstructure:"password"`
+	PasswordFile   string               `mapstructure:"passwordFile"`
+	Host           string               `mapstructure:"host"`
+	Vhost          string               `mapstructure:"vhost"`
+	AuthMechanism  string               `mapstructure:"authMechanism"`
+	ConnectionName string               `mapstructure:"connectionName"`
+	Heartbeat      time.Duration        `mapstructure:"heartbeat"`
+	FrameSize      int                  `mapstructure:"frameSize"`
+	ChannelMax     int                  `mapstructure:"channelMax"`
+	TLS            tlsconfig.Schema     `mapstructure:"tls"`
+	QueueName      string               `mapstructure:"queueName"`
+	ConsumerTag    string               `mapstructure:"consumerTag"`
+	Workers        int                  `mapstructure:"workers"`
+	HandleFuncName string               `mapstructure:"handleFuncName"`
+	EndPoints      []string             `mapstructure:"endPoints"`
+	Replies        []*reply.Destination `mapstructure:"replies"`
+	DedupKey       string               `mapstructure:"dedupKey"`
+	Validation     *validation.Config   `mapstructure:"validation"`
+}
+
+// ValidateConfig checks RabbitMQ configuration strictly without connecting to RabbitMQ
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("rabbitmq", rabbitMQSchema{})
+	if configs.GetConfigStr("rabbitmq.host") == "" {
+		ps = append(ps, configs.Problemf("rabbitmq.host", "host is required"))
+	}
+	if configs.GetConfigInt("rabbitmq.workers") < 1 {
+		ps = append(ps, configs.Problemf("rabbitmq.workers", "workers must be greater than 0"))
+	}
+	if _, err := connectionConfig(); err != nil {
+		ps = append(ps, configs.Problemf("rabbitmq", "invalid connection configuration: %v", err))
+	}
+
+	_, rps := readRoute()
+	return append(ps, rps...)
+}
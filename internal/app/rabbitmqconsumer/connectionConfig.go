@@ -0,0 +1,99 @@
+package rabbitmqconsumer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/tlsconfig"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultHeartbeat      = 10 * time.Second
+	defaultConnectionName = "hermes"
+	mechanismPlain        = "PLAIN"
+	mechanismAMQPlain     = "AMQPLAIN"
+	mechanismExternal     = "EXTERNAL"
+)
+
+// externalAuth implements SASL EXTERNAL mechanism, RabbitMQ authenticates hermes by the client certificate of TLS
+// connection and no credential is sent
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return mechanismExternal
+}
+
+func (externalAuth) Response() string {
+	return ""
+}
+
+// connectionURL returns URL of RabbitMQ without credentials and vhost, which are passed by amqp.Config instead so
+// they do not need to be escaped
+func connectionURL() string {
+	scheme := "amqp"
+	if configs.GetConfigBool("rabbitmq.tls.enabled") {
+		scheme = "amqps"
+	}
+	return fmt.Sprintf("%s://%s/", scheme, configs.GetConfigStr("rabbitmq.host"))
+}
+
+// connectionConfig returns amqp.Config of TLS, authentication, vhost and tuning settings under rabbitmq
+func connectionConfig() (amqp.Config, error) {
+	config := amqp.Config{
+		Vhost:      configs.GetConfigStr("rabbitmq.vhost"),
+		Heartbeat:  configs.GetConfigDuration("rabbitmq.heartbeat"),
+		FrameSize:  configs.GetConfigInt("rabbitmq.frameSize"),
+		ChannelMax: configs.GetConfigInt("rabbitmq.channelMax"),
+		Properties: amqp.Table{"connection_name": defaultConnectionName},
+	}
+	if config.Vhost == "" {
+		config.Vhost = "/"
+	}
+	if config.Heartbeat == 0 {
+		config.Heartbeat = defaultHeartbeat
+	}
+	if name := configs.GetConfigStr("rabbitmq.connectionName"); name != "" {
+		config.Properties["connection_name"] = name
+	}
+
+	tlsEnabled := configs.GetConfigBool("rabbitmq.tls.enabled")
+	if tlsEnabled {
+		tlsConfig, err := tlsconfig.NewTLSConfig("rabbitmq.tls")
+		if err != nil {
+			return config, err
+		}
+		config.TLSClientConfig = tlsConfig
+	}
+
+	mechanism := strings.ToUpper(configs.GetConfigStr("rabbitmq.authMechanism"))
+	if mechanism == mechanismExternal {
+		if !tlsEnabled || len(config.TLSClientConfig.Certificates) == 0 {
+			return config, fmt.Errorf("rabbitmq: %s mechanism requires TLS with client certificate", mechanismExternal)
+		}
+		config.SASL = []amqp.Authentication{externalAuth{}}
+		return config, nil
+	}
+
+	username, err := configs.GetConfigCredential("rabbitmq.username")
+	if err != nil {
+		return config, err
+	}
+	password, err := configs.GetConfigCredential("rabbitmq.password")
+	if err != nil {
+		return config, err
+	}
+
+	switch mechanism {
+	case "", mechanismPlain:
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: username, Password: password}}
+	case mechanismAMQPlain:
+		config.SASL = []amqp.Authentication{&amqp.AMQPlainAuth{Username: username, Password: password}}
+	default:
+		return config, fmt.Errorf("rabbitmq: unknown authMechanism %q, expect %s, %s or %s", mechanism, mechanismPlain, mechanismAMQPlain, mechanismExternal)
+	}
+	return config, nil
+}
@@ -0,0 +1,214 @@
+package rabbitmqconsumer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/tlsconfig/tlstest"
+
+	"github.com/streadway/amqp"
+)
+
+func loadConfig(t *testing.T, values map[string]interface{}) {
+	t.Helper()
+	if err := configs.LoadConfig("", values); err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+}
+
+func TestConnectionURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		url    string
+	}{
+		{
+			name:   "plain",
+			values: map[string]interface{}{"rabbitmq.host": "localhost:5672"},
+			url:    "amqp://localhost:5672/",
+		},
+		{
+			name:   "tls",
+			values: map[string]interface{}{"rabbitmq.host": "rabbitmq.internal:5671", "rabbitmq.tls.enabled": true},
+			url:    "amqps://rabbitmq.internal:5671/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, tt.values)
+			if url := connectionURL(); url != tt.url {
+				t.Errorf("connectionURL() = %s, want %s", url, tt.url)
+			}
+		})
+	}
+}
+
+func TestConnectionConfigSettings(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    map[string]interface{}
+		vhost     string
+		heartbeat time.Duration
+		frameSize int
+		conn      string
+	}{
+		{
+			name:      "defaults",
+			values:    map[string]interface{}{"rabbitmq.host": "localhost:5672"},
+			vhost:     "/",
+			heartbeat: defaultHeartbeat,
+			conn:      defaultConnectionName,
+		},
+		{
+			name: "configured",
+			values: map[string]interface{}{
+				"rabbitmq.vhost":          "events",
+				"rabbitmq.heartbeat":      "30s",
+				"rabbitmq.frameSize":      131072,
+				"rabbitmq.connectionName": "hermes-1",
+			},
+			vhost:     "events",
+			heartbeat: 30 * time.Second,
+			frameSize: 131072,
+			conn:      "hermes-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, tt.values)
+
+			c, err := connectionConfig()
+			if err != nil {
+				t.Fatalf("connectionConfig() error = %v", err)
+			}
+			if c.Vhost != tt.vhost || c.Heartbeat != tt.heartbeat || c.FrameSize != tt.frameSize || c.Properties["connection_name"] != tt.conn {
+				t.Errorf("connectionConfig() vhost = %s, heartbeat = %v, frameSize = %d, connection_name = %v, want %s, %v, %d, %s",
+					c.Vhost, c.Heartbeat, c.FrameSize, c.Properties["connection_name"], tt.vhost, tt.heartbeat, tt.frameSize, tt.conn)
+			}
+			if c.TLSClientConfig != nil {
+				t.Errorf("connectionConfig() TLS = %v, want nil", c.TLSClientConfig)
+			}
+		})
+	}
+}
+
+func TestConnectionConfigAuthentication(t *testing.T) {
+	certFile, keyFile := tlstest.WriteCertificate(t, "rabbitmq.internal")
+	passwordFile := filepath.Join(tempDir(t), "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		values    map[string]interface{}
+		mechanism string
+		response  string
+		err       string
+	}{
+		{
+			name:      "plain by default",
+			values:    map[string]interface{}{"rabbitmq.username": "hermes", "rabbitmq.password": "secret"},
+			mechanism: mechanismPlain,
+			response:  "\x00hermes\x00secret",
+		},
+		{
+			name:      "plain with password file",
+			values:    map[string]interface{}{"rabbitmq.username": "hermes", "rabbitmq.passwordFile": passwordFile},
+			mechanism: mechanismPlain,
+			response:  "\x00hermes\x00from-file",
+		},
+		{
+			name:      "amqplain in lower case",
+			values:    map[string]interface{}{"rabbitmq.authMechanism": "amqplain", "rabbitmq.username": "hermes", "rabbitmq.password": "secret"},
+			mechanism: mechanismAMQPlain,
+		},
+		{
+			name: "external with client certificate",
+			values: map[string]interface{}{
+				"rabbitmq.authMechanism": "EXTERNAL",
+				"rabbitmq.tls":           map[string]interface{}{"enabled": true, "caFile": certFile, "certFile": certFile, "keyFile": keyFile},
+			},
+			mechanism: mechanismExternal,
+		},
+		{
+			name:   "external without TLS",
+			values: map[string]interface{}{"rabbitmq.authMechanism": "EXTERNAL"},
+			err:    "EXTERNAL mechanism requires TLS with client certificate",
+		},
+		{
+			name: "external without client certificate",
+			values: map[string]interface{}{
+				"rabbitmq.authMechanism": "EXTERNAL",
+				"rabbitmq.tls":           map[string]interface{}{"enabled": true, "caFile": certFile},
+			},
+			err: "EXTERNAL mechanism requires TLS with client certificate",
+		},
+		{
+			name:   "unknown mechanism",
+			values: map[string]interface{}{"rabbitmq.authMechanism": "GSSAPI", "rabbitmq.username": "hermes", "rabbitmq.password": "secret"},
+			err:    `unknown authMechanism "GSSAPI"`,
+		},
+		{
+			name:   "unreadable password file",
+			values: map[string]interface{}{"rabbitmq.username": "hermes", "rabbitmq.passwordFile": passwordFile + ".missing"},
+			err:    "failed to read rabbitmq.passwordFile",
+		},
+		{
+			name:   "invalid TLS",
+			values: map[string]interface{}{"rabbitmq.tls": map[string]interface{}{"enabled": true, "certFile": certFile}},
+			err:    "rabbitmq.tls: certFile and keyFile of client certificate must be set together",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, tt.values)
+
+			c, err := connectionConfig()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("connectionConfig() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connectionConfig() error = %v", err)
+			}
+			if len(c.SASL) != 1 || c.SASL[0].Mechanism() != tt.mechanism {
+				t.Fatalf("connectionConfig() SASL = %v, want %s", c.SASL, tt.mechanism)
+			}
+			if tt.response != "" && c.SASL[0].Response() != tt.response {
+				t.Errorf("connectionConfig() SASL response = %q, want %q", c.SASL[0].Response(), tt.response)
+			}
+			if tt.mechanism == mechanismExternal {
+				if c.TLSClientConfig == nil || c.TLSClientConfig.RootCAs == nil || len(c.TLSClientConfig.Certificates) != 1 {
+					t.Errorf("connectionConfig() TLS = %+v, want root CAs and a client certificate", c.TLSClientConfig)
+				}
+				if _, ok := c.SASL[0].(externalAuth); !ok {
+					t.Errorf("connectionConfig() SASL = %T, want %T", c.SASL[0], externalAuth{})
+				}
+			}
+			if tt.mechanism == mechanismAMQPlain {
+				if a, ok := c.SASL[0].(*amqp.AMQPlainAuth); !ok || a.Username != "hermes" || a.Password != "secret" {
+					t.Errorf("connectionConfig() SASL = %#v, want AMQPLAIN of hermes", c.SASL[0])
+				}
+			}
+		})
+	}
+}
+
+// tempDir returns a directory for files of a test, which is removed once the test ends
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rabbitmqconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
@@ -1,41 +1,63 @@
 package rabbitmqconsumer
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"sync"
+	"time"
 
+	"github.com/linushung/hermes/cmd/server"
 	"github.com/linushung/hermes/internal/pkg/configs"
-	log "github.com/sirupsen/logrus"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/internal/pkg/reply"
 	"github.com/streadway/amqp"
 )
 
+// log is the logger of rabbitmq component
+var log = logging.For(logging.RabbitMQ)
+
+// redeliverInterval is how long to wait before a lost message is delivered again while circuit is closed
+const redeliverInterval = time.Second
+
 type rabbitMQConnector struct {
 	ConsumerTag string
 	Worker      int
+	Connection  *amqp.Connection
 	Channel     *amqp.Channel
 	Queue       *amqp.Queue
+
+	// mu guards route which is swapped by reloading configuration
+	mu    sync.RWMutex
+	route *route
+	// ctx of workers is cancelled by Close, so messages which are being delivered again are requeued
+	ctx    context.Context
+	cancel context.CancelFunc
+	// active counts workers which have not returned, Close waits for them before it closes the connection
+	active sync.WaitGroup
 }
 
 // InitRabbitMQConnector initialise connection and queue
-func InitRabbitMQConnector() *rabbitMQConnector {
-	username := configs.GetConfigStr("rabbitmq.username")
-	password := configs.GetConfigStr("rabbitmq.password")
+func InitRabbitMQConnector() (*rabbitMQConnector, error) {
 	host := configs.GetConfigStr("rabbitmq.host")
+	config, err := connectionConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection configuration of RabbitMQ %s: %v", host, err)
+	}
+
 	// The connection abstracts the socket connection, and takes care of protocol version negotiation and
 	// authentication and so on for us.
-	conn, err := amqp.Dial(fmt.Sprintf("amqp://%s:%s@%s", username, password, host))
+	conn, err := amqp.DialConfig(connectionURL(), config)
 	if err != nil {
-		log.Fatalf("***** [RABBITMQ][FAIL] ***** Failed to create Connection to RabbitMQ::%s %v", host, err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to create connection to RabbitMQ %s: %v", host, err)
 	}
-	// defer conn.Close()
 
 	ch, err := conn.Channel()
 	if err != nil {
-		log.Fatalf("***** [RABBITMQ][FAIL] ***** Failed to open a Channel of RabbitMQ::%v", err)
-		os.Exit(1)
+		conn.Close()
+		return nil, fmt.Errorf("failed to open a channel of RabbitMQ: %v", err)
 	}
-	// defer ch.Close()
 
 	queueName := configs.GetConfigStr("rabbitmq.queueName")
 	// Ref: https://www.rabbitmq.com/tutorials/amqp-concepts.html
@@ -57,37 +79,168 @@ func InitRabbitMQConnector() *rabbitMQConnector {
 		nil,   // arguments
 	)
 	if err != nil {
-		log.Fatalf("***** [RABBITMQ][FAIL] ***** Failed to declare Queue of RabbitMQ::%v", err)
-		os.Exit(1)
+		conn.Close()
+		return nil, fmt.Errorf("failed to declare queue of RabbitMQ: %v", err)
+	}
+
+	rt, err := loadRoute()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("invalid configuration of RabbitMQ: %v", err)
 	}
+	reply.GetPublisher().SetChannel(ch)
 
 	tag := configs.GetConfigStr("rabbitmq.consumerTag")
 	worker := configs.GetConfigInt("rabbitmq.workers")
-	return &rabbitMQConnector{tag, worker, ch, &q}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &rabbitMQConnector{
+		ConsumerTag: tag,
+		Worker:      worker,
+		Connection:  conn,
+		Channel:     ch,
+		Queue:       &q,
+		route:       rt,
+		ctx:         ctx,
+		cancel:      cancel,
+	}, nil
+}
+
+// currentRoute returns route of messages, which may be swapped by reloading configuration
+func (rmq *rabbitMQConnector) currentRoute() *route {
+	rmq.mu.RLock()
+	defer rmq.mu.RUnlock()
+	return rmq.route
+}
+
+// PrepareReload reads handler, endpoints and replies of configuration again and returns the function which swaps
+// route of messages to them. Changes of connection, queue and workers take effect after restart.
+func (rmq *rabbitMQConnector) PrepareReload() (func(), error) {
+	rt, err := loadRoute()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		rmq.mu.Lock()
+		rmq.route = rt
+		rmq.mu.Unlock()
+		log.Infof("***** [RABBITMQ] ***** Reload handler::%s with %d endpoints of Queue::%s ......", rt.Handler, len(rt.EndPoints), rmq.Queue.Name)
+	}, nil
 }
 
-func (rmq *rabbitMQConnector) InitConsumerGroup() {
+// InitConsumerGroup starts workers which consume messages of the queue
+func (rmq *rabbitMQConnector) InitConsumerGroup() error {
 	qn := rmq.Queue.Name
+	// Limit unacknowledged deliveries to the number of workers, so RabbitMQ stops pushing messages while workers are
+	// paused by an open circuit
+	if err := rmq.Channel.Qos(rmq.Worker, 0, false); err != nil {
+		return fmt.Errorf("failed to set QoS for queue %s: %v", qn, err)
+	}
+
 	msg, err := rmq.Channel.Consume(
 		qn,              // queue
 		rmq.ConsumerTag, // consumer
-		true,            // auto-ack
+		false,           // auto-ack
 		false,           // exclusive
 		false,           // no-local
 		false,           // no-wait
 		nil,             // args
 	)
 	if err != nil {
-		log.Fatalf("***** [RABBITMQ][FAIL] ***** Failed to create Consumer for Queue::%s %v", qn, err)
-		os.Exit(1)
+		return fmt.Errorf("failed to create consumer for queue %s: %v", qn, err)
 	}
 
 	for i := 0; i < rmq.Worker; i++ {
+		rmq.active.Add(1)
 		go func(i int) {
+			defer rmq.active.Done()
 			log.Infof("***** [INIT:RABBITMQ] ***** Start a RabbitMQ Consumer::%s-%v ......", qn, i+1)
-			for d := range msg {
-				log.Printf("RabbitMQ worker[%v] - Received a message from Queue:%s %s", i+1, qn, d.Body)
+			ctx := logging.NewContext(rmq.ctx, logging.Fields{logging.FieldConsumer: fmt.Sprintf("%s-%d", rmq.ConsumerTag, i+1)})
+			for {
+				// Deliveries which are not settled before Close are requeued by RabbitMQ once the connection closes
+				var d amqp.Delivery
+				var ok bool
+				select {
+				case <-ctx.Done():
+					return
+				case d, ok = <-msg:
+				}
+				if !ok {
+					return
+				}
+				if err := server.GetCircuitBreakerMgr().WaitCircuitClosed(ctx, rmq.currentRoute().register()); err != nil {
+					return
+				}
+				dctx := deliveryContext(ctx, qn, d)
+				log.WithContext(dctx).Debugf("Received a message:: %s", logpolicy.Body(d.Body))
+				settle(dctx, d, rmq.handleUntilKept(dctx, qn, d))
 			}
 		}(i)
 	}
+	return nil
+}
+
+// handleUntilKept hands d over to the current route until every endpoint receives it or keeps it in spool, as
+// consumers of Kafka do. The message which is lost, e.g. failed while circuit is open and spool is disabled, is
+// delivered again once circuit of handler is closed, endpoints which received it are skipped if messages are
+// deduplicated. It returns the error of the last attempt, which is lost only if ctx is done before d is kept.
+func (rmq *rabbitMQConnector) handleUntilKept(ctx context.Context, queue string, d amqp.Delivery) error {
+	for {
+		rt := rmq.currentRoute()
+		err := rt.handleDelivery(ctx, queue, d)
+		if err == nil {
+			return nil
+		}
+		log.WithContext(ctx).Errorf("***** [RABBITMQ][FAIL] ***** Failed to handle message of [handler::%s] [Error::%s]", rt.Handler, logpolicy.Error(err))
+		if !isLost(err) || ctx.Err() != nil {
+			return err
+		}
+
+		log.WithContext(ctx).Warnf("***** [RABBITMQ][RETRY] ***** Deliver message again once circuit of [handler::%s] is closed ......", rt.Handler)
+		if server.GetCircuitBreakerMgr().WaitCircuitClosed(ctx, rt.register()) != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(redeliverInterval):
+		}
+	}
+}
+
+// isLost reports whether err leaves the message with endpoints which neither received it nor keep it in spool, or
+// leaves it not kept at all
+func isLost(err error) bool {
+	var de *deliveryError
+	var le *lostError
+	return errors.As(err, &de) && de.lost > 0 || errors.As(err, &le)
+}
+
+// settle acknowledges d once it is kept, which is when every endpoint receives it or keeps it in spool, or it fails
+// for other reasons than endpoints, e.g. by its handler, as Kafka commits such messages. The message which is lost
+// as connector is closed is requeued, so it is delivered again by the next consumer instead of being dropped.
+func settle(ctx context.Context, d amqp.Delivery, err error) {
+	if !isLost(err) {
+		if err := d.Ack(false); err != nil {
+			log.WithContext(ctx).Errorf("***** [RABBITMQ][FAIL] ***** Failed to ack message:: %v", err)
+		}
+		return
+	}
+
+	if err := d.Nack(false, true); err != nil {
+		log.WithContext(ctx).Errorf("***** [RABBITMQ][FAIL] ***** Failed to nack message:: %v", err)
+		return
+	}
+	log.WithContext(ctx).Warnf("***** [RABBITMQ][NACK] ***** Requeue message which is not delivered as consumer stops ......")
+}
+
+// Close stops workers and consuming the queue, waits for workers to settle messages they are delivering and closes
+// the connection to RabbitMQ
+func (rmq *rabbitMQConnector) Close() error {
+	rmq.cancel()
+	if err := rmq.Channel.Cancel(rmq.ConsumerTag, false); err != nil {
+		log.Errorf("***** [RABBITMQ][FAIL] ***** Failed to cancel Consumer::%s %v", rmq.ConsumerTag, err)
+	}
+	rmq.active.Wait()
+	return rmq.Connection.Close()
 }
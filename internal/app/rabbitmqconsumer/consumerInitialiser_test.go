@@ -0,0 +1,54 @@
+package rabbitmqconsumer
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// acknowledger records how a delivery is settled
+type acknowledger struct {
+	acked, nacked, requeued bool
+}
+
+func (a *acknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		redelivered bool
+		acked       bool
+	}{
+		{name: "delivered", acked: true},
+		{name: "kept in spool", err: &deliveryError{failed: 1, total: 2}, acked: true},
+		{name: "failed by handler", err: errors.New("handler failed"), acked: true},
+		{name: "lost", err: &deliveryError{failed: 1, lost: 1, total: 1}},
+		{name: "lost again after redelivery", err: &deliveryError{failed: 1, lost: 1, total: 1}, redelivered: true},
+	}
+	for _, tt := range tests {
+		a := &acknowledger{}
+		settle(context.Background(), amqp.Delivery{Acknowledger: a, Redelivered: tt.redelivered}, tt.err)
+		if tt.acked && (!a.acked || a.nacked) {
+			t.Errorf("settle() of %s acked = %v, nacked = %v, want acked", tt.name, a.acked, a.nacked)
+		}
+		// Lost message is requeued, it is never dropped
+		if !tt.acked && (a.acked || !a.nacked || !a.requeued) {
+			t.Errorf("settle() of %s acked = %v, nacked = %v, requeued = %v, want requeued", tt.name, a.acked, a.nacked, a.requeued)
+		}
+	}
+}
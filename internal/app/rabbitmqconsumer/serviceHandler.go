@@ -0,0 +1,330 @@
+package rabbitmqconsumer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/pkg/audit"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/dedup"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/internal/pkg/reply"
+	"github.com/linushung/hermes/internal/pkg/spool"
+	"github.com/linushung/hermes/internal/pkg/validation"
+	"github.com/linushung/hermes/pkg/eventhandler"
+
+	"github.com/streadway/amqp"
+)
+
+// route decides which handler handles messages of the queue and which endpoints they are posted to
+type route struct {
+	Handler   string
+	handle    eventhandler.Handler
+	EndPoints []string
+	Replies   []*reply.Destination
+	// dedupKey identifies messages for deduplication, key of it is the message id
+	dedupKey *dedup.Key
+	// validator validates events against a JSON Schema before delivery
+	validator *validation.Validator
+}
+
+// loadRoute reads and validates handler, endpoints and replies of RabbitMQ configuration
+func loadRoute() (*route, error) {
+	rt, ps := readRoute()
+	if err := configs.ProblemsError(ps); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// readRoute reads handler, endpoints and replies of RabbitMQ configuration and returns problems of them
+func readRoute() (*route, []configs.Problem) {
+	rt := &route{
+		Handler:   configs.GetConfigStr("rabbitmq.handleFuncName"),
+		EndPoints: configs.GetConfigSlice("rabbitmq.endPoints"),
+	}
+
+	var ps []configs.Problem
+	var err error
+	if rt.handle, err = eventhandler.Lookup(rt.Handler); err != nil {
+		ps = append(ps, configs.Problemf("rabbitmq.handleFuncName", "%v", err))
+	} else if r := rt.register(); r != server.DefaultHandler && !configs.IsConfigSet("circuitbreaker.registers."+r) {
+		ps = append(ps, configs.Problemf("rabbitmq.handleFuncName", "circuit breaker register %s is referenced but not defined in circuitbreaker.registers", rt.Handler))
+	}
+
+	expr := configs.GetConfigStr("rabbitmq.dedupKey")
+	if rt.dedupKey, err = dedup.KeyOf(expr); err != nil {
+		ps = append(ps, configs.Problemf("rabbitmq.dedupKey", "%v", err))
+	} else if expr != "" && rt.dedupKey == nil {
+		ps = append(ps, configs.Problemf("rabbitmq.dedupKey", "dedupKey requires dedup section"))
+	}
+
+	var vc *validation.Config
+	if configs.IsConfigSet("rabbitmq.validation") {
+		vc = &validation.Config{}
+		if err := configs.GetConfigUnmarshalKey("rabbitmq.validation", vc); err != nil {
+			ps = append(ps, configs.Problemf("rabbitmq.validation", "%v", err))
+		}
+	}
+	if rt.validator, err = validation.New(vc); err != nil {
+		ps = append(ps, configs.Problemf("rabbitmq.validation", "%v", err))
+	}
+
+	if len(rt.EndPoints) == 0 {
+		ps = append(ps, configs.Problemf("rabbitmq.endPoints", "at least one endpoint is required"))
+	}
+	for i, e := range rt.EndPoints {
+		if err := configs.ValidateEndpoint(e); err != nil {
+			ps = append(ps, configs.Problemf(fmt.Sprintf("rabbitmq.endPoints[%d]", i), "%v", err))
+		}
+	}
+
+	if err := configs.GetConfigUnmarshalKey("rabbitmq.replies", &rt.Replies); err != nil {
+		return rt, append(ps, configs.Problemf("rabbitmq.replies", "%v", err))
+	}
+	for i, d := range rt.Replies {
+		if err := rt.validateReply(d); err != nil {
+			ps = append(ps, configs.Problemf(fmt.Sprintf("rabbitmq.replies[%d]", i), "%v", err))
+		}
+	}
+	return rt, ps
+}
+
+// register returns the circuit breaker register which the handler posts messages with
+func (rt *route) register() string {
+	return eventhandler.CircuitRegister(rt.Handler)
+}
+
+// validateReply checks the reply destination refers to an endpoint of route
+func (rt *route) validateReply(d *reply.Destination) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	for _, e := range rt.EndPoints {
+		if e == d.EndPoint {
+			return nil
+		}
+	}
+	return fmt.Errorf("reply destination refers to unknown endpoint %s", d.EndPoint)
+}
+
+// handleDelivery passes the message to the registered handler as an event, the event which the handler delivers
+// is posted to endpoints
+func (rt *route) handleDelivery(ctx context.Context, queue string, d amqp.Delivery) error {
+	e := &eventhandler.Event{
+		Source:  eventhandler.SourceRabbitMQ,
+		Topic:   queue,
+		Key:     []byte(d.RoutingKey),
+		Value:   d.Body,
+		Headers: make(map[string]string, len(d.Headers)),
+		Metadata: map[string]string{
+			"exchange":      d.Exchange,
+			"messageId":     d.MessageId,
+			"correlationId": d.CorrelationId,
+		},
+	}
+	for k, v := range d.Headers {
+		e.Headers[k] = fmt.Sprint(v)
+	}
+
+	return rt.handle.Handle(ctx, e, func(e *eventhandler.Event) error {
+		if errs := rt.validator.Validate(e.Value); len(errs) > 0 {
+			return rt.rejectDelivery(ctx, queue, d, e.Value, errs)
+		}
+		if failed, lost := rt.deliver(ctx, queue, d, e.Value); failed > 0 {
+			return &deliveryError{failed: failed, lost: lost, total: len(rt.EndPoints)}
+		}
+		return nil
+	})
+}
+
+// deliveryError reports endpoints which failed to receive a message, lost of them are failures which are not kept
+// in spool
+type deliveryError struct {
+	failed, lost, total int
+}
+
+func (e *deliveryError) Error() string {
+	return fmt.Sprintf("%d of %d endpoints failed to receive message", e.failed, e.total)
+}
+
+// lostError reports a message which is neither delivered nor kept for other reasons than endpoints, e.g. it fails
+// validation and cannot be routed to the invalid-events destination, so it is delivered again
+type lostError struct {
+	err error
+}
+
+func (e *lostError) Error() string {
+	return e.err.Error()
+}
+
+func (e *lostError) Unwrap() error {
+	return e.err
+}
+
+// deliver posts body to every endpoint with circuit breaker of the handler and publishes responses to reply
+// destinations of the endpoint. If the message has ReplyTo property, responses are published to the queue with
+// CorrelationId of the message as well. It returns number of endpoints which failed to receive the message and
+// number of them which the message is not kept in spool for.
+func (rt *route) deliver(ctx context.Context, queue string, d amqp.Delivery, body []byte) (failed, lost int) {
+	register := rt.register()
+	dd, id := dedup.GetDedup(), rt.dedupID(d, body)
+	for _, e := range rt.EndPoints {
+		ectx := logging.NewContext(ctx, logging.Fields{logging.FieldEndpoint: logpolicy.URL(e)})
+		if reserved, err := dd.Reserve(ectx, e, id); err != nil {
+			failed++
+			lost++
+			continue
+		} else if !reserved {
+			log.WithContext(ectx).Infof("***** [RABBITMQ][DEDUP] ***** Skip message which has been delivered [id::%s]", id)
+			continue
+		}
+		start := time.Now()
+		res, httpErr := server.GetCircuitBreakerMgr().CBHTTPPostContext(ectx, register, e, "application/json", body)
+		rt.publishReply(queue, e, d, res, httpErr, time.Since(start))
+		r := audit.Attempt(deliverySource(ctx, queue, d), e, 1, start, httpErr)
+		if httpErr != nil {
+			log.WithContext(ectx).Errorf("***** [RABBITMQ][FAIL] ***** Receive post error:: %s", logpolicy.Error(httpErr))
+			r.Outcome = spoolDelivery(ectx, register, e, r.Source, id, d, body, httpErr)
+			dd.Release(e, id)
+			failed++
+			if r.Outcome != audit.Spooled {
+				lost++
+			}
+		} else {
+			dd.MarkDelivered(e, id)
+		}
+		audit.GetJournal().Record(r)
+	}
+	return failed, lost
+}
+
+// rejectDelivery routes the message which fails validation to the invalid-events destination instead of delivering
+// it to endpoints, the message is dropped if there is no such destination. The message is lost if it cannot be
+// routed, so it is delivered again instead of being acknowledged.
+func (rt *route) rejectDelivery(ctx context.Context, queue string, d amqp.Delivery, body []byte, errs []string) error {
+	v := rt.validator
+	log.WithContext(ctx).Warnf("***** [RABBITMQ][INVALID] ***** Reject message of [schema::%s] [errors::%s]", v.Name(), logpolicy.Text(strings.Join(errs, "; ")))
+	err := v.Reject(&validation.Invalid{
+		Key:     []byte(d.MessageId),
+		Payload: body,
+		Errors:  errs,
+		Source: map[string]string{
+			"queue":     queue,
+			"messageId": d.MessageId,
+		},
+		Register: rt.register(),
+	})
+	if err != nil {
+		return &lostError{fmt.Errorf("failed to route invalid message to %s: %v", v.Destination(), err)}
+	}
+	return nil
+}
+
+func (rt *route) publishReply(queue, endpoint string, d amqp.Delivery, res []byte, httpErr error, latency time.Duration) {
+	dests := make([]*reply.Destination, 0, len(rt.Replies)+1)
+	for _, rd := range rt.Replies {
+		if rd.EndPoint == endpoint {
+			dests = append(dests, rd)
+		}
+	}
+	if d.ReplyTo != "" {
+		dests = append(dests, &reply.Destination{EndPoint: endpoint, RoutingKey: d.ReplyTo})
+	}
+	if len(dests) == 0 {
+		return
+	}
+
+	r := &reply.Reply{
+		CorrelationID: d.CorrelationId,
+		EndPoint:      endpoint,
+		Status:        server.StatusCode(httpErr),
+		Latency:       latency,
+		Body:          res,
+		Source: map[string]string{
+			"queue":     queue,
+			"messageId": d.MessageId,
+		},
+	}
+	if r.CorrelationID == "" {
+		r.CorrelationID = d.MessageId
+	}
+	if httpErr != nil {
+		r.Error = httpErr.Error()
+	}
+
+	for _, rd := range dests {
+		if err := reply.GetPublisher().Publish(rd, r); err != nil {
+			log.Errorf("***** [RABBITMQ][FAIL] ***** Failed to publish reply of [url::%s] to [%s] [Error::%s]", logpolicy.URL(endpoint), rd, logpolicy.Error(err))
+		}
+	}
+}
+
+// deliveryContext returns ctx carrying queue, message id and trace id of d for logs
+func deliveryContext(ctx context.Context, queue string, d amqp.Delivery) context.Context {
+	fields := logging.Fields{logging.FieldQueue: queue, logging.FieldMessageID: d.MessageId}
+	headers := make(map[string]string, len(d.Headers))
+	for k, v := range d.Headers {
+		headers[k] = fmt.Sprint(v)
+	}
+	if id := logging.TraceID(headers); id != "" {
+		fields[logging.FieldTraceID] = id
+	}
+	return logging.NewContext(ctx, fields)
+}
+
+// dedupID returns the id of d with body by dedup key of route, or "" if messages are not deduplicated
+func (rt *route) dedupID(d amqp.Delivery, body []byte) string {
+	if rt.dedupKey == nil {
+		return ""
+	}
+	headers := make(map[string]string, len(d.Headers))
+	for k, v := range d.Headers {
+		headers[k] = fmt.Sprint(v)
+	}
+	return rt.dedupKey.ID([]byte(d.MessageId), headers, body)
+}
+
+// deliverySource returns the audit source of d, the consumer is taken from ctx
+func deliverySource(ctx context.Context, queue string, d amqp.Delivery) audit.Source {
+	consumer, _ := logging.FromContext(ctx)[logging.FieldConsumer].(string)
+	return audit.Source{
+		Type:      eventhandler.SourceRabbitMQ,
+		Consumer:  consumer,
+		Queue:     queue,
+		MessageID: d.MessageId,
+	}
+}
+
+// spoolDelivery keeps the message which cannot be delivered to endpoint in spool for re-drive, if spool is enabled.
+// It returns the audit outcome of the delivery, spooled if the message is kept in spool, otherwise failed.
+func spoolDelivery(ctx context.Context, register, endpoint string, source audit.Source, dedupID string, d amqp.Delivery, body []byte, httpErr error) string {
+	sp := spool.GetSpool()
+	if sp == nil {
+		return audit.Failed
+	}
+
+	e := &spool.Entry{
+		Register:    register,
+		Endpoint:    endpoint,
+		ContentType: "application/json",
+		Payload:     body,
+		Metadata: map[string]string{
+			"exchange":   d.Exchange,
+			"routingKey": d.RoutingKey,
+			"messageId":  d.MessageId,
+		},
+		Reason:  httpErr.Error(),
+		Source:  &source,
+		DedupID: dedupID,
+	}
+	if err := sp.Append(e); err != nil {
+		log.WithContext(ctx).Errorf("***** [RABBITMQ][FAIL] ***** Failed to spool message:: %v", err)
+		return audit.Failed
+	}
+	return audit.Spooled
+}
@@ -0,0 +1,60 @@
+package rabbitmqconsumer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/validation"
+	"github.com/linushung/hermes/pkg/eventhandler"
+
+	"github.com/streadway/amqp"
+)
+
+// newSpoolValidator returns a validator which requires id and routes invalid events to spool, which is not
+// initialised, so routing invalid events fails
+func newSpoolValidator(t *testing.T) *validation.Validator {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rabbitmqconsumer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	schema := filepath.Join(dir, "event.json")
+	if err := ioutil.WriteFile(schema, []byte(`{"type": "object", "required": ["id"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := configs.LoadConfig("", map[string]interface{}{"spool.directory": dir}); err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+
+	v, err := validation.New(&validation.Config{Schema: schema, InvalidEvents: &validation.Destination{Spool: true}})
+	if err != nil {
+		t.Fatalf("validation.New() error = %v", err)
+	}
+	return v
+}
+
+func TestHandleDeliveryLosesMessageWhichIsNotRouted(t *testing.T) {
+	rt := &route{Handler: "NotificationServiceHandler", handle: eventhandler.Deliver, validator: newSpoolValidator(t)}
+	a := &acknowledger{}
+	d := amqp.Delivery{Acknowledger: a, MessageId: "1", Body: []byte(`{}`)}
+
+	err := rt.handleDelivery(context.Background(), "events", d)
+	if err == nil || !strings.Contains(err.Error(), "failed to route invalid message to spool") {
+		t.Fatalf("handleDelivery() error = %v, want invalid message is not routed", err)
+	}
+	if !isLost(err) {
+		t.Errorf("handleDelivery() error = %v, want a lost error so the message is delivered again", err)
+	}
+
+	// Message which is not routed is requeued instead of being acknowledged
+	settle(context.Background(), d, err)
+	if a.acked || !a.requeued {
+		t.Errorf("settle() acked = %v, requeued = %v, want requeued", a.acked, a.requeued)
+	}
+}
@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	filePrefix       = "audit-"
+	fileSuffix       = ".jsonl"
+	defaultDirectory = "./audit"
+	defaultMaxSizeMB = 100
+)
+
+// fileConfig is audit.file configuration
+type fileConfig struct {
+	Directory string `mapstructure:"directory"`
+	// MaxSizeMB is the size which the current file is rotated at
+	MaxSizeMB int `mapstructure:"maxSizeMB"`
+	// MaxFiles is the number of rotated files which are kept, all of them are kept if it is 0
+	MaxFiles int `mapstructure:"maxFiles"`
+}
+
+func (fc fileConfig) validate() error {
+	if fc.Directory == "" {
+		return fmt.Errorf("directory is required")
+	}
+	if fc.MaxSizeMB < 1 {
+		return fmt.Errorf("maxSizeMB must be greater than 0")
+	}
+	if fc.MaxFiles < 0 {
+		return fmt.Errorf("maxFiles must not be negative")
+	}
+	return nil
+}
+
+// fileSink appends records as JSON lines to audit-<sequence>.jsonl files of directory, a new file is started once
+// the current one exceeds maxSizeMB
+type fileSink struct {
+	fileConfig
+	active *os.File
+	size   int64
+	seq    int
+}
+
+func newFileSink(fc fileConfig) (*fileSink, error) {
+	if err := fc.validate(); err != nil {
+		return nil, err
+	}
+	return &fileSink{fileConfig: fc}, nil
+}
+
+// files returns journal files of directory in order of their sequence
+func (fs *fileSink) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(fs.Directory, filePrefix+"*"+fileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// open continues the latest journal file, files are opened when records are written first
+func (fs *fileSink) open() error {
+	if err := os.MkdirAll(fs.Directory, 0755); err != nil {
+		return err
+	}
+	files, err := fs.files()
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(files[len(files)-1]), filePrefix), fileSuffix)
+		fmt.Sscanf(name, "%d", &fs.seq)
+		fs.seq--
+	}
+	return fs.rotate()
+}
+
+// rotate starts the next journal file and removes the oldest files beyond maxFiles
+func (fs *fileSink) rotate() error {
+	if fs.active != nil {
+		if err := fs.active.Close(); err != nil {
+			return err
+		}
+		fs.active = nil
+	}
+
+	fs.seq++
+	f, err := os.OpenFile(filepath.Join(fs.Directory, fmt.Sprintf("%s%09d%s", filePrefix, fs.seq, fileSuffix)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fs.active, fs.size = f, fi.Size()
+
+	if fs.MaxFiles == 0 {
+		return nil
+	}
+	files, err := fs.files()
+	if err != nil {
+		return err
+	}
+	// The active file is not counted as a rotated file
+	for len(files) > fs.MaxFiles+1 {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (fs *fileSink) write(_ context.Context, records []*Record) error {
+	if fs.active == nil {
+		if err := fs.open(); err != nil {
+			return err
+		}
+	}
+
+	var buf []byte
+	for _, r := range records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, b...), '\n')
+	}
+
+	if fs.size > 0 && fs.size+int64(len(buf)) > int64(fs.MaxSizeMB)<<20 {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.active.Write(buf)
+	fs.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return fs.active.Sync()
+}
+
+func (fs *fileSink) query(ctx context.Context, q Query) ([]*Record, error) {
+	files, err := fs.files()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		matched, err := queryFile(file, q)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, matched...)
+	}
+	return records, nil
+}
+
+func queryFile(file string, q Query) ([]*Record, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		r := &Record{}
+		// A line which is cut by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			continue
+		}
+		if q.matches(r) {
+			records = append(records, r)
+		}
+	}
+	return records, scanner.Err()
+}
+
+func (fs *fileSink) close() error {
+	if fs.active == nil {
+		return nil
+	}
+	err := fs.active.Close()
+	fs.active = nil
+	return err
+}
@@ -0,0 +1,392 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/pkg/metrics"
+)
+
+// log is the logger of audit component
+var log = logging.For(logging.Audit)
+
+// Outcomes of delivery attempts, the outcome of the last attempt of a message to an endpoint is the final one
+const (
+	// Delivered means the endpoint accepted the message
+	Delivered = "delivered"
+	// Retrying means the attempt failed and the message is delivered again at once, e.g. a batch is split
+	Retrying = "retrying"
+	// Spooled means the attempt failed and the message is kept in spool to be re-driven
+	Spooled = "spooled"
+	// Failed means the attempt failed and the message is not delivered again
+	Failed = "failed"
+	// Expired means the message is dropped from spool after maxAge without being delivered
+	Expired = "expired"
+)
+
+const (
+	sinkFile  = "file"
+	sinkKafka = "kafka"
+	sinkSQL   = "sql"
+
+	defaultBufferSize    = 1000
+	maxBatchSize         = 500
+	flushInterval        = time.Second
+	defaultWriteTimeout  = 10 * time.Second
+	defaultRetryInterval = 5 * time.Second
+
+	// counterDropped counts records which are dropped as journal is closed
+	counterDropped = "audit.dropped"
+)
+
+var (
+	once sync.Once
+	// initErr is the error of the first Init, which is returned by later calls
+	initErr  error
+	instance *Journal
+)
+
+// Source is where a message comes from
+type Source struct {
+	// Type is kafka or rabbitmq
+	Type     string `json:"type"`
+	Consumer string `json:"consumer,omitempty"`
+	// Topic, Partition and Offset are coordinates of Kafka messages
+	Topic     string `json:"topic,omitempty"`
+	Partition int    `json:"partition"`
+	Offset    int64  `json:"offset"`
+	// Queue and MessageID identify RabbitMQ messages
+	Queue     string `json:"queue,omitempty"`
+	MessageID string `json:"messageId,omitempty"`
+	Key       string `json:"key,omitempty"`
+}
+
+// Record is an attempt to deliver a message to an endpoint through circuit breaker, retries of retryable registers
+// are part of the attempt. The first attempt of a message is 1, each re-drive of spool is a further attempt.
+type Record struct {
+	Time       time.Time `json:"time"`
+	Source     Source    `json:"source"`
+	Endpoint   string    `json:"endpoint"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode"`
+	LatencyMs  int64     `json:"latencyMs"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Attempt returns the record of an attempt to deliver the message of source to endpoint which started at start and
+// ended with err. Its outcome is delivered if err is nil, otherwise failed until the caller decides what follows.
+func Attempt(source Source, endpoint string, attempt int, start time.Time, err error) *Record {
+	r := &Record{
+		Time:       start,
+		Source:     source,
+		Endpoint:   logpolicy.URL(endpoint),
+		Attempt:    attempt,
+		StatusCode: server.StatusCode(err),
+		LatencyMs:  int64(time.Since(start) / time.Millisecond),
+		Outcome:    Delivered,
+	}
+	if err != nil {
+		r.Outcome = Failed
+		r.Error = logpolicy.Error(err)
+	}
+	return r
+}
+
+// Query selects records of a message by key, message id, or topic, partition and offset
+type Query struct {
+	Topic     string
+	Partition *int
+	Offset    *int64
+	Key       string
+	MessageID string
+	// Limit is the maximum number of the latest records, all records are returned if it is 0
+	Limit int
+}
+
+// Validate checks the query selects a message
+func (q Query) Validate() error {
+	if q.Key == "" && q.MessageID == "" && q.Offset == nil {
+		return fmt.Errorf("audit: query requires a key, a message id, or topic, partition and offset")
+	}
+	if q.Offset != nil && (q.Topic == "" || q.Partition == nil) {
+		return fmt.Errorf("audit: query by offset requires topic and partition")
+	}
+	return nil
+}
+
+func (q Query) matches(r *Record) bool {
+	s := r.Source
+	return (q.Topic == "" || q.Topic == s.Topic) &&
+		(q.Partition == nil || *q.Partition == s.Partition) &&
+		(q.Offset == nil || *q.Offset == s.Offset) &&
+		(q.Key == "" || q.Key == s.Key) &&
+		(q.MessageID == "" || q.MessageID == s.MessageID)
+}
+
+// sortRecords orders records by time and keeps the latest limit of them
+func sortRecords(records []*Record, limit int) []*Record {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records
+}
+
+// auditConfig is audit section of configuration
+type auditConfig struct {
+	// Sink is file, kafka or sql
+	Sink string `mapstructure:"sink"`
+	// BufferSize is the number of records which wait to be written, deliveries wait once it is full
+	BufferSize int             `mapstructure:"bufferSize"`
+	File       fileConfig      `mapstructure:"file"`
+	Kafka      kafkaSinkConfig `mapstructure:"kafka"`
+	SQL        sqlConfig       `mapstructure:"sql"`
+}
+
+// sink stores and looks up records
+type sink interface {
+	write(ctx context.Context, records []*Record) error
+	query(ctx context.Context, q Query) ([]*Record, error)
+	close() error
+}
+
+// Journal writes records to its sink in the background. Records are not dropped while the sink fails, deliveries
+// wait for the journal once its buffer is full until it is closed.
+type Journal struct {
+	sink    sink
+	records chan *Record
+	// quit is closed once journal is closed, records are refused and buffered ones are written
+	quit      chan struct{}
+	closeOnce sync.Once
+	// abort is closed once records cannot be written before Close returns, failed writes are not retried
+	abort   chan struct{}
+	dropped int64
+	// done is closed once records are written, it is nil unless journal is initialised to write
+	done chan struct{}
+}
+
+// GetJournal returns audit journal of hermes, or nil if audit is not configured
+func GetJournal() *Journal {
+	return instance
+}
+
+func loadConfig() (auditConfig, error) {
+	ac := auditConfig{
+		BufferSize: defaultBufferSize,
+		File:       fileConfig{Directory: defaultDirectory, MaxSizeMB: defaultMaxSizeMB},
+		Kafka:      kafkaSinkConfig{Topic: defaultTopic},
+		SQL:        sqlConfig{Table: defaultTable},
+	}
+	err := configs.GetConfigUnmarshalKey("audit", &ac)
+	return ac, err
+}
+
+// ValidateConfig checks audit configuration strictly without connecting the sink
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("audit", auditConfig{})
+	ac, err := loadConfig()
+	if err != nil {
+		return append(ps, configs.Problemf("audit", "%v", err))
+	}
+	if ac.BufferSize < 1 {
+		ps = append(ps, configs.Problemf("audit.bufferSize", "bufferSize must be greater than 0"))
+	}
+
+	switch ac.Sink {
+	case sinkFile:
+		if err := ac.File.validate(); err != nil {
+			ps = append(ps, configs.Problemf("audit.file", "%v", err))
+		}
+	case sinkKafka:
+		if err := ac.Kafka.validate(); err != nil {
+			ps = append(ps, configs.Problemf("audit.kafka", "%v", err))
+		}
+	case sinkSQL:
+		if err := ac.SQL.validate(); err != nil {
+			ps = append(ps, configs.Problemf("audit.sql", "%v", err))
+		}
+	default:
+		ps = append(ps, configs.Problemf("audit.sink", "unknown sink %q, expect %s, %s or %s", ac.Sink, sinkFile, sinkKafka, sinkSQL))
+	}
+	return ps
+}
+
+// Open opens the sink of audit configuration to query records, e.g. by hermes audit command
+func Open() (*Journal, error) {
+	ac, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var s sink
+	switch ac.Sink {
+	case sinkFile:
+		s, err = newFileSink(ac.File)
+	case sinkKafka:
+		s, err = newKafkaSink(ac.Kafka)
+	case sinkSQL:
+		s, err = newSQLSink(ac.SQL)
+	default:
+		err = fmt.Errorf("unknown sink %q", ac.Sink)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Journal{
+		sink:    s,
+		records: make(chan *Record, ac.BufferSize),
+		quit:    make(chan struct{}),
+		abort:   make(chan struct{}),
+	}, nil
+}
+
+// InitJournal opens the sink of audit configuration and starts writing records
+func InitJournal() error {
+	once.Do(func() {
+		j, err := Open()
+		if err != nil {
+			initErr = fmt.Errorf("failed to open audit journal: %v", err)
+			return
+		}
+
+		j.done = make(chan struct{})
+		go j.run()
+		instance = j
+		log.Infof("***** [INIT:AUDIT] ***** Initialise audit journal with %s sink ......", configs.GetConfigStr("audit.sink"))
+	})
+	return initErr
+}
+
+// Record adds r to journal, it waits once the buffer of journal is full until journal is closed. It does nothing if
+// journal or r is nil, so callers need not check whether audit is configured.
+func (j *Journal) Record(r *Record) {
+	if j == nil || r == nil {
+		return
+	}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	select {
+	case <-j.quit:
+		j.drop(r)
+		return
+	default:
+	}
+	select {
+	case j.records <- r:
+	case <-j.quit:
+		j.drop(r)
+	}
+}
+
+// drop counts r which is refused as journal is closed
+func (j *Journal) drop(r *Record) {
+	atomic.AddInt64(&j.dropped, 1)
+	metrics.IncCounter(counterDropped, 1)
+	log.Errorf("***** [AUDIT][FAIL] ***** Journal is closed, drop record of [endpoint::%s] [outcome::%s]", r.Endpoint, r.Outcome)
+}
+
+// Query returns records selected by q in order of time
+func (j *Journal) Query(ctx context.Context, q Query) ([]*Record, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	records, err := j.sink.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return sortRecords(records, q.Limit), nil
+}
+
+func (j *Journal) run() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]*Record, 0, maxBatchSize)
+	for {
+		select {
+		case r := <-j.records:
+			batch = append(batch, r)
+			if len(batch) >= maxBatchSize {
+				batch = j.flush(batch)
+			}
+		case <-ticker.C:
+			batch = j.flush(batch)
+		case <-j.quit:
+			for {
+				select {
+				case r := <-j.records:
+					batch = append(batch, r)
+					if len(batch) >= maxBatchSize {
+						batch = j.flush(batch)
+					}
+				default:
+					j.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes batch until it succeeds or journal is closed, hence deliveries wait for the sink to recover
+func (j *Journal) flush(batch []*Record) []*Record {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultWriteTimeout)
+		err := j.sink.write(ctx, batch)
+		cancel()
+		if err == nil {
+			return batch[:0]
+		}
+
+		log.Errorf("***** [AUDIT][FAIL] ***** Failed to write %d records, retry in %v:: %v", len(batch), defaultRetryInterval, err)
+		select {
+		case <-time.After(defaultRetryInterval):
+		case <-j.abort:
+			log.Errorf("***** [AUDIT][FAIL] ***** Drop %d records as journal is closed", len(batch))
+			return batch[:0]
+		}
+	}
+}
+
+// Close writes buffered records and closes the sink, records which cannot be written before ctx is done are
+// dropped
+func (j *Journal) Close(ctx context.Context) error {
+	closing := false
+	j.closeOnce.Do(func() {
+		closing = true
+		// Closing quit first releases callers of Record which wait for a full buffer
+		close(j.quit)
+	})
+	if !closing {
+		return nil
+	}
+
+	// Journal which is opened to query records only does not write
+	if j.done == nil {
+		return j.sink.close()
+	}
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		close(j.abort)
+		<-j.done
+	}
+	return j.sink.close()
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingSink fails every write, so journal keeps retrying the batch it holds
+type failingSink struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (s *failingSink) write(ctx context.Context, records []*Record) error {
+	return errors.New("sink is down")
+}
+
+func (s *failingSink) query(ctx context.Context, q Query) ([]*Record, error) {
+	return nil, nil
+}
+
+func (s *failingSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestCloseReleasesRecordWaitingForFullBuffer(t *testing.T) {
+	s := &failingSink{}
+	j := &Journal{
+		sink:    s,
+		records: make(chan *Record, 1),
+		quit:    make(chan struct{}),
+		abort:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go j.run()
+
+	// run takes the first record and retries writing it, the second fills the buffer and the third waits
+	recorded := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			j.Record(&Record{Endpoint: "http://localhost:8000/anything"})
+		}
+		close(recorded)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	closed := make(chan error)
+	go func() { closed <- j.Close(ctx) }()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() does not return while Record waits for a full buffer")
+	}
+	select {
+	case <-recorded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Record() does not return after journal is closed")
+	}
+	if !s.closed {
+		t.Error("Close() does not close the sink")
+	}
+
+	j.Record(&Record{Endpoint: "http://localhost:8000/anything"})
+	if j.dropped == 0 {
+		t.Error("Record() after Close does not count the dropped record")
+	}
+	if err := j.Close(context.Background()); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/kafkadialer"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const defaultTopic = "hermes-audit"
+
+// kafkaSinkConfig is audit.kafka configuration, brokers and security of kafka section are used
+type kafkaSinkConfig struct {
+	Topic string `mapstructure:"topic"`
+}
+
+func (kc kafkaSinkConfig) validate() error {
+	if kc.Topic == "" {
+		return fmt.Errorf("topic is required")
+	}
+	if configs.GetConfigStr("kafka.bootstrapservers") == "" {
+		return fmt.Errorf("kafka.bootstrapservers is required by kafka sink")
+	}
+	return nil
+}
+
+// kafkaSink produces records as JSON messages to topic. Records of a message share the key of the message, or its
+// coordinates if it has no key, so they are kept in order in a partition.
+type kafkaSink struct {
+	topic   string
+	brokers []string
+	dialer  *kafka.Dialer
+	writer  *kafka.Writer
+}
+
+func newKafkaSink(kc kafkaSinkConfig) (*kafkaSink, error) {
+	if err := kc.validate(); err != nil {
+		return nil, err
+	}
+	dialer, err := kafkadialer.NewDialer()
+	if err != nil {
+		return nil, err
+	}
+
+	brokers := strings.Split(configs.GetConfigStr("kafka.bootstrapservers"), ",")
+	return &kafkaSink{
+		topic:   kc.Topic,
+		brokers: brokers,
+		dialer:  dialer,
+		writer: kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  brokers,
+			Topic:    kc.Topic,
+			Dialer:   dialer,
+			Balancer: &kafka.Hash{},
+		}),
+	}, nil
+}
+
+// messageKey returns key of the record message
+func messageKey(s Source) string {
+	switch {
+	case s.Key != "":
+		return s.Key
+	case s.MessageID != "":
+		return s.MessageID
+	default:
+		return fmt.Sprintf("%s-%d-%d", s.Topic, s.Partition, s.Offset)
+	}
+}
+
+func (ks *kafkaSink) write(ctx context.Context, records []*Record) error {
+	msgs := make([]kafka.Message, 0, len(records))
+	for _, r := range records {
+		value, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(messageKey(r.Source)), Value: value})
+	}
+	return ks.writer.WriteMessages(ctx, msgs...)
+}
+
+// query reads every partition of topic from the first offset to the high watermark at the time of query
+func (ks *kafkaSink) query(ctx context.Context, q Query) ([]*Record, error) {
+	conn, err := ks.dialer.DialContext(ctx, "tcp", ks.brokers[0])
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := conn.ReadPartitions(ks.topic)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for _, p := range partitions {
+		matched, err := ks.queryPartition(ctx, p, q)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read partition %d of %s: %v", p.ID, ks.topic, err)
+		}
+		records = append(records, matched...)
+	}
+	return records, nil
+}
+
+func (ks *kafkaSink) queryPartition(ctx context.Context, p kafka.Partition, q Query) ([]*Record, error) {
+	conn, err := ks.dialer.DialPartition(ctx, "tcp", "", p)
+	if err != nil {
+		return nil, err
+	}
+	first, last, err := conn.ReadOffsets()
+	conn.Close()
+	if err != nil || first >= last {
+		return nil, err
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   ks.brokers,
+		Dialer:    ks.dialer,
+		Topic:     ks.topic,
+		Partition: p.ID,
+	})
+	defer reader.Close()
+	if err := reader.SetOffset(first); err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r := &Record{}
+		if err := json.Unmarshal(msg.Value, r); err == nil && q.matches(r) {
+			records = append(records, r)
+		}
+		if msg.Offset >= last-1 {
+			return records, nil
+		}
+	}
+}
+
+func (ks *kafkaSink) close() error {
+	return ks.writer.Close()
+}
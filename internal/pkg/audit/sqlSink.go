@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const defaultTable = "hermes_audit"
+
+var (
+	tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+	// dollarDrivers are drivers whose placeholders are $1, $2 ...
+	dollarDrivers = map[string]bool{"postgres": true, "pgx": true, "cloudsqlpostgres": true}
+)
+
+// columns of the audit table in order of values of a record, names avoid reserved words of SQL dialects
+var columns = []string{
+	"recorded_at", "source_type", "consumer", "topic", "partition_id", "message_offset", "queue", "message_id",
+	"message_key", "endpoint", "attempt", "status_code", "latency_ms", "outcome", "error_message",
+}
+
+// sqlConfig is audit.sql configuration. Driver has to be registered by the program which embeds hermes, e.g. by
+// importing github.com/lib/pq for postgres.
+type sqlConfig struct {
+	Driver string `mapstructure:"driver"`
+	DSN    string `mapstructure:"dsn"`
+	Table  string `mapstructure:"table"`
+	// CreateTable creates the table if it does not exist before records are written first
+	CreateTable bool `mapstructure:"createTable"`
+}
+
+func (sc sqlConfig) validate() error {
+	if sc.Driver == "" || sc.DSN == "" {
+		return fmt.Errorf("driver and dsn are required")
+	}
+	registered := false
+	for _, d := range sql.Drivers() {
+		registered = registered || d == sc.Driver
+	}
+	if !registered {
+		return fmt.Errorf("driver %s is not registered, registered drivers are %v", sc.Driver, sql.Drivers())
+	}
+	if !tableName.MatchString(sc.Table) {
+		return fmt.Errorf("invalid table name %q", sc.Table)
+	}
+	return nil
+}
+
+// sqlSink inserts records into a table by database/sql
+type sqlSink struct {
+	sqlConfig
+	db      *sql.DB
+	created sync.Once
+}
+
+func newSQLSink(sc sqlConfig) (*sqlSink, error) {
+	if err := sc.validate(); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(sc.Driver, sc.DSN)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlSink{sqlConfig: sc, db: db}, nil
+}
+
+// placeholder returns the placeholder of the nth argument of a statement, n starts from 1
+func (ss *sqlSink) placeholder(n int) string {
+	if dollarDrivers[ss.Driver] {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+func (ss *sqlSink) createTable(ctx context.Context) error {
+	_, err := ss.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	recorded_at TIMESTAMP NOT NULL,
+	source_type VARCHAR(16) NOT NULL,
+	consumer VARCHAR(255),
+	topic VARCHAR(255),
+	partition_id INTEGER,
+	message_offset BIGINT,
+	queue VARCHAR(255),
+	message_id VARCHAR(255),
+	message_key VARCHAR(1024),
+	endpoint VARCHAR(2048) NOT NULL,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER NOT NULL,
+	latency_ms BIGINT NOT NULL,
+	outcome VARCHAR(16) NOT NULL,
+	error_message TEXT
+)`, ss.Table))
+	return err
+}
+
+func (ss *sqlSink) write(ctx context.Context, records []*Record) error {
+	var err error
+	if ss.CreateTable {
+		ss.created.Do(func() { err = ss.createTable(ctx) })
+		if err != nil {
+			// Creating the table is tried again by the next write
+			ss.created = sync.Once{}
+			return err
+		}
+	}
+
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = ss.placeholder(i + 1)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", ss.Table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, r := range records {
+		s := r.Source
+		if _, err := stmt.ExecContext(ctx, r.Time.UTC(), s.Type, s.Consumer, s.Topic, s.Partition, s.Offset, s.Queue,
+			s.MessageID, s.Key, r.Endpoint, r.Attempt, r.StatusCode, r.LatencyMs, r.Outcome, r.Error); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (ss *sqlSink) query(ctx context.Context, q Query) ([]*Record, error) {
+	var conds []string
+	var args []interface{}
+	where := func(column string, v interface{}) {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf("%s = %s", column, ss.placeholder(len(args))))
+	}
+	if q.Topic != "" {
+		where("topic", q.Topic)
+	}
+	if q.Partition != nil {
+		where("partition_id", *q.Partition)
+	}
+	if q.Offset != nil {
+		where("message_offset", *q.Offset)
+	}
+	if q.Key != "" {
+		where("message_key", q.Key)
+	}
+	if q.MessageID != "" {
+		where("message_id", q.MessageID)
+	}
+
+	rows, err := ss.db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY recorded_at",
+		strings.Join(columns, ", "), ss.Table, strings.Join(conds, " AND ")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []*Record
+	for rows.Next() {
+		r := &Record{}
+		s := &r.Source
+		var consumer, topic, queue, messageID, key, errMsg sql.NullString
+		var partition, offset sql.NullInt64
+		if err := rows.Scan(&r.Time, &s.Type, &consumer, &topic, &partition, &offset, &queue, &messageID, &key,
+			&r.Endpoint, &r.Attempt, &r.StatusCode, &r.LatencyMs, &r.Outcome, &errMsg); err != nil {
+			return nil, err
+		}
+		s.Consumer, s.Topic, s.Queue, s.MessageID, s.Key = consumer.String, topic.String, queue.String, messageID.String, key.String
+		s.Partition, s.Offset = int(partition.Int64), offset.Int64
+		r.Error = errMsg.String
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (ss *sqlSink) close() error {
+	return ss.db.Close()
+}
@@ -1,43 +1,253 @@
 package configs
 
 import (
-	"os"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-var instance *viper.Viper
+var (
+	// mu guards configuration which is swapped by reloading layers
+	mu       sync.RWMutex
+	instance *viper.Viper
+	layers   Layers
+	current  *config
+	// stagedViper and staged are the candidate of WatchConfig while onChange validates it, getters read it instead
+	// of the configuration in force
+	stagedViper *viper.Viper
+	staged      *config
+	// reloadMu serialises reloading by changed files and secrets
+	reloadMu sync.Mutex
+)
+
+// InitConfig loads configs/default.yaml overridden by environment variables
+func InitConfig() error {
+	if err := LoadConfig("", nil); err != nil {
+		return fmt.Errorf("failed to parse system configuration:\n%s", err)
+	}
+	return nil
+}
+
+// LoadConfig reads configuration from file, or configs/default.yaml if file is empty, and overrides it with values
+// keyed by configuration keys(e.g. "kafka.bootstrapservers"). The default configuration file may be absent if
+// values are given.
+func LoadConfig(file string, values map[string]interface{}) error {
+	l := Layers{Values: values}
+	if file != "" {
+		l.Files = []string{file}
+	}
+	return Load(l)
+}
+
+// Load reads and merges layers of configuration, environment variables of configuration keys(e.g. envKey
+// "KAFKA_BOOTSTRAPSERVERS" mapping to configKey "kafka.bootstrapservers") override all layers
+func Load(l Layers) error {
+	c, v, err := l.candidate()
+	if err != nil {
+		return err
+	}
 
-func InitConfig() {
-	// default config
+	mu.Lock()
+	instance, layers, current = v, l, c
+	mu.Unlock()
+	log.Infof("***** [INIT:CONFIG] ***** Initialise system configuration from %s ......", strings.Join(c.files, ", "))
+	return nil
+}
+
+// candidate reads and merges layers into configuration which is not in force yet
+func (l Layers) candidate() (*config, *viper.Viper, error) {
+	c, err := l.build()
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := newViper(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, v, nil
+}
+
+func newViper(c *config) (*viper.Viper, error) {
 	v := viper.New()
-	v.SetConfigType("yaml")
-	v.SetConfigName("default")
-	v.AddConfigPath("./configs")
 	// bind env variable and modify key mapping(e.g. envKey "SYSTEM_PORT" in k8s yaml mapping to configKey "system.port")
 	v.AutomaticEnv()
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	if err := v.MergeConfigMap(c.tree); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
 
-	if err := v.ReadInConfig(); err != nil {
-		log.Fatalf("***** [CONFIG][FAIL] ***** Failed to parse system configuration: \n%s", err)
-		os.Exit(1)
+// get returns viper of the candidate which is being validated, or of the configuration in force
+func get() *viper.Viper {
+	mu.RLock()
+	defer mu.RUnlock()
+	if stagedViper != nil {
+		return stagedViper
+	}
+	return instance
+}
+
+// WatchConfig loads layers again and calls onChange each time a configuration file, a drop-in file or the
+// Kubernetes ConfigMap which is mounted as them changes, or any secret which configuration refers to changes.
+// Secrets are resolved again every secrets.refreshInterval.
+//
+// The changed configuration is built aside as a candidate which onChange validates and applies by reading it with the
+// getters of this package, components read configuration by them only while they are initialised or reloaded. The
+// candidate is put in force only once onChange accepts it, configuration files, settings and secrets which logs are
+// redacted of keep the configuration in force until then.
+//
+// The returned stop ends watching and waits for the reload in progress, it may be called more than once.
+func WatchConfig(onChange func() error) (stop func()) {
+	mu.RLock()
+	l, c := layers, current
+	mu.RUnlock()
+
+	reload := func(reason string) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+
+		log.Infof("***** [CONFIG] ***** %s ......", reason)
+		nc, nv, err := l.candidate()
+		if err != nil {
+			log.Errorf("***** [CONFIG][FAIL] ***** Failed to load changed configuration and keep the current one:: %v", err)
+			return
+		}
+
+		mu.Lock()
+		stagedViper, staged = nv, nc
+		mu.Unlock()
+		err = onChange()
+
+		mu.Lock()
+		if err == nil {
+			instance, current = nv, nc
+		}
+		stagedViper, staged = nil, nil
+		mu.Unlock()
+		if err != nil {
+			log.Errorf("***** [CONFIG][FAIL] ***** Reject changed configuration and keep the current one:: %v", err)
+		}
+	}
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	watchFiles(l, c.files, reload, quit, &wg)
+	if interval := secretRefreshInterval(); len(c.secrets) > 0 && interval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refreshSecrets(interval, reload, quit)
+		}()
 	}
 
-	instance = v
-	log.Infof("***** [INIT:CONFIG] ***** Initialise system configuration ......")
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+		wg.Wait()
+	}
+}
+
+// watchFiles calls reload once a configuration file or a drop-in file changes until quit is closed, wg is done once
+// watching ends
+func watchFiles(l Layers, configFiles []string, reload func(reason string), quit <-chan struct{}, wg *sync.WaitGroup) {
+	dirs := make(map[string]bool)
+	files := make(map[string]bool)
+	for _, f := range configFiles {
+		dirs[filepath.Dir(filepath.Clean(f))] = true
+		files[filepath.Clean(f)] = true
+	}
+	if l.Dir != "" {
+		dirs[filepath.Clean(l.Dir)] = true
+	}
+	if len(dirs) == 0 {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("***** [CONFIG][FAIL] ***** Failed to watch configuration:: %v", err)
+		return
+	}
+	for d := range dirs {
+		if err := watcher.Add(d); err != nil {
+			log.Errorf("***** [CONFIG][FAIL] ***** Failed to watch configuration directory::%s %v", d, err)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer watcher.Close()
+		for {
+			select {
+			case <-quit:
+				return
+			case e, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Clean(e.Name)
+				// Kubernetes swaps the ..data symlink of the mounted ConfigMap instead of writing files
+				if !files[name] && filepath.Base(name) != "..data" && (l.Dir == "" || filepath.Dir(name) != filepath.Clean(l.Dir)) {
+					continue
+				}
+				if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+					continue
+				}
+				reload(fmt.Sprintf("Configuration file %s is changed by %s", e.Name, e.Op))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("***** [CONFIG][FAIL] ***** Failed to watch configuration:: %v", err)
+			}
+		}
+	}()
+}
+
+// refreshSecrets resolves secrets of the current configuration every interval and calls reload once any of them
+// changes, e.g. a rotated Kubernetes secret, until quit is closed
+func refreshSecrets(interval time.Duration, reload func(reason string), quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		mu.RLock()
+		c := current
+		mu.RUnlock()
+
+		changed, err := c.secretsChanged()
+		if err != nil {
+			log.Errorf("***** [CONFIG][FAIL] ***** Failed to refresh secrets and keep the current ones:: %v", err)
+			continue
+		}
+		if changed {
+			reload("Secrets of configuration are changed")
+		}
+	}
 }
 
 // IsConfigSet checks if the key has been set in the configuration
 func IsConfigSet(key string) bool {
-	return instance.IsSet(key)
+	return get().IsSet(key)
 }
 
 // GetConfigStr return string value of configuration
 func GetConfigStr(key string) string {
 	if key != "" {
-		return instance.GetString(key)
+		return get().GetString(key)
 	}
 	return ""
 }
@@ -45,7 +255,7 @@ func GetConfigStr(key string) string {
 // GetConfigBool return boolean value of configuration
 func GetConfigBool(key string) bool {
 	if key != "" {
-		return instance.GetBool(key)
+		return get().GetBool(key)
 	}
 	return false
 }
@@ -53,7 +263,15 @@ func GetConfigBool(key string) bool {
 // GetConfigInt return integer value of configuration
 func GetConfigInt(key string) int {
 	if key != "" {
-		return instance.GetInt(key)
+		return get().GetInt(key)
+	}
+	return 0
+}
+
+// GetConfigDuration return duration value of configuration
+func GetConfigDuration(key string) time.Duration {
+	if key != "" {
+		return get().GetDuration(key)
 	}
 	return 0
 }
@@ -61,7 +279,7 @@ func GetConfigInt(key string) int {
 // GetConfigSlice return slice of string value of configuration
 func GetConfigSlice(key string) []string {
 	if key != "" {
-		return instance.GetStringSlice(key)
+		return get().GetStringSlice(key)
 	}
 	return nil
 }
@@ -69,7 +287,7 @@ func GetConfigSlice(key string) []string {
 // GetConfigMap return map value of configuration
 func GetConfigMap(key string) map[string]interface{} {
 	if key != "" {
-		return instance.GetStringMap(key)
+		return get().GetStringMap(key)
 	}
 	return nil
 }
@@ -77,7 +295,7 @@ func GetConfigMap(key string) map[string]interface{} {
 // GetConfigMapString return map of string value of configuration
 func GetConfigMapString(key string) map[string]string {
 	if key != "" {
-		return instance.GetStringMapString(key)
+		return get().GetStringMapString(key)
 	}
 	return nil
 }
@@ -85,7 +303,25 @@ func GetConfigMapString(key string) map[string]string {
 // GetConfigUnmarshalKey take a single key and unmarshals it into a Struct
 func GetConfigUnmarshalKey(key string, s interface{}) error {
 	if key != "" {
-		return instance.UnmarshalKey(key, s)
+		return get().UnmarshalKey(key, s)
 	}
 	return nil
 }
+
+// GetConfigCredential return string value of configuration, or content of the file configured by "<key>File" so
+// credentials can be mounted from Kubernetes secrets instead of being written in configuration
+func GetConfigCredential(key string) (string, error) {
+	if v := GetConfigStr(key); v != "" {
+		return v, nil
+	}
+
+	file := GetConfigStr(key + "File")
+	if file == "" {
+		return "", nil
+	}
+	v, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %sFile: %v", key, err)
+	}
+	return strings.TrimSpace(string(v)), nil
+}
@@ -0,0 +1,101 @@
+package configs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigKeepsRejectedConfigurationOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "hermes.yaml")
+	write := func(servers string) {
+		t.Helper()
+		if err := ioutil.WriteFile(file, []byte("kafka:\n  bootstrapservers: "+servers+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a:9092")
+	if err := LoadConfig(file, nil); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	seen := make(chan string, 100)
+	stop := WatchConfig(func() error {
+		servers := GetConfigStr("kafka.bootstrapservers")
+		seen <- servers
+		if servers == "b:9092" {
+			// Candidate is read by getters only, settings keep the configuration in force until it is accepted
+			for _, st := range Settings() {
+				if st.Key == "kafka.bootstrapservers" && st.Value != "a:9092" {
+					t.Errorf("setting of bootstrapservers = %v while candidate is validated, want a:9092", st.Value)
+				}
+			}
+			return fmt.Errorf("rejected")
+		}
+		return nil
+	})
+	defer stop()
+
+	// inForce waits until onChange has seen servers and returns servers in force once no reload is in progress
+	inForce := func(servers string) string {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case s := <-seen:
+				if s != servers {
+					continue
+				}
+				reloadMu.Lock()
+				defer reloadMu.Unlock()
+				return GetConfigStr("kafka.bootstrapservers")
+			case <-timeout:
+				t.Fatalf("onChange has not seen %s", servers)
+			}
+		}
+	}
+
+	write("b:9092")
+	if got := inForce("b:9092"); got != "a:9092" {
+		t.Errorf("bootstrapservers = %s after rejection, want a:9092", got)
+	}
+
+	write("c:9092")
+	if got := inForce("c:9092"); got != "c:9092" {
+		t.Errorf("bootstrapservers = %s after acceptance, want c:9092", got)
+	}
+}
+
+func TestWatchConfigStops(t *testing.T) {
+	dir := tempDir(t)
+	secret := writeLayer(t, dir, "password", "secret")
+	file := writeLayer(t, dir, "hermes.yaml", "kafka:\n  bootstrapservers: a:9092\n  password: ${file:"+secret+"}\nsecrets:\n  refreshInterval: 10ms\n")
+	if err := LoadConfig(file, nil); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	changes := make(chan struct{}, 100)
+	stop := WatchConfig(func() error {
+		changes <- struct{}{}
+		return nil
+	})
+	stop()
+	stop()
+
+	writeLayer(t, dir, "hermes.yaml", "kafka:\n  bootstrapservers: b:9092\n")
+	writeLayer(t, dir, "password", "rotated")
+	select {
+	case <-changes:
+		t.Fatalf("onChange is called after stop")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
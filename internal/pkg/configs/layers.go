@@ -0,0 +1,310 @@
+package configs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix is prefix of environment variables which override nested keys of configuration, "__" separates
+	// levels of the key and list items are indexed, e.g.
+	// HERMES__KAFKA__CONSUMERS__NOTIFICATIONSERVICE__HANDLER__ENDPOINTS__0=http://notification/events
+	// Values are parsed as YAML, so a whole section can be given as well, e.g. HERMES__KAFKA='{clients: [...]}'
+	EnvPrefix    = "HERMES__"
+	envSeparator = "__"
+
+	defaultFile = "configs/default.yaml"
+	// SourceValue is source of configuration given by values of Layers
+	SourceValue = "value"
+)
+
+// Layers are sources of configuration, each of them overrides keys of the former ones:
+//  1. Files, the base file first and then overlays
+//  2. the overlay of Environment next to the base file, e.g. configs/default.production.yaml
+//  3. drop-in *.yaml and *.yml files of Dir in order of their names
+//  4. environment variables prefixed by EnvPrefix
+//  5. Values keyed by configuration keys, e.g. "kafka.bootstrapservers"
+//
+// Maps are merged key by key, any other value including lists replaces the former one. References of secrets in
+// string values of the merged configuration are resolved at last, see RegisterSecretResolver.
+type Layers struct {
+	Files       []string
+	Environment string
+	Dir         string
+	Values      map[string]interface{}
+	// Resolvers resolve references of secrets of their schemes before the registered resolvers, without being
+	// registered
+	Resolvers map[string]SecretResolver
+}
+
+// config is the merged tree of configuration and the source of each key of it
+type config struct {
+	tree    map[string]interface{}
+	sources map[string]string
+	files   []string
+	// secrets keeps references of keys whose values are resolved from secrets, e.g. ${file:/path}
+	secrets map[string]string
+	// resolved keeps values which keys of secrets are resolved to, to tell which of them changes on refresh
+	resolved     map[string]string
+	secretValues []string
+	// resolvers are Resolvers of layers
+	resolvers map[string]SecretResolver
+}
+
+// files returns configuration files of layers in order, configs/default.yaml is the base file if Files is empty
+func (l Layers) files() ([]string, error) {
+	files := l.Files
+	if len(files) == 0 {
+		// The default configuration file may be absent if configuration is given by other layers
+		if _, err := os.Stat(defaultFile); err == nil || (l.Dir == "" && len(l.Values) == 0 && len(envOverrides()) == 0) {
+			files = []string{defaultFile}
+		}
+	}
+
+	if l.Environment != "" && len(files) > 0 {
+		base := files[0]
+		ext := filepath.Ext(base)
+		overlay := strings.TrimSuffix(base, ext) + "." + l.Environment + ext
+		if _, err := os.Stat(overlay); err == nil {
+			files = append(files[:len(files):len(files)], overlay)
+		}
+	}
+
+	if l.Dir != "" {
+		matches, err := ioutil.ReadDir(l.Dir)
+		if err != nil {
+			return nil, err
+		}
+		var dropIns []string
+		for _, fi := range matches {
+			if ext := filepath.Ext(fi.Name()); !fi.IsDir() && (ext == ".yaml" || ext == ".yml") {
+				dropIns = append(dropIns, filepath.Join(l.Dir, fi.Name()))
+			}
+		}
+		sort.Strings(dropIns)
+		files = append(files[:len(files):len(files)], dropIns...)
+	}
+	return files, nil
+}
+
+// build reads and merges all layers
+func (l Layers) build() (*config, error) {
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &config{tree: make(map[string]interface{}), sources: make(map[string]string), files: files, resolvers: l.Resolvers}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		layer := make(map[string]interface{})
+		if err := yaml.Unmarshal(b, &layer); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", f, err)
+		}
+		c.merge("", c.tree, layer, "file:"+f)
+	}
+
+	for _, name := range envOverrides() {
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, EnvPrefix)), envSeparator)
+		if err := c.set(path, parseValue(os.Getenv(name)), "env:"+name); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+
+	keys := make([]string, 0, len(l.Values))
+	for k := range l.Values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := c.set(strings.Split(strings.ToLower(k), "."), l.Values[k], SourceValue); err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %v", k, err)
+		}
+	}
+
+	if err := c.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// envOverrides returns names of environment variables prefixed by EnvPrefix in order, so parents are set before
+// their children
+func envOverrides() []string {
+	var names []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(name, EnvPrefix) && len(name) > len(EnvPrefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseValue parses value of environment variable as YAML, e.g. "3" is an integer and "[a, b]" is a list. It is
+// kept as string if it is not valid YAML.
+func parseValue(raw string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(raw), &v); err != nil || v == nil {
+		return raw
+	}
+	return normalize(v)
+}
+
+// merge merges src into dst under path, maps are merged key by key and other values replace the former ones
+func (c *config) merge(path string, dst, src map[string]interface{}, source string) {
+	for k, v := range src {
+		key := strings.ToLower(k)
+		p := joinKey(path, key)
+		if sm, ok := stringMap(v); ok {
+			dm, ok := dst[key].(map[string]interface{})
+			if !ok {
+				c.clearSources(p)
+				dm = make(map[string]interface{})
+				dst[key] = dm
+			}
+			c.sources[p] = source
+			c.merge(p, dm, sm, source)
+			continue
+		}
+		c.replace(p, dst, key, v, source)
+	}
+}
+
+// replace sets value of key of parent dst, which is at path p
+func (c *config) replace(p string, dst map[string]interface{}, key string, v interface{}, source string) {
+	c.clearSources(p)
+	v = normalize(v)
+	dst[key] = v
+	c.markSources(p, v, source)
+}
+
+// set sets value at path of keys, a numeric key of a list sets the item of the index or appends an item if it is
+// the length of the list
+func (c *config) set(path []string, v interface{}, source string) error {
+	if len(path) == 0 || path[0] == "" {
+		return fmt.Errorf("empty key")
+	}
+
+	var node interface{} = c.tree
+	// assign replaces node in its parent, as a list which grows by appending an item is a new slice
+	var assign func(interface{})
+	p := ""
+	for i, key := range path {
+		last := i == len(path)-1
+		switch n := node.(type) {
+		case map[string]interface{}:
+			p = joinKey(p, key)
+			if last {
+				if vm, ok := stringMap(v); ok {
+					if _, ok := n[key].(map[string]interface{}); ok {
+						c.sources[p] = source
+						c.merge(p, n[key].(map[string]interface{}), vm, source)
+						return nil
+					}
+				}
+				c.replace(p, n, key, v, source)
+				return nil
+			}
+			switch n[key].(type) {
+			case map[string]interface{}, []interface{}:
+			default:
+				c.clearSources(p)
+				n[key] = make(map[string]interface{})
+			}
+			c.sources[p] = source
+			node = n[key]
+			parent, k := n, key
+			assign = func(v interface{}) { parent[k] = v }
+		case []interface{}:
+			if !isIndex(key) {
+				return fmt.Errorf("%q of %s is not an index of list", key, p)
+			}
+			idx, _ := strconv.Atoi(key)
+			if idx > len(n) {
+				return fmt.Errorf("index %d of %s is out of range", idx, p)
+			}
+			p = fmt.Sprintf("%s[%d]", p, idx)
+			if idx == len(n) {
+				n = append(n, nil)
+				assign(n)
+			}
+			if last {
+				c.clearSources(p)
+				n[idx] = normalize(v)
+				c.markSources(p, n[idx], source)
+				return nil
+			}
+			if _, ok := n[idx].(map[string]interface{}); !ok {
+				n[idx] = make(map[string]interface{})
+			}
+			c.sources[p] = source
+			node = n[idx]
+			parent, j := n, idx
+			assign = func(v interface{}) { parent[j] = v }
+		default:
+			return fmt.Errorf("%s is not a map or list", p)
+		}
+	}
+	return nil
+}
+
+// isIndex reports whether key is an index of a list, which is not negative
+func isIndex(key string) bool {
+	idx, err := strconv.Atoi(key)
+	return err == nil && idx >= 0
+}
+
+// clearSources removes sources of p and keys under it
+func (c *config) clearSources(p string) {
+	for k := range c.sources {
+		if k == p || strings.HasPrefix(k, p+".") || strings.HasPrefix(k, p+"[") {
+			delete(c.sources, k)
+		}
+	}
+}
+
+// markSources records source of p and keys under it
+func (c *config) markSources(p string, v interface{}, source string) {
+	c.sources[p] = source
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for k, cv := range n {
+			c.markSources(joinKey(p, k), cv, source)
+		}
+	case []interface{}:
+		for i, cv := range n {
+			c.markSources(fmt.Sprintf("%s[%d]", p, i), cv, source)
+		}
+	}
+}
+
+// normalize converts maps of v into map[string]interface{} with lowercased keys, as viper keeps keys
+func normalize(v interface{}) interface{} {
+	if m, ok := stringMap(v); ok {
+		nm := make(map[string]interface{}, len(m))
+		for k, cv := range m {
+			nm[strings.ToLower(k)] = normalize(cv)
+		}
+		return nm
+	}
+	if l, ok := v.([]interface{}); ok {
+		nl := make([]interface{}, len(l))
+		for i, cv := range l {
+			nl[i] = normalize(cv)
+		}
+		return nl
+	}
+	return v
+}
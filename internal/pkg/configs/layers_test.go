@@ -0,0 +1,161 @@
+package configs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeLayer writes content as file name of dir and returns its path
+func writeLayer(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// lookup returns value of key in tree, e.g. "kafka.clients"
+func lookup(tree map[string]interface{}, key string) interface{} {
+	var node interface{} = tree
+	for _, k := range strings.Split(key, ".") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[k]
+	}
+	return node
+}
+
+func TestLayersPrecedence(t *testing.T) {
+	dir := tempDir(t)
+	base := writeLayer(t, dir, "hermes.yaml", `
+kafka:
+  bootstrapservers: base:9092
+  groupid: base
+  clients: [a, b]
+spool:
+  directory: ./spool
+  maxAge: 1h
+`)
+	writeLayer(t, dir, "hermes.production.yaml", "kafka:\n  groupid: production\n")
+	dropIns := filepath.Join(dir, "conf.d")
+	if err := os.Mkdir(dropIns, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeLayer(t, dropIns, "10-spool.yaml", "spool:\n  directory: /var/spool\n")
+	writeLayer(t, dropIns, "20-clients.yml", "kafka:\n  clients: [c]\n")
+	writeLayer(t, dropIns, "ignored.json", `{"kafka": {"groupid": "ignored"}}`)
+	t.Setenv(EnvPrefix+"SPOOL__MAXAGE", "2h")
+	t.Setenv(EnvPrefix+"KAFKA__BOOTSTRAPSERVERS", "env:9092")
+
+	l := Layers{
+		Files:       []string{base},
+		Environment: "production",
+		Dir:         dropIns,
+		Values:      map[string]interface{}{"kafka.bootstrapservers": "value:9092"},
+	}
+	c, err := l.build()
+	if err != nil {
+		t.Fatalf("build() error = %v", err)
+	}
+
+	tests := []struct {
+		key    string
+		value  interface{}
+		source string
+	}{
+		{key: "kafka.bootstrapservers", value: "value:9092", source: SourceValue},
+		{key: "kafka.groupid", value: "production", source: "file:" + filepath.Join(dir, "hermes.production.yaml")},
+		{key: "kafka.clients", value: []interface{}{"c"}, source: "file:" + filepath.Join(dropIns, "20-clients.yml")},
+		{key: "spool.directory", value: "/var/spool", source: "file:" + filepath.Join(dropIns, "10-spool.yaml")},
+		{key: "spool.maxage", value: "2h", source: "env:" + EnvPrefix + "SPOOL__MAXAGE"},
+	}
+	for _, tt := range tests {
+		if got := lookup(c.tree, tt.key); !reflect.DeepEqual(got, tt.value) {
+			t.Errorf("%s = %#v, want %#v", tt.key, got, tt.value)
+		}
+		if got := c.sources[tt.key]; got != tt.source {
+			t.Errorf("source of %s = %s, want %s", tt.key, got, tt.source)
+		}
+	}
+}
+
+func TestLayersEnvOverrides(t *testing.T) {
+	dir := tempDir(t)
+	base := writeLayer(t, dir, "hermes.yaml", `
+kafka:
+  consumers:
+    notificationservice:
+      concurrency: 1
+      handler:
+        endpoints: [http://a]
+`)
+	const consumer = EnvPrefix + "KAFKA__CONSUMERS__NOTIFICATIONSERVICE__"
+
+	tests := []struct {
+		name  string
+		env   string
+		value string
+		key   string
+		want  interface{}
+		err   string
+	}{
+		{name: "integer", env: consumer + "CONCURRENCY", value: "3", key: "kafka.consumers.notificationservice.concurrency", want: 3},
+		{name: "string which is not YAML", env: consumer + "ORDERING", value: "key: [", key: "kafka.consumers.notificationservice.ordering", want: "key: ["},
+		{
+			name:  "section",
+			env:   consumer + "HANDLER",
+			value: "{batchEndPoints: [{url: http://b}]}",
+			key:   "kafka.consumers.notificationservice.handler",
+			want: map[string]interface{}{
+				"endpoints":      []interface{}{"http://a"},
+				"batchendpoints": []interface{}{map[string]interface{}{"url": "http://b"}},
+			},
+		},
+		{name: "list item", env: consumer + "HANDLER__ENDPOINTS__0", value: "http://b", key: "kafka.consumers.notificationservice.handler.endpoints", want: []interface{}{"http://b"}},
+		{name: "list append", env: consumer + "HANDLER__ENDPOINTS__1", value: "http://b", key: "kafka.consumers.notificationservice.handler.endpoints", want: []interface{}{"http://a", "http://b"}},
+		{name: "list out of range", env: consumer + "HANDLER__ENDPOINTS__2", value: "http://b", err: "index 2 of kafka.consumers.notificationservice.handler.endpoints is out of range"},
+		{name: "list negative index", env: consumer + "HANDLER__ENDPOINTS__-1", value: "http://b", err: `"-1" of kafka.consumers.notificationservice.handler.endpoints is not an index of list`},
+		{name: "list key which is not numeric", env: consumer + "HANDLER__ENDPOINTS__FIRST", value: "http://b", err: `"first" of kafka.consumers.notificationservice.handler.endpoints is not an index of list`},
+		{name: "key under value", env: consumer + "CONCURRENCY__MAX", value: "3", key: "kafka.consumers.notificationservice.concurrency", want: map[string]interface{}{"max": 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+
+			c, err := Layers{Files: []string{base}}.build()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("build() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("build() error = %v", err)
+			}
+			if got := lookup(c.tree, tt.key); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %#v, want %#v", tt.key, got, tt.want)
+			}
+			if got := c.sources[tt.key]; got != "env:"+tt.env {
+				t.Errorf("source of %s = %s, want env:%s", tt.key, got, tt.env)
+			}
+		})
+	}
+}
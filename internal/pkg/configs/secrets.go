@@ -0,0 +1,251 @@
+package configs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSecretRefreshInterval = time.Minute
+	// redacted replaces secrets in logs and printed configuration
+	redacted = "******"
+)
+
+var (
+	// secretRef matches references of secrets in values of configuration, e.g. ${env:RABBITMQ_PASSWORD} or
+	// ${file:/etc/hermes/secrets/password}
+	secretRef = regexp.MustCompile(`\$\{([a-zA-Z][a-zA-Z0-9+.-]*):([^}]*)\}`)
+
+	resolverMu sync.RWMutex
+	resolvers  = map[string]SecretResolver{
+		"env":  SecretResolverFunc(resolveEnv),
+		"file": SecretResolverFunc(resolveFile),
+	}
+)
+
+// SecretResolver resolves references of secrets of a scheme, e.g. a Vault resolver registered as "vault" resolves
+// ${vault:secret/data/hermes#password} by reference "secret/data/hermes#password"
+type SecretResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// SecretResolverFunc is an adapter to use a function as SecretResolver
+type SecretResolverFunc func(ref string) (string, error)
+
+// Resolve calls f(ref)
+func (f SecretResolverFunc) Resolve(ref string) (string, error) {
+	return f(ref)
+}
+
+// RegisterSecretResolver registers resolver of references of scheme, it has to be called before configuration is
+// loaded. Resolvers of env and file are built in and can be replaced.
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolvers[scheme] = resolver
+}
+
+func resolveEnv(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return v, nil
+}
+
+// resolveFile reads the secret from file, e.g. a Kubernetes secret mount, without the trailing newline
+func resolveFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// resolveSecret resolves the reference of scheme by resolvers of layers or registered resolvers
+func (c *config) resolveSecret(scheme, ref string) (string, error) {
+	r, ok := c.resolvers[scheme]
+	if !ok {
+		resolverMu.RLock()
+		r, ok = resolvers[scheme]
+		resolverMu.RUnlock()
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown secret scheme %q", scheme)
+	}
+	return r.Resolve(ref)
+}
+
+// resolveSecrets replaces references of secrets in string values of configuration by the secrets, keys and
+// references of them are kept to print and refresh configuration without revealing secrets
+func (c *config) resolveSecrets() error {
+	c.secrets = make(map[string]string)
+	c.resolved = make(map[string]string)
+	c.secretValues = nil
+	return c.resolveNode("", c.tree, func(v interface{}) {})
+}
+
+func (c *config) resolveNode(path string, v interface{}, set func(interface{})) error {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for k, cv := range n {
+			k := k
+			if err := c.resolveNode(joinKey(path, k), cv, func(nv interface{}) { n[k] = nv }); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, cv := range n {
+			i := i
+			if err := c.resolveNode(fmt.Sprintf("%s[%d]", path, i), cv, func(nv interface{}) { n[i] = nv }); err != nil {
+				return err
+			}
+		}
+	case string:
+		if !secretRef.MatchString(n) {
+			return nil
+		}
+		resolved, secrets, err := c.resolveRefs(path, n)
+		if err != nil {
+			return err
+		}
+		c.secretValues = append(c.secretValues, secrets...)
+		c.secrets[path] = n
+		c.resolved[path] = resolved
+		set(resolved)
+	}
+	return nil
+}
+
+// resolveRefs replaces references of secrets in value of key path, it returns the resolved value and the secrets
+func (c *config) resolveRefs(path, value string) (string, []string, error) {
+	var secrets []string
+	var resolveErr error
+	resolved := secretRef.ReplaceAllStringFunc(value, func(ref string) string {
+		m := secretRef.FindStringSubmatch(ref)
+		secret, err := c.resolveSecret(m[1], m[2])
+		if err != nil && resolveErr == nil {
+			resolveErr = fmt.Errorf("failed to resolve %s of %s: %v", ref, path, err)
+		}
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+		return secret
+	})
+	return resolved, secrets, resolveErr
+}
+
+// secretsChanged resolves references of secrets again and reports whether the value of any key changes, including
+// a secret which is swapped with another one or becomes empty
+func (c *config) secretsChanged() (bool, error) {
+	for path, raw := range c.secrets {
+		resolved, _, err := c.resolveRefs(path, raw)
+		if err != nil {
+			return false, err
+		}
+		if resolved != c.resolved[path] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// secretRefreshInterval returns secrets.refreshInterval, references are not resolved again if it is 0
+func secretRefreshInterval() time.Duration {
+	if !get().IsSet("secrets.refreshInterval") {
+		return defaultSecretRefreshInterval
+	}
+	return get().GetDuration("secrets.refreshInterval")
+}
+
+// ValidateSecrets checks settings of secrets section
+func ValidateSecrets() []Problem {
+	problems := UnknownKeys("secrets", struct {
+		RefreshInterval time.Duration `mapstructure:"refreshInterval"`
+	}{})
+	if secretRefreshInterval() < 0 {
+		problems = append(problems, Problemf("secrets.refreshInterval", "refreshInterval must not be negative"))
+	}
+	return problems
+}
+
+// IsSecret reports whether value of key is resolved from a reference of secret, or the key is named as a
+// credential, e.g. rabbitmq.password
+func IsSecret(key string) bool {
+	mu.RLock()
+	c := current
+	mu.RUnlock()
+
+	key = strings.ToLower(key)
+	if c != nil {
+		if _, ok := c.secrets[key]; ok {
+			return true
+		}
+	}
+	name := key[strings.LastIndex(key, ".")+1:]
+	for _, s := range []string{"password", "token", "secret"} {
+		if strings.Contains(name, s) && !strings.HasSuffix(name, "file") {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactSecrets replaces secrets of configuration in s, longer secrets are replaced first. Secrets of the candidate
+// which is being validated are replaced as well, as its problems may be logged.
+func RedactSecrets(s string) string {
+	var secrets []string
+	mu.RLock()
+	for _, c := range []*config{current, staged} {
+		if c != nil {
+			secrets = append(secrets, c.secretValues...)
+		}
+	}
+	mu.RUnlock()
+	if len(secrets) == 0 {
+		return s
+	}
+
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
+// SecretHook returns the logrus hook which redacts secrets of configuration in messages and string fields of logs
+func SecretHook() log.Hook {
+	return secretHook{}
+}
+
+type secretHook struct{}
+
+func (secretHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire redacts a copy of fields, as fields of an entry may be shared by entries which are logged concurrently
+func (secretHook) Fire(e *log.Entry) error {
+	e.Message = RedactSecrets(e.Message)
+	data := make(log.Fields, len(e.Data))
+	for k, v := range e.Data {
+		switch s := v.(type) {
+		case string:
+			data[k] = RedactSecrets(s)
+		case error:
+			data[k] = RedactSecrets(s.Error())
+		default:
+			data[k] = v
+		}
+	}
+	e.Data = data
+	return nil
+}
@@ -0,0 +1,47 @@
+package configs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSecretsChangedComparesEveryKey(t *testing.T) {
+	defer os.Unsetenv("HERMES_TEST_USER")
+	defer os.Unsetenv("HERMES_TEST_PASSWORD")
+
+	tests := []struct {
+		name         string
+		user, passwd string
+		changed      bool
+	}{
+		{name: "unchanged", user: "alice", passwd: "bob", changed: false},
+		{name: "swapped between keys", user: "bob", passwd: "alice", changed: true},
+		{name: "emptied", user: "alice", passwd: "", changed: true},
+		{name: "rotated", user: "alice", passwd: "carol", changed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("HERMES_TEST_USER", "alice")
+			os.Setenv("HERMES_TEST_PASSWORD", "bob")
+			c := &config{tree: map[string]interface{}{
+				"rabbitmq": map[string]interface{}{
+					"username": "${env:HERMES_TEST_USER}",
+					"password": "${env:HERMES_TEST_PASSWORD}",
+				},
+			}}
+			if err := c.resolveSecrets(); err != nil {
+				t.Fatalf("resolveSecrets() error = %v", err)
+			}
+
+			os.Setenv("HERMES_TEST_USER", tt.user)
+			os.Setenv("HERMES_TEST_PASSWORD", tt.passwd)
+			changed, err := c.secretsChanged()
+			if err != nil {
+				t.Fatalf("secretsChanged() error = %v", err)
+			}
+			if changed != tt.changed {
+				t.Errorf("secretsChanged() = %t, want %t", changed, tt.changed)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package configs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Setting is an effective value of configuration and the layer which it comes from, e.g. "file:configs/default.yaml",
+// "env:HERMES__KAFKA__CLIENTS" or "value". Value of a secret is its reference(e.g. "${file:/path}") or redacted.
+type Setting struct {
+	Key    string
+	Value  interface{}
+	Source string
+	Secret bool
+}
+
+// ConfigFiles returns configuration files which are merged in order, including drop-in files
+func ConfigFiles() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if current == nil {
+		return nil
+	}
+	return append([]string(nil), current.files...)
+}
+
+// Source returns the layer which key, or its closest parent if key is not set, comes from
+func Source(key string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	if current == nil {
+		return ""
+	}
+
+	key = strings.ToLower(key)
+	if name := legacyEnv(key); os.Getenv(name) != "" {
+		return "env:" + name
+	}
+	for key != "" {
+		if s, ok := current.sources[key]; ok {
+			return s
+		}
+		i := strings.LastIndexAny(key, ".[")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return ""
+}
+
+// Settings returns every effective value of configuration with its source in order of keys, items of lists are
+// returned one by one
+func Settings() []Setting {
+	mu.RLock()
+	c := current
+	mu.RUnlock()
+	if c == nil {
+		return nil
+	}
+
+	var settings []Setting
+	collectSettings("", c.tree, &settings)
+	for i, s := range settings {
+		if ref, ok := c.secrets[s.Key]; ok {
+			settings[i].Value, settings[i].Secret = RedactSecrets(ref), true
+		} else if IsSecret(s.Key) {
+			settings[i].Value, settings[i].Secret = redacted, true
+		}
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+func collectSettings(path string, v interface{}, settings *[]Setting) {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for k, cv := range n {
+			collectSettings(joinKey(path, k), cv, settings)
+		}
+	case []interface{}:
+		for i, cv := range n {
+			collectSettings(fmt.Sprintf("%s[%d]", path, i), cv, settings)
+		}
+	default:
+		s := Setting{Key: path, Value: v, Source: Source(path)}
+		// Environment variables of configuration keys override all layers as viper does
+		if name := legacyEnv(path); os.Getenv(name) != "" {
+			s.Value = os.Getenv(name)
+		}
+		*settings = append(*settings, s)
+	}
+}
+
+// legacyEnv returns the environment variable which viper maps to key, e.g. KAFKA_BOOTSTRAPSERVERS
+func legacyEnv(key string) string {
+	if strings.Contains(key, "[") {
+		return ""
+	}
+	return strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
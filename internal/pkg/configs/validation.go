@@ -0,0 +1,231 @@
+package configs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is an invalid setting found by validating configuration, Key is the configuration key of the setting,
+// e.g. "kafka.consumers.notificationService.handler.endPoints[0]"
+type Problem struct {
+	Key     string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Key, p.Message)
+}
+
+// Problemf returns a Problem of key with formatted message
+func Problemf(key, format string, args ...interface{}) Problem {
+	return Problem{Key: key, Message: fmt.Sprintf(format, args...)}
+}
+
+// ProblemsError joins problems into an error, or returns nil if there is no problem
+func ProblemsError(problems []Problem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(problems))
+	for _, p := range problems {
+		msgs = append(msgs, p.String())
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// ValidateURL checks raw is an absolute http or https URL
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http or https URL", raw)
+	}
+	return nil
+}
+
+// ValidateEndpoint checks raw is an endpoint which events can be posted to, an absolute http or https URL, or
+// grpc://host:port or grpcs://host:port of a gRPC service
+func ValidateEndpoint(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "grpc" || u.Scheme == "grpcs" {
+		if u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("%q is not a gRPC endpoint of %s://host:port", raw, u.Scheme)
+		}
+		return nil
+	}
+	return ValidateURL(raw)
+}
+
+// UnknownKeys reports keys under key which match no mapstructure tag of schema. Nested structs, pointers, maps and
+// slices of schema are followed, keys are compared case insensitively as viper does.
+func UnknownKeys(key string, schema interface{}) []Problem {
+	return unknownKeys(key, get().Get(key), reflect.TypeOf(schema))
+}
+
+func unknownKeys(path string, value interface{}, t reflect.Type) []Problem {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var problems []Problem
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := stringMap(value)
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		schemaFields(t, fields)
+		for k, v := range m {
+			ft, ok := fields[strings.ToLower(k)]
+			if !ok {
+				problems = append(problems, Problemf(joinKey(path, k), "unknown key"))
+				continue
+			}
+			problems = append(problems, unknownKeys(joinKey(path, k), v, ft)...)
+		}
+	case reflect.Map:
+		m, _ := stringMap(value)
+		for k, v := range m {
+			problems = append(problems, unknownKeys(joinKey(path, k), v, t.Elem())...)
+		}
+	case reflect.Slice:
+		items, _ := value.([]interface{})
+		for i, item := range items {
+			problems = append(problems, unknownKeys(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	}
+	return problems
+}
+
+// schemaFields collects key and type of exported fields of struct t, fields of embedded structs with squash option
+// are collected as fields of t
+func schemaFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(f.Tag.Get("mapstructure"), ",")
+		if f.Anonymous && len(tag) > 1 && tag[1] == "squash" {
+			schemaFields(f.Type, fields)
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+}
+
+func stringMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		sm := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			sm[fmt.Sprint(k)] = v
+		}
+		return sm, true
+	}
+	return nil, false
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// KeyLines parses the YAML configuration file and returns the line of each key. Keys are lowercased and items of
+// lists are indexed, e.g. "kafka.consumers.notificationservice.handler.endpoints[0]".
+func KeyLines(file string) (map[string]int, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		return nil, err
+	}
+	lines := make(map[string]int)
+	collectLines("", &root, lines)
+	return lines, nil
+}
+
+func collectLines(path string, n *yaml.Node, lines map[string]int) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			collectLines(path, c, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := joinKey(path, strings.ToLower(n.Content[i].Value))
+			lines[key] = n.Content[i].Line
+			collectLines(key, n.Content[i+1], lines)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			key := fmt.Sprintf("%s[%d]", path, i)
+			lines[key] = c.Line
+			collectLines(key, c, lines)
+		}
+	}
+}
+
+// LineOf returns the line of key, or of its closest parent if key is not in the file(e.g. a missing required key),
+// or 0 if neither is found
+func LineOf(lines map[string]int, key string) int {
+	key = strings.ToLower(key)
+	for key != "" {
+		if l, ok := lines[key]; ok {
+			return l
+		}
+		i := strings.LastIndexAny(key, ".[")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return 0
+}
+
+// ConfigFileUsed returns the path of the base configuration file, or empty if there is none
+func ConfigFileUsed() string {
+	if files := ConfigFiles(); len(files) > 0 {
+		return files[0]
+	}
+	return ""
+}
+
+// UnknownSections reports top level keys of configuration which are none of known
+func UnknownSections(known ...string) []Problem {
+	var problems []Problem
+	for k := range get().AllSettings() {
+		found := false
+		for _, s := range known {
+			found = found || strings.EqualFold(k, s)
+		}
+		if !found {
+			problems = append(problems, Problemf(k, "unknown key"))
+		}
+	}
+	return problems
+}
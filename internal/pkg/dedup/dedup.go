@@ -0,0 +1,250 @@
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/pkg/metrics"
+)
+
+// log is the logger of dedup component
+var log = logging.For(logging.Dedup)
+
+const (
+	storeMemory = "memory"
+	storeDisk   = "disk"
+
+	defaultTTL        = time.Hour
+	defaultMaxEntries = 100000
+	defaultDirectory  = "./dedup"
+
+	// Gauges of metrics, hits is the number of deliveries which are skipped since hermes starts
+	gaugeHits    = "dedup.hits"
+	gaugeEntries = "dedup.entries"
+)
+
+var (
+	once sync.Once
+	// initErr is the error of the first Init, which is returned by later calls
+	initErr  error
+	instance *Dedup
+)
+
+// dedupConfig is dedup section of configuration
+type dedupConfig struct {
+	// Key is the key expression of handlers without their own dedupKey
+	Key string `mapstructure:"key"`
+	// TTL is how long a delivered message is remembered for an endpoint
+	TTL time.Duration `mapstructure:"ttl"`
+	// Store is memory or disk, disk keeps delivered messages in Directory across restarts
+	Store      string `mapstructure:"store"`
+	MaxEntries int    `mapstructure:"maxEntries"`
+	Directory  string `mapstructure:"directory"`
+}
+
+// Dedup remembers messages which are delivered to endpoints within TTL, so a message which is consumed again, e.g.
+// after a rebalance of Kafka consumer group, is not posted to an endpoint twice
+type Dedup struct {
+	dedupConfig
+	mu    sync.Mutex
+	store store
+	hits  int64
+	// pending keeps reserved deliveries which are neither marked nor released, their channels are closed then
+	pending map[string]chan struct{}
+}
+
+// enabled reports whether dedup section is configured
+func enabled() bool {
+	return configs.IsConfigSet("dedup")
+}
+
+// configuredExpr returns dedup.key of configuration or the default key expression
+func configuredExpr() string {
+	if expr := configs.GetConfigStr("dedup.key"); expr != "" {
+		return expr
+	}
+	return defaultExpr
+}
+
+func loadConfig() (dedupConfig, error) {
+	dc := dedupConfig{
+		Key:        defaultExpr,
+		TTL:        defaultTTL,
+		Store:      storeMemory,
+		MaxEntries: defaultMaxEntries,
+		Directory:  defaultDirectory,
+	}
+	err := configs.GetConfigUnmarshalKey("dedup", &dc)
+	return dc, err
+}
+
+// ValidateConfig checks dedup configuration strictly without opening the store
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("dedup", dedupConfig{})
+	dc, err := loadConfig()
+	if err != nil {
+		return append(ps, configs.Problemf("dedup", "%v", err))
+	}
+	if _, err := ParseKey(dc.Key); err != nil {
+		ps = append(ps, configs.Problemf("dedup.key", "%v", err))
+	}
+	if dc.TTL <= 0 {
+		ps = append(ps, configs.Problemf("dedup.ttl", "ttl must be greater than 0"))
+	}
+	if dc.MaxEntries < 1 {
+		ps = append(ps, configs.Problemf("dedup.maxEntries", "maxEntries must be greater than 0"))
+	}
+	switch dc.Store {
+	case storeMemory:
+	case storeDisk:
+		if dc.Directory == "" {
+			ps = append(ps, configs.Problemf("dedup.directory", "directory is required by disk store"))
+		}
+	default:
+		ps = append(ps, configs.Problemf("dedup.store", "unknown store %q, expect %s or %s", dc.Store, storeMemory, storeDisk))
+	}
+	return ps
+}
+
+// InitDedup opens the store of dedup configuration
+func InitDedup() error {
+	once.Do(func() {
+		dc, err := loadConfig()
+		if err != nil {
+			initErr = fmt.Errorf("failed to init dedup configuration: %v", err)
+			return
+		}
+
+		d, err := open(dc)
+		if err != nil {
+			initErr = fmt.Errorf("failed to open dedup store: %v", err)
+			return
+		}
+
+		instance = d
+		log.Infof("***** [INIT:DEDUP] ***** Initialise %s dedup store with %d entries and ttl %v ......", dc.Store, d.store.len(), dc.TTL)
+	})
+	return initErr
+}
+
+func open(dc dedupConfig) (*Dedup, error) {
+	d := &Dedup{dedupConfig: dc, pending: make(map[string]chan struct{})}
+	switch dc.Store {
+	case storeMemory:
+		d.store = newLRUStore(dc.MaxEntries)
+	case storeDisk:
+		s, err := openDiskStore(dc.Directory, dc.MaxEntries)
+		if err != nil {
+			return nil, err
+		}
+		d.store = s
+	default:
+		return nil, fmt.Errorf("unknown store %q", dc.Store)
+	}
+	d.publish()
+	return d, nil
+}
+
+// GetDedup returns dedup of hermes, or nil if dedup is not configured
+func GetDedup() *Dedup {
+	return instance
+}
+
+// pair returns the id of message id and endpoint in store, they are hashed so the store keeps neither message
+// content nor credentials of endpoints
+func pair(endpoint, id string) string {
+	sum := sha256.Sum256([]byte(endpoint + "\x00" + id))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Reserve reserves the delivery of the message of id to endpoint, the caller has to MarkDelivered or Release it once
+// the delivery succeeds or fails. It returns false if the message has been delivered to endpoint within TTL. If the
+// delivery is reserved by another caller, e.g. the same message is consumed again after a rebalance of Kafka consumer
+// group, Reserve waits until it is marked or released, and returns the error of ctx if ctx is done before. It
+// returns true if d is nil or id is empty, so messages without id are always delivered.
+func (d *Dedup) Reserve(ctx context.Context, endpoint, id string) (bool, error) {
+	if d == nil || id == "" {
+		return true, nil
+	}
+
+	p := pair(endpoint, id)
+	for {
+		d.mu.Lock()
+		if d.store.seen(p, time.Now()) {
+			d.hits++
+			d.publish()
+			d.mu.Unlock()
+			return false, nil
+		}
+		released, ok := d.pending[p]
+		if !ok {
+			d.pending[p] = make(chan struct{})
+			d.mu.Unlock()
+			return true, nil
+		}
+		d.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// MarkDelivered remembers the message of id is delivered to endpoint for TTL and ends its reservation, it does
+// nothing if d is nil or id is empty
+func (d *Dedup) MarkDelivered(endpoint, id string) {
+	if d == nil || id == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := pair(endpoint, id)
+	if err := d.store.add(p, time.Now().Add(d.TTL)); err != nil {
+		log.Errorf("***** [DEDUP][FAIL] ***** Failed to remember delivery to [url::%s]:: %v", logpolicy.URL(endpoint), err)
+	}
+	d.release(p)
+	d.publish()
+}
+
+// Release ends the reservation of the message of id to endpoint which fails to be delivered, so it can be delivered
+// again, it does nothing if d is nil or id is empty
+func (d *Dedup) Release(endpoint, id string) {
+	if d == nil || id == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.release(pair(endpoint, id))
+}
+
+// release wakes callers waiting for the reservation of p, it is called with mu held
+func (d *Dedup) release(p string) {
+	if released, ok := d.pending[p]; ok {
+		close(released)
+		delete(d.pending, p)
+	}
+}
+
+// publish records hits and entries of dedup into metrics, it is called with mu held
+func (d *Dedup) publish() {
+	metrics.SetGauge(gaugeHits, d.hits)
+	metrics.SetGauge(gaugeEntries, int64(d.store.len()))
+}
+
+// Close closes the store of dedup
+func (d *Dedup) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.store.close()
+}
@@ -0,0 +1,96 @@
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestDedup(t *testing.T, ttl time.Duration) *Dedup {
+	t.Helper()
+	d, err := open(dedupConfig{TTL: ttl, Store: storeMemory, MaxEntries: 10})
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	return d
+}
+
+func TestDedupSkipsDeliveredWithinTTL(t *testing.T) {
+	d := newTestDedup(t, 50*time.Millisecond)
+	ctx := context.Background()
+
+	if reserved, err := d.Reserve(ctx, "http://a", "1"); !reserved || err != nil {
+		t.Fatalf("Reserve() of new message = %v, %v, want true", reserved, err)
+	}
+	d.MarkDelivered("http://a", "1")
+
+	if reserved, _ := d.Reserve(ctx, "http://a", "1"); reserved {
+		t.Errorf("Reserve() of delivered message = true within ttl")
+	}
+	if reserved, _ := d.Reserve(ctx, "http://b", "1"); !reserved {
+		t.Errorf("Reserve() for another endpoint = false")
+	}
+	d.Release("http://b", "1")
+
+	time.Sleep(60 * time.Millisecond)
+	if reserved, _ := d.Reserve(ctx, "http://a", "1"); !reserved {
+		t.Errorf("Reserve() of delivered message = false after ttl")
+	}
+}
+
+func TestDedupReserveWaitsForDeliveryInProgress(t *testing.T) {
+	d := newTestDedup(t, time.Hour)
+	ctx := context.Background()
+
+	if reserved, _ := d.Reserve(ctx, "http://a", "1"); !reserved {
+		t.Fatalf("Reserve() of new message = false")
+	}
+
+	results := make(chan bool)
+	go func() {
+		reserved, _ := d.Reserve(ctx, "http://a", "1")
+		results <- reserved
+	}()
+	select {
+	case <-results:
+		t.Fatalf("Reserve() returns while the delivery is in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Released delivery is reserved by the waiting caller, which is skipped once it is marked
+	d.Release("http://a", "1")
+	if reserved := <-results; !reserved {
+		t.Fatalf("Reserve() = false after the delivery in progress is released")
+	}
+	go func() {
+		reserved, _ := d.Reserve(ctx, "http://a", "1")
+		results <- reserved
+	}()
+	d.MarkDelivered("http://a", "1")
+	if reserved := <-results; reserved {
+		t.Errorf("Reserve() = true after the delivery in progress is marked")
+	}
+
+	if reserved, _ := d.Reserve(ctx, "http://b", "1"); !reserved {
+		t.Fatalf("Reserve() for another endpoint = false")
+	}
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if reserved, err := d.Reserve(cctx, "http://b", "1"); reserved || err != context.DeadlineExceeded {
+		t.Errorf("Reserve() = %v, %v while ctx is done, want false, %v", reserved, err, context.DeadlineExceeded)
+	}
+}
+
+func TestNilDedupDeliversEveryMessage(t *testing.T) {
+	var d *Dedup
+	d.MarkDelivered("http://a", "1")
+	if reserved, err := d.Reserve(context.Background(), "http://a", "1"); !reserved || err != nil {
+		t.Errorf("Reserve() of nil dedup = %v, %v, want true", reserved, err)
+	}
+
+	d = newTestDedup(t, time.Hour)
+	d.MarkDelivered("http://a", "")
+	if reserved, _ := d.Reserve(context.Background(), "http://a", ""); !reserved {
+		t.Errorf("Reserve() of message without id = false")
+	}
+}
@@ -0,0 +1,123 @@
+package dedup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	keyMessage  = "key"
+	prefixHead  = "header:"
+	prefixJSON  = "json:"
+	defaultExpr = keyMessage
+)
+
+// Key is an expression which identifies a message for deduplication:
+//   - key is the Kafka message key, or the message id of RabbitMQ messages
+//   - header:<name> is the value of the header
+//   - json:<path> is the value of the dot separated path of JSON payload, e.g. json:event.id or json:items.0.id
+type Key struct {
+	expr string
+	// header is the header name of header:<name>
+	header string
+	// path is the path of json:<path>
+	path []string
+}
+
+// ParseKey parses the key expression
+func ParseKey(expr string) (*Key, error) {
+	switch {
+	case expr == keyMessage:
+		return &Key{expr: expr}, nil
+	case strings.HasPrefix(expr, prefixHead) && len(expr) > len(prefixHead):
+		return &Key{expr: expr, header: strings.TrimPrefix(expr, prefixHead)}, nil
+	case strings.HasPrefix(expr, prefixJSON) && len(expr) > len(prefixJSON):
+		path := strings.Split(strings.TrimPrefix(expr, prefixJSON), ".")
+		for _, p := range path {
+			if p == "" {
+				return nil, fmt.Errorf("invalid JSON path of dedup key %q", expr)
+			}
+		}
+		return &Key{expr: expr, path: path}, nil
+	default:
+		return nil, fmt.Errorf("invalid dedup key %q, expect %s, %s<name> or %s<path>", expr, keyMessage, prefixHead, prefixJSON)
+	}
+}
+
+// KeyOf returns the key of expr for a handler, or of dedup.key of configuration if expr is empty. It returns nil if
+// dedup is not configured, hence messages of the handler are not deduplicated.
+func KeyOf(expr string) (*Key, error) {
+	if !enabled() {
+		return nil, nil
+	}
+	if expr == "" {
+		expr = configuredExpr()
+	}
+	return ParseKey(expr)
+}
+
+// String returns the expression of k, or "" if k is nil
+func (k *Key) String() string {
+	if k == nil {
+		return ""
+	}
+	return k.expr
+}
+
+// ID returns the value of key of the message, it returns "" if k is nil or the message has no such value, e.g. the
+// payload is not JSON
+func (k *Key) ID(key []byte, headers map[string]string, payload []byte) string {
+	switch {
+	case k == nil:
+		return ""
+	case k.header != "":
+		for name, v := range headers {
+			if strings.EqualFold(name, k.header) {
+				return v
+			}
+		}
+		return ""
+	case k.path != nil:
+		return jsonValue(payload, k.path)
+	default:
+		return string(key)
+	}
+}
+
+// jsonValue returns the value of path of payload, strings are returned without quotes and other values as JSON
+func jsonValue(payload []byte, path []string) string {
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return ""
+	}
+
+	for _, p := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[p]
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+}
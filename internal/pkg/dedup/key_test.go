@@ -0,0 +1,72 @@
+package dedup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{expr: "key"},
+		{expr: "header:X-Event-Id"},
+		{expr: "json:event.id"},
+		{expr: "json:items.0.id"},
+		{expr: "", err: "invalid dedup key"},
+		{expr: "value", err: "invalid dedup key"},
+		{expr: "header:", err: "invalid dedup key"},
+		{expr: "json:", err: "invalid dedup key"},
+		{expr: "json:event..id", err: "invalid JSON path"},
+	}
+
+	for _, tt := range tests {
+		k, err := ParseKey(tt.expr)
+		if tt.err == "" {
+			if err != nil || k.String() != tt.expr {
+				t.Errorf("ParseKey(%q) = %v, %v, want key of the expression", tt.expr, k, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseKey(%q) error = %v, want %s", tt.expr, err, tt.err)
+		}
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	headers := map[string]string{"X-Event-Id": "from-header"}
+	payload := []byte(`{"event": {"id": "from-json", "seq": 42}, "items": [{"id": "first"}, {"id": "second"}]}`)
+
+	tests := []struct {
+		expr    string
+		payload []byte
+		id      string
+	}{
+		{expr: "key", payload: payload, id: "from-key"},
+		{expr: "header:x-event-id", payload: payload, id: "from-header"},
+		{expr: "header:X-Trace-Id", payload: payload, id: ""},
+		{expr: "json:event.id", payload: payload, id: "from-json"},
+		{expr: "json:event.seq", payload: payload, id: "42"},
+		{expr: "json:items.1.id", payload: payload, id: "second"},
+		{expr: "json:items.2.id", payload: payload, id: ""},
+		{expr: "json:event.missing", payload: payload, id: ""},
+		{expr: "json:event.id", payload: []byte(`not json`), id: ""},
+	}
+
+	for _, tt := range tests {
+		k, err := ParseKey(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseKey(%q) error = %v", tt.expr, err)
+		}
+		if id := k.ID([]byte("from-key"), headers, tt.payload); id != tt.id {
+			t.Errorf("ID() of %s = %q, want %q", tt.expr, id, tt.id)
+		}
+	}
+
+	var k *Key
+	if id := k.ID([]byte("from-key"), headers, payload); id != "" {
+		t.Errorf("ID() of nil key = %q, want empty", id)
+	}
+}
@@ -0,0 +1,197 @@
+package dedup
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const journalFile = "dedup.log"
+
+// store keeps delivered message and endpoint pairs until they expire, it is guarded by Dedup
+type store interface {
+	// seen reports whether id is kept and has not expired at now
+	seen(id string, now time.Time) bool
+	// add keeps id until expires
+	add(id string, expires time.Time) error
+	len() int
+	close() error
+}
+
+type lruEntry struct {
+	id      string
+	expires time.Time
+}
+
+// lruStore keeps the latest maxEntries ids in memory, the least recently seen id is evicted once it is full
+type lruStore struct {
+	maxEntries int
+	ids        map[string]*list.Element
+	order      *list.List
+}
+
+func newLRUStore(maxEntries int) *lruStore {
+	return &lruStore{maxEntries: maxEntries, ids: make(map[string]*list.Element), order: list.New()}
+}
+
+func (s *lruStore) seen(id string, now time.Time) bool {
+	el, ok := s.ids[id]
+	if !ok {
+		return false
+	}
+	if !now.Before(el.Value.(*lruEntry).expires) {
+		s.order.Remove(el)
+		delete(s.ids, id)
+		return false
+	}
+	s.order.MoveToFront(el)
+	return true
+}
+
+func (s *lruStore) add(id string, expires time.Time) error {
+	if el, ok := s.ids[id]; ok {
+		el.Value.(*lruEntry).expires = expires
+		s.order.MoveToFront(el)
+		return nil
+	}
+
+	s.ids[id] = s.order.PushFront(&lruEntry{id: id, expires: expires})
+	for s.order.Len() > s.maxEntries {
+		el := s.order.Back()
+		s.order.Remove(el)
+		delete(s.ids, el.Value.(*lruEntry).id)
+	}
+	return nil
+}
+
+func (s *lruStore) len() int {
+	return s.order.Len()
+}
+
+func (s *lruStore) close() error {
+	return nil
+}
+
+// journalLine is a line of the journal of diskStore
+type journalLine struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// diskStore keeps ids in an lruStore and appends them to dedup.log of directory, so they survive restarts. Ids which
+// have not expired are loaded on open and the journal is compacted once it has twice as many lines as maxEntries.
+// The journal is not synced on every add, the latest ids may be lost by a crash of the host.
+type diskStore struct {
+	*lruStore
+	path  string
+	f     *os.File
+	lines int
+}
+
+func openDiskStore(directory string, maxEntries int) (*diskStore, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &diskStore{lruStore: newLRUStore(maxEntries), path: filepath.Join(directory, journalFile)}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, s.compact()
+}
+
+// load reads ids of the journal which have not expired, a line which is cut by a crash is skipped
+func (s *diskStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var l journalLine
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil || !now.Before(l.Expires) {
+			continue
+		}
+		s.lruStore.add(l.ID, l.Expires)
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with ids in memory and continues appending to it
+func (s *diskStore) compact() error {
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	// Oldest ids are written first, so they are evicted first once the journal is loaded again
+	for el := s.order.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*lruEntry)
+		if err := enc.Encode(journalLine{ID: e.id, Expires: e.expires}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	s.lines = s.order.Len()
+	return nil
+}
+
+func (s *diskStore) add(id string, expires time.Time) error {
+	s.lruStore.add(id, expires)
+	b, err := json.Marshal(journalLine{ID: id, Expires: expires})
+	if err != nil {
+		return err
+	}
+	// Lines are written without buffering, so they reach the file even if hermes is killed
+	if _, err := s.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	s.lines++
+	if s.lines > 2*s.maxEntries {
+		return s.compact()
+	}
+	return nil
+}
+
+func (s *diskStore) closeFile() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func (s *diskStore) close() error {
+	return s.closeFile()
+}
@@ -0,0 +1,132 @@
+package dedup
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// journalLines returns number of lines of the journal of directory
+func journalLines(t *testing.T, directory string) int {
+	t.Helper()
+	f, err := os.Open(filepath.Join(directory, journalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestLRUStoreExpires(t *testing.T) {
+	now := time.Now()
+	s := newLRUStore(10)
+	s.add("a", now.Add(time.Minute))
+
+	if !s.seen("a", now) {
+		t.Errorf("seen(a) = false before it expires")
+	}
+	if s.seen("a", now.Add(time.Minute)) {
+		t.Errorf("seen(a) = true after it expires")
+	}
+	if s.len() != 0 {
+		t.Errorf("len() = %d after the expired id is seen, want 0", s.len())
+	}
+}
+
+func TestLRUStoreEvictsLeastRecentlySeen(t *testing.T) {
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	s := newLRUStore(2)
+	s.add("a", expires)
+	s.add("b", expires)
+	// a is seen, so b is the least recently seen id
+	s.seen("a", now)
+	s.add("c", expires)
+
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := s.seen(id, now); got != want {
+			t.Errorf("seen(%s) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestDiskStoreReloads(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	s, err := openDiskStore(dir, 10)
+	if err != nil {
+		t.Fatalf("openDiskStore() error = %v", err)
+	}
+	s.add("kept", now.Add(time.Hour))
+	s.add("expired", now.Add(-time.Second))
+	if err := s.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	s, err = openDiskStore(dir, 10)
+	if err != nil {
+		t.Fatalf("openDiskStore() again error = %v", err)
+	}
+	defer s.close()
+	if !s.seen("kept", now) {
+		t.Errorf("seen(kept) = false after the store is opened again")
+	}
+	if s.seen("expired", now.Add(-time.Minute)) {
+		t.Errorf("seen(expired) = true, expired ids must not be loaded")
+	}
+	if lines := journalLines(t, dir); lines != 1 {
+		t.Errorf("journal has %d lines after it is compacted on open, want 1", lines)
+	}
+}
+
+func TestDiskStoreCompacts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	s, err := openDiskStore(dir, 2)
+	if err != nil {
+		t.Fatalf("openDiskStore() error = %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := s.add(fmt.Sprintf("id-%d", i), now.Add(time.Hour)); err != nil {
+			t.Fatalf("add() error = %v", err)
+		}
+	}
+	if lines := journalLines(t, dir); lines != 2 {
+		t.Errorf("journal has %d lines after it exceeds twice of maxEntries, want 2", lines)
+	}
+	s.close()
+
+	s, err = openDiskStore(dir, 2)
+	if err != nil {
+		t.Fatalf("openDiskStore() again error = %v", err)
+	}
+	defer s.close()
+	for id, want := range map[string]bool{"id-3": false, "id-4": true, "id-5": true} {
+		if got := s.seen(id, now); got != want {
+			t.Errorf("seen(%s) = %v after compaction, want %v", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package kafkadialer
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/tlsconfig"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	defaultDialTimeout = 10 * time.Second
+	mechanismPlain     = "PLAIN"
+	mechanismSHA256    = "SCRAM-SHA-256"
+	mechanismSHA512    = "SCRAM-SHA-512"
+)
+
+// SecuritySchema lists settings of kafka.security, which is used to find unknown keys of configuration
+type SecuritySchema struct {
+	TLS  tlsconfig.Schema `mapstructure:"tls"`
+	SASL struct {
+		Mechanism    string `mapstructure:"mechanism"`
+		Username     string `mapstructure:"username"`
+		UsernameFile string `mapstructure:"usernameFile"`
+		Password     string `mapstructure:"password"`
+		PasswordFile string `mapstructure:"passwordFile"`
+	} `mapstructure:"sasl"`
+}
+
+// NewDialer returns kafka.Dialer with TLS and SASL configuration under kafka.security, which is shared by readers
+// and writers of hermes. Each value is read separately so it can be overridden by environment variables, e.g.
+// KAFKA_SECURITY_SASL_PASSWORD, and credentials can be read from files(e.g. mounted Kubernetes secrets) instead.
+func NewDialer() (*kafka.Dialer, error) {
+	dialer := &kafka.Dialer{
+		Timeout:   defaultDialTimeout,
+		DualStack: true,
+	}
+
+	if configs.GetConfigBool("kafka.security.tls.enabled") {
+		tlsConfig, err := tlsconfig.NewTLSConfig("kafka.security.tls")
+		if err != nil {
+			return nil, err
+		}
+		dialer.TLS = tlsConfig
+	}
+
+	if configs.GetConfigStr("kafka.security.sasl.mechanism") != "" {
+		mechanism, err := newSASLMechanism()
+		if err != nil {
+			return nil, err
+		}
+		dialer.SASLMechanism = mechanism
+	}
+
+	return dialer, nil
+}
+
+// NewClient returns kafka.Client which sends requests to brokers with TLS and SASL configuration of dialer, e.g.
+// fetching committed offsets of consumer groups
+func NewClient(brokers []string, dialer *kafka.Dialer) *kafka.Client {
+	return &kafka.Client{
+		Addr: kafka.TCP(brokers...),
+		Transport: &kafka.Transport{
+			DialTimeout: dialer.Timeout,
+			ClientID:    dialer.ClientID,
+			TLS:         dialer.TLS,
+			SASL:        dialer.SASLMechanism,
+		},
+	}
+}
+
+func newSASLMechanism() (sasl.Mechanism, error) {
+	username, err := configs.GetConfigCredential("kafka.security.sasl.username")
+	if err != nil {
+		return nil, err
+	}
+	password, err := configs.GetConfigCredential("kafka.security.sasl.password")
+	if err != nil {
+		return nil, err
+	}
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("kafka: SASL requires username and password")
+	}
+
+	switch mechanism := strings.ToUpper(configs.GetConfigStr("kafka.security.sasl.mechanism")); mechanism {
+	case mechanismPlain:
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case mechanismSHA256:
+		return scram.Mechanism(scram.SHA256, username, password)
+	case mechanismSHA512:
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("kafka: unknown SASL mechanism %q, expect %s, %s or %s", mechanism, mechanismPlain, mechanismSHA256, mechanismSHA512)
+	}
+}
@@ -0,0 +1,206 @@
+package kafkadialer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/tlsconfig/tlstest"
+
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+func loadConfig(t *testing.T, values map[string]interface{}) {
+	t.Helper()
+	if err := configs.LoadConfig("", values); err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+}
+
+func TestNewDialerWithoutSecurity(t *testing.T) {
+	loadConfig(t, map[string]interface{}{"kafka.bootstrapservers": "localhost:9092"})
+
+	d, err := NewDialer()
+	if err != nil {
+		t.Fatalf("NewDialer() error = %v", err)
+	}
+	if d.TLS != nil || d.SASLMechanism != nil {
+		t.Errorf("NewDialer() TLS = %v, SASLMechanism = %v, want neither", d.TLS, d.SASLMechanism)
+	}
+	if d.Timeout != defaultDialTimeout {
+		t.Errorf("NewDialer() Timeout = %v, want %v", d.Timeout, defaultDialTimeout)
+	}
+}
+
+func TestNewDialerSASLMechanism(t *testing.T) {
+	passwordFile := filepath.Join(tempDir(t), "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		sasl      map[string]interface{}
+		mechanism string
+		err       string
+	}{
+		{
+			name:      "plain",
+			sasl:      map[string]interface{}{"mechanism": "PLAIN", "username": "hermes", "password": "secret"},
+			mechanism: "PLAIN",
+		},
+		{
+			name:      "scram sha256 in lower case",
+			sasl:      map[string]interface{}{"mechanism": "scram-sha-256", "username": "hermes", "password": "secret"},
+			mechanism: "SCRAM-SHA-256",
+		},
+		{
+			name:      "scram sha512 with password file",
+			sasl:      map[string]interface{}{"mechanism": "SCRAM-SHA-512", "username": "hermes", "passwordFile": passwordFile},
+			mechanism: "SCRAM-SHA-512",
+		},
+		{
+			name: "unknown mechanism",
+			sasl: map[string]interface{}{"mechanism": "GSSAPI", "username": "hermes", "password": "secret"},
+			err:  `unknown SASL mechanism "GSSAPI"`,
+		},
+		{
+			name: "missing password",
+			sasl: map[string]interface{}{"mechanism": "PLAIN", "username": "hermes"},
+			err:  "requires username and password",
+		},
+		{
+			name: "unreadable password file",
+			sasl: map[string]interface{}{"mechanism": "PLAIN", "username": "hermes", "passwordFile": passwordFile + ".missing"},
+			err:  "failed to read kafka.security.sasl.passwordFile",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, map[string]interface{}{"kafka.security.sasl": tt.sasl})
+
+			d, err := NewDialer()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("NewDialer() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewDialer() error = %v", err)
+			}
+			if d.SASLMechanism == nil || d.SASLMechanism.Name() != tt.mechanism {
+				t.Fatalf("NewDialer() SASLMechanism = %v, want %s", d.SASLMechanism, tt.mechanism)
+			}
+			if d.TLS != nil {
+				t.Errorf("NewDialer() TLS = %v, want nil", d.TLS)
+			}
+		})
+	}
+}
+
+func TestNewDialerPlainCredentials(t *testing.T) {
+	loadConfig(t, map[string]interface{}{
+		"kafka.security.sasl": map[string]interface{}{"mechanism": "PLAIN", "username": "hermes", "password": "secret"},
+	})
+
+	d, err := NewDialer()
+	if err != nil {
+		t.Fatalf("NewDialer() error = %v", err)
+	}
+	want := plain.Mechanism{Username: "hermes", Password: "secret"}
+	if got, ok := d.SASLMechanism.(plain.Mechanism); !ok || got != want {
+		t.Errorf("NewDialer() SASLMechanism = %#v, want %#v", d.SASLMechanism, want)
+	}
+}
+
+func TestNewDialerTLS(t *testing.T) {
+	certFile, keyFile := tlstest.WriteCertificate(t, "kafka.internal")
+
+	tests := []struct {
+		name  string
+		tls   map[string]interface{}
+		check func(t *testing.T, d tlsResult)
+		err   string
+	}{
+		{
+			name: "disabled",
+			tls:  map[string]interface{}{"enabled": false, "caFile": certFile},
+			check: func(t *testing.T, d tlsResult) {
+				if d.enabled {
+					t.Errorf("TLS is enabled, want disabled")
+				}
+			},
+		},
+		{
+			name: "server verification",
+			tls:  map[string]interface{}{"enabled": true, "caFile": certFile, "serverName": "kafka.internal"},
+			check: func(t *testing.T, d tlsResult) {
+				if !d.enabled || !d.rootCAs || d.serverName != "kafka.internal" || d.insecure || d.certificates != 0 {
+					t.Errorf("TLS = %+v, want root CAs and server name", d)
+				}
+			},
+		},
+		{
+			name: "client certificate",
+			tls:  map[string]interface{}{"enabled": true, "certFile": certFile, "keyFile": keyFile, "insecureSkipVerify": true},
+			check: func(t *testing.T, d tlsResult) {
+				if !d.enabled || d.rootCAs || !d.insecure || d.certificates != 1 {
+					t.Errorf("TLS = %+v, want a client certificate without verification", d)
+				}
+			},
+		},
+		{
+			name: "certificate without key",
+			tls:  map[string]interface{}{"enabled": true, "certFile": certFile},
+			err:  "certFile and keyFile of client certificate must be set together",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, map[string]interface{}{"kafka.security.tls": tt.tls})
+
+			d, err := NewDialer()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("NewDialer() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewDialer() error = %v", err)
+			}
+			r := tlsResult{enabled: d.TLS != nil}
+			if d.TLS != nil {
+				r.rootCAs = d.TLS.RootCAs != nil
+				r.serverName = d.TLS.ServerName
+				r.insecure = d.TLS.InsecureSkipVerify
+				r.certificates = len(d.TLS.Certificates)
+			}
+			tt.check(t, r)
+		})
+	}
+}
+
+// tempDir returns a directory for files of a test, which is removed once the test ends
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kafkadialer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// tlsResult summarises tls.Config of a dialer
+type tlsResult struct {
+	enabled      bool
+	rootCAs      bool
+	serverName   string
+	insecure     bool
+	certificates int
+}
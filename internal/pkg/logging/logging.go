@@ -0,0 +1,426 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Components of hermes, each of them logs by its own logger whose level and format are configured by
+// logging.components.<component>
+const (
+	Hermes   = "hermes"
+	Kafka    = "kafka"
+	RabbitMQ = "rabbitmq"
+	// HTTP logs requests to endpoints and circuit breakers
+	HTTP  = "http"
+	Spool = "spool"
+	Reply = "reply"
+	Admin = "admin"
+	Audit = "audit"
+	Dedup = "dedup"
+	// Schema logs fetching schemas from schema registry
+	Schema = "schema"
+)
+
+// Fields of logs which identify the message in delivery
+const (
+	FieldComponent = "component"
+	FieldConsumer  = "consumer"
+	FieldTopic     = "topic"
+	FieldQueue     = "queue"
+	FieldMessageID = "message_id"
+	FieldPartition = "partition"
+	FieldOffset    = "offset"
+	FieldEndpoint  = "endpoint"
+	FieldAttempt   = "attempt"
+	FieldTraceID   = "trace_id"
+)
+
+const (
+	// FormatText logs lines of key=value pairs
+	FormatText = "text"
+	// FormatJSON logs a JSON object per line
+	FormatJSON = "json"
+
+	defaultLevel       = "debug"
+	timestampFormat    = "2006-01-02 15:04:05.000"
+	legacyLogstashHost = "connection.logstash.host"
+)
+
+var (
+	components = []string{Hermes, Kafka, RabbitMQ, HTTP, Spool, Reply, Admin, Audit, Dedup, Schema}
+
+	mu sync.RWMutex
+	// loggers are built from configuration by Init, components log by the standard logger before that
+	loggers map[string]*log.Logger
+	sinks   []*sink
+	// injected are loggers given by SetLogger, the logger of "" is used by every component without its own one
+	injected = make(map[string]*log.Logger)
+	// levelOverride is the level given by command line, which overrides levels of configuration
+	levelOverride string
+)
+
+// Fields are fields of logs
+type Fields = log.Fields
+
+// loggingConfig is logging section of configuration
+type loggingConfig struct {
+	Level      string                     `mapstructure:"level"`
+	Format     string                     `mapstructure:"format"`
+	Sinks      []sinkConfig               `mapstructure:"sinks"`
+	Components map[string]componentConfig `mapstructure:"components"`
+	// Redaction is checked by logpolicy
+	Redaction interface{} `mapstructure:"redaction"`
+}
+
+// componentConfig overrides level and format of logging for a component
+type componentConfig struct {
+	Level  string `mapstructure:"level"`
+	Format string `mapstructure:"format"`
+}
+
+// Logger logs by the logger of a component, which follows reloaded configuration and injected loggers
+type Logger struct {
+	component string
+}
+
+// For returns Logger of component, logs of it have component field
+func For(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// Entry returns an entry of the current logger of component
+func (l *Logger) Entry() *log.Entry {
+	return log.NewEntry(current(l.component)).WithField(FieldComponent, l.component)
+}
+
+// WithContext returns an entry with fields carried by ctx, see NewContext
+func (l *Logger) WithContext(ctx context.Context) *log.Entry {
+	return l.Entry().WithFields(FromContext(ctx))
+}
+
+// WithField returns an entry with field key
+func (l *Logger) WithField(key string, value interface{}) *log.Entry {
+	return l.Entry().WithField(key, value)
+}
+
+// WithFields returns an entry with fields
+func (l *Logger) WithFields(fields log.Fields) *log.Entry {
+	return l.Entry().WithFields(fields)
+}
+
+func (l *Logger) Debug(args ...interface{}) { l.Entry().Debug(args...) }
+
+func (l *Logger) Debugf(format string, args ...interface{}) { l.Entry().Debugf(format, args...) }
+
+func (l *Logger) Info(args ...interface{}) { l.Entry().Info(args...) }
+
+func (l *Logger) Infof(format string, args ...interface{}) { l.Entry().Infof(format, args...) }
+
+func (l *Logger) Warn(args ...interface{}) { l.Entry().Warn(args...) }
+
+func (l *Logger) Warnf(format string, args ...interface{}) { l.Entry().Warnf(format, args...) }
+
+func (l *Logger) Error(args ...interface{}) { l.Entry().Error(args...) }
+
+func (l *Logger) Errorf(format string, args ...interface{}) { l.Entry().Errorf(format, args...) }
+
+func (l *Logger) Fatal(args ...interface{}) { l.Entry().Fatal(args...) }
+
+func (l *Logger) Fatalf(format string, args ...interface{}) { l.Entry().Fatalf(format, args...) }
+
+type fieldsKey struct{}
+
+// NewContext returns a copy of ctx carrying fields in addition to fields of ctx, e.g. consumer, topic, partition
+// and offset of the message in delivery
+func NewContext(ctx context.Context, fields log.Fields) context.Context {
+	merged := make(log.Fields, len(fields))
+	for k, v := range FromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// FromContext returns fields carried by ctx
+func FromContext(ctx context.Context) log.Fields {
+	if ctx == nil {
+		return nil
+	}
+	fields, _ := ctx.Value(fieldsKey{}).(log.Fields)
+	return fields
+}
+
+// TraceID returns the trace id of headers of a message, which are traceparent of W3C Trace Context, B3,
+// uber-trace-id of Jaeger or x-trace-id
+func TraceID(headers map[string]string) string {
+	for k, v := range headers {
+		switch strings.ToLower(k) {
+		case "traceparent":
+			// version-traceid-parentid-flags
+			if parts := strings.Split(v, "-"); len(parts) == 4 {
+				return parts[1]
+			}
+		case "x-b3-traceid", "x-trace-id", "trace-id":
+			return v
+		case "uber-trace-id":
+			return strings.Split(v, ":")[0]
+		}
+	}
+	return ""
+}
+
+// SetLogger injects logger of component, which is used as it is instead of configuration of the component. The
+// logger of component "" is used by components without their own injected logger. It has to be called before
+// Init.
+func SetLogger(component string, logger *log.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	injected[component] = logger
+}
+
+// Init builds loggers of components from logging section of configuration, level overrides levels of all
+// components if it is not empty. Secrets of configuration are redacted in logs of all loggers.
+func Init(level string) error {
+	if level != "" {
+		if _, err := log.ParseLevel(level); err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	levelOverride = level
+	mu.Unlock()
+
+	apply, err := PrepareReload()
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// PrepareReload builds loggers from logging section of configuration again and returns the function which applies
+// them, sinks are connected or opened when they are written
+func PrepareReload() (func(), error) {
+	lc, err := load()
+	if err != nil {
+		return nil, err
+	}
+	ls, ss, err := build(lc)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		mu.Lock()
+		old := sinks
+		loggers, sinks = ls, ss
+		std := loggers[Hermes]
+		mu.Unlock()
+
+		// Logs of the standard logger, e.g. configuration and third party packages, are logged as hermes component
+		log.SetOutput(std.Out)
+		log.SetFormatter(std.Formatter)
+		log.SetLevel(std.Level)
+		log.StandardLogger().ReplaceHooks(std.Hooks)
+		for _, s := range old {
+			s.close()
+		}
+	}, nil
+}
+
+// Close closes files and connections of sinks when hermes stops, they are opened again if anything is logged
+// afterwards
+func Close() {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, s := range sinks {
+		s.close()
+	}
+}
+
+func current(component string) *log.Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	if l, ok := loggers[component]; ok {
+		return l
+	}
+	if l, ok := loggers[Hermes]; ok {
+		return l
+	}
+	return log.StandardLogger()
+}
+
+func load() (*loggingConfig, error) {
+	lc := &loggingConfig{Level: defaultLevel, Format: FormatText}
+	// Sending logs to connection.logstash.host by UDP is kept as a logstash sink
+	if host := configs.GetConfigStr(legacyLogstashHost); host != "" && !configs.IsConfigSet("logging.sinks") {
+		lc.Level, lc.Format = log.InfoLevel.String(), FormatJSON
+		lc.Sinks = []sinkConfig{{Type: sinkStdout}, {Type: sinkLogstash, Network: "udp", Address: host}}
+	}
+	if err := configs.GetConfigUnmarshalKey("logging", lc); err != nil {
+		return nil, err
+	}
+	if len(lc.Sinks) == 0 {
+		lc.Sinks = []sinkConfig{{Type: sinkStdout}}
+	}
+	return lc, nil
+}
+
+// build creates a logger for each component, every logger writes to sinks by hooks in its own format
+func build(lc *loggingConfig) (map[string]*log.Logger, []*sink, error) {
+	mu.RLock()
+	override := levelOverride
+	inj := make(map[string]*log.Logger, len(injected))
+	for k, v := range injected {
+		inj[k] = v
+	}
+	mu.RUnlock()
+
+	ss := make([]*sink, 0, len(lc.Sinks))
+	for i, sc := range lc.Sinks {
+		s, err := newSink(sc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid logging.sinks[%d]: %v", i, err)
+		}
+		ss = append(ss, s)
+	}
+
+	ls := make(map[string]*log.Logger, len(components))
+	for _, c := range components {
+		cc := componentConfig{Level: lc.Level, Format: lc.Format}
+		if o, ok := lc.Components[c]; ok {
+			if o.Level != "" {
+				cc.Level = o.Level
+			}
+			if o.Format != "" {
+				cc.Format = o.Format
+			}
+		}
+		if override != "" {
+			cc.Level = override
+		}
+
+		level, err := log.ParseLevel(cc.Level)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid level of %s: %v", c, err)
+		}
+		if l := injectedLogger(inj, c); l != nil {
+			ls[c] = wrap(l, override, level)
+			continue
+		}
+
+		formatter, err := newFormatter(cc.Format)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid format of %s: %v", c, err)
+		}
+		l := &log.Logger{
+			// Sinks write entries by hooks, hence nothing is formatted for Out
+			Out:          ioutil.Discard,
+			Formatter:    nopFormatter{},
+			Hooks:        make(log.LevelHooks),
+			Level:        level,
+			ExitFunc:     log.StandardLogger().ExitFunc,
+			ReportCaller: false,
+		}
+		l.AddHook(configs.SecretHook())
+		for _, s := range ss {
+			l.AddHook(s.hook(formatter))
+		}
+		ls[c] = l
+	}
+	return ls, ss, nil
+}
+
+func injectedLogger(inj map[string]*log.Logger, component string) *log.Logger {
+	if l, ok := inj[component]; ok {
+		return l
+	}
+	return inj[""]
+}
+
+// wrap copies the injected logger with the secret hook, so the given logger is left untouched. The secret hook
+// fires before hooks of the logger, which may send entries elsewhere.
+func wrap(l *log.Logger, override string, level log.Level) *log.Logger {
+	hooks := make(log.LevelHooks)
+	hooks.Add(configs.SecretHook())
+	for lv, hs := range l.Hooks {
+		hooks[lv] = append(hooks[lv], hs...)
+	}
+	w := &log.Logger{Out: l.Out, Formatter: l.Formatter, Hooks: hooks, Level: l.Level, ExitFunc: l.ExitFunc}
+	if override != "" {
+		w.Level = level
+	}
+	return w
+}
+
+func newFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case FormatText:
+		return &log.TextFormatter{TimestampFormat: timestampFormat, FullTimestamp: true, DisableColors: true}, nil
+	case FormatJSON:
+		return &log.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, expect %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+// nopFormatter formats nothing for Out of loggers, entries are formatted by sinks
+type nopFormatter struct{}
+
+func (nopFormatter) Format(*log.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// ValidateConfig checks logging section of configuration strictly, except redaction which is checked by logpolicy
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("logging", loggingConfig{})
+	lc, err := load()
+	if err != nil {
+		return append(ps, configs.Problemf("logging", "%v", err))
+	}
+
+	if _, err := log.ParseLevel(lc.Level); err != nil {
+		ps = append(ps, configs.Problemf("logging.level", "%v", err))
+	}
+	if _, err := newFormatter(lc.Format); err != nil {
+		ps = append(ps, configs.Problemf("logging.format", "%v", err))
+	}
+	for i, sc := range lc.Sinks {
+		if err := sc.validate(); err != nil {
+			ps = append(ps, configs.Problemf(fmt.Sprintf("logging.sinks[%d]", i), "%v", err))
+		}
+	}
+	for c, cc := range lc.Components {
+		key := "logging.components." + c
+		if !isComponent(c) {
+			ps = append(ps, configs.Problemf(key, "unknown component, expect one of %s", strings.Join(components, ", ")))
+			continue
+		}
+		if _, err := log.ParseLevel(cc.Level); cc.Level != "" && err != nil {
+			ps = append(ps, configs.Problemf(key+".level", "%v", err))
+		}
+		if _, err := newFormatter(cc.Format); cc.Format != "" && err != nil {
+			ps = append(ps, configs.Problemf(key+".format", "%v", err))
+		}
+	}
+	return ps
+}
+
+func isComponent(name string) bool {
+	for _, c := range components {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
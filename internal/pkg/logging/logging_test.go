@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+)
+
+func loadConfig(t *testing.T, values map[string]interface{}) {
+	t.Helper()
+	if err := configs.LoadConfig("", values); err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "none", headers: map[string]string{"content-type": "application/json"}},
+		{name: "w3c", headers: map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, want: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "malformed w3c", headers: map[string]string{"traceparent": "4bf92f3577b34da6"}},
+		{name: "b3", headers: map[string]string{"X-B3-TraceId": "80f198ee56343ba8"}, want: "80f198ee56343ba8"},
+		{name: "jaeger", headers: map[string]string{"uber-trace-id": "80f198ee56343ba8:e457b5a2e4d86bd1:0:1"}, want: "80f198ee56343ba8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TraceID(tt.headers); got != tt.want {
+				t.Errorf("TraceID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewContextMergesFields(t *testing.T) {
+	ctx := NewContext(context.Background(), Fields{FieldConsumer: "notification", FieldOffset: 1})
+	child := NewContext(ctx, Fields{FieldOffset: 2, FieldEndpoint: "http://localhost"})
+
+	want := Fields{FieldConsumer: "notification", FieldOffset: 2, FieldEndpoint: "http://localhost"}
+	got := FromContext(child)
+	if len(got) != len(want) {
+		t.Fatalf("FromContext() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("FromContext()[%s] = %v, want %v", k, got[k], v)
+		}
+	}
+	if FromContext(ctx)[FieldOffset] != 1 {
+		t.Errorf("NewContext() changes fields of the parent context")
+	}
+}
+
+func TestInitLogsComponentsBySinks(t *testing.T) {
+	dir := tempDir(t)
+	all, warnings := filepath.Join(dir, "all.log"), filepath.Join(dir, "warnings.log")
+	loadConfig(t, map[string]interface{}{
+		"logging.level":  "info",
+		"logging.format": FormatJSON,
+		"logging.sinks": []interface{}{
+			map[string]interface{}{"type": sinkFile, "path": all, "format": FormatText},
+			map[string]interface{}{"type": sinkFile, "path": warnings, "level": "warn"},
+		},
+		"logging.components.kafka.level": "debug",
+	})
+	if err := Init(""); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+
+	For(Kafka).Debugf("kafka debug")
+	For(Spool).Debugf("spool debug")
+	For(Spool).Warnf("spool warning")
+	Close()
+
+	tests := []struct {
+		file    string
+		logged  []string
+		omitted []string
+	}{
+		{file: all, logged: []string{"kafka debug", "spool warning", "component=spool"}, omitted: []string{"spool debug"}},
+		{file: warnings, logged: []string{`"msg":"spool warning"`}, omitted: []string{"kafka debug", "spool debug"}},
+	}
+	for _, tt := range tests {
+		b, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range tt.logged {
+			if !strings.Contains(string(b), s) {
+				t.Errorf("%s does not log %s:\n%s", filepath.Base(tt.file), s, b)
+			}
+		}
+		for _, s := range tt.omitted {
+			if strings.Contains(string(b), s) {
+				t.Errorf("%s logs %s:\n%s", filepath.Base(tt.file), s, b)
+			}
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		keys   []string
+	}{
+		{name: "valid", values: map[string]interface{}{"logging.level": "info"}},
+		{name: "level", values: map[string]interface{}{"logging.level": "loud"}, keys: []string{"logging.level"}},
+		{
+			name:   "sink",
+			values: map[string]interface{}{"logging.sinks": []interface{}{map[string]interface{}{"type": sinkLogstash}}},
+			keys:   []string{"logging.sinks[0]"},
+		},
+		{
+			name:   "unknown component",
+			values: map[string]interface{}{"logging.components.rabbit.level": "info"},
+			keys:   []string{"logging.components.rabbit"},
+		},
+		{
+			name:   "format of component",
+			values: map[string]interface{}{"logging.components.kafka.format": "xml"},
+			keys:   []string{"logging.components.kafka.format"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadConfig(t, tt.values)
+			ps := ValidateConfig()
+			if len(ps) != len(tt.keys) {
+				t.Fatalf("ValidateConfig() = %v, want problems of %v", ps, tt.keys)
+			}
+			for i, p := range ps {
+				if p.Key != tt.keys[i] {
+					t.Errorf("ValidateConfig()[%d] = %s, want problem of %s", i, p, tt.keys[i])
+				}
+			}
+		})
+	}
+}
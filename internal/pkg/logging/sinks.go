@@ -0,0 +1,335 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linushung/hermes/pkg/metrics"
+
+	logrustash "github.com/bshuster-repo/logrus-logstash-hook"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sinkStdout   = "stdout"
+	sinkLogstash = "logstash"
+	sinkFile     = "file"
+
+	defaultMaxSizeMB  = 100
+	defaultMaxBackups = 5
+	dialTimeout       = 3 * time.Second
+	// redialInterval is how long logs are dropped after logstash cannot be connected, so logging does not block
+	// delivery while logstash is down
+	redialInterval = 10 * time.Second
+	// netQueueSize is number of logs which wait to be sent to logstash, later logs are dropped while it is full
+	netQueueSize = 1024
+	// counterDropped counts logs which are dropped as logstash is down or slow
+	counterDropped = "logging.dropped"
+)
+
+// sinkConfig is an item of logging.sinks
+type sinkConfig struct {
+	// Type is stdout, logstash or file
+	Type string `mapstructure:"type"`
+	// Format overrides format of components for stdout and file, logstash is always logged in its JSON format
+	Format string `mapstructure:"format"`
+	// Level is the least severe level which is written to the sink, levels of components apply if it is empty
+	Level string `mapstructure:"level"`
+	// Network is tcp or udp(default) to connect Address of logstash
+	Network string `mapstructure:"network"`
+	Address string `mapstructure:"address"`
+	// Path is the file which is rotated once it exceeds MaxSizeMB, MaxBackups rotated files are kept as
+	// <path>.1, <path>.2 ...
+	Path       string `mapstructure:"path"`
+	MaxSizeMB  int    `mapstructure:"maxSizeMB"`
+	MaxBackups *int   `mapstructure:"maxBackups"`
+}
+
+func (sc sinkConfig) validate() error {
+	if sc.Level != "" {
+		if _, err := log.ParseLevel(sc.Level); err != nil {
+			return err
+		}
+	}
+	if sc.Format != "" {
+		if _, err := newFormatter(sc.Format); err != nil {
+			return err
+		}
+	}
+
+	switch sc.Type {
+	case sinkStdout:
+	case sinkLogstash:
+		if sc.Address == "" {
+			return fmt.Errorf("address of logstash is required")
+		}
+		if sc.Network != "" && sc.Network != "tcp" && sc.Network != "udp" {
+			return fmt.Errorf("unknown network %q, expect tcp or udp", sc.Network)
+		}
+	case sinkFile:
+		if sc.Path == "" {
+			return fmt.Errorf("path of file is required")
+		}
+		if sc.MaxSizeMB < 0 {
+			return fmt.Errorf("maxSizeMB must not be negative")
+		}
+		if sc.MaxBackups != nil && *sc.MaxBackups < 0 {
+			return fmt.Errorf("maxBackups must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown type %q, expect %s, %s or %s", sc.Type, sinkStdout, sinkLogstash, sinkFile)
+	}
+	return nil
+}
+
+// sink writes formatted entries to its writer, which is shared by loggers of all components
+type sink struct {
+	mu        sync.Mutex
+	w         io.Writer
+	formatter log.Formatter
+	levels    []log.Level
+}
+
+func newSink(sc sinkConfig) (*sink, error) {
+	if err := sc.validate(); err != nil {
+		return nil, err
+	}
+
+	s := &sink{levels: log.AllLevels}
+	if sc.Level != "" {
+		level, _ := log.ParseLevel(sc.Level)
+		s.levels = log.AllLevels[:level+1]
+	}
+	if sc.Format != "" {
+		s.formatter, _ = newFormatter(sc.Format)
+	}
+
+	switch sc.Type {
+	case sinkStdout:
+		s.w = os.Stdout
+	case sinkLogstash:
+		network := sc.Network
+		if network == "" {
+			network = "udp"
+		}
+		s.w = &netWriter{network: network, address: sc.Address}
+		s.formatter = &logrustash.LogstashFormatter{Type: "hermes"}
+	case sinkFile:
+		// The file is opened when it is written, but its directory is created now to fail early
+		if err := os.MkdirAll(filepath.Dir(sc.Path), 0755); err != nil {
+			return nil, err
+		}
+		rf := &rotatingFile{path: sc.Path, maxSize: int64(sc.MaxSizeMB) << 20, maxBackups: defaultMaxBackups}
+		if rf.maxSize == 0 {
+			rf.maxSize = defaultMaxSizeMB << 20
+		}
+		if sc.MaxBackups != nil {
+			rf.maxBackups = *sc.MaxBackups
+		}
+		s.w = rf
+	}
+	return s, nil
+}
+
+// hook returns the hook of sink for a logger, entries are formatted by formatter unless the sink has its own one
+func (s *sink) hook(formatter log.Formatter) log.Hook {
+	if s.formatter != nil {
+		formatter = s.formatter
+	}
+	return &sinkHook{sink: s, formatter: formatter}
+}
+
+func (s *sink) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(b)
+	return err
+}
+
+func (s *sink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stdout {
+		c.Close()
+	}
+}
+
+type sinkHook struct {
+	sink      *sink
+	formatter log.Formatter
+}
+
+func (h *sinkHook) Levels() []log.Level {
+	return h.sink.levels
+}
+
+func (h *sinkHook) Fire(e *log.Entry) error {
+	b, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	return h.sink.write(b)
+}
+
+// netWriter queues logs which are sent to logstash in the background, so logging neither dials nor writes under
+// the lock of the sink. Logs are dropped and counted while the queue is full or logstash cannot be connected. It
+// connects again on the next log once sending fails. Write and Close are called under the lock of the sink.
+type netWriter struct {
+	// dropped is accessed atomically
+	dropped int64
+	network string
+	address string
+	queue   chan []byte
+	// sent is closed once logs of queue are sent after it is closed
+	sent chan struct{}
+	// conn and retryAt are used by run only, retryAt is when logstash is connected again after it cannot be
+	// connected
+	conn    net.Conn
+	retryAt time.Time
+}
+
+func (w *netWriter) Write(b []byte) (int, error) {
+	if w.queue == nil {
+		w.queue, w.sent = make(chan []byte, netQueueSize), make(chan struct{})
+		go w.run(w.queue, w.sent)
+	}
+
+	// b is reused by logrus once Write returns
+	select {
+	case w.queue <- append([]byte(nil), b...):
+	default:
+		w.drop()
+	}
+	return len(b), nil
+}
+
+func (w *netWriter) run(queue <-chan []byte, sent chan<- struct{}) {
+	defer close(sent)
+	for b := range queue {
+		if err := w.send(b); err != nil {
+			w.drop()
+			fmt.Fprintf(os.Stderr, "***** [LOGGING][FAIL] ***** Failed to send logs to logstash::%s %v\n", w.address, err)
+		}
+	}
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+func (w *netWriter) send(b []byte) error {
+	if w.conn == nil {
+		if time.Now().Before(w.retryAt) {
+			w.drop()
+			return nil
+		}
+		conn, err := net.DialTimeout(w.network, w.address, dialTimeout)
+		if err != nil {
+			w.retryAt = time.Now().Add(redialInterval)
+			return err
+		}
+		w.conn = conn
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+	if _, err := w.conn.Write(b); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (w *netWriter) drop() {
+	atomic.AddInt64(&w.dropped, 1)
+	metrics.IncCounter(counterDropped, 1)
+}
+
+// Close waits for queued logs to be sent and closes the connection, the next log starts sending again
+func (w *netWriter) Close() error {
+	if w.queue == nil {
+		return nil
+	}
+	close(w.queue)
+	<-w.sent
+	w.queue, w.sent = nil, nil
+	return nil
+}
+
+// rotatingFile appends logs to path, the file is renamed to path.1 once it exceeds maxSize and former rotated
+// files are shifted, files beyond maxBackups are removed
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func (rf *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.Close()
+	if rf.maxBackups == 0 {
+		if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return rf.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
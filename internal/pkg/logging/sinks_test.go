@@ -0,0 +1,195 @@
+package logging
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestSinkConfigValidate(t *testing.T) {
+	negative := -1
+	tests := []struct {
+		name string
+		sc   sinkConfig
+		err  string
+	}{
+		{name: "stdout", sc: sinkConfig{Type: sinkStdout, Format: FormatJSON, Level: "warn"}},
+		{name: "logstash", sc: sinkConfig{Type: sinkLogstash, Network: "tcp", Address: "localhost:5000"}},
+		{name: "file", sc: sinkConfig{Type: sinkFile, Path: "/var/log/hermes.log"}},
+		{name: "unknown type", sc: sinkConfig{Type: "syslog"}, err: `unknown type "syslog"`},
+		{name: "unknown level", sc: sinkConfig{Type: sinkStdout, Level: "loud"}, err: "not a valid logrus Level"},
+		{name: "unknown format", sc: sinkConfig{Type: sinkStdout, Format: "xml"}, err: `unknown format "xml"`},
+		{name: "logstash without address", sc: sinkConfig{Type: sinkLogstash}, err: "address of logstash is required"},
+		{name: "unknown network", sc: sinkConfig{Type: sinkLogstash, Network: "unix", Address: "/tmp/logstash"}, err: `unknown network "unix"`},
+		{name: "file without path", sc: sinkConfig{Type: sinkFile}, err: "path of file is required"},
+		{name: "negative backups", sc: sinkConfig{Type: sinkFile, Path: "hermes.log", MaxBackups: &negative}, err: "maxBackups must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sc.validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("validate() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		// files are contents of path, path.1 ... after writing 4 lines of 4 bytes with maxSize of 8 bytes
+		files []string
+	}{
+		{name: "without backups", maxBackups: 0, files: []string{"ccc\nddd\n"}},
+		{name: "one backup", maxBackups: 1, files: []string{"ccc\nddd\n", "aaa\nbbb\n"}},
+		{name: "more backups than rotations", maxBackups: 3, files: []string{"ccc\nddd\n", "aaa\nbbb\n", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tempDir(t), "logs", "hermes.log")
+			rf := &rotatingFile{path: path, maxSize: 8, maxBackups: tt.maxBackups}
+			for _, line := range []string{"aaa\n", "bbb\n", "ccc\n", "ddd\n"} {
+				if _, err := rf.Write([]byte(line)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			rf.Close()
+
+			for i, want := range tt.files {
+				name := path
+				if i > 0 {
+					name = fmt.Sprintf("%s.%d", path, i)
+				}
+				b, err := ioutil.ReadFile(name)
+				if want == "" {
+					if !os.IsNotExist(err) {
+						t.Errorf("%s exists, want it absent", filepath.Base(name))
+					}
+					continue
+				}
+				if err != nil || string(b) != want {
+					t.Errorf("%s = %q, %v, want %q", filepath.Base(name), b, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNetWriterSendsLogs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	w := &netWriter{network: "tcp", address: ln.Addr().String()}
+	b := []byte("first\n")
+	w.Write(b)
+	// logrus reuses the buffer once Write returns
+	copy(b, "xxxxx\n")
+	w.Write([]byte("second\n"))
+	w.Close()
+
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("logstash receives %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("logstash has not received %s", want)
+		}
+	}
+	if dropped := atomic.LoadInt64(&w.dropped); dropped != 0 {
+		t.Errorf("dropped = %d, want 0", dropped)
+	}
+}
+
+func TestNetWriterDropsLogsWithoutBlocking(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name string
+		// prepare makes logstash unable to take logs
+		prepare func(w *netWriter)
+	}{
+		{name: "logstash is down"},
+		{
+			name: "queue is full",
+			prepare: func(w *netWriter) {
+				// Nothing takes logs from the queue, as if logstash were slow
+				w.queue, w.sent = make(chan []byte), make(chan struct{})
+				close(w.sent)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &netWriter{network: "tcp", address: address}
+			if tt.prepare != nil {
+				tt.prepare(w)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 10; i++ {
+					if n, err := w.Write([]byte("log\n")); n != 4 || err != nil {
+						t.Errorf("Write() = %d, %v, want 4, nil", n, err)
+					}
+				}
+				w.Close()
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Write() blocks while logstash cannot take logs")
+			}
+
+			if dropped := atomic.LoadInt64(&w.dropped); dropped != 10 {
+				t.Errorf("dropped = %d, want 10", dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package logpolicy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+)
+
+const (
+	// BodyNone logs size of payloads only
+	BodyNone = "none"
+	// BodyTruncated logs redacted payloads up to maxBodyBytes
+	BodyTruncated = "truncated"
+	// BodyFull logs redacted payloads entirely
+	BodyFull = "full"
+
+	defaultMaxBodyBytes = 256
+	masked              = "******"
+	// invalidURL is logged instead of a URL which cannot be parsed, as its credentials cannot be told apart
+	invalidURL = "<invalid URL>"
+)
+
+var (
+	mu      sync.RWMutex
+	current = mustCompile(policyConfig{Body: BodyTruncated, MaxBodyBytes: defaultMaxBodyBytes})
+	// urlPattern finds URLs in texts such as errors of net/http, which echo the requested URL
+	urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+	// sensitiveHeader matches names of headers whose values are masked
+	sensitiveHeader = regexp.MustCompile(`(?i)authorization|cookie|token|secret|api-?key`)
+)
+
+// policyConfig is logging.redaction configuration, which decides how payloads and URLs are logged
+type policyConfig struct {
+	// Body is none, truncated or full
+	Body         string `mapstructure:"body"`
+	MaxBodyBytes int    `mapstructure:"maxBodyBytes"`
+	// Fields are paths of JSON fields whose values are masked, e.g. "user.email" or "items.*.phone". "*" matches
+	// any key or item of list.
+	Fields []string `mapstructure:"fields"`
+	// Patterns are regular expressions of names of JSON fields whose values are masked, e.g. "(?i)password|email"
+	Patterns []string `mapstructure:"patterns"`
+	// KeepQueryParams are query parameters of URLs which are logged as they are, values of other parameters and
+	// passwords of URLs are masked
+	KeepQueryParams []string `mapstructure:"keepQueryParams"`
+}
+
+// policy is compiled policyConfig
+type policy struct {
+	policyConfig
+	fields   [][]string
+	patterns []*regexp.Regexp
+	keep     map[string]bool
+}
+
+// Init reads logging.redaction configuration, the default policy logs truncated payloads and masks URLs if it is
+// not configured
+func Init() error {
+	p, err := load()
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	current = p
+	mu.Unlock()
+	return nil
+}
+
+// PrepareReload reads logging.redaction configuration again and returns the function which applies it
+func PrepareReload() (func(), error) {
+	p, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		mu.Lock()
+		current = p
+		mu.Unlock()
+	}, nil
+}
+
+// ValidateConfig checks logging.redaction configuration strictly
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("logging.redaction", policyConfig{})
+	if _, err := load(); err != nil {
+		ps = append(ps, configs.Problemf("logging.redaction", "%v", err))
+	}
+	return ps
+}
+
+func load() (*policy, error) {
+	pc := policyConfig{Body: BodyTruncated, MaxBodyBytes: defaultMaxBodyBytes}
+	if err := configs.GetConfigUnmarshalKey("logging.redaction", &pc); err != nil {
+		return nil, err
+	}
+	return compile(pc)
+}
+
+func compile(pc policyConfig) (*policy, error) {
+	switch pc.Body {
+	case BodyNone, BodyTruncated, BodyFull:
+	default:
+		return nil, fmt.Errorf("unknown body %q, expect %s, %s or %s", pc.Body, BodyNone, BodyTruncated, BodyFull)
+	}
+	if pc.MaxBodyBytes < 1 {
+		return nil, fmt.Errorf("maxBodyBytes must be greater than 0")
+	}
+
+	p := &policy{policyConfig: pc, keep: make(map[string]bool)}
+	for _, f := range pc.Fields {
+		p.fields = append(p.fields, strings.Split(strings.ToLower(f), "."))
+	}
+	for _, pattern := range pc.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+	for _, q := range pc.KeepQueryParams {
+		p.keep[q] = true
+	}
+	return p, nil
+}
+
+func mustCompile(pc policyConfig) *policy {
+	p, err := compile(pc)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func get() *policy {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Body returns the payload to be logged, JSON fields of the policy are masked and it is truncated or omitted by
+// the policy
+func Body(body []byte) string {
+	p := get()
+	if p.Body == BodyNone {
+		return fmt.Sprintf("<%d bytes>", len(body))
+	}
+
+	s := string(p.redactJSON(body))
+	if p.Body == BodyTruncated && len(s) > p.MaxBodyBytes {
+		n := p.MaxBodyBytes
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		return fmt.Sprintf("%s...<%d bytes>", s[:n], len(body))
+	}
+	return s
+}
+
+// URL returns raw with the password of user info and values of query parameters masked, or a placeholder if raw
+// cannot be parsed
+func URL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return invalidURL
+	}
+	return get().maskURL(u)
+}
+
+// Error returns message of err with URLs in it masked, e.g. errors of net/http echo the requested URL
+func Error(err error) string {
+	if err == nil {
+		return ""
+	}
+	return Text(err.Error())
+}
+
+// Text returns s with URLs in it masked
+func Text(s string) string {
+	return urlPattern.ReplaceAllStringFunc(s, URL)
+}
+
+// Headers returns a copy of headers with values of credential headers masked, e.g. Authorization
+func Headers(headers map[string]string) map[string]string {
+	hs := make(map[string]string, len(headers))
+	for k, v := range headers {
+		if sensitiveHeader.MatchString(k) {
+			v = masked
+		}
+		hs[k] = v
+	}
+	return hs
+}
+
+func (p *policy) maskURL(u *url.URL) string {
+	// The password is masked after the URL is built, as url.UserPassword escapes the mask
+	password := false
+	if u.User != nil {
+		_, password = u.User.Password()
+		u.User = url.User(u.User.Username())
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, param := range params {
+		kv := strings.SplitN(param, "=", 2)
+		if k, err := url.QueryUnescape(kv[0]); len(kv) == 2 && (err != nil || !p.keep[k]) {
+			params[i] = kv[0] + "=" + masked
+		}
+	}
+	u.RawQuery = strings.Join(params, "&")
+	if !password {
+		return u.String()
+	}
+	user := u.User.String()
+	return strings.Replace(u.String(), user+"@", user+":"+masked+"@", 1)
+}
+
+// redactJSON masks fields of the policy in body, body is returned as it is if it is not JSON or nothing is masked
+func (p *policy) redactJSON(body []byte) []byte {
+	if len(p.fields) == 0 && len(p.patterns) == 0 {
+		return body
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+	if !p.redact(nil, v) {
+		return body
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+// redact masks fields of v under path in place and reports whether any of them is masked
+func (p *policy) redact(path []string, v interface{}) bool {
+	changed := false
+	switch n := v.(type) {
+	case map[string]interface{}:
+		for k, cv := range n {
+			cp := append(path[:len(path):len(path)], strings.ToLower(k))
+			if p.matches(cp, k) {
+				n[k] = masked
+				changed = true
+				continue
+			}
+			changed = p.redact(cp, cv) || changed
+		}
+	case []interface{}:
+		for _, cv := range n {
+			changed = p.redact(append(path[:len(path):len(path)], "*"), cv) || changed
+		}
+	}
+	return changed
+}
+
+// matches reports whether the field at path, whose name is key, is masked by fields or patterns of the policy
+func (p *policy) matches(path []string, key string) bool {
+	for _, re := range p.patterns {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	for _, f := range p.fields {
+		if len(f) != len(path) {
+			continue
+		}
+		match := true
+		for i := range f {
+			match = match && (f[i] == "*" || f[i] == path[i])
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+package reply
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/kafkadialer"
+	"github.com/linushung/hermes/internal/pkg/logging"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/streadway/amqp"
+)
+
+// log is the logger of reply component
+var log = logging.For(logging.Reply)
+
+const (
+	defaultPublishTimeout = 10 * time.Second
+	// defaultBatchTimeout bounds how long a reply waits for other messages to fill a batch, replies are written one
+	// at a time and would otherwise wait for 1s of kafka-go default
+	defaultBatchTimeout = 10 * time.Millisecond
+)
+
+var (
+	once sync.Once
+	// initErr is the error of the first Init, which is returned by later calls
+	initErr  error
+	instance *Publisher
+	// ErrNoChannel is returned when a reply is published to RabbitMQ before a RabbitMQ channel is available
+	ErrNoChannel = errors.New("reply: RabbitMQ is not connected")
+	// ErrClosed is returned when a reply is published to Kafka after publisher is closed
+	ErrClosed = errors.New("reply: publisher is closed")
+)
+
+// Destination is where responses of an endpoint are published, either a Kafka topic or a RabbitMQ exchange with
+// routing key. An empty exchange is the default exchange of RabbitMQ which routes by queue name.
+type Destination struct {
+	EndPoint   string `mapstructure:"endPoint"`
+	Topic      string `mapstructure:"topic"`
+	Exchange   string `mapstructure:"exchange"`
+	RoutingKey string `mapstructure:"routingKey"`
+}
+
+// Validate checks exactly one of Kafka topic and RabbitMQ exchange/routing key is set
+func (d *Destination) Validate() error {
+	amqpSet := d.Exchange != "" || d.RoutingKey != ""
+	switch {
+	case d.EndPoint == "":
+		return fmt.Errorf("endPoint of reply destination is required")
+	case d.Topic != "" && amqpSet:
+		return fmt.Errorf("reply destination of %s sets both topic and exchange/routingKey", d.EndPoint)
+	case d.Topic == "" && !amqpSet:
+		return fmt.Errorf("reply destination of %s requires topic or exchange/routingKey", d.EndPoint)
+	}
+	return nil
+}
+
+func (d *Destination) String() string {
+	if d.Topic != "" {
+		return "topic::" + d.Topic
+	}
+	return fmt.Sprintf("exchange::%s routingKey::%s", d.Exchange, d.RoutingKey)
+}
+
+// Reply is the outcome of posting a source message to an endpoint
+type Reply struct {
+	CorrelationID string
+	// Key is the key of the Kafka reply message, CorrelationID is used if it is empty
+	Key      []byte
+	EndPoint string
+	// Status is the HTTP status code of the response, or 0 if the endpoint could not be reached
+	Status  int
+	Latency time.Duration
+	Body    []byte
+	Error   string
+	// Source describes where the source message comes from, e.g. topic, partition and offset
+	Source map[string]string
+}
+
+// envelope is the value of a Kafka reply message, which carries the body along with status, latency and correlation
+// of the response. They are set as headers of the message as well, so consumers can route replies without decoding
+// values.
+type envelope struct {
+	CorrelationID string            `json:"correlationId,omitempty"`
+	EndPoint      string            `json:"endPoint"`
+	Status        int               `json:"status"`
+	LatencyMs     int64             `json:"latencyMs"`
+	Error         string            `json:"error,omitempty"`
+	Source        map[string]string `json:"source,omitempty"`
+	Body          json.RawMessage   `json:"body,omitempty"`
+}
+
+// Publisher publishes responses of endpoints to Kafka topics or RabbitMQ exchanges
+type Publisher struct {
+	brokers []string
+	dialer  *kafka.Dialer
+	mu      sync.Mutex
+	writers map[string]*kafka.Writer
+	// closed refuses replies to Kafka once writers are closed
+	closed  bool
+	channel *amqp.Channel
+}
+
+// GetPublisher returns reply publisher of hermes
+func GetPublisher() *Publisher {
+	return instance
+}
+
+// InitPublisher prepares Kafka dialer of reply publisher, writers of topics are created when the first reply is
+// published to them
+func InitPublisher() error {
+	once.Do(func() {
+		dialer, err := kafkadialer.NewDialer()
+		if err != nil {
+			initErr = fmt.Errorf("failed to init security configuration of Kafka: %v", err)
+			return
+		}
+
+		p := &Publisher{dialer: dialer, writers: make(map[string]*kafka.Writer)}
+		if brokers := configs.GetConfigStr("kafka.bootstrapservers"); brokers != "" {
+			p.brokers = strings.Split(brokers, ",")
+		}
+		instance = p
+	})
+	return initErr
+}
+
+// SetChannel sets the RabbitMQ channel which replies to exchanges are published through
+func (p *Publisher) SetChannel(ch *amqp.Channel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.channel = ch
+}
+
+// Publish publishes the reply to destination
+func (p *Publisher) Publish(d *Destination, r *Reply) error {
+	if d.Topic != "" {
+		return p.publishKafka(d.Topic, r)
+	}
+	return p.publishAMQP(d.Exchange, d.RoutingKey, r)
+}
+
+func (p *Publisher) writer(topic string) (*kafka.Writer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if w, ok := p.writers[topic]; ok {
+		return w, nil
+	}
+	if p.closed {
+		return nil, ErrClosed
+	}
+	if len(p.brokers) == 0 {
+		return nil, fmt.Errorf("reply: kafka.bootstrapservers is not configured")
+	}
+
+	w := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:      p.brokers,
+		Topic:        topic,
+		Dialer:       p.dialer,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: defaultBatchTimeout,
+	})
+	p.writers[topic] = w
+	return w, nil
+}
+
+func (p *Publisher) publishKafka(topic string, r *Reply) error {
+	w, err := p.writer(topic)
+	if err != nil {
+		return err
+	}
+
+	key, value, headers, err := kafkaReply(r)
+	if err != nil {
+		return err
+	}
+	return p.write(w, key, value, headers)
+}
+
+// kafkaReply returns key, value and headers of the Kafka message of r, which is keyed by its correlation id unless
+// r has a key
+func kafkaReply(r *Reply) (key, value []byte, headers map[string]string, err error) {
+	value, err = json.Marshal(envelope{
+		CorrelationID: r.CorrelationID,
+		EndPoint:      r.EndPoint,
+		Status:        r.Status,
+		LatencyMs:     r.Latency.Milliseconds(),
+		Error:         r.Error,
+		Source:        r.Source,
+		Body:          jsonBody(r.Body),
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key = r.Key
+	if len(key) == 0 {
+		key = []byte(r.CorrelationID)
+	}
+	headers = map[string]string{
+		"hermes-endpoint":   r.EndPoint,
+		"hermes-status":     strconv.Itoa(r.Status),
+		"hermes-latency-ms": strconv.FormatInt(r.Latency.Milliseconds(), 10),
+	}
+	if r.CorrelationID != "" {
+		headers["hermes-correlation-id"] = r.CorrelationID
+	}
+	if r.Error != "" {
+		headers["hermes-error"] = r.Error
+	}
+	for k, v := range r.Source {
+		headers["hermes-source-"+k] = v
+	}
+	return key, value, headers, nil
+}
+
+// PublishMessage publishes a message of key, value and headers to Kafka topic
+func (p *Publisher) PublishMessage(topic string, key, value []byte, headers map[string]string) error {
+	w, err := p.writer(topic)
+	if err != nil {
+		return err
+	}
+	return p.write(w, key, value, headers)
+}
+
+func (p *Publisher) write(w *kafka.Writer, key, value []byte, headers map[string]string) error {
+	msg := kafka.Message{Key: key, Value: value, Headers: make([]kafka.Header, 0, len(headers))}
+	for k, v := range headers {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+	sort.Slice(msg.Headers, func(i, j int) bool { return msg.Headers[i].Key < msg.Headers[j].Key })
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultPublishTimeout)
+	defer cancel()
+	return w.WriteMessages(ctx, msg)
+}
+
+// Close closes writers of Kafka topics, replies which are being written are flushed before
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	var first error
+	for topic, w := range p.writers {
+		if err := w.Close(); err != nil && first == nil {
+			first = fmt.Errorf("reply: failed to close writer of topic %s: %v", topic, err)
+		}
+		delete(p.writers, topic)
+	}
+	return first
+}
+
+func (p *Publisher) publishAMQP(exchange, routingKey string, r *Reply) error {
+	return p.PublishAMQP(exchange, routingKey, amqpReply(r))
+}
+
+// amqpReply returns the RabbitMQ message of r, which carries its correlation id as the property of AMQP
+func amqpReply(r *Reply) amqp.Publishing {
+	headers := amqp.Table{
+		"hermes-endpoint":   r.EndPoint,
+		"hermes-status":     int32(r.Status),
+		"hermes-latency-ms": r.Latency.Milliseconds(),
+	}
+	if r.Error != "" {
+		headers["hermes-error"] = r.Error
+	}
+	for k, v := range r.Source {
+		headers["hermes-source-"+k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   "application/json",
+		CorrelationId: r.CorrelationID,
+		Timestamp:     time.Now(),
+		Body:          r.Body,
+	}
+}
+
+// PublishAMQP publishes msg to RabbitMQ exchange with routing key
+func (p *Publisher) PublishAMQP(exchange, routingKey string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	ch := p.channel
+	p.mu.Unlock()
+	if ch == nil {
+		return ErrNoChannel
+	}
+	return ch.Publish(exchange, routingKey, false, false, msg)
+}
+
+// jsonBody keeps the response body as it is if it is JSON, otherwise encodes it as a JSON string
+func jsonBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	s, _ := json.Marshal(string(body))
+	return s
+}
@@ -0,0 +1,146 @@
+package reply
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/streadway/amqp"
+)
+
+func TestDestinationValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Destination
+		err  string
+	}{
+		{name: "topic", d: Destination{EndPoint: "http://a", Topic: "replies"}},
+		{name: "exchange", d: Destination{EndPoint: "http://a", Exchange: "replies"}},
+		{name: "default exchange", d: Destination{EndPoint: "http://a", RoutingKey: "replies"}},
+		{name: "without endpoint", d: Destination{Topic: "replies"}, err: "endPoint of reply destination is required"},
+		{name: "both", d: Destination{EndPoint: "http://a", Topic: "replies", RoutingKey: "replies"}, err: "sets both topic and exchange/routingKey"},
+		{name: "neither", d: Destination{EndPoint: "http://a"}, err: "requires topic or exchange/routingKey"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.d.Validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPublishRoutesByDestination(t *testing.T) {
+	tests := []struct {
+		name   string
+		d      Destination
+		closed bool
+		err    string
+	}{
+		{name: "topic", d: Destination{EndPoint: "http://a", Topic: "replies"}, err: "kafka.bootstrapservers is not configured"},
+		{name: "topic after close", d: Destination{EndPoint: "http://a", Topic: "replies"}, closed: true, err: ErrClosed.Error()},
+		{name: "exchange", d: Destination{EndPoint: "http://a", Exchange: "replies"}, err: ErrNoChannel.Error()},
+		{name: "default exchange", d: Destination{EndPoint: "http://a", RoutingKey: "replies"}, err: ErrNoChannel.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without brokers and channel, the error tells whether the reply is routed to Kafka or RabbitMQ
+			p := &Publisher{writers: make(map[string]*kafka.Writer), closed: tt.closed}
+			err := p.Publish(&tt.d, &Reply{CorrelationID: "c-1", EndPoint: tt.d.EndPoint})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Publish() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestKafkaReplyCorrelates(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   Reply
+		key     string
+		body    string
+		headers map[string]string
+	}{
+		{
+			name:  "keyed by correlation id",
+			reply: Reply{CorrelationID: "c-1", EndPoint: "http://a", Status: 200, Latency: 15 * time.Millisecond, Body: []byte(`{"ok":true}`)},
+			key:   "c-1",
+			body:  `{"ok":true}`,
+			headers: map[string]string{
+				"hermes-correlation-id": "c-1", "hermes-endpoint": "http://a", "hermes-status": "200", "hermes-latency-ms": "15",
+			},
+		},
+		{
+			name:  "own key and text body",
+			reply: Reply{CorrelationID: "c-2", Key: []byte("order-1"), EndPoint: "http://a", Status: 200, Body: []byte("accepted")},
+			key:   "order-1",
+			body:  `"accepted"`,
+			headers: map[string]string{
+				"hermes-correlation-id": "c-2", "hermes-endpoint": "http://a", "hermes-status": "200", "hermes-latency-ms": "0",
+			},
+		},
+		{
+			name: "failure without correlation id",
+			reply: Reply{
+				EndPoint: "http://a", Error: "connection refused", Source: map[string]string{"topic": "orders", "offset": "7"},
+			},
+			headers: map[string]string{
+				"hermes-endpoint": "http://a", "hermes-status": "0", "hermes-latency-ms": "0", "hermes-error": "connection refused",
+				"hermes-source-topic": "orders", "hermes-source-offset": "7",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, value, headers, err := kafkaReply(&tt.reply)
+			if err != nil {
+				t.Fatalf("kafkaReply() error = %v", err)
+			}
+			if string(key) != tt.key {
+				t.Errorf("kafkaReply() key = %s, want %s", key, tt.key)
+			}
+			if !reflect.DeepEqual(headers, tt.headers) {
+				t.Errorf("kafkaReply() headers = %v, want %v", headers, tt.headers)
+			}
+
+			var e envelope
+			if err := json.Unmarshal(value, &e); err != nil {
+				t.Fatalf("value %s is not an envelope: %v", value, err)
+			}
+			if e.CorrelationID != tt.reply.CorrelationID || e.Status != tt.reply.Status || e.Error != tt.reply.Error || string(e.Body) != tt.body {
+				t.Errorf("kafkaReply() value = %s, want correlation id %s, status %d, error %q and body %s",
+					value, tt.reply.CorrelationID, tt.reply.Status, tt.reply.Error, tt.body)
+			}
+		})
+	}
+}
+
+func TestAMQPReplyCorrelates(t *testing.T) {
+	r := &Reply{
+		CorrelationID: "c-1", EndPoint: "http://a", Status: 502, Latency: 15 * time.Millisecond, Body: []byte("bad gateway"),
+		Error: "502 Bad Gateway", Source: map[string]string{"queue": "orders"},
+	}
+	msg := amqpReply(r)
+
+	if msg.CorrelationId != "c-1" || string(msg.Body) != "bad gateway" {
+		t.Errorf("amqpReply() correlation id = %s, body = %s, want c-1 and the response body", msg.CorrelationId, msg.Body)
+	}
+	want := amqp.Table{
+		"hermes-endpoint": "http://a", "hermes-status": int32(502), "hermes-latency-ms": int64(15),
+		"hermes-error": "502 Bad Gateway", "hermes-source-queue": "orders",
+	}
+	if !reflect.DeepEqual(msg.Headers, want) {
+		t.Errorf("amqpReply() headers = %v, want %v", msg.Headers, want)
+	}
+}
@@ -0,0 +1,31 @@
+package schemaregistry
+
+import (
+	"fmt"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+// avroDecoder decodes payloads of an Avro schema, unions are decoded to the value of their branch without wrapping
+type avroDecoder struct {
+	codec *goavro.Codec
+}
+
+func newAvroDecoder(schema string) (*avroDecoder, error) {
+	codec, err := goavro.NewCodecForStandardJSONFull(schema)
+	if err != nil {
+		return nil, err
+	}
+	return &avroDecoder{codec: codec}, nil
+}
+
+func (d *avroDecoder) decode(payload []byte) ([]byte, error) {
+	v, rest, err := d.codec.NativeFromBinary(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%d bytes are left after the value", len(rest))
+	}
+	return d.codec.TextualFromNative(nil, v)
+}
@@ -0,0 +1,82 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// protoSchemaName names the schema of a payload among its references, which are named by their import paths
+const protoSchemaName = "hermes/schema.proto"
+
+// protobufDecoder decodes payloads of a Protobuf schema by the JSON mapping of proto3: field names are
+// lowerCamelCase, 64-bit integers are strings, enums are names and bytes are base64
+type protobufDecoder struct {
+	file *desc.FileDescriptor
+}
+
+// newProtobufDecoder parses the schema of sr along with schemas it refers to, well-known types of
+// google/protobuf are imported without references
+func (r *Registry) newProtobufDecoder(ctx context.Context, sr schemaResponse) (*protobufDecoder, error) {
+	files := make(map[string]string)
+	if err := r.references(ctx, sr, files); err != nil {
+		return nil, err
+	}
+	files[protoSchemaName] = sr.Schema
+
+	p := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(files)}
+	fds, err := p.ParseFiles(protoSchemaName)
+	if err != nil {
+		return nil, err
+	}
+	return &protobufDecoder{file: fds[0]}, nil
+}
+
+// decode reads message indexes which follow the schema id in Confluent wire format and decodes the message they
+// refer to, indexes are positions of a top-level message and of its nested messages
+func (d *protobufDecoder) decode(payload []byte) ([]byte, error) {
+	n, pos, err := zigzag(payload, 0)
+	if err != nil {
+		return nil, err
+	}
+	indexes := []int64{0}
+	if n > 0 {
+		indexes = indexes[:0]
+		for i := int64(0); i < n; i++ {
+			var idx int64
+			if idx, pos, err = zigzag(payload, pos); err != nil {
+				return nil, err
+			}
+			indexes = append(indexes, idx)
+		}
+	}
+
+	messages := d.file.GetMessageTypes()
+	var md *desc.MessageDescriptor
+	for _, idx := range indexes {
+		if idx < 0 || int(idx) >= len(messages) {
+			return nil, fmt.Errorf("invalid message index %v", indexes)
+		}
+		md = messages[idx]
+		messages = md.GetNestedMessageTypes()
+	}
+
+	m := dynamic.NewMessage(md)
+	if err := m.Unmarshal(payload[pos:]); err != nil {
+		return nil, err
+	}
+	return m.MarshalJSON()
+}
+
+// zigzag reads a zigzag encoded varint of buf from pos, it returns the value and the position after it
+func zigzag(buf []byte, pos int) (int64, int, error) {
+	v, n := binary.Varint(buf[pos:])
+	if n <= 0 {
+		return 0, pos, fmt.Errorf("invalid message indexes")
+	}
+	return v, pos + n, nil
+}
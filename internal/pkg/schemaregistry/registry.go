@@ -0,0 +1,291 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/internal/pkg/tlsconfig"
+)
+
+// log is the logger of schema component
+var log = logging.For(logging.Schema)
+
+const (
+	// magicByte starts payloads in wire format of Confluent schema registry, it is followed by 4 bytes schema id
+	magicByte  = 0
+	headerSize = 5
+
+	typeAvro     = "AVRO"
+	typeProtobuf = "PROTOBUF"
+	typeJSON     = "JSON"
+
+	defaultTimeout = 5 * time.Second
+	// maxResponseSize limits schema responses of registry
+	maxResponseSize = 4 << 20
+)
+
+var (
+	once sync.Once
+	// initErr is the error of the first Init, which is returned by later calls
+	initErr  error
+	instance *Registry
+)
+
+// registryConfig is schemaRegistry section of configuration
+type registryConfig struct {
+	URL          string           `mapstructure:"url"`
+	Username     string           `mapstructure:"username"`
+	Password     string           `mapstructure:"password"`
+	PasswordFile string           `mapstructure:"passwordFile"`
+	Timeout      time.Duration    `mapstructure:"timeout"`
+	TLS          tlsconfig.Schema `mapstructure:"tls"`
+}
+
+// FetchError is returned by Decode when schema registry cannot be reached or refuses to answer, e.g. by timeout, 5xx
+// or 401 status, the payload may be decoded once registry recovers
+type FetchError struct {
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// IsFetchError reports whether err of Decode is a FetchError, other errors mean the payload cannot be decoded
+func IsFetchError(err error) bool {
+	var fe *FetchError
+	return errors.As(err, &fe)
+}
+
+// decoder converts a payload without wire format header to JSON
+type decoder interface {
+	decode(payload []byte) ([]byte, error)
+}
+
+// Registry fetches schemas of payloads from a Confluent compatible schema registry and converts payloads of Avro,
+// Protobuf and JSON schemas to JSON. Schemas are immutable by id, hence they are cached until hermes stops.
+type Registry struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+
+	mu       sync.RWMutex
+	decoders map[int32]decoder
+}
+
+// schemaResponse is the response of GET /schemas/ids/{id} and GET /subjects/{subject}/versions/{version}
+type schemaResponse struct {
+	Schema     string      `json:"schema"`
+	SchemaType string      `json:"schemaType"`
+	References []reference `json:"references"`
+}
+
+// reference is a schema which a schema imports, name is the import path of Protobuf schemas
+type reference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// ValidateConfig checks schemaRegistry configuration strictly without connecting the registry
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("schemaRegistry", registryConfig{})
+	var rc registryConfig
+	if err := configs.GetConfigUnmarshalKey("schemaRegistry", &rc); err != nil {
+		return append(ps, configs.Problemf("schemaRegistry", "%v", err))
+	}
+	if err := configs.ValidateURL(rc.URL); err != nil {
+		ps = append(ps, configs.Problemf("schemaRegistry.url", "%v", err))
+	}
+	if rc.Timeout < 0 {
+		ps = append(ps, configs.Problemf("schemaRegistry.timeout", "timeout must not be negative"))
+	}
+	if _, err := newRegistry(); err != nil {
+		ps = append(ps, configs.Problemf("schemaRegistry", "%v", err))
+	}
+	return ps
+}
+
+// InitRegistry prepares the client of schema registry of configuration
+func InitRegistry() error {
+	once.Do(func() {
+		r, err := newRegistry()
+		if err != nil {
+			initErr = fmt.Errorf("failed to init schema registry: %v", err)
+			return
+		}
+		instance = r
+		log.Infof("***** [INIT:SCHEMA] ***** Decode payloads by schema registry::%s ......", logpolicy.URL(r.url))
+	})
+	return initErr
+}
+
+func newRegistry() (*Registry, error) {
+	timeout := configs.GetConfigDuration("schemaRegistry.timeout")
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if configs.GetConfigBool("schemaRegistry.tls.enabled") {
+		tlsConfig, err := tlsconfig.NewTLSConfig("schemaRegistry.tls")
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	password, err := configs.GetConfigCredential("schemaRegistry.password")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Registry{
+		url:      strings.TrimSuffix(configs.GetConfigStr("schemaRegistry.url"), "/"),
+		username: configs.GetConfigStr("schemaRegistry.username"),
+		password: password,
+		client:   &http.Client{Timeout: timeout, Transport: transport},
+		decoders: make(map[int32]decoder),
+	}, nil
+}
+
+// GetRegistry returns schema registry of hermes, or nil if schema registry is not configured
+func GetRegistry() *Registry {
+	return instance
+}
+
+// IsWireFormat reports whether payload starts with the header of Confluent wire format, JSON payloads never do
+func IsWireFormat(payload []byte) bool {
+	return len(payload) >= headerSize && payload[0] == magicByte
+}
+
+// Decode converts payload in wire format to JSON by its schema, schemas are fetched from registry once
+func (r *Registry) Decode(ctx context.Context, payload []byte) ([]byte, error) {
+	if !IsWireFormat(payload) {
+		return nil, fmt.Errorf("schema registry: payload is not in wire format")
+	}
+	id := int32(binary.BigEndian.Uint32(payload[1:headerSize]))
+
+	d, err := r.decoder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.decode(payload[headerSize:])
+	if err != nil {
+		return nil, fmt.Errorf("schema registry: failed to decode payload of schema %d: %v", id, err)
+	}
+	return v, nil
+}
+
+// decoder returns the cached decoder of schema id or fetches the schema
+func (r *Registry) decoder(ctx context.Context, id int32) (decoder, error) {
+	r.mu.RLock()
+	d, ok := r.decoders[id]
+	r.mu.RUnlock()
+	if ok {
+		return d, nil
+	}
+
+	var sr schemaResponse
+	if err := r.get(ctx, fmt.Sprintf("/schemas/ids/%d", id), &sr); err != nil {
+		return nil, fmt.Errorf("schema registry: failed to fetch schema %d: %w", id, err)
+	}
+	if sr.SchemaType == "" {
+		sr.SchemaType = typeAvro
+	}
+	var err error
+	switch sr.SchemaType {
+	case typeAvro:
+		d, err = newAvroDecoder(sr.Schema)
+	case typeProtobuf:
+		d, err = r.newProtobufDecoder(ctx, sr)
+	case typeJSON:
+		d = jsonDecoder{}
+	default:
+		err = fmt.Errorf("unsupported schema type %s", sr.SchemaType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("schema registry: invalid schema %d: %w", id, err)
+	}
+
+	r.mu.Lock()
+	r.decoders[id] = d
+	r.mu.Unlock()
+	log.Infof("***** [SCHEMA] ***** Cache %s schema %d ......", strings.ToLower(sr.SchemaType), id)
+	return d, nil
+}
+
+// references fetches schemas which sr refers to recursively, keyed by their names
+func (r *Registry) references(ctx context.Context, sr schemaResponse, refs map[string]string) error {
+	for _, ref := range sr.References {
+		if _, ok := refs[ref.Name]; ok {
+			continue
+		}
+		var rs schemaResponse
+		if err := r.get(ctx, fmt.Sprintf("/subjects/%s/versions/%d", url.PathEscape(ref.Subject), ref.Version), &rs); err != nil {
+			return fmt.Errorf("failed to fetch reference %s: %w", ref.Name, err)
+		}
+		refs[ref.Name] = rs.Schema
+		if err := r.references(ctx, rs, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", r.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	// Every failure but 404 is a FetchError, as only 404 says the schema of payload is unknown to registry
+	res, err := r.client.Do(req)
+	if err != nil {
+		return &FetchError{err}
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return &FetchError{err}
+	}
+	if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+		if res.StatusCode == http.StatusNotFound {
+			return err
+		}
+		return &FetchError{err}
+	}
+	return json.Unmarshal(body, v)
+}
+
+// jsonDecoder passes payloads of JSON schemas, which are JSON already
+type jsonDecoder struct{}
+
+func (jsonDecoder) decode(payload []byte) ([]byte, error) {
+	if !json.Valid(payload) {
+		return nil, fmt.Errorf("payload is not JSON")
+	}
+	return payload, nil
+}
@@ -0,0 +1,309 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/linkedin/goavro/v2"
+)
+
+const (
+	avroSchema = `{
+  "type": "record",
+  "name": "Advertisement",
+  "namespace": "hermes.test",
+  "fields": [
+    {"name": "id", "type": "string"},
+    {"name": "clicks", "type": "long"},
+    {"name": "channel", "type": {"type": "enum", "name": "Channel", "symbols": ["WEB", "MOBILE"]}},
+    {"name": "coupon", "type": ["null", "string"], "default": null}
+  ]
+}`
+	moneyProto = `syntax = "proto3";
+package common;
+message Money {
+  string currency = 1;
+  int64 units = 2;
+}`
+	orderProto = `syntax = "proto3";
+package shop;
+import "common/money.proto";
+import "google/protobuf/timestamp.proto";
+message Ping {}
+message Order {
+  message Line {
+    string sku = 1;
+  }
+  string id = 1;
+  common.Money total = 2;
+  google.protobuf.Timestamp created = 3;
+  repeated Line lines = 4;
+}`
+)
+
+// mockRegistry serves schemas by id and subjects by version as a Confluent schema registry, it counts requests of
+// each path
+type mockRegistry struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func newMockRegistry(t *testing.T) *mockRegistry {
+	t.Helper()
+	schemas := map[string]interface{}{
+		"/schemas/ids/1": map[string]interface{}{"schema": avroSchema},
+		"/schemas/ids/2": map[string]interface{}{
+			"schema":     orderProto,
+			"schemaType": typeProtobuf,
+			"references": []map[string]interface{}{{"name": "common/money.proto", "subject": "common.money", "version": 3}},
+		},
+		"/schemas/ids/3":                    map[string]interface{}{"schema": `{"type": "object"}`, "schemaType": typeJSON},
+		"/subjects/common.money/versions/3": map[string]interface{}{"schema": moneyProto, "schemaType": typeProtobuf},
+	}
+
+	m := &mockRegistry{requests: make(map[string]int)}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m.mu.Lock()
+		m.requests[req.URL.Path]++
+		m.mu.Unlock()
+
+		if req.URL.Path == "/schemas/ids/5" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if user, password, ok := req.BasicAuth(); !ok || user != "hermes" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error_code": 401, "message": "Unauthorized"}`))
+			return
+		}
+		s, ok := schemas[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error_code": 40403, "message": "Schema not found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+	}))
+	return m
+}
+
+func (m *mockRegistry) count(path string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests[path]
+}
+
+func newTestRegistry(t *testing.T, url, password string) *Registry {
+	t.Helper()
+	err := configs.LoadConfig("", map[string]interface{}{
+		"schemaRegistry": map[string]interface{}{"url": url, "username": "hermes", "password": password},
+	})
+	if err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+	r, err := newRegistry()
+	if err != nil {
+		t.Fatalf("newRegistry() error = %v", err)
+	}
+	return r
+}
+
+// wireFormat prefixes payload with the magic byte, schema id and message indexes of Protobuf payloads
+func wireFormat(id uint32, indexes []byte, payload []byte) []byte {
+	b := make([]byte, headerSize, headerSize+len(indexes)+len(payload))
+	binary.BigEndian.PutUint32(b[1:], id)
+	return append(append(b, indexes...), payload...)
+}
+
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("Decode() = %s, not JSON: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("Decode() = %s, want %s", got, want)
+	}
+}
+
+func TestDecodeAvro(t *testing.T) {
+	m := newMockRegistry(t)
+	defer m.Close()
+	r := newTestRegistry(t, m.URL, "secret")
+
+	codec, err := goavro.NewCodec(avroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := codec.BinaryFromNative(nil, map[string]interface{}{
+		"id": "ad-1", "clicks": int64(42), "channel": "MOBILE", "coupon": goavro.Union("string", "SPRING"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.Decode(context.Background(), wireFormat(1, nil, payload))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	assertJSON(t, got, `{"id": "ad-1", "clicks": 42, "channel": "MOBILE", "coupon": "SPRING"}`)
+}
+
+func TestDecodeProtobufWithReferences(t *testing.T) {
+	m := newMockRegistry(t)
+	defer m.Close()
+	r := newTestRegistry(t, m.URL, "secret")
+
+	p := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(map[string]string{
+		"order.proto": orderProto, "common/money.proto": moneyProto,
+	})}
+	fds, err := p.ParseFiles("order.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := fds[0].FindMessage("shop.Order")
+	msg := dynamic.NewMessage(order)
+	if err := msg.UnmarshalJSON([]byte(`{"id": "o-1", "total": {"currency": "EUR", "units": "42"}, "created": "2019-12-01T00:00:00Z", "lines": [{"sku": "a"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := dynamic.NewMessage(order.GetNestedMessageTypes()[0])
+	line.SetFieldByName("sku", "b")
+	linePayload, err := line.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		indexes []byte
+		payload []byte
+		want    string
+	}{
+		{
+			name:    "second top-level message",
+			indexes: []byte{2, 2},
+			payload: payload,
+			want:    `{"id": "o-1", "total": {"currency": "EUR", "units": "42"}, "created": "2019-12-01T00:00:00Z", "lines": [{"sku": "a"}]}`,
+		},
+		{
+			name:    "nested message",
+			indexes: []byte{4, 2, 0},
+			payload: linePayload,
+			want:    `{"sku": "b"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.Decode(context.Background(), wireFormat(2, tt.indexes, tt.payload))
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			assertJSON(t, got, tt.want)
+		})
+	}
+
+	if _, err := r.Decode(context.Background(), wireFormat(2, []byte{2, 8}, payload)); err == nil || !strings.Contains(err.Error(), "invalid message index") {
+		t.Errorf("Decode() of unknown message index error = %v, want invalid message index", err)
+	}
+	if n := m.count("/subjects/common.money/versions/3"); n != 1 {
+		t.Errorf("reference is fetched %d times, want 1", n)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	m := newMockRegistry(t)
+	defer m.Close()
+	r := newTestRegistry(t, m.URL, "secret")
+
+	got, err := r.Decode(context.Background(), wireFormat(3, nil, []byte(`{"id": "ad-1"}`)))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	assertJSON(t, got, `{"id": "ad-1"}`)
+
+	if _, err := r.Decode(context.Background(), wireFormat(3, nil, []byte(`{"id"`))); err == nil {
+		t.Error("Decode() of payload which is not JSON returns no error")
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	m := newMockRegistry(t)
+	defer m.Close()
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		password string
+		payload  []byte
+		err      string
+		// fetch is whether the error is a FetchError, which leaves the payload to be decoded again
+		fetch bool
+	}{
+		{name: "not wire format", password: "secret", payload: []byte(`{}`), err: "payload is not in wire format"},
+		{name: "unknown id", password: "secret", payload: wireFormat(9, nil, []byte{0}), err: "failed to fetch schema 9: status 404"},
+		{name: "unauthorized", password: "wrong", payload: wireFormat(1, nil, []byte{0}), err: "failed to fetch schema 1: status 401", fetch: true},
+		{name: "unavailable", password: "secret", payload: wireFormat(5, nil, []byte{0}), err: "failed to fetch schema 5: status 503", fetch: true},
+		{name: "unreachable", url: down.URL, password: "secret", payload: wireFormat(1, nil, []byte{0}), err: "failed to fetch schema 1", fetch: true},
+		{name: "truncated payload", password: "secret", payload: wireFormat(1, nil, []byte{8, 'a'}), err: "failed to decode payload of schema 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := tt.url
+			if url == "" {
+				url = m.URL
+			}
+			r := newTestRegistry(t, url, tt.password)
+			_, err := r.Decode(context.Background(), tt.payload)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Decode() error = %v, want %q", err, tt.err)
+			}
+			if fetch := IsFetchError(err); fetch != tt.fetch {
+				t.Errorf("IsFetchError(%v) = %v, want %v", err, fetch, tt.fetch)
+			}
+		})
+	}
+}
+
+func TestDecodeCachesSchemas(t *testing.T) {
+	m := newMockRegistry(t)
+	defer m.Close()
+	r := newTestRegistry(t, m.URL, "secret")
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.Decode(context.Background(), wireFormat(3, nil, []byte(`{}`))); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+	}
+	if n := m.count("/schemas/ids/3"); n != 1 {
+		t.Errorf("schema 3 is fetched %d times, want 1", n)
+	}
+
+	// Failed fetches are not cached, the schema is fetched again by the next payload
+	r.Decode(context.Background(), wireFormat(9, nil, []byte{0}))
+	r.Decode(context.Background(), wireFormat(9, nil, []byte{0}))
+	if n := m.count("/schemas/ids/9"); n != 2 {
+		t.Errorf("unknown schema 9 is fetched %d times, want 2", n)
+	}
+}
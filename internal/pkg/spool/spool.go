@@ -0,0 +1,542 @@
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/pkg/audit"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/dedup"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/pkg/metrics"
+)
+
+// log is the logger of spool component
+var log = logging.For(logging.Spool)
+
+const (
+	segmentPrefix         = "segment-"
+	segmentSuffix         = ".log"
+	defaultDirectory      = "./spool"
+	defaultMaxBytes       = 100 << 20 // 100MB
+	defaultMaxAge         = 24 * time.Hour
+	defaultRetryInterval  = 30 * time.Second
+	defaultMaxBackoff     = 10 * time.Minute
+	defaultMaxSegmentSize = 4 << 20 // 4MB
+)
+
+var (
+	once sync.Once
+	// initErr is the error of the first Init, which is returned by later calls
+	initErr  error
+	instance *Spool
+	// ErrSpoolFull is returned when appending an entry would exceed the size limit of spool
+	ErrSpoolFull = errors.New("spool: size limit exceeded")
+)
+
+type spoolConfig struct {
+	Directory      string        `mapstructure:"directory"`
+	MaxBytes       int64         `mapstructure:"maxBytes"`
+	MaxAge         time.Duration `mapstructure:"maxAge"`
+	RetryInterval  time.Duration `mapstructure:"retryInterval"`
+	MaxBackoff     time.Duration `mapstructure:"maxBackoff"`
+	MaxSegmentSize int64         `mapstructure:"maxSegmentSize"`
+}
+
+// Entry represents an undeliverable message kept in spool
+type Entry struct {
+	Register    string            `json:"register"`
+	Endpoint    string            `json:"endpoint"`
+	ContentType string            `json:"contentType"`
+	Payload     []byte            `json:"payload"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Reason      string            `json:"reason"`
+	Attempts    int               `json:"attempts"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	NextAttempt time.Time         `json:"nextAttempt"`
+	// Source identifies the message in audit records of re-drives
+	Source *audit.Source `json:"source,omitempty"`
+	// DedupID is the id of the message by dedup key, a re-drive is skipped if the message has been delivered to
+	// endpoint meanwhile, e.g. by a consumer which read it again
+	DedupID string `json:"dedupId,omitempty"`
+	// Invalid lists validation errors of an invalid event, which is kept until it expires and never re-driven
+	Invalid []string `json:"invalid,omitempty"`
+}
+
+// attempt returns the number of the next delivery attempt of entry, the delivery before it is spooled is the first
+// attempt and every failed re-drive adds one
+func (e *Entry) attempt() int {
+	return e.Attempts + 2
+}
+
+// auditRecord returns the audit record of a re-drive of entry which started at start and ended with err, or nil if
+// entry has no source, e.g. it was spooled before audit was enabled
+func (e *Entry) auditRecord(start time.Time, err error) *audit.Record {
+	if e.Source == nil {
+		return nil
+	}
+	return audit.Attempt(*e.Source, e.Endpoint, e.attempt(), start, err)
+}
+
+// context returns the context carrying endpoint, attempt and source of entry, e.g. topic, partition and offset, for
+// logs
+func (e *Entry) context() context.Context {
+	fields := logging.Fields{logging.FieldEndpoint: logpolicy.URL(e.Endpoint), logging.FieldAttempt: e.attempt()}
+	for _, k := range []string{logging.FieldTopic, logging.FieldPartition, logging.FieldOffset} {
+		if v, ok := e.Metadata[k]; ok {
+			fields[k] = v
+		}
+	}
+	return logging.NewContext(context.Background(), fields)
+}
+
+// Spool is an append-only segment log on local disk for deliveries which fail after circuit breaker and retries.
+// New entries are appended to the active segment. The re-drive loop seals the active segment, retries due entries
+// of sealed segments through circuit breaker, carries failed and not yet due entries forward into the new active
+// segment and then removes the sealed segment. An entry may therefore be delivered twice if hermes stops between
+// carrying it forward and removing its segment. If any entry cannot be carried forward, e.g. spool is full, the
+// sealed segment is kept as it is and re-driven again later, which may deliver its entries twice as well.
+type Spool struct {
+	spoolConfig
+	mu      sync.Mutex
+	active  *os.File
+	seq     int
+	size    int64
+	depth   int64
+	stopped chan struct{}
+	// redriving is closed once the re-drive loop returns, closeOnce makes Close idempotent
+	redriving chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// GetSpool returns spool of hermes, or nil if spool is not configured
+func GetSpool() *Spool {
+	return instance
+}
+
+// loadConfig reads spool configuration, settings which are not set take their defaults
+func loadConfig() (spoolConfig, error) {
+	sc := spoolConfig{
+		Directory:      defaultDirectory,
+		MaxBytes:       defaultMaxBytes,
+		MaxAge:         defaultMaxAge,
+		RetryInterval:  defaultRetryInterval,
+		MaxBackoff:     defaultMaxBackoff,
+		MaxSegmentSize: defaultMaxSegmentSize,
+	}
+	err := configs.GetConfigUnmarshalKey("spool", &sc)
+	return sc, err
+}
+
+// ValidateConfig checks spool configuration strictly without opening the spool directory. Sizes and durations which
+// are set have to be greater than 0, e.g. re-drive loop cannot tick every 0s.
+func ValidateConfig() []configs.Problem {
+	ps := configs.UnknownKeys("spool", spoolConfig{})
+	sc, err := loadConfig()
+	if err != nil {
+		return append(ps, configs.Problemf("spool", "%v", err))
+	}
+
+	positive := []struct {
+		key   string
+		value int64
+	}{
+		{"maxBytes", sc.MaxBytes},
+		{"maxAge", int64(sc.MaxAge)},
+		{"retryInterval", int64(sc.RetryInterval)},
+		{"maxBackoff", int64(sc.MaxBackoff)},
+		{"maxSegmentSize", sc.MaxSegmentSize},
+	}
+	for _, p := range positive {
+		if p.value <= 0 {
+			ps = append(ps, configs.Problemf("spool."+p.key, "%s must be greater than 0", p.key))
+		}
+	}
+	return ps
+}
+
+// InitSpool opens the spool directory and starts the re-drive loop
+func InitSpool() error {
+	once.Do(func() {
+		sc, err := loadConfig()
+		if err != nil {
+			initErr = fmt.Errorf("failed to init spool configuration: %v", err)
+			return
+		}
+
+		sp, err := open(sc)
+		if err != nil {
+			initErr = fmt.Errorf("failed to open spool directory %s: %v", sc.Directory, err)
+			return
+		}
+
+		sp.redriving = make(chan struct{})
+		go func() {
+			defer close(sp.redriving)
+			sp.redriveLoop()
+		}()
+		instance = sp
+		log.Infof("***** [INIT:SPOOL] ***** Initialise spool in %s with %d entries ......", sc.Directory, sp.depth)
+	})
+	return initErr
+}
+
+func open(sc spoolConfig) (*Spool, error) {
+	if err := os.MkdirAll(sc.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	sp := &Spool{spoolConfig: sc, stopped: make(chan struct{})}
+	segments, err := sp.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		entries, size, err := readSegment(seg)
+		if err != nil {
+			return nil, err
+		}
+		sp.depth += int64(len(entries))
+		sp.size += size
+		sp.seq = segmentSeq(seg)
+	}
+
+	if err := sp.rotate(); err != nil {
+		return nil, err
+	}
+	sp.publish()
+	return sp, nil
+}
+
+// Append writes an undeliverable message into the active segment
+func (sp *Spool) Append(e *Entry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	if e.NextAttempt.IsZero() {
+		e.NextAttempt = e.CreatedAt.Add(sp.backoff(e.Attempts))
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.append(e)
+}
+
+func (sp *Spool) append(e *Entry) error {
+	if err := sp.write(e); err != nil {
+		return err
+	}
+	sp.publish()
+	return sp.rotateFull()
+}
+
+// write writes e at the end of the active segment without rotating it, caller must hold the lock
+func (sp *Spool) write(e *Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if sp.size+int64(len(line)) > sp.MaxBytes {
+		return ErrSpoolFull
+	}
+	n, err := sp.active.Write(line)
+	sp.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := sp.active.Sync(); err != nil {
+		return err
+	}
+
+	sp.depth++
+	return nil
+}
+
+// Depth returns number of entries kept in spool
+func (sp *Spool) Depth() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.depth
+}
+
+// Close stops the re-drive loop and waits for the re-drive in progress to carry its entries forward before it closes
+// the active segment. It returns the same result if it is called again.
+func (sp *Spool) Close() error {
+	sp.closeOnce.Do(func() {
+		close(sp.stopped)
+		if sp.redriving != nil {
+			<-sp.redriving
+		}
+
+		sp.mu.Lock()
+		defer sp.mu.Unlock()
+		sp.closeErr = sp.active.Close()
+	})
+	return sp.closeErr
+}
+
+func (sp *Spool) redriveLoop() {
+	ticker := time.NewTicker(sp.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sp.stopped:
+			return
+		case <-ticker.C:
+			if err := sp.redrive(); err != nil {
+				log.Errorf("***** [SPOOL][FAIL] ***** Failed to re-drive spooled messages:: %v", err)
+			}
+		}
+	}
+}
+
+// redrive retries due entries of all sealed segments
+func (sp *Spool) redrive() error {
+	sp.mu.Lock()
+	sealed := sp.active.Name()
+	if err := sp.rotate(); err != nil {
+		sp.mu.Unlock()
+		return err
+	}
+	sp.mu.Unlock()
+
+	segments, err := sp.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segments {
+		if segmentSeq(seg) > segmentSeq(sealed) {
+			break
+		}
+		if err := sp.redriveSegment(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sp *Spool) redriveSegment(seg string) error {
+	entries, size, err := readSegment(seg)
+	if err != nil {
+		return err
+	}
+
+	var delivered, expired int
+	now := time.Now()
+	carried := make([]*Entry, 0, len(entries))
+	// failures are audit records of re-drives which failed, entries are kept either in the active segment or in the
+	// sealed one if they cannot be carried forward
+	var failures []*audit.Record
+	for _, e := range entries {
+		if now.Sub(e.CreatedAt) > sp.MaxAge {
+			log.WithContext(e.context()).Warnf("***** [SPOOL][EXPIRED] ***** Drop message for [register::%s] [metadata::%v] [reason::%s]", e.Register, e.Metadata, logpolicy.Text(e.Reason))
+			if r := e.auditRecord(now, errors.New(e.Reason)); r != nil {
+				r.Attempt, r.LatencyMs, r.Outcome = e.Attempts+1, 0, audit.Expired
+				audit.GetJournal().Record(r)
+			}
+			expired++
+			continue
+		}
+		if now.Before(e.NextAttempt) || len(e.Invalid) > 0 || sp.closing() {
+			carried = append(carried, e)
+			continue
+		}
+
+		// Re-drive waits for the delivery of the same message which is in progress, it is not cancelled by Close
+		// as the delivery ends by timeout of circuit breaker
+		if reserved, _ := dedup.GetDedup().Reserve(context.Background(), e.Endpoint, e.DedupID); !reserved {
+			log.WithContext(e.context()).Infof("***** [SPOOL][DEDUP] ***** Drop message which has been delivered [id::%s]", e.DedupID)
+			continue
+		}
+
+		start := time.Now()
+		_, httpErr := server.GetCircuitBreakerMgr().CBHTTPPostContext(e.context(), e.Register, e.Endpoint, e.ContentType, e.Payload)
+		if httpErr == nil {
+			audit.GetJournal().Record(e.auditRecord(start, nil))
+			dedup.GetDedup().MarkDelivered(e.Endpoint, e.DedupID)
+			delivered++
+			continue
+		}
+
+		dedup.GetDedup().Release(e.Endpoint, e.DedupID)
+		if r := e.auditRecord(start, httpErr); r != nil {
+			r.Outcome = audit.Spooled
+			failures = append(failures, r)
+		}
+		e.Attempts++
+		e.Reason = httpErr.Error()
+		e.NextAttempt = time.Now().Add(sp.backoff(e.Attempts))
+		carried = append(carried, e)
+	}
+
+	// Failures are recorded once spool is unlocked, as journal may keep them waiting
+	defer func() {
+		for _, r := range failures {
+			audit.GetJournal().Record(r)
+		}
+	}()
+	sp.mu.Lock()
+	err = sp.carry(seg, size, len(entries), carried)
+	sp.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if delivered > 0 || expired > 0 {
+		log.Infof("***** [SPOOL] ***** Re-drive %s:: %d delivered, %d expired, %d remaining ......", filepath.Base(seg), delivered, expired, len(carried))
+	}
+	return nil
+}
+
+// carry moves carried entries of sealed segment seg, which holds count entries of size bytes, into the active
+// segment and removes seg. Compaction is aborted and seg is kept as it is if any entry cannot be carried forward, as
+// the entry would be lost otherwise. Caller must hold the lock.
+func (sp *Spool) carry(seg string, size int64, count int, carried []*Entry) error {
+	info, err := sp.active.Stat()
+	if err != nil {
+		return err
+	}
+	offset, prevSize, prevDepth := info.Size(), sp.size, sp.depth
+
+	// Entries of sealed segment are moved into active segment, hence release them before appending
+	sp.size -= size
+	sp.depth -= int64(count)
+	for _, e := range carried {
+		if err := sp.write(e); err != nil {
+			written, writtenDepth := sp.size-(prevSize-size), sp.depth-(prevDepth-int64(count))
+			sp.size, sp.depth = prevSize, prevDepth
+			if terr := sp.active.Truncate(offset); terr != nil {
+				// Entries which are carried stay in both segments and may be delivered twice
+				sp.size += written
+				sp.depth += writtenDepth
+				sp.publish()
+				return fmt.Errorf("failed to carry entries of %s forward: %v, and to truncate active segment: %v", filepath.Base(seg), err, terr)
+			}
+			return fmt.Errorf("failed to carry entries of %s forward: %w", filepath.Base(seg), err)
+		}
+	}
+
+	if err := os.Remove(seg); err != nil {
+		return err
+	}
+	sp.publish()
+	return sp.rotateFull()
+}
+
+// closing reports whether Close is called, entries are carried forward without being re-driven then
+func (sp *Spool) closing() bool {
+	select {
+	case <-sp.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns exponential delay for the given attempts which is capped by MaxBackoff
+func (sp *Spool) backoff(attempts int) time.Duration {
+	d := sp.RetryInterval
+	for i := 0; i < attempts && d < sp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > sp.MaxBackoff {
+		d = sp.MaxBackoff
+	}
+	return d
+}
+
+// rotate seals the active segment and opens a new one, caller must hold the lock
+func (sp *Spool) rotate() error {
+	if sp.active != nil {
+		if err := sp.active.Close(); err != nil {
+			return err
+		}
+	}
+
+	sp.seq++
+	f, err := os.OpenFile(filepath.Join(sp.Directory, fmt.Sprintf("%s%020d%s", segmentPrefix, sp.seq, segmentSuffix)), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	sp.active = f
+	return nil
+}
+
+// rotateFull rotates the active segment once it reaches MaxSegmentSize, caller must hold the lock
+func (sp *Spool) rotateFull() error {
+	if info, err := sp.active.Stat(); err == nil && info.Size() >= sp.MaxSegmentSize {
+		return sp.rotate()
+	}
+	return nil
+}
+
+// segments returns segment files in the order they were created
+func (sp *Spool) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(sp.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), segmentPrefix) && strings.HasSuffix(f.Name(), segmentSuffix) {
+			segments = append(segments, filepath.Join(sp.Directory, f.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func (sp *Spool) publish() {
+	metrics.SetGauge("hermes.spool.depth", sp.depth)
+	metrics.SetGauge("hermes.spool.bytes", sp.size)
+}
+
+func readSegment(seg string) ([]*Entry, int64, error) {
+	f, err := os.Open(seg)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	var entries []*Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for scanner.Scan() {
+		size += int64(len(scanner.Bytes())) + 1
+		e := &Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// A torn write of the last line when hermes crashes, skip it instead of blocking the whole segment
+			log.Errorf("***** [SPOOL][FAIL] ***** Skip corrupted entry in %s:: %v", filepath.Base(seg), err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, size, scanner.Err()
+}
+
+func segmentSeq(seg string) int {
+	var seq int
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(seg), segmentPrefix), segmentSuffix)
+	fmt.Sscanf(name, "%d", &seq)
+	return seq
+}
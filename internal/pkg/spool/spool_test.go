@@ -0,0 +1,254 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/pkg/configs"
+)
+
+var initCircuitBreaker sync.Once
+
+// newSpool opens a spool in a temporary directory with sc, sizes and durations which are not set take their defaults
+func newSpool(t *testing.T, sc spoolConfig) *Spool {
+	t.Helper()
+	sc.Directory = tempDir(t)
+	if sc.MaxBytes == 0 {
+		sc.MaxBytes = defaultMaxBytes
+	}
+	if sc.MaxSegmentSize == 0 {
+		sc.MaxSegmentSize = defaultMaxSegmentSize
+	}
+	sc.MaxAge, sc.RetryInterval, sc.MaxBackoff = defaultMaxAge, defaultRetryInterval, defaultMaxBackoff
+
+	sp, err := open(sc)
+	if err != nil {
+		t.Fatalf("open() error = %v", err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	return sp
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeSegment writes lines as segment seq of dir
+func writeSegment(t *testing.T, dir string, seq int, lines ...string) {
+	t.Helper()
+	name := filepath.Join(dir, fmt.Sprintf("%s%020d%s", segmentPrefix, seq, segmentSuffix))
+	if err := ioutil.WriteFile(name, []byte(strings.Join(lines, "")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startEndpoint starts circuit breaker of the default register and an endpoint which answers /fail with 500
+func startEndpoint(t *testing.T) *httptest.Server {
+	t.Helper()
+	initCircuitBreaker.Do(func() {
+		values := map[string]interface{}{"kafka.bootstrapservers": "localhost:9092"}
+		if err := configs.LoadConfig("", values); err != nil {
+			t.Fatalf("failed to load configuration: %v", err)
+		}
+		if err := server.InitCircuitBreakerMgr(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAppend(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxBytes       int64
+		maxSegmentSize int64
+		depth          int64
+		// segments is number of segment files after appending 3 entries
+		segments int
+		err      error
+	}{
+		{name: "active segment", depth: 3, segments: 1},
+		{name: "rotates full segment", maxSegmentSize: 1, depth: 3, segments: 4},
+		{name: "spool full", maxBytes: 10, depth: 0, segments: 1, err: ErrSpoolFull},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := newSpool(t, spoolConfig{MaxBytes: tt.maxBytes, MaxSegmentSize: tt.maxSegmentSize})
+			for i := 0; i < 3; i++ {
+				e := &Entry{Register: server.DefaultHandler, Endpoint: "http://localhost:8000", Payload: []byte(`{}`)}
+				if err := sp.Append(e); err != tt.err {
+					t.Fatalf("Append() error = %v, want %v", err, tt.err)
+				}
+				if e.NextAttempt.Sub(e.CreatedAt) != defaultRetryInterval {
+					t.Errorf("Append() NextAttempt is %v after CreatedAt, want %v", e.NextAttempt.Sub(e.CreatedAt), defaultRetryInterval)
+				}
+			}
+
+			if got := sp.Depth(); got != tt.depth {
+				t.Errorf("Depth() = %d, want %d", got, tt.depth)
+			}
+			segments, err := sp.segments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) != tt.segments {
+				t.Errorf("segments = %v, want %d", segments, tt.segments)
+			}
+		})
+	}
+}
+
+func TestOpenReplaysSegments(t *testing.T) {
+	entry := `{"register":"GeneralEventHandler","endpoint":"http://localhost:8000","payload":"e30="}` + "\n"
+	tests := []struct {
+		name     string
+		segments [][]string
+		depth    int64
+		size     int64
+	}{
+		{name: "empty directory"},
+		{
+			name:     "segments",
+			segments: [][]string{{entry, entry}, {entry}},
+			depth:    3,
+			size:     3 * int64(len(entry)),
+		},
+		{
+			name:     "corrupt tail",
+			segments: [][]string{{entry, `{"register":"GeneralEv`}},
+			depth:    1,
+			size:     int64(len(entry)) + int64(len(`{"register":"GeneralEv`)) + 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			for i, lines := range tt.segments {
+				writeSegment(t, dir, i+1, lines...)
+			}
+
+			sp, err := open(spoolConfig{Directory: dir, MaxBytes: defaultMaxBytes, MaxSegmentSize: defaultMaxSegmentSize})
+			if err != nil {
+				t.Fatalf("open() error = %v", err)
+			}
+			defer sp.Close()
+
+			if sp.depth != tt.depth || sp.size != tt.size {
+				t.Errorf("open() depth = %d, size = %d, want %d, %d", sp.depth, sp.size, tt.depth, tt.size)
+			}
+			if seq := segmentSeq(sp.active.Name()); seq != len(tt.segments)+1 {
+				t.Errorf("active segment = %d, want %d", seq, len(tt.segments)+1)
+			}
+		})
+	}
+}
+
+func TestRedriveCompactsSegments(t *testing.T) {
+	srv := startEndpoint(t)
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	tests := []struct {
+		name  string
+		entry *Entry
+		// carried is whether the entry is carried forward into the active segment, with attempts
+		carried  bool
+		attempts int
+	}{
+		{name: "delivered", entry: &Entry{Endpoint: srv.URL + "/ok", NextAttempt: past}},
+		{name: "failed", entry: &Entry{Endpoint: srv.URL + "/fail", NextAttempt: past}, carried: true, attempts: 1},
+		{name: "not due", entry: &Entry{Endpoint: srv.URL + "/ok", NextAttempt: future}, carried: true},
+		{name: "invalid", entry: &Entry{Endpoint: srv.URL + "/ok", NextAttempt: past, Invalid: []string{"id is required"}}, carried: true},
+		{name: "expired", entry: &Entry{Endpoint: srv.URL + "/ok", CreatedAt: time.Now().Add(-2 * defaultMaxAge), NextAttempt: past}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := newSpool(t, spoolConfig{})
+			tt.entry.Register, tt.entry.Payload = server.DefaultHandler, []byte(`{}`)
+			if err := sp.Append(tt.entry); err != nil {
+				t.Fatalf("Append() error = %v", err)
+			}
+			if err := sp.redrive(); err != nil {
+				t.Fatalf("redrive() error = %v", err)
+			}
+
+			segments, err := sp.segments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) != 1 || segments[0] != sp.active.Name() {
+				t.Fatalf("segments = %v, want only active segment %s", segments, sp.active.Name())
+			}
+			entries, _, err := readSegment(sp.active.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.carried != (len(entries) == 1) {
+				t.Fatalf("active segment holds %d entries, want carried %t", len(entries), tt.carried)
+			}
+			if tt.carried && entries[0].Attempts != tt.attempts {
+				t.Errorf("carried entry attempts = %d, want %d", entries[0].Attempts, tt.attempts)
+			}
+			if want := int64(len(entries)); sp.Depth() != want {
+				t.Errorf("Depth() = %d, want %d", sp.Depth(), want)
+			}
+		})
+	}
+}
+
+func TestRedriveKeepsSegmentWhichCannotBeCarried(t *testing.T) {
+	srv := startEndpoint(t)
+	sp := newSpool(t, spoolConfig{})
+	e := &Entry{Register: server.DefaultHandler, Endpoint: srv.URL + "/fail", Payload: []byte(`{}`), NextAttempt: time.Now().Add(-time.Minute)}
+	if err := sp.Append(e); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+	sealed := sp.active.Name()
+	// The failed entry grows by its reason, so it does not fit into spool anymore
+	sp.MaxBytes = sp.size
+
+	if err := sp.redrive(); err == nil || !strings.Contains(err.Error(), "failed to carry entries") {
+		t.Fatalf("redrive() error = %v, want entries cannot be carried forward", err)
+	}
+
+	entries, _, err := readSegment(sealed)
+	if err != nil {
+		t.Fatalf("sealed segment is not kept: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Attempts != 0 {
+		t.Errorf("sealed segment holds %v, want the entry as it was spooled", entries)
+	}
+	info, err := sp.active.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("active segment holds %d bytes, want entries carried forward are truncated", info.Size())
+	}
+	if sp.Depth() != 1 {
+		t.Errorf("Depth() = %d, want 1", sp.Depth())
+	}
+}
@@ -0,0 +1,56 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+)
+
+// Schema lists settings of TLS configuration, which is used to find unknown keys of configuration
+type Schema struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"caFile"`
+	CertFile           string `mapstructure:"certFile"`
+	KeyFile            string `mapstructure:"keyFile"`
+	ServerName         string `mapstructure:"serverName"`
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+}
+
+// NewTLSConfig returns tls.Config of the configuration key, which has caFile, certFile, keyFile, serverName and
+// insecureSkipVerify settings, e.g. kafka.security.tls or rabbitmq.tls
+func NewTLSConfig(key string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         configs.GetConfigStr(key + ".serverName"),
+		InsecureSkipVerify: configs.GetConfigBool(key + ".insecureSkipVerify"),
+	}
+
+	if caFile := configs.GetConfigStr(key + ".caFile"); caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to read caFile: %v", key, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s: no certificate found in caFile %s", key, caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile := configs.GetConfigStr(key + ".certFile")
+	keyFile := configs.GetConfigStr(key + ".keyFile")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%s: certFile and keyFile of client certificate must be set together", key)
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to load client certificate: %v", key, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
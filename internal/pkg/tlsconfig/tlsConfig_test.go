@@ -0,0 +1,85 @@
+package tlsconfig
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/tlsconfig/tlstest"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	certFile, keyFile := tlstest.WriteCertificate(t, "kafka.internal")
+
+	tests := []struct {
+		name         string
+		tls          map[string]interface{}
+		rootCAs      bool
+		serverName   string
+		insecure     bool
+		certificates int
+		err          string
+	}{
+		{name: "system roots", tls: map[string]interface{}{"enabled": true}},
+		{
+			name:       "server verification",
+			tls:        map[string]interface{}{"caFile": certFile, "serverName": "kafka.internal"},
+			rootCAs:    true,
+			serverName: "kafka.internal",
+		},
+		{
+			name:         "client certificate",
+			tls:          map[string]interface{}{"certFile": certFile, "keyFile": keyFile, "insecureSkipVerify": true},
+			insecure:     true,
+			certificates: 1,
+		},
+		{
+			name: "certificate without key",
+			tls:  map[string]interface{}{"certFile": certFile},
+			err:  "tls: certFile and keyFile of client certificate must be set together",
+		},
+		{
+			name: "key without certificate",
+			tls:  map[string]interface{}{"keyFile": keyFile},
+			err:  "tls: certFile and keyFile of client certificate must be set together",
+		},
+		{
+			name: "certificate of other key",
+			tls:  map[string]interface{}{"certFile": keyFile, "keyFile": certFile},
+			err:  "tls: failed to load client certificate",
+		},
+		{
+			name: "missing CA file",
+			tls:  map[string]interface{}{"caFile": filepath.Join(filepath.Dir(certFile), "missing.pem")},
+			err:  "tls: failed to read caFile",
+		},
+		{
+			name: "CA file without certificate",
+			tls:  map[string]interface{}{"caFile": keyFile},
+			err:  "tls: no certificate found in caFile",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := configs.LoadConfig("", map[string]interface{}{"tls": tt.tls}); err != nil {
+				t.Fatalf("failed to load configuration: %v", err)
+			}
+
+			c, err := NewTLSConfig("tls")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("NewTLSConfig() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewTLSConfig() error = %v", err)
+			}
+			if (c.RootCAs != nil) != tt.rootCAs || c.ServerName != tt.serverName || c.InsecureSkipVerify != tt.insecure || len(c.Certificates) != tt.certificates {
+				t.Errorf("NewTLSConfig() root CAs = %t, server name = %s, insecure = %t, certificates = %d, want %t, %s, %t, %d",
+					c.RootCAs != nil, c.ServerName, c.InsecureSkipVerify, len(c.Certificates), tt.rootCAs, tt.serverName, tt.insecure, tt.certificates)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package validation
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// maxErrors limits validation errors reported of an event
+const maxErrors = 20
+
+// jsonSchema validates JSON documents by JSON Schema drafts 4, 6 and 7, the draft is detected by $schema of the
+// schema. $ref refers to schemas of the same document or of URLs.
+type jsonSchema struct {
+	schema *gojsonschema.Schema
+}
+
+// compileSchema parses src and checks regular expressions and references of it
+func compileSchema(src []byte) (*jsonSchema, error) {
+	s, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(src))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON Schema: %v", err)
+	}
+	return &jsonSchema{schema: s}, nil
+}
+
+// validate returns errors of document payload, each of which starts with the JSON pointer of the invalid value
+func (s *jsonSchema) validate(payload []byte) []string {
+	res, err := s.schema.Validate(gojsonschema.NewBytesLoader(payload))
+	if err != nil {
+		return []string{fmt.Sprintf("/: payload is not JSON: %v", err)}
+	}
+
+	var errs []string
+	for _, e := range res.Errors() {
+		if len(errs) >= maxErrors {
+			break
+		}
+		errs = append(errs, pointer(e.Context())+": "+e.Description())
+	}
+	return errs
+}
+
+// pointer returns the JSON pointer of context, e.g. /items/0 of (root).items.0
+func pointer(c *gojsonschema.JsonContext) string {
+	p := strings.TrimPrefix(c.String("/"), gojsonschema.STRING_CONTEXT_ROOT)
+	if p == "" {
+		return "/"
+	}
+	return p
+}
@@ -0,0 +1,214 @@
+package validation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/reply"
+	"github.com/linushung/hermes/internal/pkg/spool"
+	"github.com/linushung/hermes/pkg/metrics"
+
+	"github.com/streadway/amqp"
+)
+
+// Config is validation of events of a consumer against a JSON Schema before delivery
+type Config struct {
+	// Schema is the path of the JSON Schema file, its name without extension names the schema in metrics
+	Schema string `mapstructure:"schema"`
+	// InvalidEvents is where invalid events are routed, they are dropped if it is not set
+	InvalidEvents *Destination `mapstructure:"invalidEvents"`
+}
+
+// Destination is where invalid events are routed: a Kafka topic, a RabbitMQ exchange with routing key or spool.
+// Invalid events in spool are kept until maxAge of spool without being re-driven.
+type Destination struct {
+	Topic      string `mapstructure:"topic"`
+	Exchange   string `mapstructure:"exchange"`
+	RoutingKey string `mapstructure:"routingKey"`
+	Spool      bool   `mapstructure:"spool"`
+}
+
+// Validate checks exactly one of Kafka topic, RabbitMQ exchange/routing key and spool is set, and the section it
+// requires is configured
+func (d *Destination) Validate() error {
+	amqpSet := d.Exchange != "" || d.RoutingKey != ""
+	set := 0
+	for _, ok := range []bool{d.Topic != "", amqpSet, d.Spool} {
+		if ok {
+			set++
+		}
+	}
+	switch {
+	case set != 1:
+		return fmt.Errorf("invalidEvents requires exactly one of topic, exchange/routingKey and spool")
+	case d.Topic != "" && configs.GetConfigStr("kafka.bootstrapservers") == "":
+		return fmt.Errorf("invalidEvents topic requires kafka.bootstrapservers")
+	case amqpSet && !configs.IsConfigSet("rabbitmq"):
+		return fmt.Errorf("invalidEvents exchange/routingKey requires rabbitmq section")
+	case d.Spool && !configs.IsConfigSet("spool"):
+		return fmt.Errorf("invalidEvents spool requires spool section")
+	}
+	return nil
+}
+
+func (d *Destination) String() string {
+	switch {
+	case d.Topic != "":
+		return "topic::" + d.Topic
+	case d.Spool:
+		return "spool"
+	default:
+		return fmt.Sprintf("exchange::%s routingKey::%s", d.Exchange, d.RoutingKey)
+	}
+}
+
+// Validator validates events against a JSON Schema and routes invalid events to the invalid-events destination
+type Validator struct {
+	name   string
+	schema *jsonSchema
+	dest   *Destination
+}
+
+// New loads the schema of c, it returns nil if c is nil, hence events are not validated
+func New(c *Config) (*Validator, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Schema == "" {
+		return nil, fmt.Errorf("schema of validation is required")
+	}
+	if c.InvalidEvents != nil {
+		if err := c.InvalidEvents.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	src, err := ioutil.ReadFile(c.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %v", err)
+	}
+	s, err := compileSchema(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Schema, err)
+	}
+	base := filepath.Base(c.Schema)
+	return &Validator{name: strings.TrimSuffix(base, filepath.Ext(base)), schema: s, dest: c.InvalidEvents}, nil
+}
+
+// Name returns the name of schema of v, or "" if v is nil
+func (v *Validator) Name() string {
+	if v == nil {
+		return ""
+	}
+	return v.name
+}
+
+// Validate returns errors of payload against the schema, or nil if payload is valid or v is nil. Valid and invalid
+// events are counted by counters validation.<schema>.valid and validation.<schema>.invalid.
+func (v *Validator) Validate(payload []byte) []string {
+	if v == nil {
+		return nil
+	}
+
+	errs := v.schema.validate(payload)
+	outcome := "valid"
+	if len(errs) > 0 {
+		outcome = "invalid"
+	}
+	metrics.IncCounter(fmt.Sprintf("validation.%s.%s", v.name, outcome), 1)
+	return errs
+}
+
+// Invalid is an event which fails validation
+type Invalid struct {
+	Key     []byte
+	Payload []byte
+	Errors  []string
+	// Source describes where the event comes from, e.g. topic, partition and offset
+	Source map[string]string
+	// Register is the circuit breaker register of the handler, which spooled events are kept under
+	Register string
+}
+
+// envelope is the value of Kafka messages of invalid events, which carries validation errors along with the event.
+// Schema, errors and source are set as headers of the message as well.
+type envelope struct {
+	Schema  string            `json:"schema"`
+	Errors  []string          `json:"errors"`
+	Source  map[string]string `json:"source,omitempty"`
+	Payload json.RawMessage   `json:"payload"`
+}
+
+// Reject routes ev to the invalid-events destination, it does nothing if v is nil or has no destination
+func (v *Validator) Reject(ev *Invalid) error {
+	if v == nil || v.dest == nil {
+		return nil
+	}
+
+	switch {
+	case v.dest.Topic != "":
+		value, err := json.Marshal(envelope{Schema: v.name, Errors: ev.Errors, Source: ev.Source, Payload: jsonPayload(ev.Payload)})
+		if err != nil {
+			return err
+		}
+		errs, err := json.Marshal(ev.Errors)
+		if err != nil {
+			return err
+		}
+		headers := map[string]string{"hermes-schema": v.name, "hermes-validation-errors": string(errs)}
+		for k, s := range ev.Source {
+			headers["hermes-source-"+k] = s
+		}
+		return reply.GetPublisher().PublishMessage(v.dest.Topic, ev.Key, value, headers)
+	case v.dest.Spool:
+		sp := spool.GetSpool()
+		if sp == nil {
+			return fmt.Errorf("validation: spool is not enabled")
+		}
+		return sp.Append(&spool.Entry{
+			Register:    ev.Register,
+			ContentType: "application/json",
+			Payload:     ev.Payload,
+			Metadata:    ev.Source,
+			Reason:      fmt.Sprintf("invalid event of schema %s", v.name),
+			Invalid:     ev.Errors,
+		})
+	default:
+		errs := make([]interface{}, len(ev.Errors))
+		for i, e := range ev.Errors {
+			errs[i] = e
+		}
+		headers := amqp.Table{"hermes-schema": v.name, "hermes-validation-errors": errs}
+		for k, s := range ev.Source {
+			headers["hermes-source-"+k] = s
+		}
+		return reply.GetPublisher().PublishAMQP(v.dest.Exchange, v.dest.RoutingKey, amqp.Publishing{
+			Headers:     headers,
+			ContentType: "application/json",
+			Timestamp:   time.Now(),
+			Body:        ev.Payload,
+		})
+	}
+}
+
+// Destination returns the invalid-events destination of v, or nil if invalid events are dropped
+func (v *Validator) Destination() *Destination {
+	if v == nil {
+		return nil
+	}
+	return v.dest
+}
+
+// jsonPayload keeps payload as it is if it is JSON, otherwise encodes it as a JSON string
+func jsonPayload(payload []byte) json.RawMessage {
+	if json.Valid(payload) {
+		return payload
+	}
+	s, _ := json.Marshal(string(payload))
+	return s
+}
@@ -0,0 +1,176 @@
+package validation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/linushung/hermes/pkg/metrics"
+)
+
+const advertisementSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "required": ["id", "items"],
+  "properties": {
+    "id": {"type": "string", "format": "uuid"},
+    "email": {"type": "string", "format": "email"},
+    "items": {"type": "array", "minItems": 1, "items": {"$ref": "#/definitions/item"}}
+  },
+  "additionalProperties": false,
+  "definitions": {
+    "item": {
+      "type": "object",
+      "required": ["price"],
+      "properties": {"price": {"type": "number", "exclusiveMinimum": 0}}
+    }
+  }
+}`
+
+// countingRegistry keeps counters and gauges which are recorded into it
+type countingRegistry struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+}
+
+func (r *countingRegistry) SetGauge(name string, value int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = value
+}
+
+func (r *countingRegistry) IncCounter(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+func newValidator(t *testing.T, schema string) *Validator {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "advertisement.json")
+	if err := ioutil.WriteFile(path, []byte(schema), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := New(&Config{Schema: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return v
+}
+
+func TestValidate(t *testing.T) {
+	v := newValidator(t, advertisementSchema)
+
+	tests := []struct {
+		name    string
+		payload string
+		errs    []string
+	}{
+		{
+			name:    "valid",
+			payload: `{"id": "0b4f1c9e-4a0b-4f57-9d8e-2a4c3c1d2e3f", "items": [{"price": 1.5}]}`,
+		},
+		{
+			name:    "missing required property",
+			payload: `{"items": [{"price": 1}]}`,
+			errs:    []string{"/: id is required"},
+		},
+		{
+			name:    "wrong type",
+			payload: `{"id": 1, "items": [{"price": 1}]}`,
+			errs:    []string{"/id: Invalid type"},
+		},
+		{
+			name:    "invalid format",
+			payload: `{"id": "0b4f1c9e-4a0b-4f57-9d8e-2a4c3c1d2e3f", "email": "nobody", "items": [{"price": 1}]}`,
+			errs:    []string{"/email: Does not match format 'email'"},
+		},
+		{
+			name:    "too few items",
+			payload: `{"id": "0b4f1c9e-4a0b-4f57-9d8e-2a4c3c1d2e3f", "items": []}`,
+			errs:    []string{"/items: Array must have at least 1 items"},
+		},
+		{
+			name:    "referenced schema",
+			payload: `{"id": "0b4f1c9e-4a0b-4f57-9d8e-2a4c3c1d2e3f", "items": [{"price": 1}, {"price": 0}]}`,
+			errs:    []string{"/items/1/price: Must be greater than 0"},
+		},
+		{
+			name:    "additional property",
+			payload: `{"id": "0b4f1c9e-4a0b-4f57-9d8e-2a4c3c1d2e3f", "items": [{"price": 1}], "extra": true}`,
+			errs:    []string{"/: Additional property extra is not allowed"},
+		},
+		{
+			name:    "not JSON",
+			payload: `{"id"`,
+			errs:    []string{"/: payload is not JSON"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := v.Validate([]byte(tt.payload))
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("Validate() = %q, want %q", errs, tt.errs)
+			}
+			for i := range errs {
+				if !strings.HasPrefix(errs[i], tt.errs[i]) {
+					t.Errorf("Validate()[%d] = %q, want prefix %q", i, errs[i], tt.errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateLimitsErrors(t *testing.T) {
+	v := newValidator(t, `{"type": "array", "items": {"type": "string"}}`)
+	payload := "[" + strings.Repeat("1,", maxErrors+5) + "1]"
+	if errs := v.Validate([]byte(payload)); len(errs) != maxErrors {
+		t.Errorf("Validate() returns %d errors, want %d", len(errs), maxErrors)
+	}
+}
+
+func TestNewRejectsInvalidSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "broken.json")
+	if err := ioutil.WriteFile(path, []byte(`{"type": "object", "properties": {"id": {"pattern": "("}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(&Config{Schema: path}); err == nil || !strings.Contains(err.Error(), "invalid JSON Schema") {
+		t.Errorf("New() error = %v, want invalid JSON Schema", err)
+	}
+}
+
+func TestValidateCountsOutcomes(t *testing.T) {
+	r := &countingRegistry{counters: make(map[string]int64), gauges: make(map[string]int64)}
+	metrics.SetRegistry(r)
+	v := newValidator(t, advertisementSchema)
+
+	v.Validate([]byte(`{"id": "0b4f1c9e-4a0b-4f57-9d8e-2a4c3c1d2e3f", "items": [{"price": 1}]}`))
+	v.Validate([]byte(`{}`))
+	v.Validate([]byte(`{}`))
+
+	if got := r.counters["validation.advertisement.valid"]; got != 1 {
+		t.Errorf("counter validation.advertisement.valid = %d, want 1", got)
+	}
+	if got := r.counters["validation.advertisement.invalid"]; got != 2 {
+		t.Errorf("counter validation.advertisement.invalid = %d, want 2", got)
+	}
+	if len(r.gauges) != 0 {
+		t.Errorf("gauges = %v, want none", r.gauges)
+	}
+}
@@ -0,0 +1,145 @@
+package eventhandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/linushung/hermes/cmd/server"
+)
+
+const (
+	SourceKafka    = "kafka"
+	SourceRabbitMQ = "rabbitmq"
+)
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Handler{
+		server.DefaultHandler:        Deliver,
+		"NotificationServiceHandler": Deliver,
+	}
+	// scratch keeps handlers which Lookup finds while WithScratch runs, scratchMu serialises WithScratch
+	scratch   map[string]Handler
+	scratchMu sync.Mutex
+	// ErrUnknownHandler is returned by Lookup when no handler is registered with the name
+	ErrUnknownHandler = errors.New("eventhandler: unknown handler")
+)
+
+// Event is a message consumed from a Kafka topic or a RabbitMQ queue
+type Event struct {
+	// Source is kafka or rabbitmq
+	Source string
+	// Topic is the Kafka topic or RabbitMQ queue which the event is consumed from
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+	// Metadata describes position of the event, e.g. partition and offset of Kafka or message id of RabbitMQ
+	Metadata map[string]string
+}
+
+// DeliverFunc posts the event to endpoints of the consumer with circuit breaker of the handler, it returns an
+// error if any endpoint fails to receive the event
+type DeliverFunc func(e *Event) error
+
+// Handler handles events of Kafka and RabbitMQ consumers. A handler may transform, filter or enrich the event and
+// calls deliver to post it to endpoints of the consumer.
+type Handler interface {
+	Handle(ctx context.Context, e *Event, deliver DeliverFunc) error
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as handlers
+type HandlerFunc func(ctx context.Context, e *Event, deliver DeliverFunc) error
+
+func (f HandlerFunc) Handle(ctx context.Context, e *Event, deliver DeliverFunc) error {
+	return f(ctx, e, deliver)
+}
+
+// Deliver is the built-in handler which posts events to endpoints as they are
+var Deliver Handler = HandlerFunc(func(ctx context.Context, e *Event, deliver DeliverFunc) error {
+	return deliver(e)
+})
+
+// Register makes a handler available by name for handleFuncName of consumers. It has to be called before consumers
+// are initialised and panics if name is empty, handler is nil or name is registered already.
+func Register(name string, h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if name == "" || h == nil {
+		panic("eventhandler: Register with empty name or nil handler")
+	}
+	if _, dup := registry[name]; dup {
+		panic("eventhandler: Register called twice for handler " + name)
+	}
+	registry[name] = h
+}
+
+// Lookup returns the handler registered with name, an empty name refers to the default handler
+func Lookup(name string) (Handler, error) {
+	if name == "" {
+		name = server.DefaultHandler
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	h, ok := registry[name]
+	if !ok {
+		h, ok = scratch[name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w %q, registered handlers are %s", ErrUnknownHandler, name, strings.Join(names(), ", "))
+	}
+	return h, nil
+}
+
+// Names returns names of registered handlers in order
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return names()
+}
+
+func names() []string {
+	ns := make([]string, 0, len(registry)+len(scratch))
+	for n := range registry {
+		ns = append(ns, n)
+	}
+	for n := range scratch {
+		if _, ok := registry[n]; !ok {
+			ns = append(ns, n)
+		}
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// WithScratch runs f while Lookup finds handlers as if they were registered, they are forgotten once f returns. It
+// is used to validate configuration which refers to handlers before they are registered.
+func WithScratch(handlers map[string]Handler, f func()) {
+	scratchMu.Lock()
+	defer scratchMu.Unlock()
+
+	mu.Lock()
+	scratch = handlers
+	mu.Unlock()
+	defer func() {
+		mu.Lock()
+		scratch = nil
+		mu.Unlock()
+	}()
+	f()
+}
+
+// CircuitRegister returns the circuit breaker register which events of the handler are posted with, circuits are
+// configured under circuitbreaker.registers by handler name
+func CircuitRegister(name string) string {
+	if name == "" || name == server.DefaultHandler {
+		return server.DefaultHandler
+	}
+	return strings.ToLower(name)
+}
@@ -0,0 +1,184 @@
+package eventhandler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/linushung/hermes/cmd/server"
+)
+
+// named returns a handler which records its name in the event headers, so tests can tell which handler is found
+func named(name string) Handler {
+	return HandlerFunc(func(ctx context.Context, e *Event, deliver DeliverFunc) error {
+		e.Headers["handler"] = name
+		return deliver(e)
+	})
+}
+
+// register registers h with name for the test and forgets it once the test ends
+func register(t *testing.T, name string, h Handler) {
+	t.Helper()
+	Register(name, h)
+	t.Cleanup(func() {
+		mu.Lock()
+		delete(registry, name)
+		mu.Unlock()
+	})
+}
+
+// handle runs h and returns the handler name it records
+func handle(t *testing.T, h Handler) string {
+	t.Helper()
+	e := &Event{Headers: map[string]string{}}
+	if err := h.Handle(context.Background(), e, func(*Event) error { return nil }); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	return e.Headers["handler"]
+}
+
+func TestRegisterAndLookup(t *testing.T) {
+	register(t, "OrderHandler", named("order"))
+
+	tests := []struct {
+		name    string
+		lookup  string
+		handler string
+		err     string
+	}{
+		{name: "registered", lookup: "OrderHandler", handler: "order"},
+		{name: "default", lookup: server.DefaultHandler},
+		{name: "empty name is default", lookup: ""},
+		{name: "built-in", lookup: "NotificationServiceHandler"},
+		{name: "unknown", lookup: "PaymentHandler", err: `eventhandler: unknown handler "PaymentHandler", registered handlers are`},
+		{name: "case sensitive", lookup: "orderhandler", err: ErrUnknownHandler.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := Lookup(tt.lookup)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) || !errors.Is(err, ErrUnknownHandler) {
+					t.Fatalf("Lookup(%q) error = %v, want %q", tt.lookup, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Lookup(%q) error = %v", tt.lookup, err)
+			}
+			if got := handle(t, h); got != tt.handler {
+				t.Errorf("Lookup(%q) finds handler %q, want %q", tt.lookup, got, tt.handler)
+			}
+		})
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	register(t, "InventoryHandler", Deliver)
+
+	tests := []struct {
+		name    string
+		handler string
+		h       Handler
+	}{
+		{name: "empty name", h: Deliver},
+		{name: "nil handler", handler: "StockHandler"},
+		{name: "registered twice", handler: "InventoryHandler", h: Deliver},
+		{name: "built-in", handler: server.DefaultHandler, h: Deliver},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%q) does not panic", tt.handler)
+				}
+			}()
+			Register(tt.handler, tt.h)
+		})
+	}
+}
+
+func TestDeliverPostsEventAsItIs(t *testing.T) {
+	e := &Event{Source: SourceKafka, Topic: "orders", Value: []byte(`{"id":1}`)}
+	failure := errors.New("endpoint is unavailable")
+	var delivered *Event
+
+	err := Deliver.Handle(context.Background(), e, func(d *Event) error {
+		delivered = d
+		return failure
+	})
+	if delivered != e {
+		t.Errorf("Deliver posts %+v, want %+v", delivered, e)
+	}
+	if err != failure {
+		t.Errorf("Deliver error = %v, want error of deliver %v", err, failure)
+	}
+}
+
+func TestWithScratch(t *testing.T) {
+	register(t, "ShippingHandler", named("shipping"))
+
+	WithScratch(map[string]Handler{"RefundHandler": named("refund"), "ShippingHandler": named("scratch")}, func() {
+		h, err := Lookup("RefundHandler")
+		if err != nil {
+			t.Fatalf("Lookup() of scratch handler error = %v", err)
+		}
+		if got := handle(t, h); got != "refund" {
+			t.Errorf("Lookup() of scratch handler finds %q, want refund", got)
+		}
+
+		// Registered handlers take precedence over scratch handlers of the same name
+		h, err = Lookup("ShippingHandler")
+		if err != nil || handle(t, h) != "shipping" {
+			t.Errorf("Lookup() of registered handler finds scratch handler, error = %v", err)
+		}
+
+		names := Names()
+		count := 0
+		for _, n := range names {
+			if n == "ShippingHandler" {
+				count++
+			}
+		}
+		if !strings.Contains(strings.Join(names, ","), "RefundHandler") || count != 1 {
+			t.Errorf("Names() = %v, want RefundHandler and ShippingHandler once", names)
+		}
+	})
+
+	if _, err := Lookup("RefundHandler"); !errors.Is(err, ErrUnknownHandler) {
+		t.Errorf("Lookup() of scratch handler after WithScratch error = %v, want %v", err, ErrUnknownHandler)
+	}
+	for _, n := range Names() {
+		if n == "RefundHandler" {
+			t.Errorf("Names() after WithScratch = %v, want it without RefundHandler", Names())
+		}
+	}
+}
+
+func TestNamesAreSorted(t *testing.T) {
+	names := Names()
+	for i := 1; i < len(names); i++ {
+		if names[i-1] > names[i] {
+			t.Fatalf("Names() = %v, want sorted names", names)
+		}
+	}
+}
+
+func TestCircuitRegister(t *testing.T) {
+	tests := []struct {
+		handler  string
+		register string
+	}{
+		{handler: "", register: server.DefaultHandler},
+		{handler: server.DefaultHandler, register: server.DefaultHandler},
+		{handler: "NotificationServiceHandler", register: "notificationservicehandler"},
+	}
+
+	for _, tt := range tests {
+		if got := CircuitRegister(tt.handler); got != tt.register {
+			t.Errorf("CircuitRegister(%q) = %s, want %s", tt.handler, got, tt.register)
+		}
+	}
+}
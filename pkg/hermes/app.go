@@ -0,0 +1,462 @@
+package hermes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/cmd/server/adminserver"
+	"github.com/linushung/hermes/internal/app/kafkaconsumer"
+	"github.com/linushung/hermes/internal/app/rabbitmqconsumer"
+	"github.com/linushung/hermes/internal/pkg/audit"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/dedup"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/internal/pkg/reply"
+	"github.com/linushung/hermes/internal/pkg/schemaregistry"
+	"github.com/linushung/hermes/internal/pkg/spool"
+	"github.com/linushung/hermes/pkg/eventhandler"
+	"github.com/linushung/hermes/pkg/metrics"
+
+	log "github.com/sirupsen/logrus"
+	//"go.elastic.co/apm/module/apmlogrus"
+)
+
+const (
+	// defaultShutdownTimeout is how long Run waits for components to stop once its context is done
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// kafkaConsumers are consumers of Kafka topics which App starts and stops
+type kafkaConsumers interface {
+	OverrideOffsets(cli, position string) error
+	InitConsumerGroup() error
+	PrepareReload() (func(), error)
+	Shutdown(ctx context.Context) error
+}
+
+// rabbitMQConsumers are consumers of the RabbitMQ queue which App starts and stops
+type rabbitMQConsumers interface {
+	InitConsumerGroup() error
+	PrepareReload() (func(), error)
+	Close() error
+}
+
+// newKafkaConsumers and newRabbitMQConsumers connect consumers of configuration, tests replace them to run App without
+// brokers
+var (
+	newKafkaConsumers = func() (kafkaConsumers, error) {
+		return kafkaconsumer.InitConsumerMgr()
+	}
+	newRabbitMQConsumers = func() (rabbitMQConsumers, error) {
+		return rabbitmqconsumer.InitRabbitMQConnector()
+	}
+)
+
+// Config is configuration of an App
+type Config struct {
+	// File is path of the base configuration file, configs/default.yaml is read if it is empty
+	File string
+	// Overlays are configuration files which override File in order
+	Overlays []string
+	// Environment picks the overlay next to File, e.g. configs/default.production.yaml for "production"
+	Environment string
+	// Dir is a directory of drop-in *.yaml files which override File and Overlays in order of their names
+	Dir string
+	// Values override configuration of files and environment variables by configuration keys, e.g.
+	// "kafka.bootstrapservers"
+	Values map[string]interface{}
+	// ResetOffsets seeks consumer group of clients to positions once before consumers start, e.g.
+	// {"notificationService": "2019-12-01T00:00:00Z"}. Position is earliest, latest, RFC3339 timestamp or offset.
+	ResetOffsets map[string]string
+	// LogLevel overrides levels of all components in logging configuration, e.g. "info"
+	LogLevel string
+}
+
+// Option customises an App
+type Option func(*App) error
+
+// WithLogger makes every component of hermes log by output, formatter, level and hooks of logger instead of logging
+// configuration, except components given by WithComponentLogger
+func WithLogger(logger *log.Logger) Option {
+	return WithComponentLogger("", logger)
+}
+
+// WithComponentLogger makes component log by logger instead of logging configuration, components are hermes,
+// kafka, rabbitmq, http, spool, reply, admin, audit, dedup and schema
+func WithComponentLogger(component string, logger *log.Logger) Option {
+	return func(a *App) error {
+		a.loggers[component] = logger
+		return nil
+	}
+}
+
+// WithHTTPClient makes circuit breaker post events to endpoints by client instead of the default client of hermes
+func WithHTTPClient(client *http.Client) Option {
+	return func(a *App) error {
+		a.httpClient = client
+		return nil
+	}
+}
+
+// WithHandler registers handler by name, consumers refer to it by handleFuncName
+func WithHandler(name string, h eventhandler.Handler) Option {
+	return func(a *App) error {
+		if _, ok := a.handlers[name]; ok {
+			return fmt.Errorf("handler %s is given twice", name)
+		}
+		a.handlers[name] = h
+		return nil
+	}
+}
+
+// SecretResolver resolves references of secrets of a scheme in configuration, e.g. a Vault resolver registered as
+// "vault" resolves ${vault:secret/data/hermes#password} by reference "secret/data/hermes#password"
+type SecretResolver = configs.SecretResolver
+
+// WithSecretResolver resolves references of secrets of scheme in configuration by resolver. The env and file
+// schemes are built in, e.g. ${env:RABBITMQ_PASSWORD} and ${file:/etc/hermes/secrets/password}.
+func WithSecretResolver(scheme string, resolver SecretResolver) Option {
+	return func(a *App) error {
+		a.resolvers[scheme] = resolver
+		return nil
+	}
+}
+
+// WithMetricsRegistry makes hermes record metrics into registry instead of expvar
+func WithMetricsRegistry(registry metrics.Registry) Option {
+	return func(a *App) error {
+		a.registry = registry
+		return nil
+	}
+}
+
+var (
+	// created is set once New succeeds, as components of hermes are shared by the process. newMu serialises New.
+	created bool
+	newMu   sync.Mutex
+	// ErrAppExists is returned by New once an App has been created in the process
+	ErrAppExists = errors.New("hermes: an App has been created in this process already")
+)
+
+// App is a hermes service which consumes events from Kafka and RabbitMQ and posts them to endpoints.
+//
+// Circuit breaker, spool, reply publisher, consumers and the handlers, loggers, secret resolvers and metrics registry
+// given by options are shared by the process, hence New creates only one App per process and it cannot be run again
+// once it is shut down.
+type App struct {
+	config     Config
+	httpClient *http.Client
+	// loggers, handlers, resolvers and registry are given by options and installed into the process by New, Validate
+	// uses handlers and resolvers without installing them
+	loggers   map[string]*log.Logger
+	handlers  map[string]eventhandler.Handler
+	resolvers map[string]SecretResolver
+	registry  metrics.Registry
+
+	once     sync.Once
+	stopped  chan struct{}
+	stopErr  error
+	stopFunc []func(ctx context.Context) error
+	// reloaders prepare changed configuration of components, which is applied only if all of them are valid
+	reloaders []func() (func(), error)
+}
+
+// newApp returns App of config with options applied
+func newApp(config Config, opts []Option) (*App, error) {
+	a := &App{
+		config:    config,
+		loggers:   make(map[string]*log.Logger),
+		handlers:  make(map[string]eventhandler.Handler),
+		resolvers: make(map[string]SecretResolver),
+		stopped:   make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// checkHandlers returns an error if a handler of options is registered already
+func (a *App) checkHandlers() error {
+	for name := range a.handlers {
+		if _, err := eventhandler.Lookup(name); err == nil {
+			return fmt.Errorf("handler %s is registered already", name)
+		}
+	}
+	return nil
+}
+
+// install puts loggers, secret resolvers and metrics registry of options into the process, they are replaced by
+// options of the next New if New fails
+func (a *App) install() {
+	for component, logger := range a.loggers {
+		logging.SetLogger(component, logger)
+	}
+	for scheme, resolver := range a.resolvers {
+		configs.RegisterSecretResolver(scheme, resolver)
+	}
+	if a.registry != nil {
+		metrics.SetRegistry(a.registry)
+	}
+}
+
+// New loads configuration and applies options, components of hermes are started by Run. It returns ErrAppExists
+// once an App has been created in the process. Handlers of options are registered only if New succeeds, so New can
+// be called again after it fails.
+func New(config Config, opts ...Option) (*App, error) {
+	a, err := newApp(config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	newMu.Lock()
+	defer newMu.Unlock()
+	if created {
+		return nil, ErrAppExists
+	}
+	if err := a.checkHandlers(); err != nil {
+		return nil, err
+	}
+
+	a.install()
+	if err := loadConfig(config, nil); err != nil {
+		return nil, err
+	}
+	if err := a.initLogger(); err != nil {
+		return nil, err
+	}
+	for name, h := range a.handlers {
+		eventhandler.Register(name, h)
+	}
+	created = true
+	return a, nil
+}
+
+// loadConfig loads layers of configuration, see configs.Layers for the order of them. References of secrets are
+// resolved by resolvers before the registered ones.
+func loadConfig(config Config, resolvers map[string]SecretResolver) error {
+	l := configs.Layers{Environment: config.Environment, Dir: config.Dir, Values: config.Values, Resolvers: resolvers}
+	if config.File != "" || len(config.Overlays) > 0 {
+		l.Files = append([]string{config.File}, config.Overlays...)
+		if config.File == "" {
+			l.Files[0] = "configs/default.yaml"
+		}
+	}
+	if err := configs.Load(l); err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	return nil
+}
+
+// initLogger builds loggers of components from logging configuration, entries are redacted by logging policy
+func (a *App) initLogger() error {
+	if err := logging.Init(a.config.LogLevel); err != nil {
+		return fmt.Errorf("invalid logging configuration: %v", err)
+	}
+	if err := logpolicy.Init(); err != nil {
+		return fmt.Errorf("invalid logging.redaction configuration: %v", err)
+	}
+	return nil
+}
+
+// Run starts components of hermes and blocks until ctx is done or Shutdown is called, then it shuts App down
+func (a *App) Run(ctx context.Context) error {
+	log.Infof("***** [INIT:HERMES] ***** Start to launch Hermes 🤓 ...")
+	if err := a.start(); err != nil {
+		a.Shutdown(context.Background())
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-a.stopped:
+		return a.stopErr
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+	return a.Shutdown(sctx)
+}
+
+func (a *App) start() error {
+	if err := checkConfig(); err != nil {
+		return err
+	}
+
+	if configs.IsConfigSet("debug") {
+		srv, err := adminserver.InitDebugServer()
+		if err != nil {
+			return err
+		}
+		a.onShutdown(srv.Shutdown)
+	}
+	if err := server.InitCircuitBreakerMgrWithClient(a.httpClient); err != nil {
+		return err
+	}
+	stream, err := server.InitHystrixStreamServer()
+	if err != nil {
+		return err
+	}
+	a.onShutdown(stream.Shutdown)
+	a.reloaders = append(a.reloaders, server.GetCircuitBreakerMgr().PrepareReload, logging.PrepareReload, logpolicy.PrepareReload)
+
+	// Audit journal is closed after spool and consumers which record deliveries to it
+	if configs.IsConfigSet("audit") {
+		if err := audit.InitJournal(); err != nil {
+			return err
+		}
+		a.onShutdown(func(ctx context.Context) error {
+			return audit.GetJournal().Close(ctx)
+		})
+	}
+	// Dedup is closed after spool and consumers which deliver messages by it
+	if configs.IsConfigSet("dedup") {
+		if err := dedup.InitDedup(); err != nil {
+			return err
+		}
+		a.onShutdown(func(context.Context) error {
+			return dedup.GetDedup().Close()
+		})
+	}
+	if configs.IsConfigSet("schemaRegistry") {
+		if err := schemaregistry.InitRegistry(); err != nil {
+			return err
+		}
+	}
+	if configs.IsConfigSet("spool") {
+		if err := spool.InitSpool(); err != nil {
+			return err
+		}
+		a.onShutdown(func(context.Context) error {
+			return spool.GetSpool().Close()
+		})
+	}
+	if err := reply.InitPublisher(); err != nil {
+		return err
+	}
+	// Reply writers are closed after consumers which publish replies by them
+	a.onShutdown(func(context.Context) error {
+		return reply.GetPublisher().Close()
+	})
+
+	if configs.IsConfigSet("kafka") {
+		cmgr, err := newKafkaConsumers()
+		if err != nil {
+			return err
+		}
+		for cli, position := range a.config.ResetOffsets {
+			if err := cmgr.OverrideOffsets(cli, position); err != nil {
+				return fmt.Errorf("failed to override offsets of consumer::%s to %s: %v", cli, position, err)
+			}
+		}
+		// Consumers which are started are stopped by Shutdown if another consumer fails to start
+		a.onShutdown(cmgr.Shutdown)
+		if err := cmgr.InitConsumerGroup(); err != nil {
+			return err
+		}
+		a.reloaders = append(a.reloaders, cmgr.PrepareReload)
+	}
+
+	if configs.IsConfigSet("rabbitmq") {
+		rmq, err := newRabbitMQConsumers()
+		if err != nil {
+			return err
+		}
+		a.onShutdown(func(context.Context) error {
+			return rmq.Close()
+		})
+		if err := rmq.InitConsumerGroup(); err != nil {
+			return err
+		}
+		a.reloaders = append(a.reloaders, rmq.PrepareReload)
+	}
+
+	if configs.IsConfigSet("admin") {
+		srv, err := adminserver.InitAdminServer()
+		if err != nil {
+			return err
+		}
+		a.onShutdown(srv.Shutdown)
+	}
+
+	stopWatching := configs.WatchConfig(a.reload)
+	a.onShutdown(func(context.Context) error {
+		stopWatching()
+		return nil
+	})
+	return nil
+}
+
+// checkConfig validates configuration in force strictly and returns an error which lists its problems
+func checkConfig() error {
+	problems, err := validateConfig()
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		msgs := make([]string, 0, len(problems))
+		for _, p := range problems {
+			msgs = append(msgs, p.String())
+		}
+		return fmt.Errorf("invalid configuration:\n%s", strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
+// reload applies changed configuration to circuit breaker and consumers, it rejects the changed configuration if
+// any of them is invalid, hence the current configuration stays in force
+func (a *App) reload() error {
+	select {
+	case <-a.stopped:
+		return nil
+	default:
+	}
+
+	if err := checkConfig(); err != nil {
+		return err
+	}
+	applies := make([]func(), 0, len(a.reloaders))
+	for _, prepare := range a.reloaders {
+		apply, err := prepare()
+		if err != nil {
+			return err
+		}
+		applies = append(applies, apply)
+	}
+
+	for _, apply := range applies {
+		apply()
+	}
+	log.Infof("***** [HERMES] ***** Apply changed configuration ......")
+	return nil
+}
+
+// onShutdown adds f to functions which are called by Shutdown in reverse order of start
+func (a *App) onShutdown(f func(ctx context.Context) error) {
+	a.stopFunc = append(a.stopFunc, f)
+}
+
+// Shutdown stops watching configuration, admin server and consumers of App and closes spool, dedup and audit journal, it returns the first
+// error of them
+func (a *App) Shutdown(ctx context.Context) error {
+	a.once.Do(func() {
+		log.Infof("***** [HERMES] ***** Shutting down Hermes ......")
+		for i := len(a.stopFunc) - 1; i >= 0; i-- {
+			if err := a.stopFunc[i](ctx); err != nil && a.stopErr == nil {
+				a.stopErr = err
+			}
+		}
+		logging.Close()
+		close(a.stopped)
+	})
+	return a.stopErr
+}
@@ -0,0 +1,218 @@
+package hermes
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linushung/hermes/pkg/eventhandler"
+)
+
+func TestOptionsAreInstalledByNewOnly(t *testing.T) {
+	h := eventhandler.HandlerFunc(func(ctx context.Context, e *eventhandler.Event, deliver eventhandler.DeliverFunc) error {
+		return deliver(e)
+	})
+
+	if _, err := newApp(Config{}, []Option{WithHandler("OptionHandler", h), WithHandler("OptionHandler", h)}); err == nil {
+		t.Errorf("newApp() accepts a handler given twice")
+	}
+	if _, err := newApp(Config{}, []Option{WithHandler("OptionHandler", h)}); err != nil {
+		t.Fatalf("newApp() error = %v", err)
+	}
+	if _, err := eventhandler.Lookup("OptionHandler"); err == nil {
+		t.Fatalf("WithHandler registers handler before New")
+	}
+
+	config := Config{Values: map[string]interface{}{"circuitbreaker.registers": map[string]interface{}{}}}
+	if _, err := Validate(config, WithHandler("OptionHandler", h)); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if _, err := eventhandler.Lookup("OptionHandler"); err == nil {
+		t.Fatalf("Validate() registers handler")
+	}
+
+	invalid := config
+	invalid.LogLevel = "loud"
+	if _, err := New(invalid, WithHandler("OptionHandler", h)); err == nil {
+		t.Fatalf("New() accepts invalid log level")
+	}
+	if _, err := eventhandler.Lookup("OptionHandler"); err == nil {
+		t.Fatalf("New() which fails registers handler")
+	}
+
+	if _, err := New(config, WithHandler("OptionHandler", h)); err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := eventhandler.Lookup("OptionHandler"); err != nil {
+		t.Errorf("New() does not register handler: %v", err)
+	}
+	if _, err := New(config); err != ErrAppExists {
+		t.Errorf("second New() error = %v, want %v", err, ErrAppExists)
+	}
+}
+
+// fakeConsumers stand for Kafka and RabbitMQ consumers, they fail to start by startErr and block their stop until
+// release is closed
+type fakeConsumers struct {
+	name     string
+	startErr error
+	release  chan struct{}
+	stops    chan<- string
+}
+
+func (f *fakeConsumers) OverrideOffsets(cli, position string) error { return nil }
+func (f *fakeConsumers) InitConsumerGroup() error                   { return f.startErr }
+func (f *fakeConsumers) PrepareReload() (func(), error)             { return func() {}, nil }
+func (f *fakeConsumers) Close() error                               { return f.Shutdown(context.Background()) }
+
+func (f *fakeConsumers) Shutdown(ctx context.Context) error {
+	<-f.release
+	f.stops <- f.name
+	return nil
+}
+
+// useConsumers makes App start kafka and rabbitmq in place of consumers of configuration
+func useConsumers(t *testing.T, kafka, rabbitmq *fakeConsumers) {
+	t.Helper()
+	newKafka, newRabbitMQ := newKafkaConsumers, newRabbitMQConsumers
+	newKafkaConsumers = func() (kafkaConsumers, error) { return kafka, nil }
+	newRabbitMQConsumers = func() (rabbitMQConsumers, error) { return rabbitmq, nil }
+	t.Cleanup(func() { newKafkaConsumers, newRabbitMQConsumers = newKafka, newRabbitMQ })
+}
+
+// loadApp returns App of configuration values without creating it by New, which succeeds once per process
+func loadApp(t *testing.T, values map[string]interface{}) *App {
+	t.Helper()
+	config := Config{Values: map[string]interface{}{"circuitbreaker.streamAddress": "127.0.0.1:0"}}
+	for k, v := range values {
+		config.Values[k] = v
+	}
+	a, err := newApp(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(config, nil); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// consumerValues configure consumers of Kafka and RabbitMQ which are valid
+var consumerValues = map[string]interface{}{
+	"kafka.bootstrapservers": "localhost:9092",
+	"kafka.clients":          []interface{}{"notificationService"},
+	"kafka.consumers.notificationService": map[string]interface{}{
+		"topic": "user.event.notification", "groupID": "NotificationServiceConsumer", "concurrency": 1,
+		"handler": map[string]interface{}{"endPoints": []interface{}{"http://localhost:8000/status/200"}},
+	},
+	"rabbitmq.host":      "localhost",
+	"rabbitmq.workers":   1,
+	"rabbitmq.endPoints": []interface{}{"http://localhost:8000/status/200"},
+}
+
+func TestRunReturnsStartupError(t *testing.T) {
+	tests := []struct {
+		name        string
+		values      map[string]interface{}
+		kafkaErr    error
+		rabbitMQErr error
+		err         string
+		stops       []string
+	}{
+		{
+			name:   "invalid configuration",
+			values: map[string]interface{}{"rabbitmq.workers": 0},
+			err:    "invalid configuration:\nvalue: rabbitmq.workers: workers must be greater than 0",
+		},
+		{
+			name:     "kafka consumers fail to start",
+			kafkaErr: errors.New("failed to start consumers of kafka"),
+			err:      "failed to start consumers of kafka",
+			stops:    []string{"kafka"},
+		},
+		{
+			name:        "rabbitmq consumers fail to start",
+			rabbitMQErr: errors.New("failed to create consumer for queue"),
+			err:         "failed to create consumer for queue",
+			stops:       []string{"rabbitmq", "kafka"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stops := make(chan string, 2)
+			release := make(chan struct{})
+			close(release)
+			useConsumers(t,
+				&fakeConsumers{name: "kafka", startErr: tt.kafkaErr, release: release, stops: stops},
+				&fakeConsumers{name: "rabbitmq", startErr: tt.rabbitMQErr, release: release, stops: stops},
+			)
+			values := map[string]interface{}{}
+			for k, v := range consumerValues {
+				values[k] = v
+			}
+			for k, v := range tt.values {
+				values[k] = v
+			}
+			a := loadApp(t, values)
+
+			err := a.Run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Run() error = %v, want %q", err, tt.err)
+			}
+			select {
+			case <-a.stopped:
+			default:
+				t.Errorf("Run() which fails to start does not shut App down")
+			}
+			close(stops)
+			var stopped []string
+			for name := range stops {
+				stopped = append(stopped, name)
+			}
+			if !reflect.DeepEqual(stopped, tt.stops) {
+				t.Errorf("Run() stops consumers %v, want %v", stopped, tt.stops)
+			}
+		})
+	}
+}
+
+func TestShutdownWaitsForConsumers(t *testing.T) {
+	stops := make(chan string, 2)
+	kafka := &fakeConsumers{name: "kafka", release: make(chan struct{}), stops: stops}
+	rabbitmq := &fakeConsumers{name: "rabbitmq", release: make(chan struct{}), stops: stops}
+	useConsumers(t, kafka, rabbitmq)
+	a := loadApp(t, consumerValues)
+	if err := a.start(); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- a.Shutdown(context.Background())
+	}()
+	// Consumers of RabbitMQ are stopped before consumers of Kafka, as Shutdown stops components in reverse order
+	for _, c := range []*fakeConsumers{rabbitmq, kafka} {
+		select {
+		case err := <-shutdown:
+			t.Fatalf("Shutdown() = %v before consumers of %s stop", err, c.name)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(c.release)
+		if name := <-stops; name != c.name {
+			t.Fatalf("Shutdown() stops consumers of %s, want %s", name, c.name)
+		}
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Shutdown() does not return once consumers stop")
+	}
+}
@@ -0,0 +1,125 @@
+package hermes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/cmd/server/adminserver"
+	"github.com/linushung/hermes/internal/app/kafkaconsumer"
+	"github.com/linushung/hermes/internal/app/rabbitmqconsumer"
+	"github.com/linushung/hermes/internal/pkg/audit"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/dedup"
+	"github.com/linushung/hermes/internal/pkg/logging"
+	"github.com/linushung/hermes/internal/pkg/logpolicy"
+	"github.com/linushung/hermes/internal/pkg/schemaregistry"
+	"github.com/linushung/hermes/internal/pkg/spool"
+	"github.com/linushung/hermes/pkg/eventhandler"
+)
+
+// sections are top level keys of configuration which hermes knows
+var sections = []string{"circuitbreaker", "kafka", "rabbitmq", "spool", "audit", "dedup", "schemaRegistry", "grpc", "admin", "debug", "connection", "secrets", "logging"}
+
+// Problem is an invalid setting of configuration. Source is the configuration file or environment variable which
+// sets Key, or its closest parent if Key is missing. Line is the line of Key in the file, and 0 if it is unknown.
+type Problem struct {
+	Source  string
+	Line    int
+	Key     string
+	Message string
+}
+
+func (p Problem) String() string {
+	switch {
+	case p.Line > 0:
+		return fmt.Sprintf("%s:%d: %s: %s", p.Source, p.Line, p.Key, p.Message)
+	case p.Source != "":
+		return fmt.Sprintf("%s: %s: %s", p.Source, p.Key, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Key, p.Message)
+}
+
+// Validate loads layers of configuration and checks the merged configuration strictly without connecting to Kafka,
+// RabbitMQ or endpoints. Handlers given by WithHandler and secret resolvers given by WithSecretResolver are known to
+// validation but not installed into the process, so New can be called afterwards. It returns problems of
+// configuration in order of lines, or an error if configuration cannot be loaded.
+func Validate(config Config, opts ...Option) ([]Problem, error) {
+	a, err := newApp(config, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadConfig(config, a.resolvers); err != nil {
+		return nil, err
+	}
+
+	var problems []Problem
+	eventhandler.WithScratch(a.handlers, func() {
+		problems, err = validateConfig()
+	})
+	return problems, err
+}
+
+// validateConfig checks configuration which is loaded already
+func validateConfig() ([]Problem, error) {
+	ps := configs.UnknownSections(sections...)
+	ps = append(ps, server.ValidateConfig()...)
+	if configs.IsConfigSet("grpc") {
+		ps = append(ps, server.ValidateGRPCConfig()...)
+	}
+	ps = append(ps, configs.ValidateSecrets()...)
+	ps = append(ps, logging.ValidateConfig()...)
+	ps = append(ps, logpolicy.ValidateConfig()...)
+	if configs.IsConfigSet("kafka") {
+		ps = append(ps, kafkaconsumer.ValidateConfig()...)
+	}
+	if configs.IsConfigSet("rabbitmq") {
+		ps = append(ps, rabbitmqconsumer.ValidateConfig()...)
+	}
+	if configs.IsConfigSet("spool") {
+		ps = append(ps, spool.ValidateConfig()...)
+	}
+	if configs.IsConfigSet("audit") {
+		ps = append(ps, audit.ValidateConfig()...)
+	}
+	if configs.IsConfigSet("dedup") {
+		ps = append(ps, dedup.ValidateConfig()...)
+	}
+	if configs.IsConfigSet("schemaRegistry") {
+		ps = append(ps, schemaregistry.ValidateConfig()...)
+	}
+	if configs.IsConfigSet("admin") {
+		ps = append(ps, adminserver.ValidateConfig()...)
+	}
+	if configs.IsConfigSet("debug") {
+		ps = append(ps, adminserver.ValidateDebugConfig()...)
+	}
+
+	lines := make(map[string]map[string]int)
+	problems := make([]Problem, 0, len(ps))
+	for _, p := range ps {
+		problem := Problem{Source: configs.Source(p.Key), Key: p.Key, Message: configs.RedactSecrets(p.Message)}
+		if strings.HasPrefix(problem.Source, "file:") {
+			problem.Source = strings.TrimPrefix(problem.Source, "file:")
+			if _, ok := lines[problem.Source]; !ok {
+				var err error
+				if lines[problem.Source], err = configs.KeyLines(problem.Source); err != nil {
+					return nil, fmt.Errorf("failed to parse %s: %v", problem.Source, err)
+				}
+			}
+			problem.Line = configs.LineOf(lines[problem.Source], p.Key)
+		}
+		problems = append(problems, problem)
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Source != problems[j].Source {
+			return problems[i].Source < problems[j].Source
+		}
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Key < problems[j].Key
+	})
+	return problems, nil
+}
@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	mu       sync.RWMutex
+	registry Registry = &expvarRegistry{}
+)
+
+// Registry records metrics of hermes, e.g. depth of spool. The default registry publishes metrics by expvar on
+// /debug/vars of the debug server.
+type Registry interface {
+	// SetGauge records the current value of the gauge name
+	SetGauge(name string, value int64)
+	// IncCounter adds delta to the counter name, counters only increase since hermes starts
+	IncCounter(name string, delta int64)
+}
+
+// SetRegistry replaces the registry which metrics are recorded into, it has to be called before hermes starts
+func SetRegistry(r Registry) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry = r
+}
+
+// SetGauge records the current value of the gauge name into the registry
+func SetGauge(name string, value int64) {
+	mu.RLock()
+	r := registry
+	mu.RUnlock()
+	r.SetGauge(name, value)
+}
+
+// IncCounter adds delta to the counter name of the registry
+func IncCounter(name string, delta int64) {
+	mu.RLock()
+	r := registry
+	mu.RUnlock()
+	r.IncCounter(name, delta)
+}
+
+type expvarRegistry struct {
+	mu sync.Mutex
+}
+
+func (er *expvarRegistry) SetGauge(name string, value int64) {
+	er.get(name).Set(value)
+}
+
+func (er *expvarRegistry) IncCounter(name string, delta int64) {
+	er.get(name).Add(delta)
+}
+
+// get returns the expvar of name, it is published once it is used for the first time
+func (er *expvarRegistry) get(name string) *expvar.Int {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	v, ok := expvar.Get(name).(*expvar.Int)
+	if !ok {
+		v = expvar.NewInt(name)
+	}
+	return v
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/kafkadialer"
+	"github.com/linushung/hermes/pkg/hermes"
+
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const produceTimeout = 10 * time.Second
+
+// runProduce sends a test event to a Kafka topic by brokers and security of configuration, e.g.
+// hermes produce -client notificationService -key user-1 -value '{"id":1}'
+func runProduce(args []string) {
+	fs := flag.NewFlagSet("produce", flag.ExitOnError)
+	opts := cliOptions{}
+	opts.bind(fs)
+	brokers := fs.String("brokers", "", "comma separated brokers, default to kafka.bootstrapservers")
+	topic := fs.String("topic", "", "topic to send the event to")
+	client := fs.String("client", "", "send the event to topic of the consumer instead of -topic")
+	key := fs.String("key", "", "key of the event")
+	value := fs.String("value", "", "value of the event")
+	file := fs.String("file", "", "read value of the event from file, - for stdin")
+	fs.Parse(args)
+
+	opts.newApp(hermes.Config{})
+	if *client != "" {
+		*topic = configs.GetConfigStr("kafka.consumers." + *client + ".topic")
+	}
+	if *topic == "" {
+		log.Fatalf("***** [PRODUCE][FAIL] ***** Either -topic or -client of a configured consumer is required")
+	}
+	if *brokers == "" {
+		*brokers = configs.GetConfigStr("kafka.bootstrapservers")
+	}
+
+	body := []byte(*value)
+	if *file != "" {
+		var err error
+		if *file == "-" {
+			body, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			body, err = ioutil.ReadFile(*file)
+		}
+		if err != nil {
+			log.Fatalf("***** [PRODUCE][FAIL] ***** Failed to read value of event:: %v", err)
+		}
+	}
+
+	dialer, err := kafkadialer.NewDialer()
+	if err != nil {
+		log.Fatalf("***** [PRODUCE][FAIL] ***** Invalid security configuration:: %v", err)
+	}
+	w := kafka.NewWriter(kafka.WriterConfig{
+		Brokers:  strings.Split(*brokers, ","),
+		Topic:    *topic,
+		Dialer:   dialer,
+		Balancer: &kafka.Hash{},
+	})
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), produceTimeout)
+	defer cancel()
+	if err := w.WriteMessages(ctx, kafka.Message{Key: []byte(*key), Value: body}); err != nil {
+		log.Fatalf("***** [PRODUCE][FAIL] ***** Failed to send event to Topic::%s %v", *topic, err)
+	}
+	log.Infof("***** [PRODUCE] ***** Send event [key::%s] [bytes::%d] to Topic::%s ......", *key, len(body), *topic)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linushung/hermes/cmd/server"
+	"github.com/linushung/hermes/internal/app/kafkaconsumer"
+	"github.com/linushung/hermes/internal/pkg/configs"
+	"github.com/linushung/hermes/internal/pkg/reply"
+	"github.com/linushung/hermes/internal/pkg/schemaregistry"
+	"github.com/linushung/hermes/pkg/hermes"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const replayProgressInterval = 5 * time.Second
+
+// runReplay re-sends past Kafka events through handler and endpoints of a consumer, e.g.
+// hermes replay -client notificationService -start-time 2019-12-01T00:00:00Z -key user-1
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	opts := cliOptions{}
+	opts.bind(fs)
+	client := fs.String("client", "", "consumer whose handler and endpoints deliver events")
+	topic := fs.String("topic", "", "topic to replay, default to topic of consumer")
+	partitions := fs.String("partitions", "", "comma separated partitions, default to all partitions")
+	startOffset := fs.Int64("start-offset", -1, "offset to start replay from")
+	startTime := fs.String("start-time", "", "RFC3339 time to start replay from")
+	endOffset := fs.Int64("end-offset", -1, "offset to stop replay before, default to high watermark")
+	endTime := fs.String("end-time", "", "RFC3339 time to stop replay before")
+	key := fs.String("key", "", "only replay events with the key")
+	headers := fs.String("headers", "", "comma separated key=value headers which events must have")
+	fs.Parse(args)
+	opts.newApp(hermes.Config{})
+
+	req := kafkaconsumer.ReplayRequest{Client: *client, Topic: *topic, Key: *key}
+	if *partitions != "" {
+		for _, p := range strings.Split(*partitions, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				log.Fatalf("***** [REPLAY][FAIL] ***** Invalid partition::%s", p)
+			}
+			req.Partitions = append(req.Partitions, id)
+		}
+	}
+	if *startOffset >= 0 {
+		req.StartOffset = startOffset
+	}
+	if *endOffset >= 0 {
+		req.EndOffset = endOffset
+	}
+	req.StartTime = parseReplayTime("start-time", *startTime)
+	req.EndTime = parseReplayTime("end-time", *endTime)
+	if *headers != "" {
+		req.Headers = make(map[string]string)
+		for _, h := range strings.Split(*headers, ",") {
+			kv := strings.SplitN(h, "=", 2)
+			if len(kv) != 2 {
+				log.Fatalf("***** [REPLAY][FAIL] ***** Invalid header filter::%s", h)
+			}
+			req.Headers[kv[0]] = kv[1]
+		}
+	}
+
+	if err := server.InitCircuitBreakerMgr(); err != nil {
+		log.Fatalf("***** [REPLAY][FAIL] ***** %v", err)
+	}
+	// Replayed events in wire format of schema registry are decoded as consumers do
+	if configs.IsConfigSet("schemaRegistry") {
+		if err := schemaregistry.InitRegistry(); err != nil {
+			log.Fatalf("***** [REPLAY][FAIL] ***** %v", err)
+		}
+	}
+	if err := reply.InitPublisher(); err != nil {
+		log.Fatalf("***** [REPLAY][FAIL] ***** %v", err)
+	}
+	cmgr, err := kafkaconsumer.InitConsumerMgr()
+	if err != nil {
+		log.Fatalf("***** [REPLAY][FAIL] ***** %v", err)
+	}
+	job, err := cmgr.StartReplay(req)
+	if err != nil {
+		log.Fatalf("***** [REPLAY][FAIL] ***** Failed to start replay:: %v", err)
+	}
+
+	ticker := time.NewTicker(replayProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logReplayProgress(job.Status())
+		case <-job.Done():
+			// Stop batch endpoints which replayed events are handed over to before replay exits
+			cmgr.Shutdown(context.Background())
+			status := job.Status()
+			logReplayProgress(status)
+			if status.State != kafkaconsumer.ReplayCompleted {
+				log.Errorf("***** [REPLAY][FAIL] ***** Replay %s:: %s", status.State, status.Error)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+}
+
+func parseReplayTime(name, value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("***** [REPLAY][FAIL] ***** Invalid %s::%s %v", name, value, err)
+	}
+	return &t
+}
+
+func logReplayProgress(status kafkaconsumer.ReplayStatus) {
+	for _, pp := range status.Partitions {
+		log.Infof("***** [REPLAY:%s] ***** Partition::%d [offset::%d/%d] [delivered::%d] [filtered::%d] [failed::%d]", status.ID, pp.Partition, pp.Current, pp.End, pp.Delivered, pp.Filtered, pp.Failed)
+	}
+}
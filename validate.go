@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/linushung/hermes/pkg/hermes"
+)
+
+// runValidate checks the merged configuration strictly and exits non-zero with the file and line of each problem,
+// e.g. hermes validate -c configs/default.yaml -c configs/production.yaml
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	opts := cliOptions{}
+	opts.bind(fs)
+	fs.Parse(args)
+
+	problems, err := hermes.Validate(opts.config(hermes.Config{}))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("configuration is valid")
+}